@@ -14,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/cmd/pp/fabtoken"
 	_ "github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken/driver"
 	_ "github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/nogh/driver"
 	. "github.com/onsi/gomega"
@@ -75,6 +76,22 @@ func TestGen(t *testing.T) {
 		)
 	}
 	tests = append(tests, []T{
+		{
+			Args: []string{
+				"gen",
+				"fabtoken",
+				"--format", "xml",
+			},
+			ErrMsg: "Error: failed to generate public parameters: unknown format [xml], expected one of [json, yaml]",
+		},
+		{
+			Args: []string{
+				"gen",
+				"fabtoken",
+				"--config", "./testdata/missing.yaml",
+			},
+			ErrMsg: "Error: failed to generate public parameters: failed reading manifest [./testdata/missing.yaml]",
+		},
 		{
 			Args: []string{
 				"gen",
@@ -114,6 +131,34 @@ func TestGen(t *testing.T) {
 	gt.Expect(err).NotTo(HaveOccurred())
 }
 
+func TestGenFormat(t *testing.T) {
+	gt := NewGomegaWithT(t)
+	tokengen, err := gexec.Build("github.com/hyperledger-labs/fabric-token-sdk/cmd/tokengen")
+	gt.Expect(err).NotTo(HaveOccurred())
+	defer gexec.CleanupBuildArtifacts()
+
+	tempOutput, err := ioutil.TempDir("", "tokengen")
+	gt.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(tempOutput)
+	testGenRun(gt, tokengen, []string{"gen", "fabtoken", "--format", "yaml", "--output", tempOutput})
+	raw, err := ioutil.ReadFile(filepath.Join(tempOutput, "fabtoken_pp.yaml"))
+	gt.Expect(err).NotTo(HaveOccurred())
+	pp, err := fabtoken.Deserialize(raw)
+	gt.Expect(err).NotTo(HaveOccurred())
+	raw, err = pp.Serialize()
+	gt.Expect(err).NotTo(HaveOccurred())
+	_, _, err = token.NewServicesFromPublicParams(raw)
+	gt.Expect(err).NotTo(HaveOccurred())
+
+	out, err := exec.Command(tokengen, "gen", "fabtoken", "inspect", filepath.Join(tempOutput, "fabtoken_pp.yaml")).CombinedOutput()
+	gt.Expect(err).NotTo(HaveOccurred())
+	gt.Expect(string(out)).To(ContainSubstring("Driver: fabtoken"))
+	testGenRunWithError(gt, tokengen, []string{"gen", "fabtoken", "inspect", filepath.Join(tempOutput, "missing.json")}, "Error: failed reading public parameters")
+
+	testGenRun(gt, tokengen, []string{"gen", "fabtoken", "update", filepath.Join(tempOutput, "fabtoken_pp.yaml")})
+	testGenRunWithError(gt, tokengen, []string{"gen", "fabtoken", "update", filepath.Join(tempOutput, "fabtoken_pp.yaml"), "--issuers", "aOrg1MSP"}, "Error: failed to update public parameters: failed to get issuer identity [aOrg1MSP]: invalid input [aOrg1MSP]")
+}
+
 func testGenRunWithError(gt *WithT, tokengen string, args []string, errMsg string) {
 	b, err := exec.Command(tokengen, args...).CombinedOutput()
 	gt.Expect(err).To(HaveOccurred())
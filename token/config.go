@@ -17,3 +17,49 @@ type ConfigManager struct {
 func (m *ConfigManager) Certifiers() []string {
 	return m.cm.TMS().Certification.Interactive.IDs
 }
+
+// Auditors returns a copy of the auditor identities in the configuration of the wallets.
+func (m *ConfigManager) Auditors() []driver.Identity {
+	if w := m.wallets(); w != nil {
+		return copyIdentities(w.Auditors)
+	}
+	return nil
+}
+
+// Issuers returns a copy of the issuer identities in the configuration of the wallets.
+func (m *ConfigManager) Issuers() []driver.Identity {
+	if w := m.wallets(); w != nil {
+		return copyIdentities(w.Issuers)
+	}
+	return nil
+}
+
+// Owners returns a copy of the owner identities in the configuration of the wallets.
+func (m *ConfigManager) Owners() []driver.Identity {
+	if w := m.wallets(); w != nil {
+		return copyIdentities(w.Owners)
+	}
+	return nil
+}
+
+func (m *ConfigManager) wallets() *driver.Wallets {
+	tms := m.cm.TMS()
+	if tms == nil {
+		return nil
+	}
+	return tms.Wallets
+}
+
+// copyIdentities returns a copy of the passed identities, so that callers cannot modify the configuration
+func copyIdentities(ids []*driver.Identity) []driver.Identity {
+	if len(ids) == 0 {
+		return nil
+	}
+	res := make([]driver.Identity, 0, len(ids))
+	for _, id := range ids {
+		if id != nil {
+			res = append(res, *id)
+		}
+	}
+	return res
+}
@@ -0,0 +1,55 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/driver"
+)
+
+type configManager struct {
+	tms *driver.TMS
+}
+
+func (c *configManager) TMS() *driver.TMS { return c.tms }
+
+func (c *configManager) TranslatePath(path string) string { return path }
+
+func TestConfigManagerWallets(t *testing.T) {
+	tms := &driver.TMS{
+		Wallets: &driver.Wallets{
+			Owners: []*driver.Identity{
+				{ID: "alice", Default: true, Type: "idemix", Path: "/alice"},
+				{ID: "bob", Type: "idemix", Path: "/bob"},
+			},
+			Issuers:  []*driver.Identity{{ID: "issuer", Type: "x509", Path: "/issuer"}},
+			Auditors: []*driver.Identity{{ID: "auditor", Type: "x509", Path: "/auditor"}},
+		},
+	}
+	cm := &ConfigManager{cm: &configManager{tms: tms}}
+
+	assert.Equal(t, []driver.Identity{
+		{ID: "alice", Default: true, Type: "idemix", Path: "/alice"},
+		{ID: "bob", Type: "idemix", Path: "/bob"},
+	}, cm.Owners())
+	assert.Equal(t, []driver.Identity{{ID: "issuer", Type: "x509", Path: "/issuer"}}, cm.Issuers())
+	assert.Equal(t, []driver.Identity{{ID: "auditor", Type: "x509", Path: "/auditor"}}, cm.Auditors())
+
+	// the returned identities are copies
+	owners := cm.Owners()
+	owners[0].ID = "mallory"
+	assert.Equal(t, "alice", tms.Wallets.Owners[0].ID)
+
+	// no wallets configured
+	cm = &ConfigManager{cm: &configManager{tms: &driver.TMS{}}}
+	assert.Nil(t, cm.Owners())
+	assert.Nil(t, cm.Issuers())
+	assert.Nil(t, cm.Auditors())
+}
@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package common
 
 import (
+	"os"
 	"strings"
 
 	"github.com/hyperledger-labs/fabric-smart-client/platform/fabric/core/generic/msp/x509"
@@ -22,19 +23,57 @@ type PP interface {
 	AddIssuer(raw view.Identity)
 }
 
-// GetMSPIdentity returns the MSP identity from the passed entry formatted as <MSPConfigPath>:<MSPID>
-func GetMSPIdentity(entry string) (view.Identity, error) {
+// MSPKey references the MSP holding the key of an issuer or an auditor
+type MSPKey struct {
+	// Dir is the MSP config directory
+	Dir string `yaml:"mspDir" json:"mspDir"`
+	// ID is the MSP ID
+	ID string `yaml:"mspID" json:"mspID"`
+}
+
+// ParseMSPKey parses an entry formatted as <MSPConfigPath>:<MSPID>
+func ParseMSPKey(entry string) (MSPKey, error) {
 	entries := strings.Split(entry, ":")
 	if len(entries) != 2 {
-		return nil, errors.Errorf("invalid input [%s]", entry)
+		return MSPKey{}, errors.Errorf("invalid input [%s]", entry)
 	}
-	provider, err := x509.NewProvider(entries[0], entries[1], nil)
+	return MSPKey{Dir: entries[0], ID: entries[1]}, nil
+}
+
+func (k MSPKey) String() string {
+	return k.Dir + ":" + k.ID
+}
+
+// Check returns an error if the MSP directory does not exist
+func (k MSPKey) Check() error {
+	info, err := os.Stat(k.Dir)
 	if err != nil {
-		return nil, errors.WithMessagef(err, "failed to create x509 provider for [%s]", entry)
+		return errors.Wrapf(err, "invalid msp directory [%s]", k.Dir)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("invalid msp directory [%s]: not a directory", k.Dir)
+	}
+	return nil
+}
+
+// GetMSPIdentity returns the MSP identity from the passed entry formatted as <MSPConfigPath>:<MSPID>
+func GetMSPIdentity(entry string) (view.Identity, error) {
+	key, err := ParseMSPKey(entry)
+	if err != nil {
+		return nil, err
+	}
+	return key.Identity()
+}
+
+// Identity returns the identity of the referenced MSP
+func (k MSPKey) Identity() (view.Identity, error) {
+	provider, err := x509.NewProvider(k.Dir, k.ID, nil)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to create x509 provider for [%s]", k)
 	}
 	id, _, err := provider.Identity(nil)
 	if err != nil {
-		return nil, errors.WithMessagef(err, "failed to get identity [%s]", entry)
+		return nil, errors.WithMessagef(err, "failed to get identity [%s]", k)
 	}
 	return id, nil
 }
@@ -59,3 +98,35 @@ func SetupIssuersAndAuditors(pp PP, Auditors, Issuers []string) error {
 	}
 	return nil
 }
+
+// SetupIssuersAndAuditorsFromKeys is like SetupIssuersAndAuditors, for already parsed keys.
+// All the MSP directories are checked before any identity is loaded.
+func SetupIssuersAndAuditorsFromKeys(pp PP, auditors, issuers []MSPKey) error {
+	for _, auditor := range auditors {
+		if err := auditor.Check(); err != nil {
+			return errors.WithMessagef(err, "failed to get auditor identity [%s]", auditor)
+		}
+	}
+	for _, issuer := range issuers {
+		if err := issuer.Check(); err != nil {
+			return errors.WithMessagef(err, "failed to get issuer identity [%s]", issuer)
+		}
+	}
+	// Auditors
+	for _, auditor := range auditors {
+		id, err := auditor.Identity()
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get auditor identity [%s]", auditor)
+		}
+		pp.AddAuditor(id)
+	}
+	// Issuers
+	for _, issuer := range issuers {
+		id, err := issuer.Identity()
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get issuer identity [%s]", issuer)
+		}
+		pp.AddIssuer(id)
+	}
+	return nil
+}
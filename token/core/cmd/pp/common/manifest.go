@@ -0,0 +1,73 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package common
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest lists the issuers and auditors to include in the public parameters.
+// It is read from a YAML or JSON file, for instance:
+//
+//	issuers:
+//	  - mspDir: ./issuers/alice/msp
+//	    mspID: Org1MSP
+//	auditors:
+//	  - mspDir: ./auditor/msp
+//	    mspID: Org1MSP
+type Manifest struct {
+	// Issuers are the keys of the issuers
+	Issuers []MSPKey `yaml:"issuers" json:"issuers"`
+	// Auditors are the keys of the auditors
+	Auditors []MSPKey `yaml:"auditors" json:"auditors"`
+}
+
+// LoadManifest reads the manifest at the passed path.
+// Relative MSP directories are resolved against the directory of the manifest.
+func LoadManifest(path string) (*Manifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading manifest [%s]", path)
+	}
+	m := &Manifest{}
+	// JSON is valid YAML
+	if err := yaml.UnmarshalStrict(raw, m); err != nil {
+		return nil, errors.Wrapf(err, "failed parsing manifest [%s]", path)
+	}
+	base := filepath.Dir(path)
+	for _, keys := range [][]MSPKey{m.Issuers, m.Auditors} {
+		for i := range keys {
+			if len(keys[i].Dir) == 0 || len(keys[i].ID) == 0 {
+				return nil, errors.Errorf("invalid manifest [%s]: msp directory and msp id are required", path)
+			}
+			if !filepath.IsAbs(keys[i].Dir) {
+				keys[i].Dir = filepath.Join(base, keys[i].Dir)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Merge returns the concatenation of the passed lists of keys, without duplicates
+func Merge(lists ...[]MSPKey) []MSPKey {
+	var merged []MSPKey
+	seen := map[MSPKey]bool{}
+	for _, keys := range lists {
+		for _, key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, key)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,94 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/stretchr/testify/assert"
+)
+
+type pp struct {
+	auditors []view.Identity
+	issuers  []view.Identity
+}
+
+func (p *pp) AddAuditor(raw view.Identity) { p.auditors = append(p.auditors, raw) }
+
+func (p *pp) AddIssuer(raw view.Identity) { p.issuers = append(p.issuers, raw) }
+
+func TestLoadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlPath := filepath.Join(dir, "manifest.yaml")
+	assert.NoError(t, ioutil.WriteFile(yamlPath, []byte(`
+issuers:
+  - mspDir: issuers/alice/msp
+    mspID: Org1MSP
+  - mspDir: /etc/bob/msp
+    mspID: Org2MSP
+auditors:
+  - mspDir: auditor/msp
+    mspID: Org1MSP
+`), 0644))
+	m, err := LoadManifest(yamlPath)
+	assert.NoError(t, err)
+	assert.Equal(t, &Manifest{
+		Issuers: []MSPKey{
+			{Dir: filepath.Join(dir, "issuers/alice/msp"), ID: "Org1MSP"},
+			{Dir: "/etc/bob/msp", ID: "Org2MSP"},
+		},
+		Auditors: []MSPKey{{Dir: filepath.Join(dir, "auditor/msp"), ID: "Org1MSP"}},
+	}, m)
+
+	jsonPath := filepath.Join(dir, "manifest.json")
+	assert.NoError(t, ioutil.WriteFile(jsonPath, []byte(`{"issuers": [{"mspDir": "/etc/bob/msp", "mspID": "Org2MSP"}]}`), 0644))
+	m, err = LoadManifest(jsonPath)
+	assert.NoError(t, err)
+	assert.Equal(t, &Manifest{Issuers: []MSPKey{{Dir: "/etc/bob/msp", ID: "Org2MSP"}}}, m)
+
+	assert.NoError(t, ioutil.WriteFile(jsonPath, []byte(`{"issuers": [{"mspDir": "/etc/bob/msp"}]}`), 0644))
+	_, err = LoadManifest(jsonPath)
+	assert.EqualError(t, err, "invalid manifest ["+jsonPath+"]: msp directory and msp id are required")
+	assert.NoError(t, ioutil.WriteFile(jsonPath, []byte(`{"owners": []}`), 0644))
+	_, err = LoadManifest(jsonPath)
+	assert.Error(t, err)
+}
+
+func TestMerge(t *testing.T) {
+	alice := MSPKey{Dir: "alice", ID: "Org1MSP"}
+	bob := MSPKey{Dir: "bob", ID: "Org1MSP"}
+	charlie := MSPKey{Dir: "charlie", ID: "Org2MSP"}
+	assert.Equal(t, []MSPKey{alice, bob, charlie}, Merge([]MSPKey{alice, bob}, nil, []MSPKey{bob, charlie, alice}))
+	assert.Empty(t, Merge(nil, nil))
+}
+
+func TestSetupIssuersAndAuditorsFromKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	p := &pp{}
+	err = SetupIssuersAndAuditorsFromKeys(p, nil, []MSPKey{{Dir: dir, ID: "Org1MSP"}, {Dir: missing, ID: "Org1MSP"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get issuer identity ["+missing+":Org1MSP]: invalid msp directory ["+missing+"]")
+	err = SetupIssuersAndAuditorsFromKeys(p, []MSPKey{{Dir: file, ID: "Org1MSP"}}, nil)
+	assert.EqualError(t, err, "failed to get auditor identity ["+file+":Org1MSP]: invalid msp directory ["+file+"]: not a directory")
+	// nothing is loaded until all the directories are checked
+	assert.Empty(t, p.issuers)
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// JSONFormat is the canonical encoding of the public parameters, the one the network loads
+	JSONFormat = "json"
+	// YAMLFormat is a human-readable encoding of the public parameters, convenient to review changes.
+	// The network does not load it: it is written as a companion of the JSON file, for review only.
+	YAMLFormat = "yaml"
+)
+
+// yamlPublicParams is the YAML encoding of the FabToken public parameters.
+// Identities are base64-encoded.
+type yamlPublicParams struct {
+	Identifier        string   `yaml:"identifier"`
+	MaxTokenValue     uint64   `yaml:"maxTokenValue"`
+	QuantityPrecision uint64   `yaml:"quantityPrecision"`
+	Auditor           string   `yaml:"auditor,omitempty"`
+	Issuers           []string `yaml:"issuers,omitempty"`
+}
+
+// checkFormat returns an error if the passed format is not supported.
+// The empty format stands for JSONFormat.
+func checkFormat(format string) error {
+	switch format {
+	case "", JSONFormat, YAMLFormat:
+		return nil
+	default:
+		return errors.Errorf("unknown format [%s], expected one of [%s, %s]", format, JSONFormat, YAMLFormat)
+	}
+}
+
+// FileName returns the name of the file the public parameters are written to in the passed format
+func FileName(format string) string {
+	if format == YAMLFormat {
+		return "fabtoken_pp.yaml"
+	}
+	return "fabtoken_pp.json"
+}
+
+// writePublicParams writes raw, the canonical JSON encoding of the passed public parameters, to jsonPath,
+// and, if yamlPath is not empty, the YAML encoding of the public parameters to yamlPath, for review only
+func writePublicParams(pp *fabtoken.PublicParams, raw []byte, jsonPath, yamlPath string, perm os.FileMode) error {
+	if err := ioutil.WriteFile(jsonPath, raw, perm); err != nil {
+		return errors.Wrap(err, "failed writing public parameters to file")
+	}
+	if len(yamlPath) == 0 {
+		return nil
+	}
+	out, err := SerializeAs(pp, YAMLFormat)
+	if err != nil {
+		return errors.Wrap(err, "failed serializing public parameters")
+	}
+	if err := ioutil.WriteFile(yamlPath, out, perm); err != nil {
+		return errors.Wrap(err, "failed writing public parameters to file")
+	}
+	return nil
+}
+
+// SerializeAs encodes the public parameters in the passed format
+func SerializeAs(pp *fabtoken.PublicParams, format string) ([]byte, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	if format != YAMLFormat {
+		return pp.Serialize()
+	}
+	y := &yamlPublicParams{
+		Identifier:        pp.Label,
+		MaxTokenValue:     pp.MTV,
+		QuantityPrecision: pp.QuantityPrecision,
+	}
+	if len(pp.Auditor) != 0 {
+		y.Auditor = base64.StdEncoding.EncodeToString(pp.Auditor)
+	}
+	for _, issuer := range pp.Issuers {
+		y.Issuers = append(y.Issuers, base64.StdEncoding.EncodeToString(issuer))
+	}
+	return yaml.Marshal(y)
+}
+
+// Deserialize decodes public parameters encoded in any of the supported formats.
+// JSON is detected by its opening brace, anything else is parsed as YAML.
+func Deserialize(raw []byte) (*fabtoken.PublicParams, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		return fabtoken.NewPublicParamsFromBytes(raw, fabtoken.PublicParameters)
+	}
+	y := &yamlPublicParams{}
+	if err := yaml.UnmarshalStrict(raw, y); err != nil {
+		return nil, errors.Wrap(err, "failed parsing public parameters")
+	}
+	if y.Identifier != fabtoken.PublicParameters {
+		return nil, errors.Errorf("invalid identifier, expecting 'fabtoken', got [%s]", y.Identifier)
+	}
+	pp := &fabtoken.PublicParams{
+		Label:             y.Identifier,
+		MTV:               y.MaxTokenValue,
+		QuantityPrecision: y.QuantityPrecision,
+	}
+	var err error
+	if len(y.Auditor) != 0 {
+		if pp.Auditor, err = base64.StdEncoding.DecodeString(y.Auditor); err != nil {
+			return nil, errors.Wrap(err, "failed decoding auditor")
+		}
+	}
+	for i, issuer := range y.Issuers {
+		id, err := base64.StdEncoding.DecodeString(issuer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decoding issuer [%d]", i)
+		}
+		pp.Issuers = append(pp.Issuers, id)
+	}
+	return pp, nil
+}
@@ -0,0 +1,41 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormats(t *testing.T) {
+	pp, err := fabtoken.Setup()
+	assert.NoError(t, err)
+	pp.AddIssuer([]byte("issuer1"))
+	pp.AddIssuer([]byte("issuer2"))
+	pp.AddAuditor([]byte("auditor"))
+
+	for _, format := range []string{"", JSONFormat, YAMLFormat} {
+		raw, err := SerializeAs(pp, format)
+		assert.NoError(t, err, format)
+		pp2, err := Deserialize(raw)
+		assert.NoError(t, err, format)
+		assert.Equal(t, pp, pp2, format)
+	}
+
+	raw, err := SerializeAs(pp, YAMLFormat)
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), "identifier: fabtoken")
+	assert.Equal(t, "fabtoken_pp.yaml", FileName(YAMLFormat))
+	assert.Equal(t, "fabtoken_pp.json", FileName(""))
+
+	_, err = SerializeAs(pp, "xml")
+	assert.EqualError(t, err, "unknown format [xml], expected one of [json, yaml]")
+	_, err = Deserialize([]byte("identifier: zkatdlog\n"))
+	assert.EqualError(t, err, "invalid identifier, expecting 'fabtoken', got [zkatdlog]")
+}
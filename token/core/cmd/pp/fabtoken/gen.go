@@ -8,7 +8,6 @@ package fabtoken
 
 import (
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token/core/cmd/pp/cc"
@@ -31,6 +30,10 @@ var (
 	// Auditors is the list of auditors to include in the public parameters.
 	// Each auditor should be specified in the form of <MSP-Dir>:<MSP-ID>
 	Auditors []string
+	// Format is the encoding of the generated public parameters files, json or yaml
+	Format string
+	// ConfigPath is the path of the manifest listing issuers and auditors, in addition to the ones passed as flags
+	ConfigPath string
 )
 
 // Cmd returns the Cobra Command for Version
@@ -41,6 +44,10 @@ func Cmd() *cobra.Command {
 	flags.BoolVarP(&GenerateCCPackage, "cc", "", false, "generate chaincode package")
 	flags.StringSliceVarP(&Auditors, "auditors", "a", nil, "list of auditor keys in the form of <MSP-Dir>:<MSP-ID>")
 	flags.StringSliceVarP(&Issuers, "issuers", "s", nil, "list of issuer keys in the form of <MSP-Dir>:<MSP-ID>")
+	flags.StringVarP(&Format, "format", "f", JSONFormat, "format of the public parameters files: json, or yaml to also write, for review only, a fabtoken_pp.yaml next to the fabtoken_pp.json the network loads")
+	flags.StringVarP(&ConfigPath, "config", "c", "", "manifest file, yaml or json, listing issuers and auditors")
+	cobraCommand.AddCommand(inspectCommand)
+	cobraCommand.AddCommand(updateCmd())
 	return cobraCommand
 }
 
@@ -54,12 +61,22 @@ var cobraCommand = &cobra.Command{
 		}
 		// Parsing of the command line is done so silence cmd usage
 		cmd.SilenceUsage = true
-		raw, err := Gen(&GeneratorArgs{
+		genArgs := &GeneratorArgs{
 			OutputDir:         OutputDir,
 			GenerateCCPackage: GenerateCCPackage,
 			Issuers:           Issuers,
 			Auditors:          Auditors,
-		})
+			Format:            Format,
+		}
+		if len(ConfigPath) != 0 {
+			manifest, err := common.LoadManifest(ConfigPath)
+			if err != nil {
+				return errors.Wrap(err, "failed to generate public parameters")
+			}
+			genArgs.IssuerKeys = manifest.Issuers
+			genArgs.AuditorKeys = manifest.Auditors
+		}
+		raw, err := Gen(genArgs)
 		if err != nil {
 			return errors.Wrap(err, "failed to generate public parameters")
 		}
@@ -85,27 +102,80 @@ type GeneratorArgs struct {
 	// Auditors is the list of auditors to include in the public parameters.
 	// Each auditor should be specified in the form of <MSP-Dir>:<MSP-ID>
 	Auditors []string
+	// Format is the encoding of the generated public parameters files, JSONFormat or YAMLFormat.
+	// The JSON file, the one the network loads, is always written. YAMLFormat also writes its YAML companion, for review only.
+	// If empty, JSONFormat is used.
+	Format string
+	// IssuerKeys is the list of already parsed issuers to include in the public parameters,
+	// in addition to Issuers. For instance, the issuers listed in a manifest.
+	IssuerKeys []common.MSPKey
+	// AuditorKeys is the list of already parsed auditors to include in the public parameters,
+	// in addition to Auditors
+	AuditorKeys []common.MSPKey
+	// SkipWrite, if true, prevents the public parameters from being written to the output directory
+	SkipWrite bool
 }
 
-// Gen generates the public parameters for the FabToken driver
+// Gen generates the public parameters for the FabToken driver, and writes them in the requested format.
+// Independently of the format, it returns the canonical JSON encoding the network loads.
 func Gen(args *GeneratorArgs) ([]byte, error) {
+	_, raw, err := Generate(args)
+	return raw, err
+}
+
+// Generate is like Gen, and also returns the generated public parameters,
+// so that callers can inspect or further modify them without deserializing the returned bytes.
+// Set args.SkipWrite to not write any file.
+func Generate(args *GeneratorArgs) (*fabtoken.PublicParams, []byte, error) {
+	if err := checkFormat(args.Format); err != nil {
+		return nil, nil, err
+	}
+	auditors, err := parseKeys("auditor", args.Auditors)
+	if err != nil {
+		return nil, nil, err
+	}
+	issuers, err := parseKeys("issuer", args.Issuers)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Setup
 	pp, err := fabtoken.Setup()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed setting up public parameters")
+		return nil, nil, errors.Wrap(err, "failed setting up public parameters")
 	}
-	if err := common.SetupIssuersAndAuditors(pp, args.Auditors, args.Issuers); err != nil {
-		return nil, err
+	if err := common.SetupIssuersAndAuditorsFromKeys(
+		pp,
+		common.Merge(auditors, args.AuditorKeys),
+		common.Merge(issuers, args.IssuerKeys),
+	); err != nil {
+		return nil, nil, err
 	}
-	// Store Public Params
 	raw, err := pp.Serialize()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed serializing public parameters")
+		return nil, nil, errors.Wrap(err, "failed serializing public parameters")
+	}
+	if args.SkipWrite {
+		return pp, raw, nil
+	}
+	// Store Public Params
+	yamlPath := ""
+	if args.Format == YAMLFormat {
+		yamlPath = filepath.Join(args.OutputDir, FileName(YAMLFormat))
 	}
-	path := filepath.Join(args.OutputDir, "fabtoken_pp.json")
-	if err := ioutil.WriteFile(path, raw, 0755); err != nil {
-		return nil, errors.Wrap(err, "failed writing public parameters to file")
+	if err := writePublicParams(pp, raw, filepath.Join(args.OutputDir, FileName(JSONFormat)), yamlPath, 0755); err != nil {
+		return nil, nil, err
 	}
 
-	return raw, nil
+	return pp, raw, nil
+}
+
+func parseKeys(role string, entries []string) ([]common.MSPKey, error) {
+	keys := make([]common.MSPKey, len(entries))
+	for i, entry := range entries {
+		var err error
+		if keys[i], err = common.ParseMSPKey(entry); err != nil {
+			return nil, errors.WithMessagef(err, "failed to get %s identity [%s]", role, entry)
+		}
+	}
+	return keys, nil
 }
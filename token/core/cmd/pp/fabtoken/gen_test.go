@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabtoken")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// no file is written
+	pp, raw, err := Generate(&GeneratorArgs{OutputDir: dir, SkipWrite: true})
+	assert.NoError(t, err)
+	assert.Equal(t, fabtoken.PublicParameters, pp.Label)
+	assert.Equal(t, fabtoken.MaxMoney, pp.MTV)
+	expected, err := pp.Serialize()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, raw)
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// the parameters can be modified and serialized without any round trip through disk
+	pp.AddIssuer([]byte("issuer"))
+	raw, err = pp.Serialize()
+	assert.NoError(t, err)
+	pp2, err := fabtoken.NewPublicParamsFromBytes(raw, fabtoken.PublicParameters)
+	assert.NoError(t, err)
+	assert.Equal(t, pp, pp2)
+
+	// the files hold the returned parameters: the json file the network loads, and its yaml companion for review
+	pp, raw, err = Generate(&GeneratorArgs{OutputDir: dir, Format: YAMLFormat})
+	assert.NoError(t, err)
+	out, err := ioutil.ReadFile(filepath.Join(dir, FileName(YAMLFormat)))
+	assert.NoError(t, err)
+	pp2, err = Deserialize(out)
+	assert.NoError(t, err)
+	assert.Equal(t, pp, pp2)
+	out, err = ioutil.ReadFile(filepath.Join(dir, FileName(JSONFormat)))
+	assert.NoError(t, err)
+	assert.Equal(t, raw, out)
+	pp2, err = fabtoken.NewPublicParamsFromBytes(out, fabtoken.PublicParameters)
+	assert.NoError(t, err)
+	assert.Equal(t, pp, pp2)
+	pp2, err = Deserialize(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, pp, pp2)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var inspectCommand = &cobra.Command{
+	Use:   "inspect <pp-file>",
+	Short: "Inspect FabToken public parameters.",
+	Long:  `Validates FabToken public parameters, in json or yaml format, and prints a summary of their content.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected the path of the public parameters file")
+		}
+		// Parsing of the command line is done so silence cmd usage
+		cmd.SilenceUsage = true
+		raw, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "failed reading public parameters [%s]", args[0])
+		}
+		return Inspect(raw, cmd.OutOrStdout())
+	},
+}
+
+// Inspect deserializes and validates the passed public parameters, in any of the supported formats,
+// and writes a human-readable summary of their content to the passed writer
+func Inspect(raw []byte, w io.Writer) error {
+	pp, err := Deserialize(raw)
+	if err != nil {
+		return errors.WithMessage(err, "failed deserializing public parameters")
+	}
+	if err := pp.Validate(); err != nil {
+		return err
+	}
+	summary := pp.Summary()
+	issuers, err := mspIDs(summary.Issuers)
+	if err != nil {
+		return errors.WithMessage(err, "invalid issuer")
+	}
+	auditors, err := mspIDs(summary.Auditors)
+	if err != nil {
+		return errors.WithMessage(err, "invalid auditor")
+	}
+
+	fmt.Fprintf(w, "Driver: %s\n", summary.Label)
+	fmt.Fprintf(w, "Max token value: %d\n", summary.MaxTokenValue)
+	fmt.Fprintf(w, "Quantity precision: %d\n", summary.QuantityPrecision)
+	fmt.Fprintf(w, "Issuers: %d\n", len(issuers))
+	for i, id := range issuers {
+		fmt.Fprintf(w, "  [%d] %s\n", i, id)
+	}
+	fmt.Fprintf(w, "Auditors: %d\n", len(auditors))
+	for i, id := range auditors {
+		fmt.Fprintf(w, "  [%d] %s\n", i, id)
+	}
+	// FabToken does not embed any issuing policy, any of the issuers can issue
+	fmt.Fprintf(w, "Issuing policy: none\n")
+	return nil
+}
+
+// mspIDs returns the MSP IDs of the passed serialized MSP identities
+func mspIDs(ids []view.Identity) ([]string, error) {
+	mspIDs := make([]string, len(ids))
+	for i, id := range ids {
+		si := &msp.SerializedIdentity{}
+		if err := proto.Unmarshal(id, si); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal identity [%d] to msp.SerializedIdentity{}", i)
+		}
+		if len(si.Mspid) == 0 {
+			return nil, errors.Errorf("identity [%d] has no msp id", i)
+		}
+		mspIDs[i] = si.Mspid
+	}
+	return mspIDs, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect(t *testing.T) {
+	pp, err := fabtoken.Setup()
+	assert.NoError(t, err)
+	for _, mspID := range []string{"Org1MSP", "Org2MSP"} {
+		id, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: []byte("cert")})
+		assert.NoError(t, err)
+		pp.AddIssuer(id)
+	}
+	id, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "AuditorMSP", IdBytes: []byte("cert")})
+	assert.NoError(t, err)
+	pp.AddAuditor(id)
+
+	for _, format := range []string{JSONFormat, YAMLFormat} {
+		raw, err := SerializeAs(pp, format)
+		assert.NoError(t, err)
+		out := &bytes.Buffer{}
+		assert.NoError(t, Inspect(raw, out), format)
+		assert.Equal(t, `Driver: fabtoken
+Max token value: 21000000000000000
+Quantity precision: 64
+Issuers: 2
+  [0] Org1MSP
+  [1] Org2MSP
+Auditors: 1
+  [0] AuditorMSP
+Issuing policy: none
+`, out.String(), format)
+	}
+
+	// invalid identities
+	pp.AddIssuer([]byte("not an identity"))
+	raw, err := pp.Serialize()
+	assert.NoError(t, err)
+	assert.Error(t, Inspect(raw, &bytes.Buffer{}))
+
+	// invalid parameters
+	pp.Issuers = nil
+	pp.MTV = 0
+	raw, err = pp.Serialize()
+	assert.NoError(t, err)
+	assert.EqualError(t, Inspect(raw, &bytes.Buffer{}), "invalid public parameters: max token value must be positive")
+	assert.Error(t, Inspect([]byte("{"), &bytes.Buffer{}))
+}
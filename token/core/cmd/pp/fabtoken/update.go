@@ -0,0 +1,244 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/cmd/pp/common"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// updateOutputDir is the directory to output the updated public parameters to, if not updated in place
+	updateOutputDir string
+	// updateIssuers is the list of issuers to add to the public parameters
+	updateIssuers []string
+	// updateAuditors is the list of auditors to add to the public parameters
+	updateAuditors []string
+	// updateConfigPath is the path of the manifest listing the issuers and auditors to add
+	updateConfigPath string
+)
+
+// updateCmd returns the Cobra Command for Update
+func updateCmd() *cobra.Command {
+	flags := updateCommand.Flags()
+	flags.StringVarP(&updateOutputDir, "output", "o", "", "output folder, the public parameters are updated in place if not set")
+	flags.StringSliceVarP(&updateAuditors, "auditors", "a", nil, "list of auditor keys in the form of <MSP-Dir>:<MSP-ID>")
+	flags.StringSliceVarP(&updateIssuers, "issuers", "s", nil, "list of issuer keys in the form of <MSP-Dir>:<MSP-ID>")
+	flags.StringVarP(&updateConfigPath, "config", "c", "", "manifest file, yaml or json, listing issuers and auditors")
+	return updateCommand
+}
+
+var updateCommand = &cobra.Command{
+	Use:   "update <pp-file>",
+	Short: "Update FabToken public parameters.",
+	Long:  `Adds issuers and auditors to existing FabToken public parameters, preserving the rest of the parameters.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected the path of the public parameters file")
+		}
+		// Parsing of the command line is done so silence cmd usage
+		cmd.SilenceUsage = true
+		updateArgs := &UpdateArgs{
+			InputPath: args[0],
+			OutputDir: updateOutputDir,
+			Issuers:   updateIssuers,
+			Auditors:  updateAuditors,
+		}
+		if len(updateConfigPath) != 0 {
+			manifest, err := common.LoadManifest(updateConfigPath)
+			if err != nil {
+				return errors.Wrap(err, "failed to update public parameters")
+			}
+			updateArgs.IssuerKeys = manifest.Issuers
+			updateArgs.AuditorKeys = manifest.Auditors
+		}
+		res, err := Update(updateArgs)
+		if err != nil {
+			return errors.Wrap(err, "failed to update public parameters")
+		}
+		for _, warning := range res.Warnings {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s\n", warning)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Public parameters written to [%s]\n", res.Path)
+		if len(res.ReviewPath) != 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "Public parameters for review written to [%s]\n", res.ReviewPath)
+		}
+		return nil
+	},
+}
+
+type UpdateArgs struct {
+	// InputPath is the path of the public parameters to update, in json or yaml format.
+	// A yaml file is taken as the review companion of the fabtoken_pp.json file next to it, see GeneratorArgs.Format.
+	InputPath string
+	// OutputDir is the directory to output the updated public parameters to.
+	// If empty, the public parameters are updated in place.
+	OutputDir string
+	// Issuers is the list of issuers to add to the public parameters.
+	// Each issuer should be specified in the form of <MSP-Dir>:<MSP-ID>
+	Issuers []string
+	// Auditors is the list of auditors to add to the public parameters.
+	// Each auditor should be specified in the form of <MSP-Dir>:<MSP-ID>
+	Auditors []string
+	// IssuerKeys is the list of already parsed issuers to add, in addition to Issuers
+	IssuerKeys []common.MSPKey
+	// AuditorKeys is the list of already parsed auditors to add, in addition to Auditors
+	AuditorKeys []common.MSPKey
+}
+
+// UpdateResult is the outcome of Update
+type UpdateResult struct {
+	// PublicParams are the updated public parameters
+	PublicParams *fabtoken.PublicParams
+	// Raw is the canonical JSON encoding of the updated public parameters, the one the network loads
+	Raw []byte
+	// Path is the file the canonical JSON encoding of the updated public parameters is written to
+	Path string
+	// ReviewPath, if not empty, is the file the YAML encoding of the updated public parameters is written to, for review only
+	ReviewPath string
+	// Warnings are the anomalies found in the public parameters that did not prevent the update
+	Warnings []string
+}
+
+// identities collects the identities loaded by common.SetupIssuersAndAuditorsFromKeys
+type identities struct {
+	auditors []view.Identity
+	issuers  []view.Identity
+}
+
+func (i *identities) AddAuditor(raw view.Identity) {
+	i.auditors = append(i.auditors, raw)
+}
+
+func (i *identities) AddIssuer(raw view.Identity) {
+	i.issuers = append(i.issuers, raw)
+}
+
+// Update adds issuers and auditors to existing public parameters, and writes them in their original format.
+// The JSON file the network loads is always written. When the input is in yaml format,
+// the input is rewritten too, as the review companion of the JSON file.
+// It refuses to add an issuer or an auditor already present.
+// FabToken supports a single auditor, therefore adding an auditor replaces the existing one, if any.
+func Update(args *UpdateArgs) (*UpdateResult, error) {
+	raw, err := ioutil.ReadFile(args.InputPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading public parameters [%s]", args.InputPath)
+	}
+	pp, err := Deserialize(raw)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed deserializing public parameters [%s]", args.InputPath)
+	}
+	format := JSONFormat
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		format = YAMLFormat
+	}
+
+	auditors, err := parseKeys("auditor", args.Auditors)
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := parseKeys("issuer", args.Issuers)
+	if err != nil {
+		return nil, err
+	}
+	ids := &identities{}
+	if err := common.SetupIssuersAndAuditorsFromKeys(
+		ids,
+		common.Merge(auditors, args.AuditorKeys),
+		common.Merge(issuers, args.IssuerKeys),
+	); err != nil {
+		return nil, err
+	}
+
+	res := &UpdateResult{PublicParams: pp}
+	if res.Warnings, err = addIdentities(pp, ids); err != nil {
+		return nil, err
+	}
+
+	// Store Public Params
+	if res.Raw, err = pp.Serialize(); err != nil {
+		return nil, errors.Wrap(err, "failed serializing public parameters")
+	}
+	res.Path = args.InputPath
+	if format == YAMLFormat {
+		res.ReviewPath = args.InputPath
+		res.Path = filepath.Join(filepath.Dir(args.InputPath), FileName(JSONFormat))
+	}
+	if len(args.OutputDir) != 0 {
+		res.Path = filepath.Join(args.OutputDir, FileName(JSONFormat))
+		if format == YAMLFormat {
+			res.ReviewPath = filepath.Join(args.OutputDir, FileName(YAMLFormat))
+		}
+	}
+	perm := os.FileMode(0755)
+	if info, err := os.Stat(args.InputPath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := writePublicParams(pp, res.Raw, res.Path, res.ReviewPath, perm); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// addIdentities adds the passed issuers and auditors to the public parameters, refusing duplicates.
+// It returns the warnings about the update.
+func addIdentities(pp *fabtoken.PublicParams, ids *identities) ([]string, error) {
+	warnings := driverWarnings(pp)
+	if len(ids.auditors) > 1 {
+		return nil, errors.Errorf("fabtoken supports a single auditor, got [%d]", len(ids.auditors))
+	}
+	for i, issuer := range ids.issuers {
+		for _, existing := range pp.Issuers {
+			if issuer.Equal(existing) {
+				return nil, errors.Errorf("issuer [%d] already in the public parameters", i)
+			}
+		}
+		for j := 0; j < i; j++ {
+			if issuer.Equal(ids.issuers[j]) {
+				return nil, errors.Errorf("issuer [%d] is a duplicate of issuer [%d]", i, j)
+			}
+		}
+	}
+	if len(ids.auditors) == 1 {
+		switch {
+		case ids.auditors[0].Equal(pp.Auditor):
+			return nil, errors.New("auditor already in the public parameters")
+		case len(pp.Auditor) != 0:
+			warnings = append(warnings, "fabtoken supports a single auditor, the existing auditor is replaced")
+		}
+		pp.AddAuditor(ids.auditors[0])
+	}
+	for _, issuer := range ids.issuers {
+		pp.AddIssuer(issuer)
+	}
+	return warnings, nil
+}
+
+// driverWarnings returns a warning if the public parameters were generated by a driver
+// whose defaults differ from the current ones
+func driverWarnings(pp *fabtoken.PublicParams) []string {
+	current, err := fabtoken.Setup()
+	if err != nil {
+		return []string{fmt.Sprintf("failed checking the driver version: %s", err)}
+	}
+	if pp.MTV != current.MTV || pp.QuantityPrecision != current.QuantityPrecision {
+		return []string{fmt.Sprintf(
+			"the public parameters were generated by a different version of the driver: max token value [%d], quantity precision [%d], expected [%d] and [%d]",
+			pp.MTV, pp.QuantityPrecision, current.MTV, current.QuantityPrecision,
+		)}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/cmd/pp/common"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/fabtoken"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabtoken")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pp, _, err := Generate(&GeneratorArgs{OutputDir: dir, Format: YAMLFormat})
+	assert.NoError(t, err)
+	pp.AddIssuer([]byte("issuer"))
+	raw, err := SerializeAs(pp, YAMLFormat)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, FileName(YAMLFormat))
+	assert.NoError(t, ioutil.WriteFile(path, raw, 0644))
+
+	// the yaml file is rewritten, in place or in the output directory, together with the json file the network loads
+	res, err := Update(&UpdateArgs{InputPath: path})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "fabtoken_pp.json"), res.Path)
+	assert.Equal(t, path, res.ReviewPath)
+	assert.Equal(t, pp, res.PublicParams)
+	assert.Empty(t, res.Warnings)
+	out, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, out)
+	out, err = ioutil.ReadFile(res.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, res.Raw, out)
+	loaded, err := fabtoken.NewPublicParamsFromBytes(out, fabtoken.PublicParameters)
+	assert.NoError(t, err)
+	assert.Equal(t, pp, loaded)
+	outDir := filepath.Join(dir, "out")
+	assert.NoError(t, os.Mkdir(outDir, 0755))
+	res, err = Update(&UpdateArgs{InputPath: path, OutputDir: outDir})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(outDir, "fabtoken_pp.json"), res.Path)
+	assert.Equal(t, filepath.Join(outDir, "fabtoken_pp.yaml"), res.ReviewPath)
+
+	// json files are rewritten in place, without review companion
+	res, err = Update(&UpdateArgs{InputPath: filepath.Join(outDir, "fabtoken_pp.json")})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(outDir, "fabtoken_pp.json"), res.Path)
+	assert.Empty(t, res.ReviewPath)
+
+	// keys are checked before anything is written
+	missing := filepath.Join(dir, "missing")
+	_, err = Update(&UpdateArgs{InputPath: path, IssuerKeys: []common.MSPKey{{Dir: missing, ID: "Org1MSP"}}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get issuer identity ["+missing+":Org1MSP]")
+	_, err = Update(&UpdateArgs{InputPath: missing})
+	assert.Error(t, err)
+}
+
+func TestAddIdentities(t *testing.T) {
+	pp, err := fabtoken.Setup()
+	assert.NoError(t, err)
+	pp.AddIssuer([]byte("alice"))
+
+	warnings, err := addIdentities(pp, &identities{issuers: []view.Identity{[]byte("bob")}, auditors: []view.Identity{[]byte("auditor")}})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, [][]byte{[]byte("alice"), []byte("bob")}, pp.Issuers)
+	assert.Equal(t, []byte("auditor"), pp.Auditor)
+
+	// duplicates are refused, leaving the public parameters untouched
+	_, err = addIdentities(pp, &identities{issuers: []view.Identity{[]byte("charlie"), []byte("alice")}})
+	assert.EqualError(t, err, "issuer [1] already in the public parameters")
+	_, err = addIdentities(pp, &identities{issuers: []view.Identity{[]byte("charlie"), []byte("charlie")}})
+	assert.EqualError(t, err, "issuer [1] is a duplicate of issuer [0]")
+	_, err = addIdentities(pp, &identities{auditors: []view.Identity{[]byte("auditor")}})
+	assert.EqualError(t, err, "auditor already in the public parameters")
+	_, err = addIdentities(pp, &identities{auditors: []view.Identity{[]byte("a1"), []byte("a2")}})
+	assert.EqualError(t, err, "fabtoken supports a single auditor, got [2]")
+	assert.Len(t, pp.Issuers, 2)
+
+	// replacing the auditor, or updating parameters of a different version of the driver, is allowed with a warning
+	pp.MTV = 1000
+	warnings, err = addIdentities(pp, &identities{auditors: []view.Identity{[]byte("auditor2")}})
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], "different version of the driver")
+	assert.Equal(t, "fabtoken supports a single auditor, the existing auditor is replaced", warnings[1])
+	assert.Equal(t, []byte("auditor2"), pp.Auditor)
+}
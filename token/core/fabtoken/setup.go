@@ -104,6 +104,64 @@ func (pp *PublicParams) Precision() uint64 {
 	return pp.QuantityPrecision
 }
 
+// ParamsSummary is a structured summary of the content of public parameters,
+// meant for inspection by tools without poking at internal fields.
+type ParamsSummary struct {
+	// Label is the identifier of the public parameters
+	Label string
+	// Issuers are the identities of the issuers
+	Issuers []view.Identity
+	// Auditors are the identities of the auditors
+	Auditors []view.Identity
+	// Certifiers are the identities of the certifiers
+	Certifiers []view.Identity
+	// Curve is the name of the curve in use, if any
+	Curve string
+	// MaxTokenValue is the maximum value a token can carry
+	MaxTokenValue uint64
+	// QuantityPrecision is the precision used to represent quantities
+	QuantityPrecision uint64
+}
+
+// Summary returns a structured summary of the public parameters.
+// FabToken has no certifiers and does not use any curve, therefore the corresponding fields are left empty.
+func (pp *PublicParams) Summary() ParamsSummary {
+	summary := ParamsSummary{
+		Label:             pp.Label,
+		MaxTokenValue:     pp.MTV,
+		QuantityPrecision: pp.QuantityPrecision,
+	}
+	for _, issuer := range pp.Issuers {
+		summary.Issuers = append(summary.Issuers, issuer)
+	}
+	if len(pp.Auditor) != 0 {
+		summary.Auditors = append(summary.Auditors, pp.Auditor)
+	}
+	return summary
+}
+
+// Validate checks that the public parameters are well-formed
+func (pp *PublicParams) Validate() error {
+	if pp.Label != PublicParameters {
+		return errors.Errorf("invalid public parameters: invalid identifier, expecting 'fabtoken', got [%s]", pp.Label)
+	}
+	if pp.QuantityPrecision == 0 || pp.QuantityPrecision > 64 {
+		return errors.Errorf("invalid public parameters: quantity precision must be between 1 and 64, got [%d]", pp.QuantityPrecision)
+	}
+	if pp.MTV == 0 {
+		return errors.New("invalid public parameters: max token value must be positive")
+	}
+	if pp.QuantityPrecision < 64 && pp.MTV >= uint64(1)<<pp.QuantityPrecision {
+		return errors.Errorf("invalid public parameters: max token value [%d] exceeds the quantity precision [%d]", pp.MTV, pp.QuantityPrecision)
+	}
+	for i, issuer := range pp.Issuers {
+		if len(issuer) == 0 {
+			return errors.Errorf("invalid public parameters: empty issuer [%d]", i)
+		}
+	}
+	return nil
+}
+
 func Setup() (*PublicParams, error) {
 	return &PublicParams{
 		MTV:               MaxMoney,
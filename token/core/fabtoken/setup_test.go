@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fabtoken
+
+import (
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary(t *testing.T) {
+	pp, err := Setup()
+	assert.NoError(t, err)
+	summary := pp.Summary()
+	assert.Equal(t, PublicParameters, summary.Label)
+	assert.Empty(t, summary.Issuers)
+	assert.Empty(t, summary.Auditors)
+
+	pp.AddIssuer([]byte("issuer1"))
+	pp.AddIssuer([]byte("issuer2"))
+	pp.AddAuditor([]byte("auditor"))
+
+	// the summary survives a serialization round trip
+	raw, err := pp.Serialize()
+	assert.NoError(t, err)
+	pp, err = NewPublicParamsFromBytes(raw, PublicParameters)
+	assert.NoError(t, err)
+
+	summary = pp.Summary()
+	assert.Equal(t, ParamsSummary{
+		Label:             PublicParameters,
+		Issuers:           []view.Identity{[]byte("issuer1"), []byte("issuer2")},
+		Auditors:          []view.Identity{[]byte("auditor")},
+		MaxTokenValue:     MaxMoney,
+		QuantityPrecision: DefaultPrecision,
+	}, summary)
+}
+
+func TestValidate(t *testing.T) {
+	pp, err := Setup()
+	assert.NoError(t, err)
+	assert.NoError(t, pp.Validate())
+
+	pp.AddIssuer(nil)
+	assert.EqualError(t, pp.Validate(), "invalid public parameters: empty issuer [0]")
+
+	pp, err = Setup()
+	assert.NoError(t, err)
+	pp.QuantityPrecision = 16
+	assert.EqualError(t, pp.Validate(), "invalid public parameters: max token value [21000000000000000] exceeds the quantity precision [16]")
+	pp.QuantityPrecision = 0
+	assert.EqualError(t, pp.Validate(), "invalid public parameters: quantity precision must be between 1 and 64, got [0]")
+	pp.QuantityPrecision = DefaultPrecision
+	pp.MTV = 0
+	assert.EqualError(t, pp.Validate(), "invalid public parameters: max token value must be positive")
+}
@@ -6,6 +6,7 @@ SPDX-License-Identifier: Apache-2.0
 package rangeproof
 
 import (
+	"context"
 	"encoding/json"
 	"math"
 	"sync"
@@ -42,6 +43,9 @@ type Prover struct {
 	*Verifier
 	tokenWitness []*token.TokenDataWitness
 	Signatures   []*pssign.Signature
+	// Sequential, if true, makes the prover generate the membership proofs one after the other
+	// on the calling goroutine, instead of concurrently
+	Sequential bool
 }
 
 func NewProver(tw []*token.TokenDataWitness, token []*mathlib.G1, signatures []*pssign.Signature, exponent int, pp []*mathlib.G1, PK []*mathlib.G2, P *mathlib.G1, Q *mathlib.G2, c *mathlib.Curve) *Prover {
@@ -104,6 +108,12 @@ type commitmentWitnessBlindingFactor struct {
 }
 
 func (p *Prover) Prove() ([]byte, error) {
+	return p.ProveWithContext(context.Background())
+}
+
+// ProveWithContext is like Prove, but stops as soon as possible once the passed context is done,
+// returning the context's error. The membership proofs not started yet are skipped.
+func (p *Prover) ProveWithContext(ctx context.Context) ([]byte, error) {
 	proof := &Proof{}
 	var err error
 	preProcessed, err := p.preProcess()
@@ -112,32 +122,48 @@ func (p *Prover) Prove() ([]byte, error) {
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(p.Token) * p.Exponent)
 
 	parallelErr := &atomic.Value{}
 
 	proof.MembershipProofs = make([]*MembershipProof, len(p.Token))
+launch:
 	for k := 0; k < len(proof.MembershipProofs); k++ {
 		proof.MembershipProofs[k] = &MembershipProof{}
 		proof.MembershipProofs[k].Commitments = make([]*mathlib.G1, p.Exponent)
 		proof.MembershipProofs[k].SignatureProofs = make([][]byte, p.Exponent)
 		for i := 0; i < p.Exponent; i++ {
+			// once the context is done, no more provers are built: wait for the launched ones and return
+			if ctx.Err() != nil {
+				break launch
+			}
+			wg.Add(1)
 			proof.MembershipProofs[k].Commitments[i] = preProcessed.commitment[k][i]
 			mp := sigproof.NewMembershipProver(preProcessed.witness[k][i], proof.MembershipProofs[k].Commitments[i], p.P, p.Q, p.PK, p.PedersenParams[:2], p.Curve)
 
-			go func(k, i int) {
+			prove := func(k, i int) {
 				defer wg.Done()
+				if ctx.Err() != nil {
+					return
+				}
 				var err error
 				proof.MembershipProofs[k].SignatureProofs[i], err = mp.Prove()
 				if err != nil {
 					parallelErr.Store(err)
 				}
-			}(k, i)
+			}
+			if p.Sequential {
+				prove(k, i)
+			} else {
+				go prove(k, i)
+			}
 		}
 	}
 
 	wg.Wait()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if parallelErr.Load() != nil {
 		return nil, parallelErr.Load().(error)
 	}
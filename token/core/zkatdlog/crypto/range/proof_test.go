@@ -6,6 +6,8 @@ SPDX-License-Identifier: Apache-2.0
 package rangeproof_test
 
 import (
+	"context"
+
 	"github.com/IBM/mathlib"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto/pssign"
 	rp "github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto/range"
@@ -32,6 +34,15 @@ var _ = Describe("range proof", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
+	Context("when the context is done", func() {
+		It("returns the context's error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			proof, err := prover.ProveWithContext(ctx)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(proof).To(BeNil())
+		})
+	})
 })
 
 func getRangeProver() *rp.Prover {
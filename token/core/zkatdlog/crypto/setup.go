@@ -19,6 +19,12 @@ import (
 const (
 	DLogPublicParameters = "zkatdlog"
 	DefaultPrecision     = uint64(64)
+
+	// pedersenGenerators is the number of generators used to commit to a token: type, value, and blinding factor
+	pedersenGenerators = 3
+	// rangeSignPKLength is the length of the public key of the PS signatures on the values of the range,
+	// each signature is on a single message
+	rangeSignPKLength = 3
 )
 
 type PublicParams struct {
@@ -37,6 +43,21 @@ type PublicParams struct {
 	Hash []byte
 }
 
+// IssuingPolicy is the M-of-N policy that governs issuance:
+// at least Threshold of the Issuers must sign an issue action.
+type IssuingPolicy struct {
+	Threshold int
+	Issuers   [][]byte
+}
+
+// Validate checks that the threshold is between one and the number of issuers
+func (p *IssuingPolicy) Validate() error {
+	if p.Threshold < 1 || p.Threshold > len(p.Issuers) {
+		return errors.Errorf("invalid issuing policy: threshold [%d] must be between 1 and the number of issuers [%d]", p.Threshold, len(p.Issuers))
+	}
+	return nil
+}
+
 type RangeProofParams struct {
 	SignPK       []*math.G2
 	SignedValues []*pssign.Signature
@@ -117,6 +138,56 @@ func (pp *PublicParams) Deserialize(raw []byte) error {
 	return nil
 }
 
+// Validate checks that the public parameters carry all the elements needed to generate and verify proofs,
+// and that they are consistent with each other
+func (pp *PublicParams) Validate() error {
+	if pp.Curve < 0 || pp.Curve >= len(math.Curves) {
+		return errors.Errorf("invalid public parameters: unknown curve [%d]", pp.Curve)
+	}
+	if pp.P == nil {
+		return errors.New("invalid public parameters: nil generator P")
+	}
+	if len(pp.ZKATPedParams) != pedersenGenerators {
+		return errors.Errorf("invalid public parameters: expected [%d] pedersen generators, got [%d]", pedersenGenerators, len(pp.ZKATPedParams))
+	}
+	for i, g := range pp.ZKATPedParams {
+		if g == nil {
+			return errors.Errorf("invalid public parameters: nil pedersen generator [%d]", i)
+		}
+	}
+	return pp.RangeProofParams.Validate()
+}
+
+// Validate checks that the range proof parameters are present and well-formed
+func (rpp *RangeProofParams) Validate() error {
+	if rpp == nil {
+		return errors.New("invalid public parameters: nil range proof parameters")
+	}
+	if rpp.Q == nil {
+		return errors.New("invalid public parameters: nil range proof generator Q")
+	}
+	if len(rpp.SignPK) != rangeSignPKLength {
+		return errors.Errorf("invalid public parameters: expected [%d] range proof public keys, got [%d]", rangeSignPKLength, len(rpp.SignPK))
+	}
+	for i, pk := range rpp.SignPK {
+		if pk == nil {
+			return errors.Errorf("invalid public parameters: nil range proof public key [%d]", i)
+		}
+	}
+	if len(rpp.SignedValues) == 0 {
+		return errors.New("invalid public parameters: no signed values for range proofs")
+	}
+	for i, sig := range rpp.SignedValues {
+		if sig == nil || sig.R == nil || sig.S == nil {
+			return errors.Errorf("invalid public parameters: invalid signed value [%d]", i)
+		}
+	}
+	if rpp.Exponent <= 0 {
+		return errors.Errorf("invalid public parameters: range proof exponent must be positive, got [%d]", rpp.Exponent)
+	}
+	return nil
+}
+
 func (pp *PublicParams) GeneratePedersenParameters() error {
 	curve := math.Curves[pp.Curve]
 	rand, err := curve.Rand()
@@ -124,7 +195,7 @@ func (pp *PublicParams) GeneratePedersenParameters() error {
 		return errors.Errorf("failed to get RNG")
 	}
 	pp.P = curve.GenG1.Mul(curve.NewRandomZr(rand))
-	pp.ZKATPedParams = make([]*math.G1, 3)
+	pp.ZKATPedParams = make([]*math.G1, pedersenGenerators)
 
 	for i := 0; i < len(pp.ZKATPedParams); i++ {
 		pp.ZKATPedParams[i] = curve.GenG1.Mul(curve.NewRandomZr(rand))
@@ -163,6 +234,35 @@ func (pp *PublicParams) ComputeHash(raw []byte) error {
 	return nil
 }
 
+// SetIssuingPolicy validates the passed issuing policy and stores it, serialized, in the public parameters
+func (pp *PublicParams) SetIssuingPolicy(policy *IssuingPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		return errors.Wrap(err, "failed marshalling issuing policy")
+	}
+	pp.IssuingPolicy = raw
+	return nil
+}
+
+// GetIssuingPolicy returns the issuing policy stored in the public parameters, parsed and validated.
+// It returns nil if no issuing policy is set.
+func (pp *PublicParams) GetIssuingPolicy() (*IssuingPolicy, error) {
+	if len(pp.IssuingPolicy) == 0 {
+		return nil, nil
+	}
+	policy := &IssuingPolicy{}
+	if err := json.Unmarshal(pp.IssuingPolicy, policy); err != nil {
+		return nil, errors.Wrap(err, "failed unmarshalling issuing policy")
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
 func (pp *PublicParams) AddAuditor(auditor view.Identity) {
 	pp.Auditor = auditor
 }
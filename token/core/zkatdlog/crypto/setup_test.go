@@ -21,3 +21,51 @@ func TestSetup(t *testing.T) {
 	fmt.Printf("elapsed %d", e.Sub(s).Milliseconds())
 	assert.NoError(t, err)
 }
+
+func TestIssuingPolicy(t *testing.T) {
+	pp, err := Setup(100, 2, nil, math3.FP256BN_AMCL)
+	assert.NoError(t, err)
+	policy, err := pp.GetIssuingPolicy()
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	assert.Error(t, pp.SetIssuingPolicy(&IssuingPolicy{Threshold: 3, Issuers: [][]byte{[]byte("alice"), []byte("bob")}}))
+	assert.Error(t, pp.SetIssuingPolicy(&IssuingPolicy{Threshold: 0, Issuers: [][]byte{[]byte("alice")}}))
+
+	// round-trip a 2-of-3 policy
+	expected := &IssuingPolicy{Threshold: 2, Issuers: [][]byte{[]byte("alice"), []byte("bob"), []byte("charlie")}}
+	assert.NoError(t, pp.SetIssuingPolicy(expected))
+	raw, err := pp.Serialize()
+	assert.NoError(t, err)
+	pp2, err := NewPublicParamsFromBytes(raw, DLogPublicParameters)
+	assert.NoError(t, err)
+	policy, err = pp2.GetIssuingPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, policy)
+}
+
+func TestValidate(t *testing.T) {
+	pp, err := Setup(100, 2, nil, math3.FP256BN_AMCL)
+	assert.NoError(t, err)
+	assert.NoError(t, pp.Validate())
+
+	raw, err := pp.Serialize()
+	assert.NoError(t, err)
+	for name, corrupt := range map[string]func(pp *PublicParams){
+		"curve":          func(pp *PublicParams) { pp.Curve = len(math3.Curves) },
+		"generator":      func(pp *PublicParams) { pp.P = nil },
+		"pedersen":       func(pp *PublicParams) { pp.ZKATPedParams = pp.ZKATPedParams[:2] },
+		"pedersen nil":   func(pp *PublicParams) { pp.ZKATPedParams[1] = nil },
+		"range":          func(pp *PublicParams) { pp.RangeProofParams = nil },
+		"range Q":        func(pp *PublicParams) { pp.RangeProofParams.Q = nil },
+		"range PK":       func(pp *PublicParams) { pp.RangeProofParams.SignPK[2] = nil },
+		"signed values":  func(pp *PublicParams) { pp.RangeProofParams.SignedValues = nil },
+		"signed value":   func(pp *PublicParams) { pp.RangeProofParams.SignedValues[7].S = nil },
+		"range exponent": func(pp *PublicParams) { pp.RangeProofParams.Exponent = 0 },
+	} {
+		pp, err := NewPublicParamsFromBytes(raw, DLogPublicParameters)
+		assert.NoError(t, err)
+		corrupt(pp)
+		assert.Error(t, pp.Validate(), name)
+	}
+}
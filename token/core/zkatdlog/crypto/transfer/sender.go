@@ -48,7 +48,10 @@ func (s *Sender) GenerateZKTransfer(values []uint64, owners [][]byte) (*Transfer
 	for i := 0; i < len(s.InputInformation); i++ {
 		intw[i] = &token.TokenDataWitness{Value: s.InputInformation[i].Value, Type: s.InputInformation[i].Type, BlindingFactor: s.InputInformation[i].BlindingFactor}
 	}
-	prover := NewProver(intw, outtw, in, out, s.PublicParams)
+	prover, err := NewProver(intw, outtw, in, out, s.PublicParams)
+	if err != nil {
+		return nil, nil, err
+	}
 	proof, err := prover.Prove()
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to generate zero-knowledge proof for transfer request")
@@ -6,8 +6,11 @@ SPDX-License-Identifier: Apache-2.0
 package transfer
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"sync"
+	"time"
 
 	math "github.com/IBM/mathlib"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto"
@@ -23,6 +26,20 @@ type Proof struct {
 	RangeCorrectness []byte // range correctness proof
 }
 
+// ProofFormat is the encoding of a serialized transfer proof
+type ProofFormat int
+
+const (
+	// JSONProof encodes the proof as JSON. It is the default, for compatibility.
+	JSONProof ProofFormat = iota
+	// BinaryProof encodes the proof as the concatenation of its length-prefixed components,
+	// preceded by binaryProofMagic. It is more compact than JSON, which base64-encodes the components.
+	BinaryProof
+)
+
+// binaryProofMagic is the first byte of a binary proof. A JSON proof starts with '{' instead.
+const binaryProofMagic = 0x01
+
 // verifier for zkat transfer
 type Verifier struct {
 	WellFormedness   common.Verifier
@@ -33,10 +50,36 @@ type Verifier struct {
 type Prover struct {
 	WellFormedness   common.Prover
 	RangeCorrectness common.Prover
+	// Format is the encoding of the generated proofs, JSONProof by default
+	Format ProofFormat
+	// Sequential, if true, makes the prover generate the well-formedness and the range proofs one after the other,
+	// instead of concurrently. See WithSequentialProof.
+	Sequential bool
+}
+
+// ProverOption configures a Prover
+type ProverOption func(*Prover)
+
+// WithSequentialProof makes the prover generate all the components of the proof one after the other,
+// on the calling goroutine, for a deterministic single-threaded behavior
+func WithSequentialProof() ProverOption {
+	return func(p *Prover) {
+		p.Sequential = true
+	}
 }
 
-func NewProver(inputwitness, outputwitness []*token.TokenDataWitness, inputs, outputs []*math.G1, pp *crypto.PublicParams) *Prover {
+// NewProver returns a prover of transfer proofs.
+// By default, the well-formedness and the range proofs are generated concurrently, as they are independent.
+// The provers only read the passed public parameters, which can then be shared.
+// It returns an error if the public parameters are not valid.
+func NewProver(inputwitness, outputwitness []*token.TokenDataWitness, inputs, outputs []*math.G1, pp *crypto.PublicParams, opts ...ProverOption) (*Prover, error) {
+	if err := pp.Validate(); err != nil {
+		return nil, errors.WithMessage(err, "failed to create transfer prover")
+	}
 	p := &Prover{}
+	for _, opt := range opts {
+		opt(p)
+	}
 
 	inW := make([]*token.TokenDataWitness, len(inputwitness))
 	outW := make([]*token.TokenDataWitness, len(outputwitness))
@@ -49,95 +92,274 @@ func NewProver(inputwitness, outputwitness []*token.TokenDataWitness, inputs, ou
 		outW[i] = outputwitness[i].Clone()
 	}
 	if len(inputwitness) != 1 || len(outputwitness) != 1 {
-		p.RangeCorrectness = rangeproof.NewProver(outW, outputs, pp.RangeProofParams.SignedValues, pp.RangeProofParams.Exponent, pp.ZKATPedParams, pp.RangeProofParams.SignPK, pp.P, pp.RangeProofParams.Q, math.Curves[pp.Curve])
+		rp := rangeproof.NewProver(outW, outputs, pp.RangeProofParams.SignedValues, pp.RangeProofParams.Exponent, pp.ZKATPedParams, pp.RangeProofParams.SignPK, pp.P, pp.RangeProofParams.Q, math.Curves[pp.Curve])
+		rp.Sequential = p.Sequential
+		p.RangeCorrectness = rp
 	}
 	wfw := NewWellFormednessWitness(inW, outW)
 	p.WellFormedness = NewWellFormednessProver(wfw, pp.ZKATPedParams, inputs, outputs, math.Curves[pp.Curve])
-	return p
+	return p, nil
 }
 
-func NewVerifier(inputs, outputs []*math.G1, pp *crypto.PublicParams) *Verifier {
+// NewVerifier returns a verifier of transfer proofs.
+// It returns an error if the public parameters are not valid.
+func NewVerifier(inputs, outputs []*math.G1, pp *crypto.PublicParams) (*Verifier, error) {
+	if err := pp.Validate(); err != nil {
+		return nil, errors.WithMessage(err, "failed to create transfer verifier")
+	}
 	v := &Verifier{}
 	if len(inputs) != 1 || len(outputs) != 1 {
 		v.RangeCorrectness = rangeproof.NewVerifier(outputs, uint64(len(pp.RangeProofParams.SignedValues)), pp.RangeProofParams.Exponent, pp.ZKATPedParams, pp.RangeProofParams.SignPK, pp.P, pp.RangeProofParams.Q, math.Curves[pp.Curve])
 	}
 	v.WellFormedness = NewWellFormednessVerifier(pp.ZKATPedParams, inputs, outputs, math.Curves[pp.Curve])
 
-	return v
+	return v, nil
 }
 
+// VerifyWithCandidates verifies the passed transfer proof against each of the candidate public parameters, in order.
+// This supports the rotation of the public parameters, when proofs might have been generated against
+// either the previous or the new version.
+// It returns the candidate under which the proof is valid, or an error if none of them validates it.
+func VerifyWithCandidates(inputs, outputs []*math.G1, proof []byte, candidates []*crypto.PublicParams) (*crypto.PublicParams, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("invalid transfer proof: no candidate public parameters")
+	}
+	var err error
+	for _, pp := range candidates {
+		var v *Verifier
+		if v, err = NewVerifier(inputs, outputs, pp); err != nil {
+			continue
+		}
+		if err = v.Verify(proof); err == nil {
+			return pp, nil
+		}
+	}
+	return nil, errors.WithMessagef(err, "invalid transfer proof: not valid under any of the [%d] candidate public parameters", len(candidates))
+}
+
+// Serialize encodes the proof as JSON
 func (p *Proof) Serialize() ([]byte, error) {
-	return json.Marshal(p)
+	return p.SerializeAs(JSONProof)
 }
 
+// SerializeAs encodes the proof in the passed format
+func (p *Proof) SerializeAs(format ProofFormat) ([]byte, error) {
+	switch format {
+	case JSONProof:
+		return json.Marshal(p)
+	case BinaryProof:
+		raw := make([]byte, 1, 1+2*binary.MaxVarintLen64+len(p.WellFormedness)+len(p.RangeCorrectness))
+		raw[0] = binaryProofMagic
+		for _, component := range [][]byte{p.WellFormedness, p.RangeCorrectness} {
+			var length [binary.MaxVarintLen64]byte
+			raw = append(raw, length[:binary.PutUvarint(length[:], uint64(len(component)))]...)
+			raw = append(raw, component...)
+		}
+		return raw, nil
+	default:
+		return nil, errors.Errorf("unknown proof format [%d]", format)
+	}
+}
+
+// Deserialize decodes a proof serialized in any of the supported formats, detected from its first byte
 func (p *Proof) Deserialize(bytes []byte) error {
-	return json.Unmarshal(bytes, p)
+	if len(bytes) == 0 || bytes[0] != binaryProofMagic {
+		return json.Unmarshal(bytes, p)
+	}
+	raw := bytes[1:]
+	var components [2][]byte
+	for i := range components {
+		length, n := binary.Uvarint(raw)
+		if n <= 0 || length > uint64(len(raw)-n) {
+			return errors.New("invalid binary proof: truncated")
+		}
+		raw = raw[n:]
+		if length != 0 {
+			components[i] = raw[:length]
+		}
+		raw = raw[length:]
+	}
+	if len(raw) != 0 {
+		return errors.Errorf("invalid binary proof: [%d] trailing bytes", len(raw))
+	}
+	p.WellFormedness = components[0]
+	p.RangeCorrectness = components[1]
+	return nil
+}
+
+// CancelledError is returned by ProveWithContext when the context is done before the proof is generated.
+// It tells a cancellation apart from a failure to generate the proof.
+type CancelledError struct {
+	// Err is the error of the context
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return "transfer proof generation cancelled: " + e.Err.Error()
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// contextProver is implemented by the provers that can be cancelled
+type contextProver interface {
+	ProveWithContext(ctx context.Context) ([]byte, error)
 }
 
 func (p *Prover) Prove() ([]byte, error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
+	return p.ProveWithContext(context.Background())
+}
 
+// ProveWithContext is like Prove, but aborts once the passed context is done, returning a *CancelledError.
+// The context is checked before each stage and, if the range prover supports it, within the range proof.
+func (p *Prover) ProveWithContext(ctx context.Context) ([]byte, error) {
+	raw, _, err := p.ProveWithStats(ctx)
+	return raw, err
+}
+
+// ProofStats describes a generated transfer proof: the size, in bytes, of each of its components
+// and how long each of them took to generate
+type ProofStats struct {
+	// WellFormednessSize is the size of the well-formedness proof
+	WellFormednessSize int
+	// RangeCorrectnessSize is the size of the range proof, zero if the transfer needs none
+	RangeCorrectnessSize int
+	// Size is the size of the serialized proof
+	Size int
+	// WellFormednessDuration is the time spent generating the well-formedness proof
+	WellFormednessDuration time.Duration
+	// RangeCorrectnessDuration is the time spent generating the range proof
+	RangeCorrectnessDuration time.Duration
+	// Duration is the time spent generating the whole proof, serialization included.
+	// When the components are generated concurrently, it is less than the sum of their durations.
+	Duration time.Duration
+}
+
+// ProveWithStats is like ProveWithContext, and also returns the stats of the generated proof
+func (p *Prover) ProveWithStats(ctx context.Context) ([]byte, *ProofStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, &CancelledError{Err: err}
+	}
+
+	start := time.Now()
+	stats := &ProofStats{}
 	var wfProof, rangeProof []byte
 	var wfErr, rangeErr error
 
-	go func() {
-		defer wg.Done()
-		if p.RangeCorrectness != nil {
+	proveWF := func() {
+		begin := time.Now()
+		wfProof, wfErr = p.WellFormedness.Prove()
+		stats.WellFormednessDuration = time.Since(begin)
+	}
+	proveRange := func() {
+		begin := time.Now()
+		if cp, ok := p.RangeCorrectness.(contextProver); ok {
+			rangeProof, rangeErr = cp.ProveWithContext(ctx)
+		} else if p.RangeCorrectness != nil {
 			rangeProof, rangeErr = p.RangeCorrectness.Prove()
 		}
-	}()
+		stats.RangeCorrectnessDuration = time.Since(begin)
+	}
 
-	wfProof, wfErr = p.WellFormedness.Prove()
+	if p.Sequential {
+		proveWF()
+		if wfErr == nil && ctx.Err() == nil {
+			proveRange()
+		}
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proveRange()
+		}()
+		proveWF()
+		wg.Wait()
+	}
 
-	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, &CancelledError{Err: err}
+	}
 
 	if wfErr != nil {
-		return nil, errors.Wrapf(wfErr, "failed to generate transfer proof")
+		return nil, nil, errors.Wrapf(wfErr, "failed to generate well-formedness proof for transfer")
 	}
 
 	if rangeErr != nil {
-		return nil, errors.Wrapf(rangeErr, "failed to generate range proof for transfer")
+		return nil, nil, errors.Wrapf(rangeErr, "failed to generate range proof for transfer")
 	}
 
 	proof := &Proof{
 		WellFormedness:   wfProof,
 		RangeCorrectness: rangeProof,
 	}
+	raw, err := proof.SerializeAs(p.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.WellFormednessSize = len(wfProof)
+	stats.RangeCorrectnessSize = len(rangeProof)
+	stats.Size = len(raw)
+	stats.Duration = time.Since(start)
 
-	return proof.Serialize()
+	return raw, stats, nil
 }
 
 func (v *Verifier) Verify(proof []byte) error {
+	_, err := v.VerifyWithStats(proof)
+	return err
+}
+
+// VerificationStats describes how long the verification of each component of a transfer proof took
+type VerificationStats struct {
+	// WellFormednessDuration is the time spent verifying the well-formedness proof
+	WellFormednessDuration time.Duration
+	// RangeCorrectnessDuration is the time spent verifying the range proof
+	RangeCorrectnessDuration time.Duration
+	// Duration is the time spent verifying the whole proof, parsing included
+	Duration time.Duration
+}
+
+// VerifyWithStats is like Verify, and also returns the timings of the verification.
+// The stats are returned also when the proof is invalid, unless it cannot be parsed.
+func (v *Verifier) VerifyWithStats(proof []byte) (*VerificationStats, error) {
+	start := time.Now()
 	tp := *&Proof{}
 	err := tp.Deserialize(proof)
 	if err != nil {
-		return errors.Wrapf(err, "invalid transfer proof: cannot parse proof")
+		return nil, errors.Wrapf(err, "invalid transfer proof: cannot parse proof")
 	}
 
+	stats := &VerificationStats{}
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	var wfErr, rangeErr error
 
 	// verify well-formedness of inputs and outputs
+	begin := time.Now()
 	wfErr = v.WellFormedness.Verify(tp.WellFormedness)
+	stats.WellFormednessDuration = time.Since(begin)
 
 	go func() {
 		defer wg.Done()
 		// verify range proof
 		if v.RangeCorrectness != nil {
+			begin := time.Now()
 			rangeErr = v.RangeCorrectness.Verify(tp.RangeCorrectness)
+			stats.RangeCorrectnessDuration = time.Since(begin)
 		}
 	}()
 
 	wg.Wait()
+	stats.Duration = time.Since(start)
 
 	if wfErr != nil {
-		return wfErr
+		return stats, wfErr
 	}
 
-	return rangeErr
+	return stats, rangeErr
 }
 
 func (w *WellFormednessWitness) GetInValues() []*math.Zr {
@@ -6,8 +6,11 @@ SPDX-License-Identifier: Apache-2.0
 package transfer_test
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	math "github.com/IBM/mathlib"
 	. "github.com/onsi/ginkgo"
@@ -85,7 +88,42 @@ var _ = Describe("Transfer", func() {
 	})
 })
 
-func prepareZKTransfer() (*transfer.Prover, *transfer.Verifier) {
+var _ = Describe("Transfer with candidate public parameters", func() {
+	It("selects the public parameters the proof has been generated against", func() {
+		previous, err := crypto.Setup(100, 2, nil, math.FP256BN_AMCL)
+		Expect(err).NotTo(HaveOccurred())
+		current, err := crypto.Setup(100, 2, nil, math.FP256BN_AMCL)
+		Expect(err).NotTo(HaveOccurred())
+
+		wfw, in, out := prepareInputsForZKTransfer(previous)
+		ttype := "ABC"
+		intw := make([]*token.TokenDataWitness, len(wfw.GetInValues()))
+		for i := 0; i < len(intw); i++ {
+			intw[i] = &token.TokenDataWitness{BlindingFactor: wfw.GetInBlindingFators()[i], Value: wfw.GetInValues()[i], Type: ttype}
+		}
+		outtw := make([]*token.TokenDataWitness, len(wfw.GetOutValues()))
+		for i := 0; i < len(outtw); i++ {
+			outtw[i] = &token.TokenDataWitness{BlindingFactor: wfw.GetOutBlindingFators()[i], Value: wfw.GetOutValues()[i], Type: ttype}
+		}
+		prover, err := transfer.NewProver(intw, outtw, in, out, previous)
+		Expect(err).NotTo(HaveOccurred())
+		proof, err := prover.Prove()
+		Expect(err).NotTo(HaveOccurred())
+
+		pp, err := transfer.VerifyWithCandidates(in, out, proof, []*crypto.PublicParams{current, previous})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pp).To(BeIdenticalTo(previous))
+
+		_, err = transfer.VerifyWithCandidates(in, out, proof, []*crypto.PublicParams{current})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not valid under any of the [1] candidate public parameters"))
+
+		_, err = transfer.VerifyWithCandidates(in, out, proof, nil)
+		Expect(err).To(MatchError("invalid transfer proof: no candidate public parameters"))
+	})
+})
+
+func prepareZKTransfer(opts ...transfer.ProverOption) (*transfer.Prover, *transfer.Verifier) {
 	pp, err := crypto.Setup(100, 2, nil, math.FP256BN_AMCL)
 	Expect(err).NotTo(HaveOccurred())
 
@@ -107,8 +145,10 @@ func prepareZKTransfer() (*transfer.Prover, *transfer.Verifier) {
 	for i := 0; i < len(outtw); i++ {
 		outtw[i] = &token.TokenDataWitness{BlindingFactor: outBF[i], Value: outValues[i], Type: ttype}
 	}
-	prover := transfer.NewProver(intw, outtw, in, out, pp)
-	verifier := transfer.NewVerifier(in, out, pp)
+	prover, err := transfer.NewProver(intw, outtw, in, out, pp, opts...)
+	Expect(err).NotTo(HaveOccurred())
+	verifier, err := transfer.NewVerifier(in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
 
 	return prover, verifier
 }
@@ -136,8 +176,10 @@ func prepareZKTransferWithWrongSum() (*transfer.Prover, *transfer.Verifier) {
 		outtw[i] = &token.TokenDataWitness{BlindingFactor: outBF[i], Value: outValues[i], Type: ttype}
 	}
 
-	prover := transfer.NewProver(intw, outtw, in, out, pp)
-	verifier := transfer.NewVerifier(in, out, pp)
+	prover, err := transfer.NewProver(intw, outtw, in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
+	verifier, err := transfer.NewVerifier(in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
 
 	return prover, verifier
 }
@@ -165,8 +207,10 @@ func prepareZKTransferWithInvalidRange() (*transfer.Prover, *transfer.Verifier)
 		outtw[i] = &token.TokenDataWitness{BlindingFactor: outBF[i], Value: outValues[i], Type: ttype}
 	}
 
-	prover := transfer.NewProver(intw, outtw, in, out, pp)
-	verifier := transfer.NewVerifier(in, out, pp)
+	prover, err := transfer.NewProver(intw, outtw, in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
+	verifier, err := transfer.NewVerifier(in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
 	return prover, verifier
 }
 
@@ -286,8 +330,125 @@ func prepareOwnershipTransfer() (*transfer.Prover, *transfer.Verifier) {
 	for i := 0; i < len(outtw); i++ {
 		outtw[i] = &token.TokenDataWitness{BlindingFactor: outBF[i], Value: outValues[i], Type: ttype}
 	}
-	prover := transfer.NewProver(intw, outtw, in, out, pp)
-	verifier := transfer.NewVerifier(in, out, pp)
+	prover, err := transfer.NewProver(intw, outtw, in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
+	verifier, err := transfer.NewVerifier(in, out, pp)
+	Expect(err).NotTo(HaveOccurred())
 
 	return prover, verifier
 }
+
+func TestProofFormats(t *testing.T) {
+	RegisterTestingT(t)
+
+	proof := &transfer.Proof{WellFormedness: []byte("well-formedness"), RangeCorrectness: []byte("range")}
+	jsonRaw, err := proof.Serialize()
+	Expect(err).NotTo(HaveOccurred())
+	binaryRaw, err := proof.SerializeAs(transfer.BinaryProof)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(len(binaryRaw)).To(BeNumerically("<", len(jsonRaw)))
+
+	// both formats are detected on deserialization
+	for _, raw := range [][]byte{jsonRaw, binaryRaw} {
+		decoded := &transfer.Proof{}
+		Expect(decoded.Deserialize(raw)).To(Succeed())
+		Expect(decoded).To(Equal(proof))
+	}
+
+	// no range proof, as for one-to-one transfers
+	binaryRaw, err = (&transfer.Proof{WellFormedness: []byte("well-formedness")}).SerializeAs(transfer.BinaryProof)
+	Expect(err).NotTo(HaveOccurred())
+	decoded := &transfer.Proof{}
+	Expect(decoded.Deserialize(binaryRaw)).To(Succeed())
+	Expect(decoded.RangeCorrectness).To(BeNil())
+
+	Expect(decoded.Deserialize(binaryRaw[:5])).To(MatchError("invalid binary proof: truncated"))
+	Expect(decoded.Deserialize(append(binaryRaw, 0))).To(MatchError("invalid binary proof: [1] trailing bytes"))
+	_, err = proof.SerializeAs(transfer.ProofFormat(7))
+	Expect(err).To(MatchError("unknown proof format [7]"))
+
+	// proofs generated in binary format verify
+	prover, verifier := prepareZKTransfer()
+	prover.Format = transfer.BinaryProof
+	raw, err := prover.Prove()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(raw[0]).To(Equal(byte(0x01)))
+	Expect(verifier.Verify(raw)).To(Succeed())
+}
+
+func TestProveWithContext(t *testing.T) {
+	RegisterTestingT(t)
+
+	prover, verifier := prepareZKTransfer()
+
+	// a done context aborts the generation with a cancellation error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	proof, err := prover.ProveWithContext(ctx)
+	Expect(proof).To(BeNil())
+	var cancelled *transfer.CancelledError
+	Expect(errors.As(err, &cancelled)).To(BeTrue())
+	Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	Expect(err).To(MatchError("transfer proof generation cancelled: context canceled"))
+
+	// cancellation during the range proof
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = prover.ProveWithContext(ctx)
+	Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+	proof, err = prover.ProveWithContext(context.Background())
+	Expect(err).NotTo(HaveOccurred())
+	Expect(verifier.Verify(proof)).To(Succeed())
+}
+
+func TestSequentialProve(t *testing.T) {
+	RegisterTestingT(t)
+
+	prover, verifier := prepareZKTransfer(transfer.WithSequentialProof())
+	Expect(prover.Sequential).To(BeTrue())
+	proof, err := prover.Prove()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(verifier.Verify(proof)).To(Succeed())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = prover.ProveWithContext(ctx)
+	Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+}
+
+func TestProveWithStats(t *testing.T) {
+	RegisterTestingT(t)
+
+	prover, verifier := prepareZKTransfer()
+	raw, stats, err := prover.ProveWithStats(context.Background())
+	Expect(err).NotTo(HaveOccurred())
+	proof := &transfer.Proof{}
+	Expect(proof.Deserialize(raw)).To(Succeed())
+	Expect(stats.Size).To(Equal(len(raw)))
+	Expect(stats.WellFormednessSize).To(Equal(len(proof.WellFormedness)))
+	Expect(stats.RangeCorrectnessSize).To(Equal(len(proof.RangeCorrectness)))
+	Expect(stats.RangeCorrectnessSize).To(BeNumerically(">", 0))
+	Expect(stats.WellFormednessDuration).To(BeNumerically(">", 0))
+	Expect(stats.RangeCorrectnessDuration).To(BeNumerically(">", 0))
+	Expect(stats.Duration).To(BeNumerically(">=", stats.RangeCorrectnessDuration))
+
+	vstats, err := verifier.VerifyWithStats(raw)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(vstats.WellFormednessDuration).To(BeNumerically(">", 0))
+	Expect(vstats.RangeCorrectnessDuration).To(BeNumerically(">", 0))
+	Expect(vstats.Duration).To(BeNumerically(">=", vstats.WellFormednessDuration))
+}
+
+func TestInvalidPublicParams(t *testing.T) {
+	RegisterTestingT(t)
+
+	pp, err := crypto.Setup(100, 2, nil, math.FP256BN_AMCL)
+	Expect(err).NotTo(HaveOccurred())
+	pp.RangeProofParams = nil
+
+	_, err = transfer.NewProver(nil, nil, nil, nil, pp)
+	Expect(err).To(MatchError(ContainSubstring("nil range proof parameters")))
+	_, err = transfer.NewVerifier(nil, nil, pp)
+	Expect(err).To(MatchError(ContainSubstring("nil range proof parameters")))
+}
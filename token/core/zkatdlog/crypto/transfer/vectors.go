@@ -0,0 +1,172 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package transfer
+
+import (
+	"encoding/json"
+	"io"
+
+	math "github.com/IBM/mathlib"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto/common"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto/token"
+	"github.com/pkg/errors"
+)
+
+const (
+	// VectorBase is the base used to set up the public parameters of the test vectors
+	VectorBase = 100
+	// VectorExponent is the exponent used to set up the public parameters of the test vectors
+	VectorExponent = 2
+)
+
+// VectorSpec describes the input/output configuration of a transfer test vector
+type VectorSpec struct {
+	// Type is the token type
+	Type string
+	// InValues are the values of the inputs
+	InValues []uint64
+	// OutValues are the values of the outputs
+	OutValues []uint64
+}
+
+// Vector is a transfer test vector.
+// It carries everything needed to re-verify the proof with the current code.
+// Vectors are not reproducible: the public parameters, the witnesses, and the proofs are randomized,
+// then a golden file of vectors is meant to be re-verified, not compared byte by byte with new vectors.
+type Vector struct {
+	Spec VectorSpec
+	// PublicParams are the serialized public parameters the proof was generated against
+	PublicParams []byte
+	// Inputs are the serialized input commitments
+	Inputs [][]byte
+	// Outputs are the serialized output commitments
+	Outputs [][]byte
+	// Proof is the serialized transfer proof
+	Proof []byte
+}
+
+// GenerateTestVectors generates a transfer proof for each of the passed specs.
+// All vectors share the same public parameters. Each call generates different vectors, see Vector.
+func GenerateTestVectors(cases []VectorSpec) ([]Vector, error) {
+	pp, err := crypto.Setup(VectorBase, VectorExponent, nil, math.FP256BN_AMCL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed setting up public parameters")
+	}
+	ppRaw, err := pp.Serialize()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed serializing public parameters")
+	}
+	c := math.Curves[pp.Curve]
+	rng, err := c.Rand()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed getting random number generator")
+	}
+
+	vectors := make([]Vector, len(cases))
+	for i, spec := range cases {
+		inW, inputs, err := vectorTokens(spec.InValues, spec.Type, pp, c, rng)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed computing inputs for vector [%d]", i)
+		}
+		outW, outputs, err := vectorTokens(spec.OutValues, spec.Type, pp, c, rng)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed computing outputs for vector [%d]", i)
+		}
+		prover, err := NewProver(inW, outW, inputs, outputs, pp)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed creating prover for vector [%d]", i)
+		}
+		proof, err := prover.Prove()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed generating proof for vector [%d]", i)
+		}
+		vectors[i] = Vector{
+			Spec:         spec,
+			PublicParams: ppRaw,
+			Inputs:       g1sToBytes(inputs),
+			Outputs:      g1sToBytes(outputs),
+			Proof:        proof,
+		}
+	}
+	return vectors, nil
+}
+
+// VerifyTestVectors unmarshals the passed JSON-encoded test vectors and verifies each of them.
+func VerifyTestVectors(raw []byte) error {
+	var vectors []Vector
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		return errors.Wrap(err, "failed unmarshalling test vectors")
+	}
+	for i, vector := range vectors {
+		if err := vector.Verify(); err != nil {
+			return errors.WithMessagef(err, "failed verifying vector [%d]", i)
+		}
+	}
+	return nil
+}
+
+// Verify checks that the proof of the vector verifies against its public parameters and commitments
+func (v *Vector) Verify() error {
+	pp, err := crypto.NewPublicParamsFromBytes(v.PublicParams, crypto.DLogPublicParameters)
+	if err != nil {
+		return errors.WithMessage(err, "failed deserializing public parameters")
+	}
+	c := math.Curves[pp.Curve]
+	if len(v.Inputs) != len(v.Spec.InValues) || len(v.Outputs) != len(v.Spec.OutValues) {
+		return errors.Errorf("number of commitments does not match the spec")
+	}
+	inputs, err := bytesToG1s(v.Inputs, c)
+	if err != nil {
+		return errors.WithMessage(err, "failed deserializing inputs")
+	}
+	outputs, err := bytesToG1s(v.Outputs, c)
+	if err != nil {
+		return errors.WithMessage(err, "failed deserializing outputs")
+	}
+	verifier, err := NewVerifier(inputs, outputs, pp)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(v.Proof)
+}
+
+func vectorTokens(values []uint64, ttype string, pp *crypto.PublicParams, c *math.Curve, rng io.Reader) ([]*token.TokenDataWitness, []*math.G1, error) {
+	tw := make([]*token.TokenDataWitness, len(values))
+	tokens := make([]*math.G1, len(values))
+	for i, v := range values {
+		tw[i] = &token.TokenDataWitness{
+			Type:           ttype,
+			Value:          c.NewZrFromInt(int64(v)),
+			BlindingFactor: c.NewRandomZr(rng),
+		}
+		var err error
+		tokens[i], err = common.ComputePedersenCommitment([]*math.Zr{c.HashToZr([]byte(ttype)), tw[i].Value, tw[i].BlindingFactor}, pp.ZKATPedParams, c)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return tw, tokens, nil
+}
+
+func g1sToBytes(points []*math.G1) [][]byte {
+	res := make([][]byte, len(points))
+	for i, p := range points {
+		res[i] = p.Bytes()
+	}
+	return res
+}
+
+func bytesToG1s(raw [][]byte, c *math.Curve) ([]*math.G1, error) {
+	res := make([]*math.G1, len(raw))
+	for i, b := range raw {
+		var err error
+		if res[i], err = c.NewG1FromBytes(b); err != nil {
+			return nil, errors.Wrapf(err, "invalid commitment at index [%d]", i)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package transfer_test
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/core/zkatdlog/crypto/transfer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "regenerate the transfer proof golden test vectors, which are re-verified, not compared byte by byte")
+
+var vectorSpecs = []transfer.VectorSpec{
+	{Type: "ABC", InValues: []uint64{90}, OutValues: []uint64{90}},
+	{Type: "ABC", InValues: []uint64{90}, OutValues: []uint64{40, 50}},
+	{Type: "ABC", InValues: []uint64{90, 60}, OutValues: []uint64{150}},
+	{Type: "XYZ", InValues: []uint64{10, 20, 30}, OutValues: []uint64{25, 25, 5, 5}},
+}
+
+var _ = Describe("Test Vectors", func() {
+	goldenFile := filepath.Join("testdata", "vectors.json")
+
+	It("generates vectors that verify", func() {
+		vectors, err := transfer.GenerateTestVectors(vectorSpecs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vectors).To(HaveLen(len(vectorSpecs)))
+		raw, err := json.Marshal(vectors)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transfer.VerifyTestVectors(raw)).To(Succeed())
+
+		if *updateVectors {
+			Expect(ioutil.WriteFile(goldenFile, raw, 0644)).To(Succeed())
+		}
+	})
+
+	It("verifies the golden vectors", func() {
+		raw, err := ioutil.ReadFile(goldenFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transfer.VerifyTestVectors(raw)).To(Succeed())
+	})
+
+	It("rejects tampered vectors", func() {
+		vectors, err := transfer.GenerateTestVectors(vectorSpecs[1:2])
+		Expect(err).NotTo(HaveOccurred())
+		vectors[0].Outputs[0], vectors[0].Outputs[1] = vectors[0].Outputs[1], vectors[0].Inputs[0]
+		raw, err := json.Marshal(vectors)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transfer.VerifyTestVectors(raw)).NotTo(Succeed())
+	})
+})
@@ -237,10 +237,14 @@ func (v *Validator) verifyTransfer(inputTokens [][]byte, tr driver.TransferActio
 		in[i] = tok.GetCommitment()
 	}
 
-	return transfer.NewVerifier(
+	verifier, err := transfer.NewVerifier(
 		in,
 		action.GetOutputCommitments(),
-		v.pp).Verify(action.GetProof())
+		v.pp)
+	if err != nil {
+		return errors.WithMessagef(err, "invalid transfer")
+	}
+	return verifier.Verify(action.GetProof())
 }
 
 type backend struct {
@@ -142,7 +142,11 @@ func (s *Service) VerifyTransfer(action driver.TransferAction, tokenInfos [][]by
 		}
 		logger.Debugf("transfer output [%s,%s,%s]", tok.Type, tok.Quantity, view.Identity(tok.Owner.Raw))
 	}
-	return transfer.NewVerifier(tr.InputCommitments, com, pp).Verify(tr.Proof)
+	verifier, err := transfer.NewVerifier(tr.InputCommitments, com, pp)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(tr.Proof)
 }
 
 func (s *Service) DeserializeTransferAction(raw []byte) (driver.TransferAction, error) {
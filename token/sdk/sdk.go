@@ -20,8 +20,10 @@ import (
 	network2 "github.com/hyperledger-labs/fabric-token-sdk/token/sdk/network"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/sdk/vault"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/appendlog"
 	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/badger"
-	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/memory"
+	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/leveldb"
+	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/postgres"
 	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/certifier/dummy"
 	_ "github.com/hyperledger-labs/fabric-token-sdk/token/services/certifier/interactive"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/network"
@@ -87,7 +89,7 @@ func (p *SDK) Install() error {
 	// AuditDB
 	driverName := view2.GetConfigService(p.registry).GetString("token.auditor.auditdb.persistence.type")
 	if len(driverName) == 0 {
-		driverName = "memory"
+		driverName = auditdb.InMemoryDriver
 	}
 	assert.NoError(p.registry.RegisterService(auditdb.NewManager(p.registry, driverName)))
 
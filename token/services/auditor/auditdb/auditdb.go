@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package auditdb
 
 import (
+	"context"
 	"math/big"
 	"reflect"
 	"sort"
@@ -25,6 +26,9 @@ import (
 
 var logger = flogging.MustGetLogger("token-sdk.auditor.auditdb")
 
+// ErrDuplicateAppend is returned by Append, under FailOnDuplicateAppend, when the transaction has already been appended
+var ErrDuplicateAppend = errors.New("transaction already appended")
+
 var (
 	driversMu sync.RWMutex
 	drivers   = make(map[string]driver.Driver)
@@ -45,6 +49,18 @@ func Register(name string, driver driver.Driver) {
 	drivers[name] = driver
 }
 
+// RegisterOrReplace makes a AuditDB driver available by the provided name,
+// replacing the driver already registered by that name, if any.
+// If driver is nil, it panics.
+func RegisterOrReplace(name string, driver driver.Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("auditor: RegisterOrReplace driver is nil")
+	}
+	drivers[name] = driver
+}
+
 func unregisterAllDrivers() {
 	driversMu.Lock()
 	defer driversMu.Unlock()
@@ -88,6 +104,30 @@ const (
 	Redeem
 )
 
+// String returns the name of the transaction type
+func (t TransactionType) String() string {
+	switch t {
+	case Issue:
+		return "Issue"
+	case Transfer:
+		return "Transfer"
+	case Redeem:
+		return "Redeem"
+	default:
+		return "Unknown(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+// IsValid returns true if the transaction type is one of the known transaction types
+func (t TransactionType) IsValid() bool {
+	switch t {
+	case Issue, Transfer, Redeem:
+		return true
+	default:
+		return false
+	}
+}
+
 // MovementRecord is a record of a movement of assets
 type MovementRecord struct {
 	// TxID is the transaction ID
@@ -100,12 +140,16 @@ type MovementRecord struct {
 	Amount *big.Int
 	// Status is the status of the transaction
 	Status TxStatus
+	// Quarantined is true if the transaction has been put in quarantine pending review
+	Quarantined bool
 }
 
 // TransactionRecord is a record of a transaction
 type TransactionRecord struct {
 	// TxID is the transaction ID
 	TxID string
+	// ActionIndex is the index, in the token request, of the action this record refers to
+	ActionIndex int
 	// TransactionType is the type of transaction
 	TransactionType TransactionType
 	// SenderEID is the enrollment ID of the account that is sending tokens
@@ -120,6 +164,17 @@ type TransactionRecord struct {
 	Timestamp time.Time
 	// Status is the status of the transaction
 	Status TxStatus
+	// Reference is an application-defined reference attached to the transaction (e.g. an invoice number)
+	Reference string
+	// Quarantined is true if the transaction has been put in quarantine pending review
+	Quarantined bool
+	// QuarantineReason is the reason why the transaction has been put in quarantine
+	QuarantineReason string
+	// Reorgs is the number of times the transaction has been reverted from Confirmed to Pending
+	// due to a ledger reorganization
+	Reorgs int
+	// FailureReason is the reason, if recorded, why the transaction failed to commit
+	FailureReason string
 }
 
 func (t *TransactionRecord) String() string {
@@ -135,18 +190,43 @@ func (t *TransactionRecord) String() string {
 	s.WriteString(" ")
 	s.WriteString(t.TokenType)
 	s.WriteString(" ")
-	s.WriteString(t.Amount.String())
+	if t.Amount == nil {
+		s.WriteString("<nil>")
+	} else {
+		s.WriteString(t.Amount.String())
+	}
 	s.WriteString(" ")
 	s.WriteString(t.Timestamp.String())
 	s.WriteString(" ")
 	s.WriteString(string(t.Status))
+	if len(t.Reference) != 0 {
+		s.WriteString(" ")
+		s.WriteString(t.Reference)
+	}
+	if t.Quarantined {
+		s.WriteString(" quarantined[")
+		s.WriteString(t.QuarantineReason)
+		s.WriteString("]")
+	}
+	if t.Reorgs != 0 {
+		s.WriteString(" reorgs[")
+		s.WriteString(strconv.Itoa(t.Reorgs))
+		s.WriteString("]")
+	}
+	if len(t.FailureReason) != 0 {
+		s.WriteString(" failure[")
+		s.WriteString(t.FailureReason)
+		s.WriteString("]")
+	}
 	s.WriteString("}")
 	return s.String()
 }
 
 // TransactionIterator is an iterator over transaction records
 type TransactionIterator struct {
-	it driver.TransactionIterator
+	db  *AuditDB
+	ctx context.Context
+	it  driver.TransactionIterator
 }
 
 // Close closes the iterator. It must be called when done with the iterator.
@@ -157,53 +237,291 @@ func (t *TransactionIterator) Close() {
 // Next returns the next transaction record, if any.
 // It returns nil, nil if there are no more records.
 func (t *TransactionIterator) Next() (*TransactionRecord, error) {
-	next, err := t.it.Next()
-	if err != nil {
-		return nil, err
-	}
-	if next == nil {
-		return nil, nil
+	for {
+		if err := t.ctx.Err(); err != nil {
+			return nil, errors.WithMessage(err, "transaction iteration cancelled")
+		}
+		next, err := t.it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, nil
+		}
+		skip, err := t.db.checkTransactionType(next)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			continue
+		}
+		t.db.stats.addRows("Transactions", 1)
+		record := toTransactionRecord(next)
+		if record.Amount, err = t.db.checkAmount(record.TxID, record.Amount); err != nil {
+			return nil, err
+		}
+		return record, nil
 	}
+}
+
+// toTransactionRecord converts a driver transaction record into a TransactionRecord
+func toTransactionRecord(record *driver.TransactionRecord) *TransactionRecord {
 	return &TransactionRecord{
-		TxID:            next.TxID,
-		TransactionType: TransactionType(next.TransactionType),
-		SenderEID:       next.SenderEID,
-		RecipientEID:    next.RecipientEID,
-		TokenType:       next.TokenType,
-		Amount:          next.Amount,
-		Timestamp:       next.Timestamp,
-		Status:          TxStatus(next.Status),
-	}, nil
+		TxID:             record.TxID,
+		ActionIndex:      record.ActionIndex,
+		TransactionType:  TransactionType(record.TransactionType),
+		SenderEID:        record.SenderEID,
+		RecipientEID:     record.RecipientEID,
+		TokenType:        record.TokenType,
+		Amount:           record.Amount,
+		Timestamp:        record.Timestamp,
+		Status:           TxStatus(record.Status),
+		Reference:        record.Reference,
+		Quarantined:      record.Quarantined,
+		QuarantineReason: record.QuarantineReason,
+		Reorgs:           record.Reorgs,
+		FailureReason:    record.FailureReason,
+	}
 }
 
 // QueryExecutor executors queries against the audit DB
 type QueryExecutor struct {
 	db     *AuditDB
+	ctx    context.Context
 	closed bool
 }
 
 // NewPaymentsFilter returns a programmable filter over the payments sent or received by enrollment IDs.
 func (qe *QueryExecutor) NewPaymentsFilter() *PaymentsFilter {
 	return &PaymentsFilter{
-		db: qe.db,
+		db:  qe.db,
+		ctx: qe.ctx,
 	}
 }
 
 // NewHoldingsFilter returns a programmable filter over the holdings owned by enrollment IDs.
 func (qe *QueryExecutor) NewHoldingsFilter() *HoldingsFilter {
 	return &HoldingsFilter{
-		db: qe.db,
+		db:  qe.db,
+		ctx: qe.ctx,
+	}
+}
+
+// store returns the driver with its queries bound to the context of the query executor
+func (qe *QueryExecutor) store() driver.AuditDB {
+	return qe.db.store(qe.ctx)
+}
+
+// QueryOption refines the selection of a transaction query
+type QueryOption func(*driver.QueryTransactionsParams)
+
+// WithReference selects only the transactions carrying the passed reference
+func WithReference(ref string) QueryOption {
+	return func(p *driver.QueryTransactionsParams) {
+		p.Reference = ref
+	}
+}
+
+// WithQuarantined selects only the transactions that are, or are not, in quarantine
+func WithQuarantined(quarantined bool) QueryOption {
+	return func(p *driver.QueryTransactionsParams) {
+		p.Quarantined = &quarantined
+	}
+}
+
+// WithStatus selects only the transactions whose status is among the passed ones
+func WithStatus(statuses ...TxStatus) QueryOption {
+	return func(p *driver.QueryTransactionsParams) {
+		p.Statuses = nil
+		for _, status := range statuses {
+			p.Statuses = append(p.Statuses, driver.TxStatus(status))
+		}
+	}
+}
+
+// WithTransactionType selects only the transactions whose type is among the passed ones
+func WithTransactionType(types ...TransactionType) QueryOption {
+	return func(p *driver.QueryTransactionsParams) {
+		p.TransactionTypes = nil
+		for _, tt := range types {
+			p.TransactionTypes = append(p.TransactionTypes, driver.TransactionType(tt))
+		}
+	}
+}
+
+// WithPage selects the page of transactions starting at the passed offset and containing at most limit transactions.
+// If limit is not positive, all the transactions from the offset on are selected.
+// Transactions are ordered by timestamp, transaction ID and action index, so that paging is stable.
+func WithPage(offset, limit int) QueryOption {
+	return func(p *driver.QueryTransactionsParams) {
+		p.Offset = offset
+		p.Limit = limit
 	}
 }
 
 // Transactions returns an iterators of transaction records in the given time internal.
 // If from and to are both nil, all transactions are returned.
-func (qe *QueryExecutor) Transactions(from, to *time.Time) (*TransactionIterator, error) {
-	it, err := qe.db.db.QueryTransactions(from, to)
+// Additional query options can be used to further restrict the selection.
+func (qe *QueryExecutor) Transactions(from, to *time.Time, opts ...QueryOption) (*TransactionIterator, error) {
+	if err := qe.ctx.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to query transactions")
+	}
+	params := driver.QueryTransactionsParams{From: from, To: to}
+	for _, opt := range opts {
+		opt(&params)
+	}
+	start := time.Now()
+	it, err := qe.store().QueryTransactions(params)
+	qe.db.stats.observeQuery("Transactions", start)
 	if err != nil {
 		return nil, errors.Errorf("failed to query transactions: %s", err)
 	}
-	return &TransactionIterator{it: it}, nil
+	return &TransactionIterator{db: qe.db, ctx: qe.ctx, it: it}, nil
+}
+
+// FailedTransactions returns an iterator over the Deleted transaction records in the given time interval,
+// that is, the transactions that failed to commit. Each record carries the failure reason, if one was recorded
+// with SetStatusWithReason.
+// If from and to are both nil, all failed transactions are returned.
+func (qe *QueryExecutor) FailedTransactions(from, to *time.Time) (*TransactionIterator, error) {
+	return qe.Transactions(from, to, WithStatus(Deleted))
+}
+
+// FindDuplicates returns the transaction IDs, among the transactions in the passed time interval, whose records
+// appear more times than their action structure implies, as it happens when a transaction is appended twice.
+// For each offending transaction ID, the returned map holds the number of times the transaction has been recorded.
+// If from and to are both nil, all transactions are considered.
+func (qe *QueryExecutor) FindDuplicates(from, to *time.Time) (map[string]int, error) {
+	start := time.Now()
+	duplicates, err := qe.store().QueryDuplicateTransactions(from, to)
+	qe.db.stats.observeQuery("FindDuplicates", start)
+	if err != nil {
+		return nil, errors.Errorf("failed to query duplicate transactions: %s", err)
+	}
+	qe.db.stats.addRows("FindDuplicates", len(duplicates))
+	return duplicates, nil
+}
+
+// MultiTypeActions returns the IDs of the transactions, among the transactions in the passed time interval,
+// with an action that moved more than one token type, such as an atomic swap.
+// If from and to are both nil, all transactions are considered.
+func (qe *QueryExecutor) MultiTypeActions(from, to *time.Time) ([]string, error) {
+	start := time.Now()
+	txIDs, err := qe.store().QueryMultiTypeActions(from, to)
+	qe.db.stats.observeQuery("MultiTypeActions", start)
+	if err != nil {
+		return nil, errors.Errorf("failed to query multi-type actions: %s", err)
+	}
+	qe.db.stats.addRows("MultiTypeActions", len(txIDs))
+	return txIDs, nil
+}
+
+// MovementSummaryRow is the flow of a token type in and out of an enrollment ID
+type MovementSummaryRow struct {
+	EnrollmentID string
+	TokenType    string
+	// Received is the sum of the amounts received
+	Received *big.Int
+	// Sent is the sum of the amounts sent, as a positive number
+	Sent *big.Int
+	// Net is Received minus Sent
+	Net *big.Int
+}
+
+// MovementSummary returns, for each enrollment ID and token type, the amounts received and sent, and the net flow,
+// over the movements of the transactions in the passed time interval. If from and to are both nil, all
+// transactions are considered. Only the movements in the passed statuses are considered, Confirmed by default.
+// Rows are sorted by enrollment ID and token type.
+func (qe *QueryExecutor) MovementSummary(from, to *time.Time, statuses ...TxStatus) ([]MovementSummaryRow, error) {
+	params := driver.QueryMovementSummaryParams{From: from, To: to, Statuses: []driver.TxStatus{driver.Confirmed}}
+	if len(statuses) != 0 {
+		params.Statuses = nil
+		for _, status := range statuses {
+			params.Statuses = append(params.Statuses, driver.TxStatus(status))
+		}
+	}
+	start := time.Now()
+	rows, err := qe.store().QueryMovementSummary(params)
+	qe.db.stats.observeQuery("MovementSummary", start)
+	if err != nil {
+		return nil, errors.Errorf("failed to query movement summary: %s", err)
+	}
+	qe.db.stats.addRows("MovementSummary", len(rows))
+	res := make([]MovementSummaryRow, len(rows))
+	for i, row := range rows {
+		res[i] = MovementSummaryRow{
+			EnrollmentID: row.EnrollmentID,
+			TokenType:    row.TokenType,
+			Received:     row.Received,
+			Sent:         row.Sent,
+			Net:          row.Net,
+		}
+	}
+	return res, nil
+}
+
+// LatestByEnrollment returns, for each of the passed enrollment IDs, the most recent transaction record
+// in which the enrollment ID appears either as sender or as recipient.
+// Enrollment IDs without transactions are absent from the returned map.
+func (qe *QueryExecutor) LatestByEnrollment(eIDs []string) (map[string]*TransactionRecord, error) {
+	start := time.Now()
+	records, err := qe.store().QueryLatestTransactions(deduplicate(eIDs))
+	qe.db.stats.observeQuery("LatestByEnrollment", start)
+	if err != nil {
+		return nil, errors.Errorf("failed to query latest transactions: %s", err)
+	}
+	qe.db.stats.addRows("LatestByEnrollment", len(records))
+	res := make(map[string]*TransactionRecord, len(records))
+	for eID, record := range records {
+		skip, err := qe.db.checkTransactionType(record)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			continue
+		}
+		tr := toTransactionRecord(record)
+		if tr.Amount, err = qe.db.checkAmount(tr.TxID, tr.Amount); err != nil {
+			return nil, err
+		}
+		res[eID] = tr
+	}
+	return res, nil
+}
+
+// TotalValue returns the holdings of the passed enrollment ID expressed in the reference unit.
+// The holdings are the balances returned by the holdings filter, see HoldingsFilter.Balance, of the available
+// movements, Pending included: the movements of the transactions in quarantine are not counted.
+// The balance of each token type is multiplied by the rate found in the passed table for that token type.
+// Tokens whose type is the reference unit itself count at rate one, unless the table says otherwise.
+// Token types without a rate make the call fail or are skipped, depending on the configured policy.
+func (qe *QueryExecutor) TotalValue(eID string, rates map[string]*big.Rat, reference string) (*big.Rat, error) {
+	balances, err := qe.NewHoldingsFilter().ByEnrollmentId(eID).Available().WithPending().Balance()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to query the balances of [%s]", eID)
+	}
+	tokenTypes := make([]string, 0, len(balances))
+	for tokenType := range balances {
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+	sort.Strings(tokenTypes)
+
+	total := new(big.Rat)
+	for _, tokenType := range tokenTypes {
+		rate, ok := rates[tokenType]
+		if !ok {
+			if tokenType == reference {
+				rate = big.NewRat(1, 1)
+			} else if qe.db.opts.MissingRatePolicy == SkipMissingRate {
+				logger.Debugf("no rate for token type [%s], skipping it", tokenType)
+				continue
+			} else {
+				return nil, errors.Errorf("no rate for token type [%s] into [%s]", tokenType, reference)
+			}
+		}
+		total.Add(total, new(big.Rat).Mul(new(big.Rat).SetInt(balances[tokenType]), rate))
+	}
+	return total, nil
 }
 
 // Done closes the query executor. It must be called when the query executor is no longer needed.s
@@ -231,57 +549,213 @@ type AuditDB struct {
 	// * an exclusive lock is held when Commit is called.
 	db        driver.AuditDB
 	storeLock sync.RWMutex
+	lockStats lockStats
+	stats     *dbStats
+	opts      *Options
+	// appendSlots, if not nil, is shared by the audit dbs of the same Manager to bound the appends in flight
+	appendSlots chan struct{}
+	// pruneSlot is held by the prune in flight started by Manager.RunRetention
+	pruneSlot chan struct{}
 
 	eIDsLocks sync.Map
 
+	// subscriptions to the status changes
+	subscriptions statusSubscriptions
+
 	// status related fields
 	statusUpdating atomic.Bool
 	pendingTXs     []string
 	wg             sync.WaitGroup
 }
 
-func newAuditDB(p driver.AuditDB) *AuditDB {
+func newAuditDB(p driver.AuditDB, opts *Options, stats *dbStats) *AuditDB {
 	return &AuditDB{
 		db:         p,
+		stats:      stats,
+		opts:       opts,
 		eIDsLocks:  sync.Map{},
 		pendingTXs: make([]string, 0, 10000),
+		pruneSlot:  make(chan struct{}, 1),
 	}
 }
 
-// Append appends the passed token request to the audit database
-func (db *AuditDB) Append(req *token.Request) error {
+// AuditRecordProvider is a source of audit records, such as a token request (*token.Request),
+// a replay log, or a mock.
+type AuditRecordProvider interface {
+	// AuditRecord returns the audit record to append to the audit database
+	AuditRecord() (*token.AuditRecord, error)
+}
+
+// referencedRecordProvider is an AuditRecordProvider that carries the reference of its record
+type referencedRecordProvider interface {
+	AuditRecordProvider
+	reference() string
+}
+
+// Append appends the audit record provided by the passed provider, typically a token request, to the audit database.
+// The MetadataExtractor, if set, is applied only when the provider is a *token.Request.
+// If the transaction has already been appended, the DuplicateAppendPolicy applies.
+func (db *AuditDB) Append(provider AuditRecordProvider) error {
+	return db.AppendContext(context.Background(), provider)
+}
+
+// AppendContext is like Append, but it gives up when the passed context is done: while waiting for an append slot
+// or for the store lock, or between the stages of the update, which is then discarded.
+// Drivers implementing driver.ContextAuditDB also abort the operation in progress, such as a blocked statement.
+func (db *AuditDB) AppendContext(ctx context.Context, provider AuditRecordProvider) error {
 	logger.Debugf("Appending new record... [%d]", db.counter)
-	db.storeLock.Lock()
-	defer db.storeLock.Unlock()
+	defer db.stats.observeAppend(time.Now())
+	release, err := db.acquireAppendSlotContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	unlock, err := db.lockStoreContext(ctx, "Append")
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	logger.Debug("lock acquired")
 
-	record, err := req.AuditRecord()
+	record, err := provider.AuditRecord()
 	if err != nil {
-		return errors.WithMessagef(err, "failed getting audit records for request [%s]", req.Anchor)
+		return errors.WithMessagef(err, "failed getting audit records")
+	}
+	reference := ""
+	switch p := provider.(type) {
+	case referencedRecordProvider:
+		reference = p.reference()
+	case *token.Request:
+		if db.opts.MetadataExtractor != nil {
+			reference, err = db.opts.MetadataExtractor(p)
+			if err != nil {
+				return errors.WithMessagef(err, "failed extracting reference for request [%s]", p.Anchor)
+			}
+		}
 	}
 
-	if err := db.db.BeginUpdate(); err != nil {
+	if err := db.appendRecord(ctx, record, reference); err != nil {
+		return err
+	}
+
+	logger.Debugf("Appending new completed without errors")
+	return nil
+}
+
+// store returns the driver with its operations bound to the passed context, if the driver supports it
+func (db *AuditDB) store(ctx context.Context) driver.AuditDB {
+	if c, ok := db.db.(driver.ContextAuditDB); ok {
+		return c.WithContext(ctx)
+	}
+	return db.db
+}
+
+// acquireAppendSlotContext waits for a free append slot, if appends are bounded, and returns the function to release it.
+// It stops waiting for a slot when the passed context is done.
+func (db *AuditDB) acquireAppendSlotContext(ctx context.Context) (func(), error) {
+	if db.appendSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case db.appendSlots <- struct{}{}:
+		return func() { <-db.appendSlots }, nil
+	case <-ctx.Done():
+		return nil, errors.WithMessage(ctx.Err(), "failed acquiring append slot")
+	}
+}
+
+// appendRecord appends the movements and the transactions of the passed audit record in a single update.
+// The caller is expected to hold the store lock.
+func (db *AuditDB) appendRecord(ctx context.Context, record *token.AuditRecord, reference string) error {
+	store := db.store(ctx)
+	record, err := db.resolveEnrollmentIDs(record)
+	if err != nil {
+		return errors.WithMessagef(err, "resolve enrollment ids for txid '%s' failed", record.Anchor)
+	}
+	// a retried append finds the records of the transaction already stored
+	status, err := store.GetStatus(record.Anchor)
+	if err != nil {
+		return errors.WithMessagef(err, "get status for txid '%s' failed", record.Anchor)
+	}
+	replace := false
+	if len(status) != 0 {
+		switch db.opts.DuplicateAppendPolicy {
+		case FailOnDuplicateAppend:
+			return errors.Wrapf(ErrDuplicateAppend, "txid '%s'", record.Anchor)
+		case SkipDuplicateAppend:
+			logger.Debugf("txid '%s' already appended, skipping", record.Anchor)
+			return nil
+		case ReplaceDuplicateAppend:
+			logger.Debugf("txid '%s' already appended, replacing its records", record.Anchor)
+			replace = true
+		}
+	}
+
+	// collect all the rows first, so that they are flushed to the driver in a single batch each
+	movements := db.movementRecords(record)
+	transactions, err := db.transactionRecords(record, reference)
+	if err != nil {
+		return errors.WithMessagef(err, "append transactions for txid '%s' failed", record.Anchor)
+	}
+	if replace {
+		for _, movement := range movements {
+			movement.Status = status
+		}
+		for _, transaction := range transactions {
+			transaction.Status = status
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.WithMessagef(err, "append for txid '%s' cancelled", record.Anchor)
+	}
+
+	if err := store.BeginUpdate(); err != nil {
 		db.rollback(err)
 		return errors.WithMessagef(err, "begin update for txid '%s' failed", record.Anchor)
 	}
-	if err := db.appendSendMovements(record); err != nil {
+	if replace {
+		if _, err := store.DeleteMovements(record.Anchor); err != nil {
+			db.rollback(err)
+			return errors.WithMessagef(err, "deleting movements for txid '%s' failed", record.Anchor)
+		}
+		if _, err := store.DeleteTransactions(record.Anchor); err != nil {
+			db.rollback(err)
+			return errors.WithMessagef(err, "deleting transactions for txid '%s' failed", record.Anchor)
+		}
+	}
+	if err := store.AddMovements(movements); err != nil {
 		db.rollback(err)
-		return errors.WithMessagef(err, "append send movements for txid '%s' failed", record.Anchor)
+		return errors.WithMessagef(err, "append movements for txid '%s' failed", record.Anchor)
 	}
-	if err := db.appendReceivedMovements(record); err != nil {
+	logger.Debugf("finished to append movements for tx [%s]", record.Anchor)
+	if err := ctx.Err(); err != nil {
 		db.rollback(err)
-		return errors.WithMessagef(err, "append received movements for txid '%s' failed", record.Anchor)
+		return errors.WithMessagef(err, "append for txid '%s' cancelled", record.Anchor)
 	}
-	if err := db.appendTransactions(record); err != nil {
+	if err := store.AddTransactions(transactions); err != nil {
 		db.rollback(err)
 		return errors.WithMessagef(err, "append transactions for txid '%s' failed", record.Anchor)
 	}
-	if err := db.db.Commit(); err != nil {
+	logger.Debugf("finished appending transactions for tx [%s]", record.Anchor)
+	if err := ctx.Err(); err != nil {
+		db.rollback(err)
+		return errors.WithMessagef(err, "append for txid '%s' cancelled", record.Anchor)
+	}
+	if err := store.Commit(); err != nil {
 		db.rollback(err)
 		return errors.WithMessagef(err, "committing tx for txid '%s' failed", record.Anchor)
 	}
+	return nil
+}
 
-	logger.Debugf("Appending new completed without errors")
+// Sync makes durable all the records appended so far.
+// It should be invoked at checkpoints, for instance before reporting externally that a transaction is final.
+func (db *AuditDB) Sync() error {
+	defer db.lockStore("Sync")()
+
+	if err := db.db.Sync(); err != nil {
+		return errors.Wrapf(err, "failed syncing audit db")
+	}
 	return nil
 }
 
@@ -290,30 +764,365 @@ func (db *AuditDB) NewQueryExecutor() *QueryExecutor {
 	db.counter.Inc()
 	db.storeLock.RLock()
 
-	return &QueryExecutor{db: db}
+	return &QueryExecutor{db: db, ctx: context.Background()}
 }
 
-// SetStatus sets the status of the audit records with the passed transaction id to the passed status
+// NewQueryExecutorContext returns a new query executor bound to the passed context.
+// It fails if the context is done before the store lock is acquired for reading.
+// Once the context is done, the iterators returned by the query executor fail on Next,
+// and the query executor must still be released with Done.
+// The queries run by drivers implementing driver.ContextAuditDB are bound to the context as well.
+func (db *AuditDB) NewQueryExecutorContext(ctx context.Context) (*QueryExecutor, error) {
+	// the read lock is released by Done
+	if _, err := db.rLockStoreContext(ctx, "Query"); err != nil {
+		return nil, err
+	}
+	db.counter.Inc()
+
+	return &QueryExecutor{db: db, ctx: ctx}, nil
+}
+
+// SetStatus sets the status of the audit records with the passed transaction id to the passed status.
+// Only the transitions permitted by the state machine are applied, see CanTransition. The others fail
+// with an IllegalTransitionError. Setting the status of an unknown transaction has no effect.
 func (db *AuditDB) SetStatus(txID string, status TxStatus) error {
-	logger.Debugf("Set status [%s][%s]...[%d]", txID, status, db.counter)
-	db.storeLock.Lock()
-	defer db.storeLock.Unlock()
+	return db.SetStatusWithReason(txID, status, "")
+}
+
+// SetStatusWithReason sets the status of the audit records with the passed transaction id to the passed status,
+// recording the passed reason in the transaction records. It is meant to explain why a transaction is Deleted.
+// Any previously recorded reason is replaced, an empty reason clears it.
+func (db *AuditDB) SetStatusWithReason(txID string, status TxStatus, reason string) error {
+	return db.SetStatusContext(context.Background(), txID, status, reason)
+}
+
+// SetStatusContext is like SetStatusWithReason, but it gives up waiting for the store lock when the passed
+// context is done. Drivers implementing driver.ContextAuditDB also abort the update in progress.
+func (db *AuditDB) SetStatusContext(ctx context.Context, txID string, status TxStatus, reason string) error {
+	return db.setStatus(ctx, txID, nil, status, reason)
+}
+
+// SetStatusIf sets the status of the audit records with the passed transaction id to the second passed status,
+// provided that the transaction is in the first one. Otherwise, it fails with a StatusMismatchError.
+// The check and the update are atomic, so that concurrent finality handlers do not override each other.
+// As for SetStatus, only the transitions permitted by the state machine are applied.
+func (db *AuditDB) SetStatusIf(txID string, from, to TxStatus) error {
+	return db.setStatus(context.Background(), txID, &from, to, "")
+}
+
+// setStatus sets the status of the passed transaction, checking first, if expected is not nil,
+// that the transaction is in the expected status
+func (db *AuditDB) setStatus(ctx context.Context, txID string, expected *TxStatus, status TxStatus, reason string) error {
+	logger.Debugf("Set status [%s][%s][%s]...[%d]", txID, status, reason, db.counter)
+	defer db.stats.observeSetStatus(time.Now())
+	unlock, err := db.lockStoreContext(ctx, "SetStatus")
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	logger.Debug("lock acquired")
 
-	if err := db.db.SetStatus(txID, driver.TxStatus(status)); err != nil {
+	store := db.store(ctx)
+	s, err := store.GetStatus(txID)
+	if err != nil {
+		return errors.Wrapf(err, "failed getting status of [%s]", txID)
+	}
+	current := TxStatus(s)
+	if expected != nil && current != *expected {
+		return &StatusMismatchError{TxID: txID, Expected: *expected, Actual: current}
+	}
+	if len(current) != 0 && !CanTransition(current, status) {
+		return &IllegalTransitionError{TxID: txID, From: current, To: status}
+	}
+
+	if err := store.SetStatus(txID, driver.TxStatus(status), reason); err != nil {
 		db.rollback(err)
 		return errors.Wrapf(err, "failed setting status [%s][%s]", txID, status)
 	}
+	if len(current) != 0 && current != status {
+		db.subscriptions.notify(txID, status)
+	}
 	logger.Debugf("Set status [%s][%s]...[%d] done without errors", txID, status, db.counter)
 	return nil
 }
 
+// Reorg reverts the passed transactions from Confirmed back to Pending, as needed when a ledger
+// reorganization makes them unconfirmed. Each reversal is recorded in the Reorgs counter of the
+// transaction records. Pending transactions are left unchanged, while Deleted transactions cannot be reorged.
+// The transactions are reorged in a single update: if any of them is Deleted, or the update fails,
+// none is reorged. Subscribers are notified of the reverted transactions only once the update is committed.
+func (db *AuditDB) Reorg(txIDs []string) error {
+	logger.Debugf("Reorg [%v]...[%d]", txIDs, db.counter)
+	defer db.lockStore("Reorg")()
+	logger.Debug("lock acquired")
+
+	var reverted []string
+	for _, txID := range txIDs {
+		status, err := db.db.GetStatus(txID)
+		if err != nil {
+			return errors.Wrapf(err, "failed getting status of [%s]", txID)
+		}
+		switch status {
+		case driver.Deleted:
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		case driver.Confirmed:
+			reverted = append(reverted, txID)
+		}
+	}
+
+	if err := db.db.BeginUpdate(); err != nil {
+		db.rollback(err)
+		return errors.WithMessagef(err, "begin update for reorg failed")
+	}
+	for _, txID := range txIDs {
+		if err := db.db.Reorg(txID); err != nil {
+			db.rollback(err)
+			return errors.Wrapf(err, "failed reorging [%s]", txID)
+		}
+	}
+	if err := db.db.Commit(); err != nil {
+		db.rollback(err)
+		return errors.WithMessagef(err, "committing reorg failed")
+	}
+	for _, txID := range reverted {
+		db.subscriptions.notify(txID, Pending)
+	}
+	logger.Debugf("Reorg [%v]...[%d] done without errors", txIDs, db.counter)
+	return nil
+}
+
+// RecomputeTransactions rebuilds the transaction records of the passed transaction from its movement records,
+// replacing, in a single update, the transaction records currently stored, if any.
+// For each token type, the enrollment ID with a negative movement is the sender and those with a positive movement
+// are the recipients. Without a sender, the recipients were issued tokens. What the sender spent and
+// no recipient received has been redeemed.
+// Movements are net amounts, therefore the change returned to the sender is not reconstructed,
+// and the rebuilt records carry neither the original timestamp nor the reference.
+// Movements do not record the action they come from either: the rebuilt records all refer to the first action,
+// and transactions whose movements span more than one token type, that is, with more than one action,
+// are rejected.
+// It returns the number of transaction records written.
+func (db *AuditDB) RecomputeTransactions(txID string) (int, error) {
+	logger.Debugf("Recompute transactions [%s]...[%d]", txID, db.counter)
+	defer db.lockStore("RecomputeTransactions")()
+	logger.Debug("lock acquired")
+
+	movements, err := db.db.QueryMovementsByTxID(txID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed querying movements of [%s]", txID)
+	}
+	if supplyEID := db.opts.SupplyEnrollmentID; len(supplyEID) != 0 {
+		// the movements of the supply pseudo-account are not transfers between parties
+		var parties []*driver.MovementRecord
+		for _, movement := range movements {
+			if movement.EnrollmentID != supplyEID {
+				parties = append(parties, movement)
+			}
+		}
+		movements = parties
+	}
+	records, err := transactionsFromMovements(txID, movements)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := db.db.BeginUpdate(); err != nil {
+		db.rollback(err)
+		return 0, errors.WithMessagef(err, "begin update for txid '%s' failed", txID)
+	}
+	if _, err := db.db.DeleteTransactions(txID); err != nil {
+		db.rollback(err)
+		return 0, errors.WithMessagef(err, "deleting transactions for txid '%s' failed", txID)
+	}
+	if err := db.db.AddTransactions(records); err != nil {
+		db.rollback(err)
+		return 0, errors.WithMessagef(err, "adding transactions for txid '%s' failed", txID)
+	}
+	if err := db.db.Commit(); err != nil {
+		db.rollback(err)
+		return 0, errors.WithMessagef(err, "committing tx for txid '%s' failed", txID)
+	}
+	logger.Debugf("Recompute transactions [%s]...[%d] done without errors, written [%d] records", txID, db.counter, len(records))
+	return len(records), nil
+}
+
+// transactionsFromMovements derives the transaction records of the passed transaction from the passed movements.
+// See RecomputeTransactions.
+func transactionsFromMovements(txID string, movements []*driver.MovementRecord) ([]*driver.TransactionRecord, error) {
+	type flows struct {
+		senders    []*driver.MovementRecord
+		recipients []*driver.MovementRecord
+	}
+	var tokenTypes []string
+	byType := map[string]*flows{}
+	for _, movement := range movements {
+		if movement.TxID != txID || movement.Amount == nil {
+			continue
+		}
+		f, ok := byType[movement.TokenType]
+		if !ok {
+			f = &flows{}
+			byType[movement.TokenType] = f
+			tokenTypes = append(tokenTypes, movement.TokenType)
+		}
+		if movement.Amount.Sign() < 0 {
+			f.senders = append(f.senders, movement)
+		} else {
+			f.recipients = append(f.recipients, movement)
+		}
+	}
+	if len(tokenTypes) == 0 {
+		return nil, errors.Errorf("no movements found for txid '%s'", txID)
+	}
+	if len(tokenTypes) > 1 {
+		return nil, errors.Errorf("cannot attribute movements to actions for txid '%s', found [%d] token types", txID, len(tokenTypes))
+	}
+
+	var records []*driver.TransactionRecord
+	timestamp := time.Now()
+	newRecord := func(movement *driver.MovementRecord, tt driver.TransactionType, sender, recipient string, amount *big.Int) *driver.TransactionRecord {
+		return &driver.TransactionRecord{
+			TxID:            txID,
+			TransactionType: tt,
+			SenderEID:       sender,
+			RecipientEID:    recipient,
+			TokenType:       movement.TokenType,
+			Amount:          amount,
+			Timestamp:       timestamp,
+			Status:          movement.Status,
+			Quarantined:     movement.Quarantined,
+		}
+	}
+	for _, tokenType := range tokenTypes {
+		f := byType[tokenType]
+		if len(f.senders) > 1 {
+			return nil, errors.Errorf("cannot attribute movements of type [%s] for txid '%s', found [%d] senders", tokenType, txID, len(f.senders))
+		}
+		if len(f.senders) == 0 {
+			for _, recipient := range f.recipients {
+				records = append(records, newRecord(recipient, driver.Issue, "", recipient.EnrollmentID, new(big.Int).Set(recipient.Amount)))
+			}
+			continue
+		}
+		sender := f.senders[0]
+		redeemed := new(big.Int).Neg(sender.Amount)
+		for _, recipient := range f.recipients {
+			records = append(records, newRecord(recipient, driver.Transfer, sender.EnrollmentID, recipient.EnrollmentID, new(big.Int).Set(recipient.Amount)))
+			redeemed.Sub(redeemed, recipient.Amount)
+		}
+		if redeemed.Sign() > 0 {
+			records = append(records, newRecord(sender, driver.Redeem, sender.EnrollmentID, "", redeemed))
+		}
+	}
+	return records, nil
+}
+
+// Prune removes the transaction records older than the passed time, unless Pending.
+// The movement records of the removed Deleted transactions are removed as well, while the other movement records
+// are kept because they back the holdings.
+// It returns the number of removed records.
+func (db *AuditDB) Prune(before time.Time) (int, error) {
+	return db.PruneContext(context.Background(), before)
+}
+
+// PruneContext is like Prune, but it stops waiting for the store lock once the passed context is done.
+// The prune is bound to the context as well, see driver.ContextAuditDB, and then aborted by the drivers
+// that support it.
+func (db *AuditDB) PruneContext(ctx context.Context, before time.Time) (int, error) {
+	logger.Debugf("Prune [%s]...[%d]", before, db.counter)
+	unlock, err := db.lockStoreContext(ctx, "Prune")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	logger.Debug("lock acquired")
+
+	removed, err := db.store(ctx).Prune(before)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed pruning records before [%s]", before)
+	}
+	logger.Debugf("Prune [%s]...[%d] done without errors, removed [%d] records", before, db.counter, removed)
+	return removed, nil
+}
+
+// DeleteTransactionsBefore deletes, in a single transaction, the transaction records older than the passed time
+// whose transaction is Confirmed or Deleted, together with all the movement records of those transactions.
+// Unlike Prune, it also deletes the movement records of Confirmed transactions, therefore the holdings computed
+// afterwards no longer account for them. It is meant to enforce a legal retention period. Pending transactions
+// are never deleted.
+// It returns the number of deleted records.
+func (db *AuditDB) DeleteTransactionsBefore(t time.Time) (int, error) {
+	logger.Debugf("Delete transactions before [%s]...[%d]", t, db.counter)
+	defer db.lockStore("DeleteTransactionsBefore")()
+	logger.Debug("lock acquired")
+
+	removed, err := db.db.DeleteTransactionsBefore(t, false)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed deleting records before [%s]", t)
+	}
+	logger.Debugf("Delete transactions before [%s]...[%d] done without errors, removed [%d] records", t, db.counter, removed)
+	return removed, nil
+}
+
+// CountTransactionsBefore is the dry run of DeleteTransactionsBefore: it returns the number of records
+// that DeleteTransactionsBefore would delete, without deleting them
+func (db *AuditDB) CountTransactionsBefore(t time.Time) (int, error) {
+	defer db.lockStore("CountTransactionsBefore")()
+
+	count, err := db.db.DeleteTransactionsBefore(t, true)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed counting records before [%s]", t)
+	}
+	return count, nil
+}
+
+// Quarantine puts in quarantine the audit records with the passed transaction id, recording the passed reason.
+// Quarantined records are kept, and can be excluded from the computation of the available holdings.
+func (db *AuditDB) Quarantine(txID string, reason string) error {
+	return db.setQuarantine(txID, true, reason)
+}
+
+// Unquarantine removes from quarantine the audit records with the passed transaction id
+func (db *AuditDB) Unquarantine(txID string) error {
+	return db.setQuarantine(txID, false, "")
+}
+
+func (db *AuditDB) setQuarantine(txID string, quarantined bool, reason string) error {
+	logger.Debugf("Set quarantine [%s][%v]...[%d]", txID, quarantined, db.counter)
+	defer db.lockStore("SetQuarantine")()
+	logger.Debug("lock acquired")
+
+	if err := db.db.SetQuarantine(txID, quarantined, reason); err != nil {
+		return errors.Wrapf(err, "failed setting quarantine [%s][%v]", txID, quarantined)
+	}
+	logger.Debugf("Set quarantine [%s][%v]...[%d] done without errors", txID, quarantined, db.counter)
+	return nil
+}
+
 // AcquireLocks acquires locks for the passed enrollment ids.
 // This can be used to prevent concurrent read/write access to the audit records of the passed enrollment ids.
 func (db *AuditDB) AcquireLocks(eIDs ...string) error {
+	return db.AcquireLocksWithContext(context.Background(), eIDs...)
+}
+
+// AcquireLocksWithContext is like AcquireLocks, but it gives up when the passed context is done before all the locks
+// are acquired. In that case, the locks acquired so far are released, and the returned error, whose cause is the
+// error of the context, names the enrollment id whose lock was being waited for.
+// The lock being waited for is released as soon as it is eventually acquired.
+func (db *AuditDB) AcquireLocksWithContext(ctx context.Context, eIDs ...string) error {
+	var acquired []string
 	for _, id := range deduplicate(eIDs) {
-		lock, _ := db.eIDsLocks.LoadOrStore(id, &sync.RWMutex{})
-		lock.(*sync.RWMutex).Lock()
+		l, _ := db.eIDsLocks.LoadOrStore(id, &sync.RWMutex{})
+		lock := l.(*sync.RWMutex)
+		_, err := acquireContext(ctx, "lock for enrollment id ["+id+"]", func() func() {
+			lock.Lock()
+			return lock.Unlock
+		})
+		if err != nil {
+			db.Unlock(acquired...)
+			return err
+		}
+		acquired = append(acquired, id)
 	}
 	return nil
 }
@@ -330,81 +1139,176 @@ func (db *AuditDB) Unlock(eIDs ...string) {
 	}
 }
 
-func (db *AuditDB) appendSendMovements(record *token.AuditRecord) error {
-	inputs := record.Inputs
-	outputs := record.Outputs
-	// we need to consider both inputs and outputs enrollment IDs because the record can refer to a redeem
-	eIDs := joinIOEIDs(record)
-	tokenTypes := outputs.TokenTypes()
-
-	for _, eID := range eIDs {
-		for _, tokenType := range tokenTypes {
-			sent := inputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
-			received := outputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
-			diff := sent.Sub(sent, received)
-			if diff.Cmp(big.NewInt(0)) <= 0 {
-				continue
-			}
-
-			if err := db.db.AddMovement(&driver.MovementRecord{
-				TxID:         record.Anchor,
-				EnrollmentID: eID,
-				Amount:       diff.Neg(diff),
-				TokenType:    tokenType,
-				Status:       driver.Pending,
-			}); err != nil {
-				if err1 := db.db.Discard(); err1 != nil {
-					logger.Errorf("got error %s; discarding caused %s", err.Error(), err1.Error())
-				}
-				return err
-			}
+// resolveEnrollmentIDs returns a copy of the passed audit record whose inputs and outputs carry
+// the enrollment IDs returned by the configured EnrollmentResolver.
+// If no resolver is configured, the passed audit record is returned as is.
+func (db *AuditDB) resolveEnrollmentIDs(record *token.AuditRecord) (*token.AuditRecord, error) {
+	resolver := db.opts.EnrollmentResolver
+	if resolver == nil {
+		return record, nil
+	}
+	resolve := func(owner []byte, eID string) (string, error) {
+		if len(owner) == 0 {
+			// no owner, nothing to resolve (e.g. redeem)
+			return eID, nil
+		}
+		resolved, err := resolver(owner)
+		if err != nil {
+			return "", errors.WithMessagef(err, "failed resolving enrollment id of [%s]", eID)
 		}
+		return resolved, nil
 	}
-	logger.Debugf("finished to append send movements for tx [%s]", record.Anchor)
 
-	return nil
+	inputs := make([]*token.Input, record.Inputs.Count())
+	for i := range inputs {
+		input := *record.Inputs.At(i)
+		eID, err := resolve(input.Owner, input.EnrollmentID)
+		if err != nil {
+			return record, err
+		}
+		input.EnrollmentID = eID
+		inputs[i] = &input
+	}
+	outputs := make([]*token.Output, record.Outputs.Count())
+	for i := range outputs {
+		output := *record.Outputs.At(i)
+		eID, err := resolve(output.Owner, output.EnrollmentID)
+		if err != nil {
+			return record, err
+		}
+		output.EnrollmentID = eID
+		outputs[i] = &output
+	}
+	return &token.AuditRecord{
+		Anchor:  record.Anchor,
+		Inputs:  token.NewInputStream(nil, inputs, record.Outputs.Precision),
+		Outputs: token.NewOutputStream(outputs, record.Outputs.Precision),
+	}, nil
 }
 
-func (db *AuditDB) appendReceivedMovements(record *token.AuditRecord) error {
-	inputs := record.Inputs
-	outputs := record.Outputs
+// movementRecords returns, for each enrollment ID and token type, the movement of the passed record.
+// Sent and received amounts are accumulated in a single pass over inputs and outputs.
+// Send movements come first, followed by the received ones.
+func (db *AuditDB) movementRecords(record *token.AuditRecord) []*driver.MovementRecord {
 	// we need to consider both inputs and outputs enrollment IDs because the record can refer to a redeem
 	eIDs := joinIOEIDs(record)
-	tokenTypes := outputs.TokenTypes()
+	tokenTypes := record.Outputs.TokenTypes()
+
+	type key struct {
+		eID       string
+		tokenType string
+	}
+	sent := map[key]*big.Int{}
+	for i := 0; i < record.Inputs.Count(); i++ {
+		input := record.Inputs.At(i)
+		k := key{eID: input.EnrollmentID, tokenType: input.Type}
+		if sum, ok := sent[k]; ok {
+			sum.Add(sum, input.Quantity.ToBigInt())
+		} else {
+			sent[k] = input.Quantity.ToBigInt()
+		}
+	}
+	received := map[key]*big.Int{}
+	for i := 0; i < record.Outputs.Count(); i++ {
+		output := record.Outputs.At(i)
+		k := key{eID: output.EnrollmentID, tokenType: output.Type}
+		if sum, ok := received[k]; ok {
+			sum.Add(sum, output.Quantity.ToBigInt())
+		} else {
+			received[k] = output.Quantity.ToBigInt()
+		}
+	}
 
+	var sendMovements, receivedMovements []*driver.MovementRecord
+	zero := big.NewInt(0)
+	diff := new(big.Int)
 	for _, eID := range eIDs {
 		for _, tokenType := range tokenTypes {
-			received := outputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
-			sent := inputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
-			diff := received.Sub(received, sent)
-			if diff.Cmp(big.NewInt(0)) <= 0 {
-				// Nothing received
-				continue
+			k := key{eID: eID, tokenType: tokenType}
+			s, r := sent[k], received[k]
+			if s == nil {
+				s = zero
 			}
-
-			if err := db.db.AddMovement(&driver.MovementRecord{
-				TxID:         record.Anchor,
-				EnrollmentID: eID,
-				Amount:       diff,
-				TokenType:    tokenType,
-				Status:       driver.Pending,
-			}); err != nil {
-				if err1 := db.db.Discard(); err1 != nil {
-					logger.Errorf("got error %s; discarding caused %s", err.Error(), err1.Error())
-				}
-				return err
+			if r == nil {
+				r = zero
+			}
+			switch diff.Sub(r, s); diff.Cmp(zero) {
+			case -1:
+				sendMovements = append(sendMovements, &driver.MovementRecord{
+					TxID:         record.Anchor,
+					EnrollmentID: eID,
+					Amount:       new(big.Int).Set(diff),
+					TokenType:    tokenType,
+					Status:       driver.Pending,
+				})
+			case 1:
+				receivedMovements = append(receivedMovements, &driver.MovementRecord{
+					TxID:         record.Anchor,
+					EnrollmentID: eID,
+					Amount:       new(big.Int).Set(diff),
+					TokenType:    tokenType,
+					Status:       driver.Pending,
+				})
 			}
 		}
 	}
-	logger.Debugf("finished to append received movements for tx [%s]", record.Anchor)
 
-	return nil
+	movements := append(sendMovements, receivedMovements...)
+	if len(db.opts.SupplyEnrollmentID) != 0 {
+		movements = append(movements, supplyMovements(record, db.opts.SupplyEnrollmentID)...)
+	}
+	return movements
 }
 
-func (db *AuditDB) appendTransactions(record *token.AuditRecord) error {
+// supplyMovements returns, for each token type whose supply is changed by the passed record, a movement of
+// the supply pseudo-account with the passed enrollment ID: positive for issued tokens, negative for redeemed ones.
+// Redeemed tokens are the outputs without an owner.
+func supplyMovements(record *token.AuditRecord, supplyEID string) []*driver.MovementRecord {
+	var tokenTypes []string
+	delta := map[string]*big.Int{}
+	add := func(tokenType string, amount *big.Int) {
+		sum, ok := delta[tokenType]
+		if !ok {
+			sum = new(big.Int)
+			delta[tokenType] = sum
+			tokenTypes = append(tokenTypes, tokenType)
+		}
+		sum.Add(sum, amount)
+	}
+	for i := 0; i < record.Inputs.Count(); i++ {
+		input := record.Inputs.At(i)
+		add(input.Type, new(big.Int).Neg(input.Quantity.ToBigInt()))
+	}
+	for i := 0; i < record.Outputs.Count(); i++ {
+		output := record.Outputs.At(i)
+		if len(output.Owner) == 0 {
+			continue
+		}
+		add(output.Type, output.Quantity.ToBigInt())
+	}
+
+	var movements []*driver.MovementRecord
+	for _, tokenType := range tokenTypes {
+		if delta[tokenType].Sign() == 0 {
+			continue
+		}
+		movements = append(movements, &driver.MovementRecord{
+			TxID:         record.Anchor,
+			EnrollmentID: supplyEID,
+			Amount:       delta[tokenType],
+			TokenType:    tokenType,
+			Status:       driver.Pending,
+		})
+	}
+	return movements
+}
+
+// transactionRecords returns the transaction records of the passed record, action by action
+func (db *AuditDB) transactionRecords(record *token.AuditRecord, reference string) ([]*driver.TransactionRecord, error) {
 	inputs := record.Inputs
 	outputs := record.Outputs
 
+	var records []*driver.TransactionRecord
 	actionIndex := 0
 	timestamp := time.Now()
 	for {
@@ -423,14 +1327,10 @@ func (db *AuditDB) appendTransactions(record *token.AuditRecord) error {
 
 		// create a transaction record from ins and ous
 
-		// All ins should be for same EID, check this
+		// All ins should be for same EID, check this, unless they can be split
 		inEIDs := ins.EnrollmentIDs()
-		if len(inEIDs) > 1 {
-			return errors.Errorf("expected at most 1 input enrollment id, got %d", len(inEIDs))
-		}
-		inEID := ""
-		if len(inEIDs) == 1 {
-			inEID = inEIDs[0]
+		if len(inEIDs) > 1 && db.opts.MultipleSendersPolicy != SplitByInputAmount {
+			return nil, errors.Errorf("expected at most 1 input enrollment id, got %d", len(inEIDs))
 		}
 
 		outEIDs := ous.EnrollmentIDs()
@@ -452,28 +1352,110 @@ func (db *AuditDB) appendTransactions(record *token.AuditRecord) error {
 					}
 				}
 
-				if err := db.db.AddTransaction(&driver.TransactionRecord{
-					TxID:            record.Anchor,
-					SenderEID:       inEID,
-					RecipientEID:    outEID,
-					TokenType:       tokenType,
-					Amount:          received,
-					Status:          driver.Pending,
-					TransactionType: tt,
-					Timestamp:       timestamp,
-				}); err != nil {
-					if err1 := db.db.Discard(); err1 != nil {
-						logger.Errorf("got error %s; discarding caused %s", err.Error(), err1.Error())
+				for _, share := range senderShares(ins, inEIDs, tokenType, received) {
+					if share.amount.Sign() == 0 {
+						continue
 					}
-					return err
+					records = append(records, &driver.TransactionRecord{
+						TxID:            record.Anchor,
+						ActionIndex:     actionIndex,
+						SenderEID:       share.eID,
+						RecipientEID:    outEID,
+						TokenType:       tokenType,
+						Amount:          share.amount,
+						Status:          driver.Pending,
+						TransactionType: tt,
+						Timestamp:       timestamp,
+						Reference:       reference,
+					})
 				}
 			}
 		}
 
 		actionIndex++
 	}
-	logger.Debugf("finished appending transactions for tx [%s]", record.Anchor)
+	return records, nil
+}
+
+type senderShare struct {
+	eID    string
+	amount *big.Int
+}
+
+// senderShares attributes the passed amount, received in the action with the passed inputs, to the senders of the action.
+// With more than one sender, each gets a share proportional to the amount of inputs of the same token type it spent,
+// or an equal share if no input has that token type. The rounding remainder goes to the last sender.
+func senderShares(ins *token.InputStream, inEIDs []string, tokenType string, received *big.Int) []senderShare {
+	switch len(inEIDs) {
+	case 0:
+		return []senderShare{{amount: received}}
+	case 1:
+		return []senderShare{{eID: inEIDs[0], amount: received}}
+	}
+
+	weights := make([]*big.Int, len(inEIDs))
+	total := big.NewInt(0)
+	for i, eID := range inEIDs {
+		weights[i] = ins.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
+		total.Add(total, weights[i])
+	}
+	if total.Sign() == 0 {
+		for i := range weights {
+			weights[i] = big.NewInt(1)
+		}
+		total.SetInt64(int64(len(weights)))
+	}
+
+	shares := make([]senderShare, len(inEIDs))
+	assigned := big.NewInt(0)
+	for i, eID := range inEIDs {
+		amount := new(big.Int)
+		if i == len(inEIDs)-1 {
+			amount.Sub(received, assigned)
+		} else {
+			amount.Mul(received, weights[i])
+			amount.Quo(amount, total)
+			assigned.Add(assigned, amount)
+		}
+		shares[i] = senderShare{eID: eID, amount: amount}
+	}
+	return shares
+}
+
+// checkTransactionType checks that the passed record carries a known transaction type.
+// It returns true if the record must be skipped, or an error, depending on the configured policy.
+func (db *AuditDB) checkTransactionType(record *driver.TransactionRecord) (bool, error) {
+	if TransactionType(record.TransactionType).IsValid() {
+		return false, nil
+	}
+	if db.opts.UnknownTransactionTypePolicy == SkipUnknownTransactionType {
+		logger.Warnf("skipping record for tx [%s], unknown transaction type [%d]", record.TxID, record.TransactionType)
+		return true, nil
+	}
+	return false, errors.Errorf("unknown transaction type [%d] for tx [%s]", record.TransactionType, record.TxID)
+}
+
+// checkAmount returns the passed amount if not nil.
+// Otherwise, depending on the configured policy, it returns zero or an error.
+func (db *AuditDB) checkAmount(txID string, amount *big.Int) (*big.Int, error) {
+	if amount != nil {
+		return amount, nil
+	}
+	if db.opts.NilAmountPolicy == ZeroNilAmount {
+		logger.Warnf("nil amount for tx [%s], treating it as zero", txID)
+		return big.NewInt(0), nil
+	}
+	return nil, errors.Errorf("nil amount for tx [%s]", txID)
+}
 
+// checkMovementAmounts checks that the passed movement records carry an amount.
+// Depending on the configured policy, nil amounts are either reported as an error or later summed as zero.
+func (db *AuditDB) checkMovementAmounts(records []*driver.MovementRecord) error {
+	for _, record := range records {
+		if _, err := db.checkAmount(record.TxID, record.Amount); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -485,39 +1467,198 @@ func (db *AuditDB) rollback(err error) {
 
 // Manager handles the audit databases
 type Manager struct {
-	sp     view2.ServiceProvider
-	driver string
-	mutex  sync.Mutex
-	dbs    map[string]*AuditDB
+	sp          view2.ServiceProvider
+	driver      string
+	opts        *Options
+	appendSlots chan struct{}
+	stats       *stats
+	mutex       sync.Mutex
+	dbs         map[string]*AuditDB
 }
 
 // NewManager creates a new audit manager
-func NewManager(sp view2.ServiceProvider, driver string) *Manager {
+func NewManager(sp view2.ServiceProvider, driver string, opts ...Option) *Manager {
+	options := compile(opts...)
+	var appendSlots chan struct{}
+	if options.MaxConcurrentAppends > 0 {
+		appendSlots = make(chan struct{}, options.MaxConcurrentAppends)
+	}
 	return &Manager{
-		sp:     sp,
-		driver: driver,
-		dbs:    map[string]*AuditDB{},
+		sp:          sp,
+		driver:      driver,
+		opts:        options,
+		appendSlots: appendSlots,
+		stats:       newStats(options.MetricsProvider),
+		dbs:         map[string]*AuditDB{},
 	}
 }
 
 // AuditDB returns an AuditDB for the given auditor wallet
 func (cm *Manager) AuditDB(w *token.AuditorWallet) (*AuditDB, error) {
+	return cm.auditDB(cm.opts.WalletKeyFunc(w))
+}
+
+// auditDB returns the AuditDB bound to the passed wallet key, opening it in the namespace given by the key
+// if not already available
+func (cm *Manager) auditDB(key string) (*AuditDB, error) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
-	id := w.ID()
-	c, ok := cm.dbs[id]
+	c, ok := cm.dbs[key]
 	if !ok {
-		driver, err := drivers[cm.driver].Open(cm.sp, "")
+		driver, err := drivers[cm.driver].Open(cm.sp, key)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed instantiating audit db driver")
 		}
-		c = newAuditDB(driver)
-		cm.dbs[id] = c
+		if err := ensureUniqueConstraints(driver); err != nil {
+			return nil, errors.WithMessagef(err, "failed setting up audit db for wallet [%s]", key)
+		}
+		c = cm.newAuditDB(key, driver)
+		cm.dbs[key] = c
 	}
 	return c, nil
 }
 
+// RetentionResult is the outcome of the retention run on the audit db of a wallet
+type RetentionResult struct {
+	// Removed is the number of removed records
+	Removed int
+	// Duration is the time spent pruning the audit db
+	Duration time.Duration
+	// Err is the reason, if any, why the prune failed or did not complete in time
+	Err error
+}
+
+// RunRetention prunes each managed audit db to the retention horizon configured for its wallet with WithRetention.
+// Audit dbs of wallets without a retention horizon are left untouched. Pending records are never pruned.
+// Wallets are pruned, in wallet key order, by a pool of WithRetentionWorkers workers, each prune bounded
+// by WithRetentionTimeout. A wallet whose prune fails or times out does not stop the others.
+// It returns, for each wallet whose prune has been started, the outcome of the prune. The returned error,
+// if any, lists the failed wallets.
+// Once the passed context is done, no further prune is started and the context error is returned.
+func (cm *Manager) RunRetention(ctx context.Context) (map[string]*RetentionResult, error) {
+	res := map[string]*RetentionResult{}
+	if cm.opts.RetentionResolver == nil {
+		return res, nil
+	}
+
+	type job struct {
+		id     string
+		db     *AuditDB
+		before time.Time
+	}
+	now := time.Now()
+	cm.mutex.Lock()
+	var jobs []job
+	for id, db := range cm.dbs {
+		if horizon, ok := cm.opts.RetentionResolver(id); ok {
+			jobs = append(jobs, job{id: id, db: db, before: now.Add(-horizon)})
+		}
+	}
+	cm.mutex.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].id < jobs[j].id })
+
+	workers := cm.opts.RetentionWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	queue := make(chan job)
+	var resLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				r := pruneWithTimeout(ctx, j.db, j.before, cm.opts.RetentionTimeout)
+				resLock.Lock()
+				res[j.id] = r
+				resLock.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, j := range jobs {
+		select {
+		case <-ctx.Done():
+			break feed
+		case queue <- j:
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	var failed []string
+	for _, j := range jobs {
+		if r := res[j.id]; r.Err != nil {
+			logger.Errorf("failed running retention for wallet [%s]: %s", j.id, r.Err)
+			failed = append(failed, j.id)
+		}
+	}
+	if len(failed) != 0 {
+		return res, errors.Errorf("failed running retention for wallets [%s]", strings.Join(failed, ", "))
+	}
+	return res, nil
+}
+
+// pruneWithTimeout prunes the passed audit db, giving up when the passed context is done or, if positive,
+// the timeout expires. The prune is bound to the same context, and then aborted by the drivers that support it.
+// With the others, a prune that has been given up keeps running until the driver returns, and the next prune
+// of the same audit db waits for it, so that prunes do not pile up.
+func pruneWithTimeout(ctx context.Context, db *AuditDB, before time.Time, timeout time.Duration) *RetentionResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	type outcome struct {
+		removed int
+		err     error
+	}
+	start := time.Now()
+	select {
+	case db.pruneSlot <- struct{}{}:
+	case <-ctx.Done():
+		return &RetentionResult{Duration: time.Since(start), Err: errors.Wrapf(ctx.Err(), "previous prune still running")}
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		defer func() { <-db.pruneSlot }()
+		removed, err := db.PruneContext(ctx, before)
+		done <- outcome{removed: removed, err: err}
+	}()
+	select {
+	case o := <-done:
+		return &RetentionResult{Removed: o.removed, Duration: time.Since(start), Err: o.err}
+	case <-ctx.Done():
+		return &RetentionResult{Duration: time.Since(start), Err: errors.Wrapf(ctx.Err(), "prune did not complete")}
+	}
+}
+
+// newAuditDB returns a new AuditDB, backed by the passed driver, that shares the append slots of the manager
+func (cm *Manager) newAuditDB(key string, p driver.AuditDB) *AuditDB {
+	db := newAuditDB(p, cm.opts, &dbStats{stats: cm.stats, wallet: key})
+	db.appendSlots = cm.appendSlots
+	return db
+}
+
+// ensureUniqueConstraints asks the passed driver to reject duplicate transaction records.
+// Drivers that cannot enforce the constraints are accepted with a warning.
+func ensureUniqueConstraints(p driver.AuditDB) error {
+	err := p.EnsureUniqueConstraints()
+	if errors.Cause(err) == driver.ErrUniqueConstraintsNotSupported {
+		logger.Warnf("audit db driver does not enforce unique constraints, duplicate transaction records will not be rejected")
+		return nil
+	}
+	if err != nil {
+		return errors.WithMessage(err, "failed ensuring unique constraints")
+	}
+	return nil
+}
+
 var (
 	managerType = reflect.TypeOf((*Manager)(nil))
 )
@@ -0,0 +1,2059 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view"
+	"github.com/hyperledger/fabric/common/metrics/metricsfakes"
+	"github.com/pkg/errors"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/memory"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	token2 "github.com/hyperledger-labs/fabric-token-sdk/token/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownTransactionType(t *testing.T) {
+	records := []*driver.TransactionRecord{
+		{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Confirmed},
+		{TxID: "1", TransactionType: driver.TransactionType(42), RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Confirmed},
+		{TxID: "2", TransactionType: driver.Redeem, SenderEID: "alice", TokenType: "EUR", Amount: big.NewInt(5), Status: driver.Confirmed},
+	}
+	p := &memory.Persistence{}
+	for _, record := range records {
+		assert.NoError(t, p.AddTransaction(record))
+	}
+
+	// default: fail
+	db := auditdb.NewAuditDB(p)
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", tx.TxID)
+	_, err = it.Next()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown transaction type [42] for tx [1]")
+	it.Close()
+	qe.Done()
+
+	// skip
+	db = auditdb.NewAuditDB(p, auditdb.WithUnknownTransactionTypePolicy(auditdb.SkipUnknownTransactionType))
+	qe = db.NewQueryExecutor()
+	it, err = qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "2"}, txIDs(t, it))
+	qe.Done()
+}
+
+func TestPagination(t *testing.T) {
+	t0 := time.Now()
+	records := []*driver.TransactionRecord{
+		{TxID: "b", ActionIndex: 1, Timestamp: t0},
+		{TxID: "a", ActionIndex: 0, Timestamp: t0},
+		{TxID: "b", ActionIndex: 0, Timestamp: t0},
+		{TxID: "z", ActionIndex: 0, Timestamp: t0.Add(-time.Second)},
+		{TxID: "c", ActionIndex: 0, Timestamp: t0},
+		{TxID: "a", ActionIndex: 1, Timestamp: t0},
+	}
+	p := &memory.Persistence{}
+	for _, record := range records {
+		record.TransactionType = driver.Issue
+		record.Amount = big.NewInt(1)
+		assert.NoError(t, p.AddTransaction(record))
+	}
+	db := auditdb.NewAuditDB(p)
+
+	// the page boundary falls in the middle of the records sharing timestamp t0
+	var keys []string
+	for offset := 0; ; offset += 4 {
+		qe := db.NewQueryExecutor()
+		it, err := qe.Transactions(nil, nil, auditdb.WithPage(offset, 4))
+		assert.NoError(t, err)
+		var page []string
+		for {
+			tx, err := it.Next()
+			assert.NoError(t, err)
+			if tx == nil {
+				break
+			}
+			page = append(page, tx.TxID+strconv.Itoa(tx.ActionIndex))
+		}
+		it.Close()
+		qe.Done()
+		if len(page) == 0 {
+			break
+		}
+		keys = append(keys, page...)
+	}
+	assert.Equal(t, []string{"z0", "a0", "a1", "b0", "b1", "c0"}, keys)
+}
+
+func TestFindDuplicates(t *testing.T) {
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+	// append tx2 twice more, by mistake
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	duplicates, err := qe.FindDuplicates(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"tx2": 3}, duplicates)
+
+	// a transaction with many records, one per recipient, is not a duplicate
+	p = &memory.Persistence{}
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", RecipientEID: "alice", TokenType: "EUR"}))
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", RecipientEID: "bob", TokenType: "EUR"}))
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", ActionIndex: 1, RecipientEID: "bob", TokenType: "EUR"}))
+	duplicates, err = p.QueryDuplicateTransactions(nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, duplicates)
+}
+
+func TestReference(t *testing.T) {
+	req := token.NewRequest(nil, "tx1")
+	req.SetApplicationMetadata("invoice", []byte("INV-001"))
+	ref, err := auditdb.ApplicationMetadataExtractor("invoice")(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "INV-001", ref)
+	ref, err = auditdb.ApplicationMetadataExtractor("missing")(req)
+	assert.NoError(t, err)
+	assert.Empty(t, ref)
+
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), "INV-001"))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), "INV-002"))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "alice", "EUR", 30), ""))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil, auditdb.WithReference("INV-002"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tx2"}, txIDs(t, it))
+	it, err = qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tx1", "tx2", "tx3"}, txIDs(t, it))
+}
+
+func TestQuarantine(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "alice", "EUR", 20), ""))
+	assert.NoError(t, db.Quarantine("tx2", "suspicious amount"))
+
+	holdings := func(available bool) uint64 {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		filter := qe.NewHoldingsFilter().ByEnrollmentId("alice").ByType("EUR")
+		if available {
+			filter = filter.Available()
+		}
+		filter, err := filter.Execute()
+		assert.NoError(t, err)
+		return filter.Sum().ToBigInt().Uint64()
+	}
+	assert.Equal(t, uint64(30), holdings(false))
+	assert.Equal(t, uint64(10), holdings(true))
+
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil, auditdb.WithQuarantined(true))
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "tx2", tx.TxID)
+	assert.Equal(t, "suspicious amount", tx.QuarantineReason)
+	it.Close()
+	it, err = qe.Transactions(nil, nil, auditdb.WithQuarantined(false))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tx1"}, txIDs(t, it))
+	qe.Done()
+
+	assert.NoError(t, db.Unquarantine("tx2"))
+	assert.Equal(t, uint64(30), holdings(true))
+}
+
+func TestNilAmount(t *testing.T) {
+	record := &auditdb.TransactionRecord{TxID: "tx1", RecipientEID: "alice", TokenType: "EUR"}
+	assert.Contains(t, record.String(), "EUR <nil>")
+
+	p := &memory.Persistence{}
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Status: driver.Confirmed}))
+	assert.NoError(t, p.AddMovement(&driver.MovementRecord{TxID: "tx1", EnrollmentID: "alice", TokenType: "EUR", Status: driver.Confirmed}))
+	assert.NoError(t, p.AddMovement(&driver.MovementRecord{TxID: "tx2", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(5), Status: driver.Confirmed}))
+
+	// default: fail
+	db := auditdb.NewAuditDB(p)
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	_, err = it.Next()
+	assert.EqualError(t, err, "nil amount for tx [tx1]")
+	it.Close()
+	_, err = qe.NewHoldingsFilter().ByEnrollmentId("alice").Execute()
+	assert.EqualError(t, err, "nil amount for tx [tx1]")
+	qe.Done()
+
+	// zero
+	db = auditdb.NewAuditDB(p, auditdb.WithNilAmountPolicy(auditdb.ZeroNilAmount))
+	qe = db.NewQueryExecutor()
+	defer qe.Done()
+	it, err = qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), tx.Amount.Int64())
+	it.Close()
+	holdings, err := qe.NewHoldingsFilter().ByEnrollmentId("alice").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), holdings.Sum().ToBigInt().Int64())
+}
+
+func TestTotalValue(t *testing.T) {
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "alice", "USD", 20), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "alice", "GBP", 30), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx4", "bob", "USD", 100), ""))
+	// the transactions in quarantine are not counted
+	assert.NoError(t, db.AppendRecord(issueRecord("tx5", "alice", "EUR", 1000), ""))
+	assert.NoError(t, db.Quarantine("tx5", "suspicious"))
+	rates := map[string]*big.Rat{
+		"USD": big.NewRat(9, 10),
+	}
+
+	// EUR is the reference unit, GBP has no rate
+	qe := db.NewQueryExecutor()
+	_, err := qe.TotalValue("alice", rates, "EUR")
+	assert.EqualError(t, err, "no rate for token type [GBP] into [EUR]")
+	qe.Done()
+
+	db = auditdb.NewAuditDB(p, auditdb.WithMissingRatePolicy(auditdb.SkipMissingRate))
+	qe = db.NewQueryExecutor()
+	defer qe.Done()
+	total, err := qe.TotalValue("alice", rates, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, big.NewRat(28, 1).Cmp(total))
+
+	rates["GBP"] = big.NewRat(23, 20)
+	total, err = qe.TotalValue("alice", rates, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, big.NewRat(125, 2).Cmp(total))
+}
+
+// failingSyncDB is a memory driver whose Sync always fails
+type failingSyncDB struct {
+	*memory.Persistence
+}
+
+func (f *failingSyncDB) Sync() error {
+	return errors.New("disk full")
+}
+
+// blockingDB blocks BeginUpdate until released, signaling each call on entered
+type blockingDB struct {
+	*memory.Persistence
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingDB) BeginUpdate() error {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.Persistence.BeginUpdate()
+}
+
+func TestMaxConcurrentAppends(t *testing.T) {
+	entered := make(chan struct{}, 3)
+	release := make(chan struct{})
+	m := auditdb.NewManager(nil, "memory", auditdb.WithMaxConcurrentAppends(2))
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		db := m.NewAuditDB(&blockingDB{Persistence: &memory.Persistence{}, entered: entered, release: release})
+		go func(i int) {
+			errs <- db.AppendRecord(issueRecord("tx"+strconv.Itoa(i), "alice", "EUR", 10), "")
+		}(i)
+	}
+
+	// two appends are in flight, the third one waits
+	<-entered
+	<-entered
+	select {
+	case <-entered:
+		t.Fatal("the third append should wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// releasing one append lets the third one in
+	release <- struct{}{}
+	assert.NoError(t, <-errs)
+	<-entered
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+}
+
+func TestRunRetention(t *testing.T) {
+	now := time.Now()
+	seed := func() *memory.Persistence {
+		p := &memory.Persistence{}
+		for i, record := range []*driver.TransactionRecord{
+			{TxID: "old-confirmed", Timestamp: now.Add(-48 * time.Hour), Status: driver.Confirmed},
+			{TxID: "old-deleted", Timestamp: now.Add(-48 * time.Hour), Status: driver.Deleted},
+			{TxID: "old-pending", Timestamp: now.Add(-48 * time.Hour), Status: driver.Pending},
+			{TxID: "mid-confirmed", Timestamp: now.Add(-12 * time.Hour), Status: driver.Confirmed},
+			{TxID: "new-confirmed", Timestamp: now.Add(-time.Hour), Status: driver.Confirmed},
+		} {
+			record.TransactionType = driver.Issue
+			record.RecipientEID = "alice"
+			record.TokenType = "EUR"
+			record.Amount = big.NewInt(int64(i + 1))
+			assert.NoError(t, p.AddTransaction(record))
+			assert.NoError(t, p.AddMovement(&driver.MovementRecord{TxID: record.TxID, EnrollmentID: "alice", TokenType: "EUR", Amount: record.Amount, Status: record.Status}))
+		}
+		return p
+	}
+
+	m := auditdb.NewManager(nil, "memory", auditdb.WithRetention(auditdb.RetentionByWallet(map[string]time.Duration{
+		"daily":  24 * time.Hour,
+		"hourly": 2 * time.Hour,
+	})))
+	daily := m.AddAuditDB("daily", seed())
+	hourly := m.AddAuditDB("hourly", seed())
+	forever := m.AddAuditDB("forever", seed())
+
+	results, err := m.RunRetention(context.Background())
+	assert.NoError(t, err)
+	// daily: old-confirmed, old-deleted and the movement of old-deleted
+	// hourly: in addition, mid-confirmed
+	assert.Len(t, results, 2)
+	assert.Equal(t, 3, results["daily"].Removed)
+	assert.Equal(t, 4, results["hourly"].Removed)
+
+	remaining := func(db *auditdb.AuditDB) []string {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil)
+		assert.NoError(t, err)
+		return txIDs(t, it)
+	}
+	assert.Equal(t, []string{"old-pending", "mid-confirmed", "new-confirmed"}, remaining(daily))
+	assert.Equal(t, []string{"old-pending", "new-confirmed"}, remaining(hourly))
+	assert.Len(t, remaining(forever), 5)
+
+	// holdings are not affected
+	qe := hourly.NewQueryExecutor()
+	filter, err := qe.NewHoldingsFilter().ByEnrollmentId("alice").ByType("EUR").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1+3+4+5), filter.Sum().ToBigInt().Uint64())
+	qe.Done()
+
+	// a done context stops the run
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = m.RunRetention(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+// pruneDB replaces the prune of an in-memory audit db with the passed function
+type pruneDB struct {
+	*memory.Persistence
+	prune func() (int, error)
+}
+
+func (p *pruneDB) Prune(before time.Time) (int, error) {
+	return p.prune()
+}
+
+func TestRunRetentionFailures(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	m := auditdb.NewManager(nil, "memory",
+		auditdb.WithRetention(func(string) (time.Duration, bool) { return time.Hour, true }),
+		auditdb.WithRetentionWorkers(2),
+		auditdb.WithRetentionTimeout(50*time.Millisecond),
+	)
+	m.AddAuditDB("alice", &pruneDB{Persistence: &memory.Persistence{}, prune: func() (int, error) { return 3, nil }})
+	m.AddAuditDB("bob", &pruneDB{Persistence: &memory.Persistence{}, prune: func() (int, error) { return 0, errors.New("disk full") }})
+	var carolPrunes int32
+	m.AddAuditDB("carol", &pruneDB{Persistence: &memory.Persistence{}, prune: func() (int, error) {
+		atomic.AddInt32(&carolPrunes, 1)
+		<-release
+		return 0, nil
+	}})
+	m.AddAuditDB("dave", &pruneDB{Persistence: &memory.Persistence{}, prune: func() (int, error) { return 5, nil }})
+
+	results, err := m.RunRetention(context.Background())
+	assert.EqualError(t, err, "failed running retention for wallets [bob, carol]")
+	assert.Len(t, results, 4)
+	assert.NoError(t, results["alice"].Err)
+	assert.Equal(t, 3, results["alice"].Removed)
+	assert.NoError(t, results["dave"].Err)
+	assert.Equal(t, 5, results["dave"].Removed)
+	assert.Equal(t, "disk full", errors.Cause(results["bob"].Err).Error())
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(results["carol"].Err))
+	assert.True(t, results["carol"].Duration >= 50*time.Millisecond)
+
+	// the next run waits for the prune still running instead of starting another one
+	results, err = m.RunRetention(context.Background())
+	assert.EqualError(t, err, "failed running retention for wallets [bob, carol]")
+	assert.EqualError(t, results["carol"].Err, "previous prune still running: context deadline exceeded")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&carolPrunes))
+
+	// once it completes, the audit db is pruned again
+	release <- struct{}{}
+	results, err = m.RunRetention(context.Background())
+	assert.EqualError(t, err, "failed running retention for wallets [bob, carol]")
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(results["carol"].Err))
+	assert.Equal(t, "prune did not complete: context deadline exceeded", results["carol"].Err.Error())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&carolPrunes))
+}
+
+func TestDeleteTransactionsBefore(t *testing.T) {
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "carol", "EUR", 30), ""))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Deleted))
+	before := time.Now().Add(time.Hour)
+
+	// the dry run counts the records of tx1 and tx2, the pending tx3 is kept
+	count, err := db.CountTransactionsBefore(before)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = db.CountTransactionsBefore(before)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	removed, err := db.DeleteTransactionsBefore(before)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tx3"}, txIDs(t, it))
+	it.Close()
+	qe.Done()
+	movements, err := p.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 1)
+	assert.Equal(t, "tx3", movements[0].TxID)
+
+	// nothing left to delete
+	removed, err = db.DeleteTransactionsBefore(before)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestStatusTransitions(t *testing.T) {
+	assert.True(t, auditdb.CanTransition(auditdb.Pending, auditdb.Confirmed))
+	assert.True(t, auditdb.CanTransition(auditdb.Pending, auditdb.Deleted))
+	assert.True(t, auditdb.CanTransition(auditdb.Confirmed, auditdb.Confirmed))
+	assert.False(t, auditdb.CanTransition(auditdb.Confirmed, auditdb.Pending))
+	assert.False(t, auditdb.CanTransition(auditdb.Deleted, auditdb.Confirmed))
+	assert.False(t, auditdb.CanTransition("", ""))
+	assert.Equal(t, []auditdb.TxStatus{auditdb.Confirmed, auditdb.Deleted}, auditdb.StatusTransitions(auditdb.Pending))
+	assert.Empty(t, auditdb.StatusTransitions(auditdb.Confirmed))
+
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+
+	// illegal transitions are rejected
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	err := db.SetStatus("tx1", auditdb.Pending)
+	assert.EqualError(t, err, "illegal status transition for tx [tx1] from [Confirmed] to [Pending]")
+	assert.IsType(t, &auditdb.IllegalTransitionError{}, err)
+	// unknown transactions are left alone
+	assert.NoError(t, db.SetStatus("unknown", auditdb.Confirmed))
+
+	// compare and swap
+	err = db.SetStatusIf("tx2", auditdb.Confirmed, auditdb.Deleted)
+	assert.EqualError(t, err, "status of tx [tx2] is [Pending], expected [Confirmed]")
+	assert.Equal(t, &auditdb.StatusMismatchError{TxID: "tx2", Expected: auditdb.Confirmed, Actual: auditdb.Pending}, err)
+	assert.NoError(t, db.SetStatusIf("tx2", auditdb.Pending, auditdb.Deleted))
+	err = db.SetStatusIf("tx2", auditdb.Pending, auditdb.Confirmed)
+	assert.IsType(t, &auditdb.StatusMismatchError{}, err)
+	err = db.SetStatusIf("tx2", auditdb.Deleted, auditdb.Confirmed)
+	assert.IsType(t, &auditdb.IllegalTransitionError{}, err)
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	for _, expected := range []auditdb.TxStatus{auditdb.Confirmed, auditdb.Deleted} {
+		tr, err := it.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, tr.Status)
+	}
+}
+
+func TestSubscribeStatus(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+
+	tx1, cancelTx1 := db.SubscribeStatus("tx1")
+	all, cancelAll := db.SubscribeAllStatuses()
+
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	// setting the same status again is not a change
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Deleted))
+	assert.NoError(t, db.Reorg([]string{"tx1"}))
+
+	assert.Equal(t, auditdb.Confirmed, <-tx1)
+	assert.Equal(t, auditdb.Pending, <-tx1)
+	assert.Len(t, tx1, 0)
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx1", Status: auditdb.Confirmed}, <-all)
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx2", Status: auditdb.Deleted}, <-all)
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx1", Status: auditdb.Pending}, <-all)
+	assert.Len(t, all, 0)
+
+	// cancelling closes the channels, and can be done twice
+	cancelTx1()
+	cancelTx1()
+	cancelAll()
+	_, ok := <-tx1
+	assert.False(t, ok)
+	_, ok = <-all
+	assert.False(t, ok)
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+}
+
+func TestDuplicateAppendPolicy(t *testing.T) {
+	countRecords := func(p *memory.Persistence) (int, int) {
+		movements, err := p.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+		assert.NoError(t, err)
+		it, err := p.QueryTransactions(driver.QueryTransactionsParams{})
+		assert.NoError(t, err)
+		defer it.Close()
+		transactions := 0
+		for {
+			tr, err := it.Next()
+			assert.NoError(t, err)
+			if tr == nil {
+				break
+			}
+			transactions++
+		}
+		return len(movements), transactions
+	}
+
+	// by default, the records are appended again
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	movements, transactions := countRecords(p)
+	assert.Equal(t, 2, movements)
+	assert.Equal(t, 2, transactions)
+
+	p = &memory.Persistence{}
+	db = auditdb.NewAuditDB(p, auditdb.WithDuplicateAppendPolicy(auditdb.FailOnDuplicateAppend))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	err := db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), "")
+	assert.EqualError(t, err, "txid 'tx1': transaction already appended")
+	assert.Equal(t, auditdb.ErrDuplicateAppend, errors.Cause(err))
+	movements, transactions = countRecords(p)
+	assert.Equal(t, 1, movements)
+	assert.Equal(t, 1, transactions)
+
+	p = &memory.Persistence{}
+	db = auditdb.NewAuditDB(p, auditdb.WithDuplicateAppendPolicy(auditdb.SkipDuplicateAppend))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	movements, transactions = countRecords(p)
+	assert.Equal(t, 1, movements)
+	assert.Equal(t, 1, transactions)
+
+	// the replaced records keep the status of the transaction
+	p = &memory.Persistence{}
+	db = auditdb.NewAuditDB(p, auditdb.WithDuplicateAppendPolicy(auditdb.ReplaceDuplicateAppend))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 15), "INV-001"))
+	movements, transactions = countRecords(p)
+	assert.Equal(t, 1, movements)
+	assert.Equal(t, 1, transactions)
+	it, err := p.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	tr, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), tr.Amount.Int64())
+	assert.Equal(t, "INV-001", tr.Reference)
+	assert.Equal(t, driver.Confirmed, tr.Status)
+	it.Close()
+}
+
+func TestDuplicateAppendPolicyWithManager(t *testing.T) {
+	open := func(key string, policy auditdb.DuplicateAppendPolicy) *auditdb.AuditDB {
+		db, err := auditdb.NewManager(nil, "memory",
+			auditdb.WithWalletKeyFunc(func(*token.AuditorWallet) string { return key }),
+			auditdb.WithDuplicateAppendPolicy(policy),
+		).AuditDB(nil)
+		assert.NoError(t, err)
+		return db
+	}
+	amounts := func(db *auditdb.AuditDB) []int64 {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil, auditdb.WithStatus(auditdb.Pending, auditdb.Confirmed))
+		assert.NoError(t, err)
+		defer it.Close()
+		var amounts []int64
+		for {
+			tr, err := it.Next()
+			assert.NoError(t, err)
+			if tr == nil {
+				break
+			}
+			amounts = append(amounts, tr.Amount.Int64())
+		}
+		return amounts
+	}
+
+	// the unique constraints reject the records appended again
+	db := open("duplicates-append", auditdb.AppendDuplicates)
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	err := db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)})
+	assert.Error(t, err)
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+	assert.Equal(t, []int64{10}, amounts(db))
+
+	db = open("duplicates-fail", auditdb.FailOnDuplicateAppend)
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	err = db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)})
+	assert.Equal(t, auditdb.ErrDuplicateAppend, errors.Cause(err))
+	assert.Equal(t, []int64{10}, amounts(db))
+
+	db = open("duplicates-skip", auditdb.SkipDuplicateAppend)
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	assert.Equal(t, []int64{10}, amounts(db))
+
+	db = open("duplicates-replace", auditdb.ReplaceDuplicateAppend)
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 15)}))
+	assert.Equal(t, []int64{15}, amounts(db))
+}
+
+func TestSupplyMovements(t *testing.T) {
+	records := []*token.AuditRecord{
+		issueRecord("issue1", "alice", "EUR", 100),
+		issueRecord("issue2", "bob", "EUR", 50),
+		issueRecord("issue3", "alice", "USD", 20),
+		{
+			// alice sends 30 EUR to bob
+			Anchor: "transfer",
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(100)},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(30)},
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(70)},
+			}, 64),
+		},
+		{
+			// bob redeems 40 EUR, getting 10 EUR back as change
+			Anchor: "redeem",
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(50)},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Type: "EUR", Quantity: token2.NewQuantityFromUInt64(40)},
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			}, 64),
+		},
+	}
+	supply := func(db *auditdb.AuditDB, tokenType string) uint64 {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		filter, err := qe.NewHoldingsFilter().ByEnrollmentId("supply").ByType(tokenType).Execute()
+		assert.NoError(t, err)
+		return filter.Sum().ToBigInt().Uint64()
+	}
+
+	db := auditdb.NewAuditDB(&memory.Persistence{}, auditdb.WithSupplyMovements("supply"))
+	for _, record := range records {
+		assert.NoError(t, db.AppendRecord(record, ""))
+	}
+	assert.Equal(t, uint64(100+50-40), supply(db, "EUR"))
+	assert.Equal(t, uint64(20), supply(db, "USD"))
+	// supply movements do not take part in the recomputation of the transaction records
+	withSupply, err := db.RecomputeTransactions("redeem")
+	assert.NoError(t, err)
+
+	// off by default
+	db = auditdb.NewAuditDB(&memory.Persistence{})
+	for _, record := range records {
+		assert.NoError(t, db.AppendRecord(record, ""))
+	}
+	assert.Equal(t, uint64(0), supply(db, "EUR"))
+	withoutSupply, err := db.RecomputeTransactions("redeem")
+	assert.NoError(t, err)
+	assert.Equal(t, withoutSupply, withSupply)
+}
+
+// slowStatusDB holds SetStatus for the passed delay, signaling each call on entered
+type slowStatusDB struct {
+	*memory.Persistence
+	delay   time.Duration
+	entered chan struct{}
+}
+
+func (s *slowStatusDB) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	s.entered <- struct{}{}
+	time.Sleep(s.delay)
+	return s.Persistence.SetStatus(txID, status, reason)
+}
+
+// lockMetrics records the lock observations per operation
+type lockMetrics struct {
+	lock  sync.Mutex
+	waits map[string]int
+	holds map[string]int
+}
+
+func (m *lockMetrics) ObserveLockWait(operation string, _ time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.waits[operation]++
+}
+
+func (m *lockMetrics) ObserveLockHold(operation string, _ time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.holds[operation]++
+}
+
+func TestLockStats(t *testing.T) {
+	delay := 50 * time.Millisecond
+	p := &slowStatusDB{Persistence: &memory.Persistence{}, delay: delay, entered: make(chan struct{}, 2)}
+	metrics := &lockMetrics{waits: map[string]int{}, holds: map[string]int{}}
+	db := auditdb.NewAuditDB(p, auditdb.WithLockMetrics(metrics))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- db.SetStatus("tx1", auditdb.Confirmed)
+	}()
+	// the first call holds the lock while the second one waits for it
+	<-p.entered
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Confirmed))
+	assert.NoError(t, <-errs)
+
+	stats := db.LockStats()
+	assert.Equal(t, int64(2), stats.Acquisitions)
+	assert.True(t, stats.MaxHold >= delay, "max hold [%s]", stats.MaxHold)
+	assert.True(t, stats.TotalHold >= 2*delay, "total hold [%s]", stats.TotalHold)
+	assert.True(t, stats.MaxWait >= delay/2, "max wait [%s]", stats.MaxWait)
+	assert.True(t, stats.MaxWait <= stats.TotalWait)
+	assert.Equal(t, map[string]int{"SetStatus": 2}, metrics.waits)
+	assert.Equal(t, map[string]int{"SetStatus": 2}, metrics.holds)
+}
+
+func TestInMemoryDriver(t *testing.T) {
+	auditdb.ResetInMemory()
+	defer auditdb.ResetInMemory()
+
+	count := func(db *auditdb.AuditDB) int {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil)
+		assert.NoError(t, err)
+		return len(txIDs(t, it))
+	}
+
+	// the alias opens the same audit dbs
+	db, err := auditdb.NewManager(nil, auditdb.InMemoryDriver).AuditDBByKey("alice")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	alias, err := auditdb.NewManager(nil, auditdb.InMemoryDriverAlias).AuditDBByKey("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count(alias))
+
+	// after the reset, the namespace is empty
+	auditdb.ResetInMemory()
+	fresh, err := auditdb.NewManager(nil, auditdb.InMemoryDriver).AuditDBByKey("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count(fresh))
+}
+
+func TestNewInMemoryForTest(t *testing.T) {
+	db1, cleanup1 := auditdb.NewInMemoryForTest()
+	defer cleanup1()
+	db2, cleanup2 := auditdb.NewInMemoryForTest()
+	defer cleanup2()
+
+	assert.NoError(t, db1.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	count := func(db *auditdb.AuditDB) int {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil)
+		assert.NoError(t, err)
+		return len(txIDs(t, it))
+	}
+	assert.Equal(t, 1, count(db1))
+	assert.Equal(t, 0, count(db2))
+
+	// the in-memory driver is registered again if replaced
+	auditdb.RegisterOrReplace(auditdb.InMemoryDriver, namespaces)
+	opened := len(namespaces.namespaces)
+	db3, cleanup3 := auditdb.NewInMemoryForTest()
+	defer cleanup3()
+	assert.Equal(t, 0, count(db3))
+	assert.Len(t, namespaces.namespaces, opened)
+	assert.Contains(t, auditdb.Drivers(), auditdb.InMemoryDriver)
+}
+
+func TestMultiTypeActions(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	// alice sends 10 EUR and 5 USD to bob in a single action
+	assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+		Anchor: "multi",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+	}, ""))
+	// alice swaps 10 EUR for 5 USD of bob, in two actions
+	assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+		Anchor: "two-actions",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{ActionIndex: 1, Owner: []byte("bob"), EnrollmentID: "bob", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{ActionIndex: 1, Owner: []byte("alice"), EnrollmentID: "alice", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+	}, ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("issue", "alice", "EUR", 10), ""))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	txIDs, err := qe.MultiTypeActions(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"multi"}, txIDs)
+}
+
+func TestMovementSummary(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("issue", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.SetStatus("issue", auditdb.Confirmed))
+	time.Sleep(time.Millisecond)
+	mid := time.Now()
+	// alice pays 4 EUR to bob and takes 6 EUR back as change, her movement is the net amount sent
+	assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+		Anchor: "payment",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(4)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(6)},
+		}, 64),
+	}, ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("pending", "carol", "USD", 5), ""))
+	assert.NoError(t, db.SetStatus("payment", auditdb.Confirmed))
+
+	row := func(eID, tokenType string, received, sent, net int64) auditdb.MovementSummaryRow {
+		return auditdb.MovementSummaryRow{
+			EnrollmentID: eID,
+			TokenType:    tokenType,
+			Received:     big.NewInt(received),
+			Sent:         big.NewInt(sent),
+			Net:          big.NewInt(net),
+		}
+	}
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+
+	// confirmed only, by default
+	rows, err := qe.MovementSummary(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []auditdb.MovementSummaryRow{
+		row("alice", "EUR", 10, 4, 6),
+		row("bob", "EUR", 4, 0, 4),
+	}, rows)
+
+	// time window
+	rows, err = qe.MovementSummary(&mid, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []auditdb.MovementSummaryRow{
+		row("alice", "EUR", 0, 4, -4),
+		row("bob", "EUR", 4, 0, 4),
+	}, rows)
+
+	// status filter
+	rows, err = qe.MovementSummary(nil, nil, auditdb.Pending)
+	assert.NoError(t, err)
+	assert.Equal(t, []auditdb.MovementSummaryRow{row("carol", "USD", 5, 0, 5)}, rows)
+}
+
+func TestMultipleSenders(t *testing.T) {
+	// alice and bob join their EUR to pay carol and dave in a single action
+	record := &token.AuditRecord{
+		Anchor: "coin-join",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(30)},
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("carol"), EnrollmentID: "carol", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(20)},
+			{Owner: []byte("dave"), EnrollmentID: "dave", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(20)},
+		}, 64),
+	}
+
+	// the dbs opened by the manager enforce the unique constraints, that must tell the senders apart
+	walletKey := func(key string) auditdb.Option {
+		return auditdb.WithWalletKeyFunc(func(*token.AuditorWallet) string { return key })
+	}
+	db, err := auditdb.NewManager(nil, "memory", walletKey("coin-join-reject")).AuditDB(nil)
+	assert.NoError(t, err)
+	err = db.Append(&recordProvider{record: record})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected at most 1 input enrollment id, got 2")
+
+	db, err = auditdb.NewManager(nil, "memory",
+		walletKey("coin-join-split"),
+		auditdb.WithMultipleSendersPolicy(auditdb.SplitByInputAmount),
+	).AuditDB(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Append(&recordProvider{record: record}))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	amounts := map[string]int64{}
+	for {
+		tr, err := it.Next()
+		assert.NoError(t, err)
+		if tr == nil {
+			break
+		}
+		assert.Equal(t, auditdb.Transfer, tr.TransactionType)
+		amounts[tr.SenderEID+"->"+tr.RecipientEID] = tr.Amount.Int64()
+	}
+	assert.Equal(t, map[string]int64{
+		"alice->carol": 15,
+		"bob->carol":   5,
+		"alice->dave":  15,
+		"bob->dave":    5,
+	}, amounts)
+}
+
+// batchCountingDB counts the calls the audit db makes to add records
+type batchCountingDB struct {
+	*memory.Persistence
+	single, batches int
+}
+
+func (db *batchCountingDB) AddMovement(record *driver.MovementRecord) error {
+	db.single++
+	return db.Persistence.AddMovement(record)
+}
+
+func (db *batchCountingDB) AddTransaction(record *driver.TransactionRecord) error {
+	db.single++
+	return db.Persistence.AddTransaction(record)
+}
+
+func (db *batchCountingDB) AddMovements(records []*driver.MovementRecord) error {
+	db.batches++
+	return db.Persistence.AddMovements(records)
+}
+
+func (db *batchCountingDB) AddTransactions(records []*driver.TransactionRecord) error {
+	db.batches++
+	return db.Persistence.AddTransactions(records)
+}
+
+func TestAppendBatches(t *testing.T) {
+	record := &token.AuditRecord{
+		Anchor: "tx1",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(30)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("carol"), EnrollmentID: "carol", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("dave"), EnrollmentID: "dave", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+	}
+	p := &batchCountingDB{Persistence: &memory.Persistence{}}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(record, ""))
+
+	// one batch of movements and one of transactions, no single-row insert
+	assert.Equal(t, 2, p.batches)
+	assert.Equal(t, 0, p.single)
+	movements, err := p.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 4)
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	assert.Equal(t, []string{"tx1", "tx1", "tx1"}, txIDs(t, it))
+}
+
+func TestRecomputeTransactions(t *testing.T) {
+	// alice sends 6 EUR to bob, 1 EUR to charlie, and redeems 2 EUR, getting 1 EUR back as change
+	record := &token.AuditRecord{
+		Anchor: "tx1",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(6)},
+			{Owner: []byte("charlie"), EnrollmentID: "charlie", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(1)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(1)},
+			{Type: "EUR", Quantity: token2.NewQuantityFromUInt64(2)},
+		}, 64),
+	}
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(record, ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "dave", "USD", 5), ""))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+
+	// the transaction rows of tx1 get lost, its movements remain
+	deleted, err := p.DeleteTransactions("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, deleted)
+
+	written, err := db.RecomputeTransactions("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, written)
+
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	var res []string
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			break
+		}
+		res = append(res, fmt.Sprintf("%s:%d:%s>%s:%s:%s", tx.TxID, tx.TransactionType, tx.SenderEID, tx.RecipientEID, tx.Amount, tx.Status))
+	}
+	it.Close()
+	qe.Done()
+	assert.Equal(t, []string{
+		"tx2:0:>dave:5:Pending",
+		"tx1:1:alice>bob:6:Confirmed",
+		"tx1:1:alice>charlie:1:Confirmed",
+		"tx1:2:alice>:2:Confirmed",
+	}, res)
+
+	_, err = db.RecomputeTransactions("tx3")
+	assert.EqualError(t, err, "no movements found for txid 'tx3'")
+
+	// movements do not tell the actions of a transaction moving more than one token type
+	record = &token.AuditRecord{
+		Anchor: "tx4",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+	}
+	assert.NoError(t, db.AppendRecord(record, ""))
+	_, err = db.RecomputeTransactions("tx4")
+	assert.EqualError(t, err, "cannot attribute movements to actions for txid 'tx4', found [2] token types")
+}
+
+func TestFormatAmount(t *testing.T) {
+	// plain decimals by default
+	s, err := auditdb.FormatAmount(big.NewInt(1000), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "1000", s)
+	s, err = auditdb.FormatAmount(nil, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "", s)
+
+	// fixed width, lexicographic order matches numeric order
+	small, err := auditdb.FormatAmount(big.NewInt(900), 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "000900", small)
+	large, err := auditdb.FormatAmount(big.NewInt(1000), 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "001000", large)
+	assert.True(t, small < large)
+
+	// overflow
+	_, err = auditdb.FormatAmount(big.NewInt(1000), 3)
+	assert.EqualError(t, err, "amount [1000] exceeds the width of [3] digits")
+	_, err = auditdb.FormatAmount(big.NewInt(-1), 3)
+	assert.EqualError(t, err, "negative amount [-1] cannot be padded")
+}
+
+func TestExportTransactions(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 900), "INV-1"))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 1000), ""))
+
+	export := func(opts ...auditdb.ExportOption) ([][]string, error) {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		var buf bytes.Buffer
+		if err := qe.ExportTransactions(&buf, auditdb.CSVFormat, nil, nil, opts...); err != nil {
+			return nil, err
+		}
+		rows, err := csv.NewReader(&buf).ReadAll()
+		assert.NoError(t, err)
+		assert.Len(t, rows, 3)
+		assert.Equal(t, auditdb.ExportHeader, rows[0])
+		return rows[1:], nil
+	}
+
+	// plain decimals
+	rows, err := export()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tx1", "0", "Issue", "", "alice", "EUR", "900"}, rows[0][:7])
+	assert.Equal(t, "INV-1", rows[0][9])
+	assert.Equal(t, "1000", rows[1][6])
+
+	// fixed width
+	rows, err = export(auditdb.WithFixedWidthAmount(6))
+	assert.NoError(t, err)
+	assert.Equal(t, "000900", rows[0][6])
+	assert.Equal(t, "001000", rows[1][6])
+
+	// overflow
+	_, err = export(auditdb.WithFixedWidthAmount(3))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "amount [1000] exceeds the width of [3] digits")
+
+	// unknown format
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	err = qe.ExportTransactions(&bytes.Buffer{}, auditdb.ExportFormat(42), nil, nil)
+	assert.EqualError(t, err, "unknown export format [42]")
+}
+
+// closeTrackingDB records whether the transaction iterators it returns are closed
+type closeTrackingDB struct {
+	*memory.Persistence
+	closed bool
+}
+
+func (db *closeTrackingDB) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	it, err := db.Persistence.QueryTransactions(params)
+	if err != nil {
+		return nil, err
+	}
+	return &closeTrackingIterator{TransactionIterator: it, db: db}, nil
+}
+
+type closeTrackingIterator struct {
+	driver.TransactionIterator
+	db *closeTrackingDB
+}
+
+func (it *closeTrackingIterator) Close() {
+	it.db.closed = true
+	it.TransactionIterator.Close()
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestExportTransactionsJSONLines(t *testing.T) {
+	p := &closeTrackingDB{Persistence: &memory.Persistence{}}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 900), "INV-1"))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 1000), ""))
+	assert.NoError(t, db.SetStatusWithReason("tx2", auditdb.Deleted, "mvcc conflict"))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	var buf bytes.Buffer
+	assert.NoError(t, qe.ExportTransactions(&buf, auditdb.JSONLinesFormat, nil, nil))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], `{"TxID":"tx1","ActionIndex":"0","TransactionType":"Issue"`))
+	row := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+	assert.Len(t, row, len(auditdb.ExportHeader))
+	assert.Equal(t, "1000", row["Amount"])
+	assert.Equal(t, "Deleted", row["Status"])
+	assert.Equal(t, "mvcc conflict", row["FailureReason"])
+	assert.True(t, p.closed)
+
+	// the iterator is closed on write errors too
+	for _, format := range []auditdb.ExportFormat{auditdb.CSVFormat, auditdb.JSONLinesFormat} {
+		p.closed = false
+		err := qe.ExportTransactions(failingWriter{}, format, nil, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "disk full")
+		assert.True(t, p.closed)
+	}
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	p := &memory.Persistence{}
+	assert.NoError(t, p.EnsureUniqueConstraints())
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	err := db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), "")
+	assert.Error(t, err)
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	duplicates, err := qe.FindDuplicates(nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, duplicates)
+}
+
+// namespaceDriver opens a new in-memory audit db for each call, recording the namespaces it is asked for
+type namespaceDriver struct {
+	namespaces []string
+}
+
+func (d *namespaceDriver) Open(_ view.ServiceProvider, name string) (driver.AuditDB, error) {
+	d.namespaces = append(d.namespaces, name)
+	return &memory.Persistence{}, nil
+}
+
+var namespaces = &namespaceDriver{}
+
+func init() {
+	auditdb.Register("namespaces", namespaces)
+}
+
+func TestWalletKeyNamespaces(t *testing.T) {
+	d := namespaces
+	d.namespaces = nil
+
+	m := auditdb.NewManager(nil, "namespaces")
+	alice, err := m.AuditDBByKey("alice")
+	assert.NoError(t, err)
+	bob, err := m.AuditDBByKey("bob")
+	assert.NoError(t, err)
+	again, err := m.AuditDBByKey("alice")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"alice", "bob"}, d.namespaces)
+	assert.True(t, alice == again)
+	assert.False(t, alice == bob)
+}
+
+func TestTransactionTypeFilter(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("issue", "alice", "EUR", 30), ""))
+	start := time.Now()
+	for _, txID := range []string{"redeem1", "redeem2"} {
+		assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+			Anchor: txID,
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(5)},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Type: "EUR", Quantity: token2.NewQuantityFromUInt64(5)},
+			}, 64),
+		}, ""))
+	}
+	assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+		Anchor: "transfer",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+		}, 64),
+	}, ""))
+	assert.NoError(t, db.SetStatus("redeem1", auditdb.Confirmed))
+
+	query := func(from *time.Time, opts ...auditdb.QueryOption) []string {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(from, nil, opts...)
+		assert.NoError(t, err)
+		defer it.Close()
+		var txIDs []string
+		for {
+			record, err := it.Next()
+			assert.NoError(t, err)
+			if record == nil {
+				return txIDs
+			}
+			txIDs = append(txIDs, record.TxID)
+		}
+	}
+	assert.Equal(t, []string{"redeem1", "redeem2"}, query(nil, auditdb.WithTransactionType(auditdb.Redeem)))
+	assert.Equal(t, []string{"issue", "transfer"}, query(nil, auditdb.WithTransactionType(auditdb.Issue, auditdb.Transfer)))
+	assert.Equal(t, []string{"redeem2", "transfer"}, query(&start, auditdb.WithTransactionType(auditdb.Redeem, auditdb.Transfer), auditdb.WithStatus(auditdb.Pending)))
+}
+
+func TestPaymentsByType(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	for i, tokenType := range []string{"EUR", "USD", "CHF"} {
+		txID := fmt.Sprintf("tx%d", i)
+		assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+			Anchor: txID,
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: tokenType, Quantity: token2.NewQuantityFromUInt64(uint64(10 * (i + 1)))},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: tokenType, Quantity: token2.NewQuantityFromUInt64(uint64(10 * (i + 1)))},
+			}, 64),
+		}, ""))
+	}
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	payments, err := qe.NewPaymentsFilter().ByEnrollmentId("alice").ByType("USD").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20), payments.Sum().ToBigInt().Uint64())
+	payments, err = qe.NewPaymentsFilter().ByEnrollmentId("alice").ByType("EUR").ByType("CHF").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(40), payments.Sum().ToBigInt().Uint64())
+	payments, err = qe.NewPaymentsFilter().ByEnrollmentId("bob").ByType("USD").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), payments.Sum().ToBigInt().Uint64())
+}
+
+func TestHoldingsBalance(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "alice", "USD", 5), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "bob", "EUR", 3), ""))
+	assert.NoError(t, db.AppendRecord(&token.AuditRecord{
+		Anchor: "tx4",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(4)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(4)},
+		}, 64),
+	}, ""))
+	for _, txID := range []string{"tx1", "tx3", "tx4"} {
+		assert.NoError(t, db.SetStatus(txID, auditdb.Confirmed))
+	}
+
+	balance := func(f func(*auditdb.HoldingsFilter) *auditdb.HoldingsFilter) map[string]*big.Int {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		res, err := f(qe.NewHoldingsFilter()).Balance()
+		assert.NoError(t, err)
+		return res
+	}
+	alice := func(f *auditdb.HoldingsFilter) *auditdb.HoldingsFilter { return f.ByEnrollmentId("alice") }
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(6)}, balance(alice))
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(6), "USD": big.NewInt(5)}, balance(func(f *auditdb.HoldingsFilter) *auditdb.HoldingsFilter {
+		return alice(f).WithPending()
+	}))
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(7)}, balance(func(f *auditdb.HoldingsFilter) *auditdb.HoldingsFilter {
+		return f.ByEnrollmentId("bob").ByType("EUR")
+	}))
+
+	assert.NoError(t, db.Quarantine("tx3", "suspicious"))
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(4)}, balance(func(f *auditdb.HoldingsFilter) *auditdb.HoldingsFilter {
+		return f.ByEnrollmentId("bob").Available()
+	}))
+}
+
+func TestAcquireLocksWithContext(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AcquireLocks("bob"))
+
+	// alice is acquired, then the wait for bob expires and alice is released
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.AcquireLocksWithContext(ctx, "alice", "bob", "alice")
+	assert.EqualError(t, err, "failed acquiring lock for enrollment id [bob]: context deadline exceeded")
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, db.AcquireLocksWithContext(ctx, "alice"))
+	db.Unlock("alice")
+
+	// once bob is released, the lock given up is released as well
+	db.Unlock("bob")
+	assert.NoError(t, db.AcquireLocksWithContext(ctx, "alice", "bob"))
+	db.Unlock("alice", "bob")
+}
+
+func TestContextCancellation(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+
+	// a query executor holds the store lock for reading, appends wait until the context expires
+	qe := db.NewQueryExecutor()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.AppendContext(ctx, &recordProvider{record: issueRecord("tx2", "alice", "EUR", 20)})
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	err = db.SetStatusContext(ctx, "tx1", auditdb.Confirmed, "")
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	qe.Done()
+
+	// the lock is not left behind by the cancelled operations
+	assert.NoError(t, db.AppendContext(context.Background(), &recordProvider{record: issueRecord("tx2", "alice", "EUR", 20)}))
+	assert.NoError(t, db.SetStatusContext(context.Background(), "tx1", auditdb.Confirmed, ""))
+
+	// iterators stop when the context of their query executor is done
+	ctx, cancel = context.WithCancel(context.Background())
+	qe, err = db.NewQueryExecutorContext(ctx)
+	assert.NoError(t, err)
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	record, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "tx1", record.TxID)
+	cancel()
+	_, err = it.Next()
+	assert.Error(t, err)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	it.Close()
+	qe.Done()
+
+	_, err = db.NewQueryExecutorContext(ctx)
+	assert.Error(t, err)
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Confirmed))
+}
+
+// remoteDB is an audit db whose operations, once bound to a context that can be done, block until it is,
+// as those of a remote database that does not answer
+type remoteDB struct {
+	*memory.Persistence
+	ctx context.Context
+}
+
+func (db *remoteDB) WithContext(ctx context.Context) driver.AuditDB {
+	return &remoteDB{Persistence: db.Persistence, ctx: ctx}
+}
+
+func (db *remoteDB) block() error {
+	if db.ctx == nil || db.ctx.Done() == nil {
+		return nil
+	}
+	<-db.ctx.Done()
+	return db.ctx.Err()
+}
+
+func (db *remoteDB) AddTransactions(records []*driver.TransactionRecord) error {
+	if err := db.block(); err != nil {
+		return err
+	}
+	return db.Persistence.AddTransactions(records)
+}
+
+func (db *remoteDB) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	if err := db.block(); err != nil {
+		return err
+	}
+	return db.Persistence.SetStatus(txID, status, reason)
+}
+
+func (db *remoteDB) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	if err := db.block(); err != nil {
+		return nil, err
+	}
+	return db.Persistence.QueryTransactions(params)
+}
+
+func (db *remoteDB) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
+	if err := db.block(); err != nil {
+		return nil, err
+	}
+	return db.Persistence.QueryMovements(enrollmentIDs, tokenTypes, txStatuses, searchDirection, movementDirection, numRecords)
+}
+
+func (db *remoteDB) Prune(before time.Time) (int, error) {
+	if err := db.block(); err != nil {
+		return 0, err
+	}
+	return db.Persistence.Prune(before)
+}
+
+func TestContextAuditDB(t *testing.T) {
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(&remoteDB{Persistence: p})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+
+	// the driver operations are bound to the context of the caller, and abort once it is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.AppendContext(ctx, &recordProvider{record: issueRecord("tx2", "alice", "EUR", 20)})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	status, err := p.GetStatus("tx2")
+	assert.NoError(t, err)
+	assert.Empty(t, status)
+
+	err = db.SetStatusContext(ctx, "tx1", auditdb.Confirmed, "")
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	status, err = p.GetStatus("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, status)
+
+	// so are the queries of a query executor bound to a context
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	qe, err := db.NewQueryExecutorContext(ctx)
+	assert.NoError(t, err)
+	defer qe.Done()
+	_, err = qe.Transactions(nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+	_, err = qe.NewHoldingsFilter().ByEnrollmentId("alice").Execute()
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	qe.Done()
+
+	// and so is the prune
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = db.PruneContext(ctx, time.Now().Add(time.Hour))
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestMetrics(t *testing.T) {
+	newHistogram := func() *metricsfakes.Histogram {
+		h := &metricsfakes.Histogram{}
+		h.WithReturns(h)
+		return h
+	}
+	appendDuration, setStatusDuration, queryDuration := newHistogram(), newHistogram(), newHistogram()
+	rowsReturned := &metricsfakes.Counter{}
+	rowsReturned.WithReturns(rowsReturned)
+	lockWait := &metricsfakes.Gauge{}
+	lockWait.WithReturns(lockWait)
+	provider := &metricsfakes.Provider{}
+	provider.NewHistogramReturnsOnCall(0, appendDuration)
+	provider.NewHistogramReturnsOnCall(1, setStatusDuration)
+	provider.NewHistogramReturnsOnCall(2, queryDuration)
+	provider.NewCounterReturns(rowsReturned)
+	provider.NewGaugeReturns(lockWait)
+
+	m := auditdb.NewManager(nil, "namespaces", auditdb.WithMetricsProvider(provider))
+	db := m.AddAuditDB("alice-wallet", &memory.Persistence{})
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx2", "alice", "EUR", 20)}))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, txIDs(t, it), 2)
+	qe.Done()
+
+	assert.Equal(t, 3, provider.NewHistogramCallCount())
+	assert.Equal(t, "append_duration", provider.NewHistogramArgsForCall(0).Name)
+	assert.Equal(t, 2, appendDuration.ObserveCallCount())
+	assert.Equal(t, []string{"wallet", "alice-wallet"}, appendDuration.WithArgsForCall(0))
+	assert.Equal(t, 1, setStatusDuration.ObserveCallCount())
+	assert.Equal(t, 1, queryDuration.ObserveCallCount())
+	assert.Equal(t, []string{"wallet", "alice-wallet", "query", "Transactions"}, queryDuration.WithArgsForCall(0))
+	rows := 0.0
+	for i := 0; i < rowsReturned.AddCallCount(); i++ {
+		rows += rowsReturned.AddArgsForCall(i)
+	}
+	assert.Equal(t, 2.0, rows)
+	assert.Equal(t, 3, lockWait.SetCallCount())
+	assert.Equal(t, []string{"wallet", "alice-wallet", "operation", "SetStatus"}, lockWait.WithArgsForCall(2))
+
+	// no provider, no-op collectors
+	db = auditdb.NewManager(nil, "namespaces").AddAuditDB("bob-wallet", &memory.Persistence{})
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "bob", "EUR", 10)}))
+}
+
+func TestFailedTransactions(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "bob", "EUR", 20), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "carol", "EUR", 30), ""))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatusWithReason("tx2", auditdb.Deleted, "mvcc conflict"))
+	assert.NoError(t, db.SetStatus("tx3", auditdb.Deleted))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.FailedTransactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	reasons := map[string]string{}
+	for {
+		record, err := it.Next()
+		assert.NoError(t, err)
+		if record == nil {
+			break
+		}
+		assert.Equal(t, auditdb.Deleted, record.Status)
+		reasons[record.TxID] = record.FailureReason
+	}
+	assert.Equal(t, map[string]string{"tx2": "mvcc conflict", "tx3": ""}, reasons)
+}
+
+// noSnapshotDB is an audit db that does not support snapshots
+type noSnapshotDB struct {
+	*memory.Persistence
+}
+
+func (db *noSnapshotDB) Snapshot() (*driver.Snapshot, error) {
+	return nil, driver.ErrSnapshotNotSupported
+}
+
+func TestManagerSnapshot(t *testing.T) {
+	transactions := func(m *auditdb.Manager, key string) map[string]auditdb.TxStatus {
+		db, err := m.AuditDBByKey(key)
+		assert.NoError(t, err)
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil)
+		assert.NoError(t, err)
+		defer it.Close()
+		res := map[string]auditdb.TxStatus{}
+		for {
+			record, err := it.Next()
+			assert.NoError(t, err)
+			if record == nil {
+				return res
+			}
+			res[record.TxID+"/"+record.RecipientEID+"/"+record.Amount.String()] = record.Status
+		}
+	}
+
+	carolWallet := &token.AuditorWallet{}
+	source := auditdb.NewManager(nil, "namespaces", auditdb.WithWalletKeyFunc(func(w *token.AuditorWallet) string {
+		if w == carolWallet {
+			return "carol-wallet"
+		}
+		return "unknown"
+	}))
+	alice, err := source.AuditDBByKey("alice-wallet")
+	assert.NoError(t, err)
+	assert.NoError(t, alice.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, alice.SetStatus("tx1", auditdb.Confirmed))
+	bob, err := source.AuditDBByKey("bob-wallet")
+	assert.NoError(t, err)
+	assert.NoError(t, bob.AppendRecord(issueRecord("tx2", "bob", "USD", 20), ""))
+
+	// only the audit dbs opened so far are part of the snapshot
+	var buf bytes.Buffer
+	assert.NoError(t, source.Snapshot(&buf))
+	wallets := func(raw []byte) []string {
+		s := &struct{ Wallets map[string]json.RawMessage }{}
+		assert.NoError(t, json.Unmarshal(raw, s))
+		var keys []string
+		for key := range s.Wallets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	assert.Equal(t, []string{"alice-wallet", "bob-wallet"}, wallets(buf.Bytes()))
+
+	// the audit dbs of the passed wallets are opened and included
+	buf.Reset()
+	assert.NoError(t, source.Snapshot(&buf, carolWallet))
+	raw := buf.Bytes()
+	assert.Equal(t, []string{"alice-wallet", "bob-wallet", "carol-wallet"}, wallets(raw))
+
+	target := auditdb.NewManager(nil, "namespaces")
+	assert.NoError(t, target.Restore(bytes.NewReader(raw)))
+	assert.Equal(t, map[string]auditdb.TxStatus{"tx1/alice/10": auditdb.Confirmed}, transactions(target, "alice-wallet"))
+	assert.Equal(t, map[string]auditdb.TxStatus{"tx2/bob/20": auditdb.Pending}, transactions(target, "bob-wallet"))
+	restored, err := target.AuditDBByKey("bob-wallet")
+	assert.NoError(t, err)
+	qe := restored.NewQueryExecutor()
+	holdings, err := qe.NewHoldingsFilter().ByEnrollmentId("bob").ByType("USD").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), holdings.Sum().ToBigInt().Int64())
+	qe.Done()
+
+	// restoring again fails, and leaves the audit dbs untouched
+	err = target.Restore(bytes.NewReader(raw))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "audit db for wallet [alice-wallet] is not empty")
+	assert.Len(t, transactions(target, "bob-wallet"), 1)
+
+	// drivers without snapshot support
+	unsupported := auditdb.NewManager(nil, "namespaces")
+	unsupported.AddAuditDB("carol-wallet", &noSnapshotDB{Persistence: &memory.Persistence{}})
+	err = unsupported.Snapshot(&buf)
+	assert.Error(t, err)
+	assert.Equal(t, driver.ErrSnapshotNotSupported, errors.Cause(err))
+	assert.Contains(t, err.Error(), "failed taking snapshot of audit db for wallet [carol-wallet]")
+}
+
+// recordProvider is a mock AuditRecordProvider
+type recordProvider struct {
+	record *token.AuditRecord
+	err    error
+}
+
+func (p *recordProvider) AuditRecord() (*token.AuditRecord, error) {
+	return p.record, p.err
+}
+
+func TestAppendFromProvider(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{}, auditdb.WithMetadataExtractor(func(*token.Request) (string, error) {
+		return "", errors.New("extractor must not be called for non-request providers")
+	}))
+	assert.NoError(t, db.Append(&recordProvider{record: issueRecord("tx1", "alice", "EUR", 10)}))
+
+	err := db.Append(&recordProvider{err: errors.New("no record")})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no record")
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	record, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "tx1", record.TxID)
+	assert.Equal(t, "alice", record.RecipientEID)
+	assert.Equal(t, big.NewInt(10), record.Amount)
+	record, err = it.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestReorg(t *testing.T) {
+	p := &failingReorgDB{Persistence: &memory.Persistence{}}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "alice", "EUR", 20), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx3", "alice", "EUR", 40), ""))
+	assert.NoError(t, db.SetStatus("tx1", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Confirmed))
+	assert.NoError(t, db.SetStatus("tx3", auditdb.Deleted))
+
+	confirmedHoldings := func() uint64 {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		filter, err := qe.NewHoldingsFilter().ByEnrollmentId("alice").ByType("EUR").Confirmed().Execute()
+		assert.NoError(t, err)
+		return filter.Sum().ToBigInt().Uint64()
+	}
+	assert.Equal(t, uint64(30), confirmedHoldings())
+
+	assert.NoError(t, db.Reorg([]string{"tx2"}))
+	assert.Equal(t, uint64(10), confirmedHoldings())
+
+	qe := db.NewQueryExecutor()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	var records []*auditdb.TransactionRecord
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			break
+		}
+		records = append(records, tx)
+	}
+	it.Close()
+	qe.Done()
+	assert.Len(t, records, 3)
+	assert.Equal(t, auditdb.Confirmed, records[0].Status)
+	assert.Equal(t, 0, records[0].Reorgs)
+	assert.Equal(t, auditdb.Pending, records[1].Status)
+	assert.Equal(t, 1, records[1].Reorgs)
+
+	// reorging a pending transaction is a no-op
+	assert.NoError(t, db.Reorg([]string{"tx2"}))
+	assert.Equal(t, uint64(10), confirmedHoldings())
+
+	// deleted transactions cannot be reorged, and the other transactions are left untouched
+	all, cancel := db.SubscribeAllStatuses()
+	defer cancel()
+	assert.EqualError(t, db.Reorg([]string{"tx1", "tx3"}), "transaction [tx3] is deleted")
+	assert.Equal(t, uint64(10), confirmedHoldings())
+
+	// a failure of the driver undoes the whole reorg
+	p.failOn = "tx2"
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Confirmed))
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx2", Status: auditdb.Confirmed}, <-all)
+	err = db.Reorg([]string{"tx1", "tx2"})
+	assert.EqualError(t, err, "failed reorging [tx2]: injected failure")
+	assert.Equal(t, uint64(30), confirmedHoldings())
+	select {
+	case event := <-all:
+		t.Fatalf("unexpected notification %v", event)
+	default:
+	}
+
+	// subscribers are notified once the reorg is committed
+	p.failOn = ""
+	assert.NoError(t, db.Reorg([]string{"tx1", "tx2"}))
+	assert.Equal(t, uint64(0), confirmedHoldings())
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx1", Status: auditdb.Pending}, <-all)
+	assert.Equal(t, auditdb.StatusEvent{TxID: "tx2", Status: auditdb.Pending}, <-all)
+
+	// confirm again after the reorg
+	assert.NoError(t, db.SetStatus("tx2", auditdb.Confirmed))
+	assert.Equal(t, uint64(20), confirmedHoldings())
+}
+
+// failingReorgDB fails the reorg of the failOn transaction
+type failingReorgDB struct {
+	*memory.Persistence
+	failOn string
+}
+
+func (db *failingReorgDB) Reorg(txID string) error {
+	if txID == db.failOn {
+		return errors.New("injected failure")
+	}
+	return db.Persistence.Reorg(txID)
+}
+
+func TestSync(t *testing.T) {
+	db := auditdb.NewAuditDB(&memory.Persistence{})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.NoError(t, db.Sync())
+
+	db = auditdb.NewAuditDB(&failingSyncDB{Persistence: &memory.Persistence{}})
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "alice", "EUR", 10), ""))
+	assert.EqualError(t, db.Sync(), "failed syncing audit db: disk full")
+}
+
+func TestEnrollmentResolver(t *testing.T) {
+	directory := map[string]string{
+		"nym1": "alice",
+		"nym2": "alice",
+	}
+	resolver := func(identity []byte) (string, error) {
+		eID, ok := directory[string(identity)]
+		if !ok {
+			return "", errors.Errorf("identity [%s] not in directory", identity)
+		}
+		return eID, nil
+	}
+	db := auditdb.NewAuditDB(&memory.Persistence{}, auditdb.WithEnrollmentResolver(resolver))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx1", "nym1", "EUR", 10), ""))
+	assert.NoError(t, db.AppendRecord(issueRecord("tx2", "nym2", "EUR", 20), ""))
+	assert.Error(t, db.AppendRecord(issueRecord("tx3", "nym3", "EUR", 30), ""))
+
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	holdings, err := qe.NewHoldingsFilter().ByEnrollmentId("alice").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), holdings.Sum().ToBigInt().Int64())
+	holdings, err = qe.NewHoldingsFilter().ByEnrollmentId("nym1").Execute()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), holdings.Sum().ToBigInt().Int64())
+	latest, err := qe.LatestByEnrollment([]string{"alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tx2", latest["alice"].TxID)
+}
+
+// txIDs drains the passed iterator, closes it, and returns the transaction ids of the records found
+func txIDs(t *testing.T, it *auditdb.TransactionIterator) []string {
+	defer it.Close()
+	var res []string
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			return res
+		}
+		res = append(res, tx.TxID)
+	}
+}
+
+func TestMovements(t *testing.T) {
+	// alice sends 7 EUR to bob, gets 3 EUR back as change, and redeems 5 USD
+	record := &token.AuditRecord{
+		Anchor: "tx1",
+		Inputs: token.NewInputStream(nil, []*token.Input{
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(6)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(4)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+		Outputs: token.NewOutputStream([]*token.Output{
+			{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(7)},
+			{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(3)},
+			{ActionIndex: 1, Type: "USD", Quantity: token2.NewQuantityFromUInt64(5)},
+		}, 64),
+	}
+	p := &memory.Persistence{}
+	db := auditdb.NewAuditDB(p)
+	assert.NoError(t, db.AppendMovements(record))
+
+	movements, err := p.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	var res []string
+	for _, movement := range movements {
+		res = append(res, movement.EnrollmentID+":"+movement.TokenType+":"+movement.Amount.String())
+	}
+	assert.Equal(t, []string{"alice:EUR:-7", "alice:USD:-5", "bob:EUR:7"}, res)
+}
+
+func TestMovementsEquivalence(t *testing.T) {
+	records := []*token.AuditRecord{
+		issueRecord("issue", "alice", "EUR", 10),
+		{
+			Anchor: "transfer",
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: "USD", Quantity: token2.NewQuantityFromUInt64(4), ActionIndex: 1},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Owner: []byte("bob"), EnrollmentID: "bob", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(6)},
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(4)},
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "USD", Quantity: token2.NewQuantityFromUInt64(4), ActionIndex: 1},
+			}, 64),
+		},
+		{
+			Anchor: "redeem",
+			Inputs: token.NewInputStream(nil, []*token.Input{
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(10)},
+			}, 64),
+			Outputs: token.NewOutputStream([]*token.Output{
+				{Type: "EUR", Quantity: token2.NewQuantityFromUInt64(8)},
+				{Owner: []byte("alice"), EnrollmentID: "alice", Type: "EUR", Quantity: token2.NewQuantityFromUInt64(2)},
+			}, 64),
+		},
+	}
+	for _, record := range records {
+		p := &memory.Persistence{}
+		assert.NoError(t, auditdb.NewAuditDB(p).AppendMovements(record))
+		movements, err := p.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending}, driver.FromBeginning, driver.All, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, twoPassMovements(record), movements, "movements of [%s] differ", record.Anchor)
+	}
+}
+
+// twoPassMovements computes the movements of the passed record as appendMovements did before computing them
+// in a single pass: first all the send movements, then all the received ones.
+func twoPassMovements(record *token.AuditRecord) []*driver.MovementRecord {
+	inputs, outputs := record.Inputs, record.Outputs
+	var eIDs []string
+	seen := map[string]bool{}
+	for _, eID := range append(inputs.EnrollmentIDs(), outputs.EnrollmentIDs()...) {
+		if !seen[eID] {
+			seen[eID] = true
+			eIDs = append(eIDs, eID)
+		}
+	}
+	tokenTypes := outputs.TokenTypes()
+
+	var res []*driver.MovementRecord
+	for _, eID := range eIDs {
+		for _, tokenType := range tokenTypes {
+			sent := inputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
+			received := outputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
+			diff := sent.Sub(sent, received)
+			if diff.Cmp(big.NewInt(0)) <= 0 {
+				continue
+			}
+			res = append(res, &driver.MovementRecord{TxID: record.Anchor, EnrollmentID: eID, Amount: diff.Neg(diff), TokenType: tokenType, Status: driver.Pending})
+		}
+	}
+	for _, eID := range eIDs {
+		for _, tokenType := range tokenTypes {
+			received := outputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
+			sent := inputs.ByEnrollmentID(eID).ByType(tokenType).Sum().ToBigInt()
+			diff := received.Sub(received, sent)
+			if diff.Cmp(big.NewInt(0)) <= 0 {
+				continue
+			}
+			res = append(res, &driver.MovementRecord{TxID: record.Anchor, EnrollmentID: eID, Amount: diff, TokenType: tokenType, Status: driver.Pending})
+		}
+	}
+	return res
+}
+
+func BenchmarkAppendMovements(b *testing.B) {
+	// a transfer from one sender to 1,000 holders
+	const holders = 1000
+	inputs := []*token.Input{{
+		Owner:        []byte("sender"),
+		EnrollmentID: "sender",
+		Type:         "EUR",
+		Quantity:     token2.NewQuantityFromUInt64(10 * holders),
+	}}
+	var outputs []*token.Output
+	for i := 0; i < holders; i++ {
+		eID := "holder" + strconv.Itoa(i)
+		outputs = append(outputs, &token.Output{
+			Owner:        []byte(eID),
+			EnrollmentID: eID,
+			Type:         "EUR",
+			Quantity:     token2.NewQuantityFromUInt64(10),
+		})
+	}
+	record := &token.AuditRecord{
+		Anchor:  "tx1",
+		Inputs:  token.NewInputStream(nil, inputs, 64),
+		Outputs: token.NewOutputStream(outputs, 64),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db := auditdb.NewAuditDB(&memory.Persistence{})
+		if err := db.AppendMovements(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// issueRecord returns an audit record for an issue action of the passed amount to the passed enrollment ID
+func issueRecord(anchor, eID, tokenType string, amount uint64) *token.AuditRecord {
+	return &token.AuditRecord{
+		Anchor: anchor,
+		Inputs: token.NewInputStream(nil, nil, 64),
+		Outputs: token.NewOutputStream([]*token.Output{{
+			ActionIndex:  0,
+			Owner:        []byte(eID),
+			EnrollmentID: eID,
+			Type:         tokenType,
+			Quantity:     token2.NewQuantityFromUInt64(amount),
+		}}, 64),
+	}
+}
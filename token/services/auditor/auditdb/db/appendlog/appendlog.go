@@ -0,0 +1,699 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package appendlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/memory"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxSegmentSize is the size, in bytes, above which a new segment is started
+	DefaultMaxSegmentSize = 16 * 1024 * 1024
+
+	snapshotFile  = "snapshot.json"
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+)
+
+const (
+	opAddMovement        = "AddMovement"
+	opAddTransaction     = "AddTransaction"
+	opSetStatus          = "SetStatus"
+	opReorg              = "Reorg"
+	opSetQuarantine      = "SetQuarantine"
+	opDeleteTransactions = "DeleteTransactions"
+	opDeleteMovements    = "DeleteMovements"
+	opPrune              = "Prune"
+	opDeleteBefore       = "DeleteTransactionsBefore"
+)
+
+// operation is a mutation of the audit db, as recorded in the log
+type operation struct {
+	Op          string
+	Movement    *driver.MovementRecord    `json:",omitempty"`
+	Transaction *driver.TransactionRecord `json:",omitempty"`
+	TxID        string                    `json:",omitempty"`
+	Status      driver.TxStatus           `json:",omitempty"`
+	Reason      string                    `json:",omitempty"`
+	Quarantined bool                      `json:",omitempty"`
+	Before      time.Time                 `json:",omitempty"`
+}
+
+// entry is a line of a segment. Hash chains the entry to the previous one: it is the hash of
+// the hash of the previous entry concatenated with the raw operation.
+type entry struct {
+	Hash string
+	Op   json.RawMessage
+}
+
+// snapshot folds the segments compacted so far. Hash chains the snapshot to the last folded entry:
+// it is the hash of Prev concatenated with the raw body.
+type snapshot struct {
+	Prev string
+	Hash string
+	Body json.RawMessage
+}
+
+type snapshotBody struct {
+	// LastSegment is the number of the last folded segment
+	LastSegment  int
+	Movements    []*driver.MovementRecord
+	Transactions []*driver.TransactionRecord
+}
+
+// Persistence is an audit db that writes every mutation to an append-only, hash-chained log of segments,
+// and serves queries from an in-memory index rebuilt from the log on open.
+// Compact folds the segments into a snapshot.
+type Persistence struct {
+	path           string
+	maxSegmentSize int64
+
+	lock    sync.RWMutex
+	index   *memory.Persistence
+	unique  bool
+	head    string
+	segment *os.File
+	segNum  int
+	segSize int64
+	// pending holds the operations of the current update, nil if no update is in progress
+	pending []*operation
+}
+
+// OpenLog opens the append-only log at the passed path, verifying its hash chain and rebuilding the index.
+// A new segment is started when the current one exceeds maxSegmentSize bytes.
+func OpenLog(path string, maxSegmentSize int64) (*Persistence, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed creating folders for log [%s]", path)
+	}
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+	p := &Persistence{path: path, maxSegmentSize: maxSegmentSize}
+	if err := p.load(); err != nil {
+		return nil, errors.WithMessagef(err, "failed loading log [%s]", path)
+	}
+	if err := p.openSegment(p.segNum); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Persistence) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.segment == nil {
+		return nil
+	}
+	err := p.segment.Close()
+	p.segment = nil
+	if err != nil {
+		return errors.Wrap(err, "could not close segment")
+	}
+	return nil
+}
+
+func (p *Persistence) BeginUpdate() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending != nil {
+		return errors.New("previous commit in progress")
+	}
+	p.pending = []*operation{}
+	return nil
+}
+
+func (p *Persistence) Commit() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending == nil {
+		return errors.New("no commit in progress")
+	}
+	ops := p.pending
+	p.pending = nil
+	if err := p.write(ops...); err != nil {
+		// the index already reflects the operations, restore it to the logged state
+		if rerr := p.load(); rerr != nil {
+			return errors.WithMessagef(err, "failed restoring the index [%s]", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Persistence) Discard() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending == nil {
+		return errors.New("no commit in progress")
+	}
+	p.pending = nil
+	// the operations of the update have been applied to the index, rebuild it from the log
+	return p.load()
+}
+
+func (p *Persistence) Sync() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.segment.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync segment")
+	}
+	return nil
+}
+
+func (p *Persistence) GetStatus(txID string) (driver.TxStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.index.GetStatus(txID)
+}
+
+func (p *Persistence) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	return p.apply(&operation{Op: opSetStatus, TxID: txID, Status: status, Reason: reason})
+}
+
+func (p *Persistence) Reorg(txID string) error {
+	return p.apply(&operation{Op: opReorg, TxID: txID})
+}
+
+func (p *Persistence) SetQuarantine(txID string, quarantined bool, reason string) error {
+	return p.apply(&operation{Op: opSetQuarantine, TxID: txID, Quarantined: quarantined, Reason: reason})
+}
+
+func (p *Persistence) AddMovement(record *driver.MovementRecord) error {
+	return p.apply(&operation{Op: opAddMovement, Movement: record})
+}
+
+func (p *Persistence) AddTransaction(record *driver.TransactionRecord) error {
+	return p.apply(&operation{Op: opAddTransaction, Transaction: record})
+}
+
+// AddMovements applies the passed movement records to the index at once
+func (p *Persistence) AddMovements(records []*driver.MovementRecord) error {
+	ops := make([]*operation, len(records))
+	for i, record := range records {
+		ops[i] = &operation{Op: opAddMovement, Movement: record}
+	}
+	return p.apply(ops...)
+}
+
+// AddTransactions applies the passed transaction records to the index at once
+func (p *Persistence) AddTransactions(records []*driver.TransactionRecord) error {
+	ops := make([]*operation, len(records))
+	for i, record := range records {
+		ops[i] = &operation{Op: opAddTransaction, Transaction: record}
+	}
+	return p.apply(ops...)
+}
+
+func (p *Persistence) DeleteTransactions(txID string) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending == nil {
+		return 0, errors.New("no commit in progress")
+	}
+	deleted, err := p.index.DeleteTransactions(txID)
+	if err != nil {
+		return 0, err
+	}
+	p.pending = append(p.pending, &operation{Op: opDeleteTransactions, TxID: txID})
+	return deleted, nil
+}
+
+func (p *Persistence) DeleteMovements(txID string) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending == nil {
+		return 0, errors.New("no commit in progress")
+	}
+	deleted, err := p.index.DeleteMovements(txID)
+	if err != nil {
+		return 0, err
+	}
+	p.pending = append(p.pending, &operation{Op: opDeleteMovements, TxID: txID})
+	return deleted, nil
+}
+
+func (p *Persistence) Prune(before time.Time) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	removed, err := p.index.Prune(before)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.record(&operation{Op: opPrune, Before: before}); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// DeleteTransactionsBefore removes the records from the index and logs the deletion as a single operation
+func (p *Persistence) DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if dryRun {
+		return p.index.DeleteTransactionsBefore(before, true)
+	}
+	removed, err := p.index.DeleteTransactionsBefore(before, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.record(&operation{Op: opDeleteBefore, Before: before}); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// EnsureUniqueConstraints enforces the unique constraints on the in-memory index.
+// The log itself never contains a rejected record, because operations are logged only once applied.
+func (p *Persistence) EnsureUniqueConstraints() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.index.EnsureUniqueConstraints(); err != nil {
+		return err
+	}
+	p.unique = true
+	return nil
+}
+
+func (p *Persistence) Snapshot() (*driver.Snapshot, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.Snapshot()
+}
+
+// Restore loads the records of the passed snapshot into the index and appends them to the log,
+// as if they had been added one by one.
+func (p *Persistence) Restore(snapshot *driver.Snapshot) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending != nil {
+		return errors.New("cannot restore a snapshot during an update")
+	}
+	if err := p.index.Restore(snapshot); err != nil {
+		return err
+	}
+	var ops []*operation
+	for _, record := range snapshot.Movements {
+		ops = append(ops, &operation{Op: opAddMovement, Movement: record})
+	}
+	for _, record := range snapshot.Transactions {
+		ops = append(ops, &operation{Op: opAddTransaction, Transaction: record})
+	}
+	if err := p.write(ops...); err != nil {
+		if rerr := p.load(); rerr != nil {
+			return errors.WithMessagef(err, "failed restoring the index [%s]", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Persistence) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryTransactions(params)
+}
+
+func (p *Persistence) QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryDuplicateTransactions(from, to)
+}
+
+func (p *Persistence) QueryMultiTypeActions(from, to *time.Time) ([]string, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryMultiTypeActions(from, to)
+}
+
+func (p *Persistence) QueryLatestTransactions(enrollmentIDs []string) (map[string]*driver.TransactionRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryLatestTransactions(enrollmentIDs)
+}
+
+func (p *Persistence) QueryBalances(params driver.QueryBalancesParams) (map[string]*big.Int, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryBalances(params)
+}
+
+func (p *Persistence) QueryMovementSummary(params driver.QueryMovementSummaryParams) ([]*driver.MovementSummaryRow, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryMovementSummary(params)
+}
+
+func (p *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryMovements(enrollmentIDs, tokenTypes, txStatuses, searchDirection, movementDirection, numRecords)
+}
+
+// QueryMovementsByTxID returns the movements of the passed transaction, as served by the index
+func (p *Persistence) QueryMovementsByTxID(txID string) ([]*driver.MovementRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.index.QueryMovementsByTxID(txID)
+}
+
+// Compact folds the segments into a snapshot of the current records, and starts a new segment.
+// The snapshot is chained to the last folded entry, so that the log stays tamper-evident.
+// It fails if an update is in progress.
+func (p *Persistence) Compact() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending != nil {
+		return errors.New("cannot compact while an update is in progress")
+	}
+
+	movements, err := p.index.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return errors.WithMessage(err, "failed reading movements")
+	}
+	it, err := p.index.QueryTransactions(driver.QueryTransactionsParams{})
+	if err != nil {
+		return errors.WithMessage(err, "failed reading transactions")
+	}
+	body := &snapshotBody{LastSegment: p.segNum, Movements: movements}
+	for {
+		record, err := it.Next()
+		if err != nil {
+			return errors.WithMessage(err, "failed reading transactions")
+		}
+		if record == nil {
+			break
+		}
+		body.Transactions = append(body.Transactions, record)
+	}
+	it.Close()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed marshalling snapshot body")
+	}
+	s := &snapshot{Prev: p.head, Hash: chain(p.head, raw), Body: raw}
+	rawSnapshot, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed marshalling snapshot")
+	}
+
+	// replace the snapshot atomically, then remove the folded segments.
+	// Segments left behind by a failure are skipped on load, being numbered up to LastSegment.
+	tmp := filepath.Join(p.path, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, rawSnapshot); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(p.path, snapshotFile)); err != nil {
+		return errors.Wrap(err, "failed replacing snapshot")
+	}
+	if err := p.segment.Close(); err != nil {
+		return errors.Wrap(err, "could not close segment")
+	}
+	segments, err := p.segments()
+	if err != nil {
+		return err
+	}
+	for _, num := range segments {
+		if num > body.LastSegment {
+			continue
+		}
+		if err := os.Remove(p.segmentPath(num)); err != nil {
+			return errors.Wrapf(err, "failed removing segment [%d]", num)
+		}
+	}
+	p.head = s.Hash
+	return p.openSegment(p.segNum + 1)
+}
+
+// apply applies the passed operations to the index and records them in the log.
+// Outside an update, if an operation fails, the index is restored to the logged state.
+func (p *Persistence) apply(ops ...*operation) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, op := range ops {
+		if err := applyTo(p.index, op); err != nil {
+			if i > 0 && p.pending == nil {
+				if rerr := p.load(); rerr != nil {
+					return errors.WithMessagef(err, "failed restoring the index [%s]", rerr)
+				}
+			}
+			return err
+		}
+	}
+	return p.record(ops...)
+}
+
+// record appends the passed operations, already applied to the index, to the current update if any,
+// or to the log otherwise
+func (p *Persistence) record(ops ...*operation) error {
+	if p.pending != nil {
+		p.pending = append(p.pending, ops...)
+		return nil
+	}
+	if err := p.write(ops...); err != nil {
+		if rerr := p.load(); rerr != nil {
+			return errors.WithMessagef(err, "failed restoring the index [%s]", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// write appends the passed operations to the current segment, chaining them to the head of the log
+func (p *Persistence) write(ops ...*operation) error {
+	var buf bytes.Buffer
+	head := p.head
+	for _, op := range ops {
+		rawOp, err := json.Marshal(op)
+		if err != nil {
+			return errors.Wrapf(err, "failed marshalling operation [%s]", op.Op)
+		}
+		head = chain(head, rawOp)
+		line, err := json.Marshal(&entry{Hash: head, Op: rawOp})
+		if err != nil {
+			return errors.Wrapf(err, "failed marshalling entry [%s]", op.Op)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if p.segSize > 0 && p.segSize+int64(buf.Len()) > p.maxSegmentSize {
+		if err := p.segment.Close(); err != nil {
+			return errors.Wrap(err, "could not close segment")
+		}
+		if err := p.openSegment(p.segNum + 1); err != nil {
+			return err
+		}
+	}
+	n, err := p.segment.Write(buf.Bytes())
+	p.segSize += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed writing to segment [%d]", p.segNum)
+	}
+	p.head = head
+	return nil
+}
+
+// load rebuilds the index from the snapshot and the segments, verifying the hash chain
+func (p *Persistence) load() error {
+	index := &memory.Persistence{}
+	head := ""
+	lastFolded := -1
+
+	raw, err := ioutil.ReadFile(filepath.Join(p.path, snapshotFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrap(err, "failed reading snapshot")
+	default:
+		s := &snapshot{}
+		if err := json.Unmarshal(raw, s); err != nil {
+			return errors.Wrap(err, "failed unmarshalling snapshot")
+		}
+		if chain(s.Prev, s.Body) != s.Hash {
+			return errors.New("snapshot hash mismatch, the log has been tampered with")
+		}
+		body := &snapshotBody{}
+		if err := json.Unmarshal(s.Body, body); err != nil {
+			return errors.Wrap(err, "failed unmarshalling snapshot body")
+		}
+		for _, record := range body.Movements {
+			if err := index.AddMovement(record); err != nil {
+				return err
+			}
+		}
+		for _, record := range body.Transactions {
+			if err := index.AddTransaction(record); err != nil {
+				return err
+			}
+		}
+		head = s.Hash
+		lastFolded = body.LastSegment
+	}
+
+	segments, err := p.segments()
+	if err != nil {
+		return err
+	}
+	p.segNum = lastFolded + 1
+	for _, num := range segments {
+		if num <= lastFolded {
+			continue
+		}
+		p.segNum = num
+		if head, err = replay(p.segmentPath(num), head, index); err != nil {
+			return errors.WithMessagef(err, "failed replaying segment [%d]", num)
+		}
+	}
+	if p.unique {
+		if err := index.EnsureUniqueConstraints(); err != nil {
+			return err
+		}
+	}
+	p.index = index
+	p.head = head
+	return nil
+}
+
+// replay applies to the passed index the operations in the passed segment, verifying that they
+// are chained to the passed head. It returns the new head.
+func replay(path string, head string, index *memory.Persistence) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed opening segment")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		e := &entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return "", errors.Wrapf(err, "failed unmarshalling entry at line [%d]", line)
+		}
+		if head = chain(head, e.Op); head != e.Hash {
+			return "", errors.Errorf("hash mismatch at line [%d], the log has been tampered with", line)
+		}
+		op := &operation{}
+		if err := json.Unmarshal(e.Op, op); err != nil {
+			return "", errors.Wrapf(err, "failed unmarshalling operation at line [%d]", line)
+		}
+		if err := applyTo(index, op); err != nil {
+			return "", errors.WithMessagef(err, "failed applying operation at line [%d]", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "failed reading segment")
+	}
+	return head, nil
+}
+
+func applyTo(index *memory.Persistence, op *operation) error {
+	var err error
+	switch op.Op {
+	case opAddMovement:
+		err = index.AddMovement(op.Movement)
+	case opAddTransaction:
+		err = index.AddTransaction(op.Transaction)
+	case opSetStatus:
+		err = index.SetStatus(op.TxID, op.Status, op.Reason)
+	case opReorg:
+		err = index.Reorg(op.TxID)
+	case opSetQuarantine:
+		err = index.SetQuarantine(op.TxID, op.Quarantined, op.Reason)
+	case opDeleteTransactions:
+		_, err = index.DeleteTransactions(op.TxID)
+	case opDeleteMovements:
+		_, err = index.DeleteMovements(op.TxID)
+	case opPrune:
+		_, err = index.Prune(op.Before)
+	case opDeleteBefore:
+		_, err = index.DeleteTransactionsBefore(op.Before, false)
+	default:
+		err = errors.Errorf("unknown operation [%s]", op.Op)
+	}
+	return err
+}
+
+// segments returns the numbers of the segments on disk, in order
+func (p *Persistence) segments() ([]int, error) {
+	infos, err := ioutil.ReadDir(p.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed listing segments")
+	}
+	var nums []int
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var num int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &num); err != nil {
+			return nil, errors.Wrapf(err, "invalid segment name [%s]", name)
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+func (p *Persistence) segmentPath(num int) string {
+	return filepath.Join(p.path, fmt.Sprintf("%s%08d%s", segmentPrefix, num, segmentSuffix))
+}
+
+// openSegment opens, for appending, the segment with the passed number
+func (p *Persistence) openSegment(num int) error {
+	f, err := os.OpenFile(p.segmentPath(num), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening segment [%d]", num)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed reading size of segment [%d]", num)
+	}
+	p.segment = f
+	p.segNum = num
+	p.segSize = info.Size()
+	return nil
+}
+
+func chain(prev string, raw []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(raw)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeFileSync(path string, raw []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed creating [%s]", path)
+	}
+	defer f.Close()
+	if _, err := f.Write(raw); err != nil {
+		return errors.Wrapf(err, "failed writing [%s]", path)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed syncing [%s]", path)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package appendlog
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendAndQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenLog(dir, 0)
+	assert.NoError(t, err)
+	populate(t, db)
+	assertState(t, db)
+	assert.NoError(t, db.Close())
+
+	// the index is rebuilt from the log
+	db, err = OpenLog(dir, 0)
+	assert.NoError(t, err)
+	assertState(t, db)
+
+	// a discarded update leaves no trace
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "tx4", TransactionType: driver.Issue, RecipientEID: "carol", TokenType: "EUR", Amount: big.NewInt(1), Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.Discard())
+	assertState(t, db)
+	assert.NoError(t, db.Close())
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// small segments, to have more than one
+	db, err := OpenLog(dir, 512)
+	assert.NoError(t, err)
+	populate(t, db)
+	segments, err := db.segments()
+	assert.NoError(t, err)
+	assert.True(t, len(segments) > 1)
+
+	assert.NoError(t, db.Compact())
+	assertState(t, db)
+	segments, err = db.segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+
+	// appends after compaction chain to the snapshot
+	assert.NoError(t, db.SetQuarantine("tx2", true, "review"))
+	assert.NoError(t, db.Close())
+
+	db, err = OpenLog(dir, 512)
+	assert.NoError(t, err)
+	assertState(t, db)
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{Quarantined: boolPtr(true)})
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "tx2", tx.TxID)
+	assert.Equal(t, "review", tx.QuarantineReason)
+	it.Close()
+
+	// compacting twice keeps the chain
+	assert.NoError(t, db.Compact())
+	assert.NoError(t, db.Close())
+	db, err = OpenLog(dir, 512)
+	assert.NoError(t, err)
+	assertState(t, db)
+	assert.NoError(t, db.Close())
+}
+
+func TestTamperEvidence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenLog(dir, 0)
+	assert.NoError(t, err)
+	populate(t, db)
+	assert.NoError(t, db.Close())
+
+	path := db.segmentPath(0)
+	raw, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(strings.Replace(string(raw), `"Amount":10`, `"Amount":1000`, 1)), 0644))
+
+	_, err = OpenLog(dir, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "the log has been tampered with")
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenLog(filepath.Join(dir, "source"), 0)
+	assert.NoError(t, err)
+	populate(t, db)
+	snapshot, err := db.Snapshot()
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	db, err = OpenLog(filepath.Join(dir, "target"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Restore(snapshot))
+	assertState(t, db)
+	assert.Error(t, db.Restore(snapshot))
+	assert.NoError(t, db.Close())
+
+	// the restored records are in the log
+	db, err = OpenLog(filepath.Join(dir, "target"), 0)
+	assert.NoError(t, err)
+	assertState(t, db)
+	assert.NoError(t, db.Close())
+}
+
+func TestDeleteTransactionsBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenLog(dir, 0)
+	assert.NoError(t, err)
+	populate(t, db)
+	// tx1 is Confirmed and tx3 is Deleted, tx2 is Pending after the reorg
+	removed, err := db.DeleteTransactionsBefore(time.Now().Add(time.Hour), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	assert.NoError(t, db.Close())
+
+	// the deletion is replayed from the log
+	db, err = OpenLog(dir, 0)
+	assert.NoError(t, err)
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	record, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "tx2", record.TxID)
+	record, err = it.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	it.Close()
+	movements, err := db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 1)
+	assert.NoError(t, db.Close())
+}
+
+func populate(t *testing.T, db *Persistence) {
+	now := time.Now()
+	assert.NoError(t, db.EnsureUniqueConstraints())
+	for i, txID := range []string{"tx1", "tx2", "tx3"} {
+		assert.NoError(t, db.BeginUpdate())
+		amount := big.NewInt(int64(10 * (i + 1)))
+		assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: txID, EnrollmentID: "alice", TokenType: "EUR", Amount: amount, Status: driver.Pending}))
+		assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: txID, TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: amount, Timestamp: now.Add(time.Duration(i) * time.Minute), Status: driver.Pending}))
+		assert.NoError(t, db.Commit())
+	}
+	assert.Error(t, db.AddTransaction(&driver.TransactionRecord{TxID: "tx1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: now, Status: driver.Pending}))
+	assert.NoError(t, db.SetStatus("tx1", driver.Confirmed, ""))
+	assert.NoError(t, db.SetStatus("tx2", driver.Confirmed, ""))
+	assert.NoError(t, db.SetStatus("tx3", driver.Deleted, "mvcc conflict"))
+	assert.NoError(t, db.Reorg("tx2"))
+}
+
+func assertState(t *testing.T, db *Persistence) {
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	var records []*driver.TransactionRecord
+	for {
+		record, err := it.Next()
+		assert.NoError(t, err)
+		if record == nil {
+			break
+		}
+		records = append(records, record)
+	}
+	it.Close()
+	assert.Len(t, records, 3)
+	assert.Equal(t, driver.Confirmed, records[0].Status)
+	assert.Equal(t, driver.Pending, records[1].Status)
+	assert.Equal(t, 1, records[1].Reorgs)
+	assert.Equal(t, driver.Deleted, records[2].Status)
+	assert.Equal(t, "mvcc conflict", records[2].FailureReason)
+
+	movements, err := db.QueryMovements([]string{"alice"}, []string{"EUR"}, nil, driver.FromBeginning, driver.Received, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 2)
+	assert.Equal(t, big.NewInt(10), movements[0].Amount)
+	assert.Equal(t, big.NewInt(20), movements[1].Amount)
+
+	latest, err := db.QueryLatestTransactions([]string{"alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tx2", latest["alice"].TxID)
+
+	files, err := filepath.Glob(filepath.Join(db.path, "*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,50 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package appendlog
+
+import (
+	"path/filepath"
+
+	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/flogging"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+)
+
+var logger = flogging.MustGetLogger("token-sdk.auditor.auditdb.appendlog")
+
+type Opts struct {
+	Path string
+	// MaxSegmentSize is the size, in bytes, above which a new segment is started.
+	// It defaults to DefaultMaxSegmentSize.
+	MaxSegmentSize int64
+}
+
+type Driver struct {
+}
+
+// Open opens the append-only log in the folder named after the passed namespace, under the configured path
+func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, error) {
+	opts := &Opts{}
+	err := view2.GetConfigService(sp).UnmarshalKey("token.auditor.auditdb.persistence.opts", opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting opts for audit db")
+	}
+	opts.Path = filepath.Join(opts.Path, name)
+	logger.Debugf("init append-only log at [%s]", opts.Path)
+
+	persistence, err := OpenLog(opts.Path, opts.MaxSegmentSize)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed opening append-only log [%s]", opts.Path)
+	}
+	return persistence, nil
+}
+
+func init() {
+	auditdb.Register("appendlog", &Driver{})
+}
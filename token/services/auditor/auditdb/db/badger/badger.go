@@ -9,6 +9,7 @@ package badger
 import (
 	"bytes"
 	"context"
+	"math/big"
 	"sort"
 	"strings"
 	"sync"
@@ -125,6 +126,13 @@ func (db *Persistence) Discard() error {
 	return nil
 }
 
+func (db *Persistence) Sync() error {
+	if err := db.db.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync DB")
+	}
+	return nil
+}
+
 func (db *Persistence) AddMovement(record *driver.MovementRecord) error {
 	logger.Debugf("Adding movement record [%s:%s:%s:%s]", record.TxID, record.TokenType, record.EnrollmentID, record.Amount)
 	next, key, err := db.movementKey(record.TxID)
@@ -174,15 +182,381 @@ func (db *Persistence) AddTransaction(record *driver.TransactionRecord) error {
 	return nil
 }
 
-func (db *Persistence) QueryTransactions(from, to *time.Time) (driver.TransactionIterator, error) {
+// AddMovements sets the passed movement records one by one in the current transaction
+func (db *Persistence) AddMovements(records []*driver.MovementRecord) error {
+	for _, record := range records {
+		if err := db.AddMovement(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTransactions sets the passed transaction records one by one in the current transaction
+func (db *Persistence) AddTransactions(records []*driver.TransactionRecord) error {
+	for _, record := range records {
+		if err := db.AddTransaction(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureUniqueConstraints is not supported by the badger driver: transaction keys are indexed by sequence number,
+// and checking uniqueness on append would require scanning all the transaction records.
+// It always returns driver.ErrUniqueConstraintsNotSupported.
+func (db *Persistence) EnsureUniqueConstraints() error {
+	return driver.ErrUniqueConstraintsNotSupported
+}
+
+// Snapshot is not supported by the badger driver, use the backup facility of badger instead.
+// It always returns driver.ErrSnapshotNotSupported.
+func (db *Persistence) Snapshot() (*driver.Snapshot, error) {
+	return nil, driver.ErrSnapshotNotSupported
+}
+
+// Restore is not supported by the badger driver, use the backup facility of badger instead.
+// It always returns driver.ErrSnapshotNotSupported.
+func (db *Persistence) Restore(*driver.Snapshot) error {
+	return driver.ErrSnapshotNotSupported
+}
+
+func (db *Persistence) DeleteTransactions(txID string) (int, error) {
+	return db.deleteRecords("tx", txID)
+}
+
+func (db *Persistence) DeleteMovements(txID string) (int, error) {
+	return db.deleteRecords("mv", txID)
+}
+
+// deleteRecords deletes, in the current transaction, the records of the passed transaction under the passed prefix
+func (db *Persistence) deleteRecords(kind string, txID string) (int, error) {
+	if db.txn == nil {
+		return 0, errors.New("no commit in progress")
+	}
+	it := db.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	// keys end with the separator followed by the transaction id
+	var toDelete [][]byte
+	prefix := []byte(kind)
+	suffix := []byte(keys.NamespaceSeparator + txID)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if key := it.Item().Key(); bytes.HasSuffix(key, suffix) {
+			toDelete = append(toDelete, it.Item().KeyCopy(nil))
+		}
+	}
+	for _, key := range toDelete {
+		if err := db.txn.Delete(key); err != nil {
+			return 0, errors.Wrapf(err, "could not delete key %s", string(key))
+		}
+	}
+	return len(toDelete), nil
+}
+
+// GetStatus scans the transaction records, and then the movement records, for the first one of the passed transaction
+func (db *Persistence) GetStatus(txID string) (driver.TxStatus, error) {
 	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
 	it := txn.NewIterator(badger.DefaultIteratorOptions)
-	it.Seek([]byte("tx"))
+	defer it.Close()
+
+	// keys end with the separator followed by the transaction id
+	suffix := []byte(keys.NamespaceSeparator + txID)
+	for _, prefix := range [][]byte{[]byte("tx"), []byte("mv")} {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if !bytes.HasSuffix(item.Key(), suffix) {
+				continue
+			}
+			var status driver.TxStatus
+			err := item.Value(func(val []byte) error {
+				if string(prefix) == "tx" {
+					record, err := UnmarshalTransactionRecord(val)
+					if err != nil {
+						return err
+					}
+					status = record.Record.Status
+					return nil
+				}
+				record, err := UnmarshalMovementRecord(val)
+				if err != nil {
+					return err
+				}
+				status = record.Record.Status
+				return nil
+			})
+			if err != nil {
+				return "", errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+			}
+			return status, nil
+		}
+	}
+	return "", nil
+}
+
+func (db *Persistence) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	records, err := db.queryTransactions(params)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionIterator{txs: params.Page(records)}, nil
+}
 
-	return &TransactionIterator{it: it, from: from, to: to}, nil
+func (db *Persistence) QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error) {
+	records, err := db.queryTransactions(driver.QueryTransactionsParams{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return driver.CountDuplicates(records), nil
 }
 
-func (db *Persistence) SetStatus(txID string, status driver.TxStatus) error {
+func (db *Persistence) QueryMultiTypeActions(from, to *time.Time) ([]string, error) {
+	records, err := db.queryTransactions(driver.QueryTransactionsParams{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return driver.MultiTypeActions(records), nil
+}
+
+// queryTransactions returns all the transaction records selected by the passed parameters, sorted and not paged
+func (db *Persistence) queryTransactions(params driver.QueryTransactionsParams) ([]*driver.TransactionRecord, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte("tx")
+	var records []*driver.TransactionRecord
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		var record *TransactionRecord
+		err := item.Value(func(val []byte) error {
+			var err error
+			if record, err = UnmarshalTransactionRecord(val); err != nil {
+				return errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get transaction for key %s", string(item.Key()))
+		}
+
+		// is record in the time range
+		if params.From != nil && record.Record.Timestamp.Before(*params.From) {
+			continue
+		}
+		if params.To != nil && record.Record.Timestamp.After(*params.To) {
+			continue
+		}
+		if len(params.Reference) != 0 && record.Record.Reference != params.Reference {
+			continue
+		}
+		if params.Quarantined != nil && record.Record.Quarantined != *params.Quarantined {
+			continue
+		}
+		if !params.SelectsStatus(record.Record.Status) {
+			continue
+		}
+		if !params.SelectsTransactionType(record.Record.TransactionType) {
+			continue
+		}
+		logger.Debugf("found transaction [%s,%s]", string(item.Key()), record.Record.TxID)
+		records = append(records, record.Record)
+	}
+	driver.SortTransactions(records)
+	return records, nil
+}
+
+func (db *Persistence) QueryLatestTransactions(enrollmentIDs []string) (map[string]*driver.TransactionRecord, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte("tx")
+	res := map[string]*driver.TransactionRecord{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		var record *TransactionRecord
+		err := item.Value(func(val []byte) error {
+			var err error
+			if record, err = UnmarshalTransactionRecord(val); err != nil {
+				return errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get transaction for key %s", string(item.Key()))
+		}
+		if record.Record.Status == driver.Deleted {
+			continue
+		}
+		for _, id := range enrollmentIDs {
+			if record.Record.SenderEID != id && record.Record.RecipientEID != id {
+				continue
+			}
+			if latest, ok := res[id]; ok && latest.Timestamp.After(record.Record.Timestamp) {
+				continue
+			}
+			res[id] = record.Record
+		}
+	}
+	return res, nil
+}
+
+func (db *Persistence) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		record.Status = status
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		record.Status = status
+		record.FailureReason = reason
+		return nil
+	})
+}
+
+func (db *Persistence) Reorg(txID string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		switch record.Status {
+		case driver.Deleted:
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		case driver.Confirmed:
+			record.Status = driver.Pending
+		}
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		switch record.Status {
+		case driver.Deleted:
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		case driver.Confirmed:
+			record.Status = driver.Pending
+			record.Reorgs++
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) Prune(before time.Time) (int, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	keys, err := selectBefore(txn, before, func(status driver.TxStatus) bool {
+		// the movement records of the other transactions back the holdings
+		return status == driver.Deleted
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return 0, errors.Wrapf(err, "could not delete key %s", string(key))
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, errors.Wrap(err, "could not flush pruned keys")
+	}
+	return len(keys), nil
+}
+
+// DeleteTransactionsBefore selects and deletes the records in a single badger transaction.
+// Deleting many records at once may fail with badger.ErrTxnTooBig, in which case nothing is deleted.
+func (db *Persistence) DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error) {
+	txn := db.db.NewTransaction(!dryRun)
+	defer txn.Discard()
+	keys, err := selectBefore(txn, before, func(driver.TxStatus) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+	if dryRun || len(keys) == 0 {
+		return len(keys), nil
+	}
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return 0, errors.Wrapf(err, "could not delete key %s", string(key))
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, errors.Wrap(err, "could not commit deletion")
+	}
+	return len(keys), nil
+}
+
+// selectBefore returns the keys of the transaction records older than the passed time, unless Pending,
+// followed by the keys of the movement records of those transactions whose status is accepted by withMovements
+func selectBefore(txn *badger.Txn, before time.Time, withMovements func(status driver.TxStatus) bool) ([][]byte, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	// select the transaction records to remove
+	var keys [][]byte
+	selected := map[string]bool{}
+	prefix := []byte("tx")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		var record *TransactionRecord
+		err := item.Value(func(val []byte) error {
+			var err error
+			if record, err = UnmarshalTransactionRecord(val); err != nil {
+				return errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get transaction for key %s", string(item.Key()))
+		}
+		if record.Record.Status == driver.Pending || !record.Record.Timestamp.Before(before) {
+			continue
+		}
+		if withMovements(record.Record.Status) {
+			selected[record.Record.TxID] = true
+		}
+		keys = append(keys, item.KeyCopy(nil))
+	}
+	// select the movement records of the selected transactions
+	if len(selected) != 0 {
+		prefix = []byte("mv")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var record *MovementRecord
+			err := item.Value(func(val []byte) error {
+				var err error
+				if record, err = UnmarshalMovementRecord(val); err != nil {
+					return errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not get movement for key %s", string(item.Key()))
+			}
+			if selected[record.Record.TxID] {
+				keys = append(keys, item.KeyCopy(nil))
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (db *Persistence) SetQuarantine(txID string, quarantined bool, reason string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		record.Quarantined = quarantined
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		record.Quarantined = quarantined
+		record.QuarantineReason = reason
+		return nil
+	})
+}
+
+// updateRecords applies the passed update functions to all the movement and transaction records of the passed transaction.
+// If any of the update functions fails, no record is updated.
+func (db *Persistence) updateRecords(txID string, updateMovement func(*driver.MovementRecord) error, updateTransaction func(*driver.TransactionRecord) error) error {
 	// search for all matching keys
 	type Entry struct {
 		key   string
@@ -219,6 +593,7 @@ func (db *Persistence) SetStatus(txID string, status driver.TxStatus) error {
 
 	// update status for all matching keys
 	txn := db.db.NewTransaction(true)
+	defer txn.Discard()
 	for _, entry := range entries {
 		var bytes []byte
 		switch {
@@ -227,7 +602,9 @@ func (db *Persistence) SetStatus(txID string, status driver.TxStatus) error {
 			if err != nil {
 				return errors.Wrapf(err, "could not unmarshal key %s", entry.key)
 			}
-			record.Record.Status = status
+			if err := updateMovement(record.Record); err != nil {
+				return err
+			}
 			bytes, err = MarshalMovementRecord(record)
 			if err != nil {
 				return errors.Wrapf(err, "could not marshal record for key %s", entry.key)
@@ -237,7 +614,9 @@ func (db *Persistence) SetStatus(txID string, status driver.TxStatus) error {
 			if err != nil {
 				return errors.Wrapf(err, "could not unmarshal key %s", entry.key)
 			}
-			record.Record.Status = status
+			if err := updateTransaction(record.Record); err != nil {
+				return err
+			}
 			bytes, err = MarshalTransactionRecord(record)
 			if err != nil {
 				return errors.Wrapf(err, "could not marshal record for key %s", entry.key)
@@ -252,12 +631,24 @@ func (db *Persistence) SetStatus(txID string, status driver.TxStatus) error {
 		}
 	}
 	if err := txn.Commit(); err != nil {
-		txn.Discard()
-		return errors.Wrapf(err, "could not commit transaction to set status for tx %s", txID)
+		return errors.Wrapf(err, "could not commit transaction to update records for tx %s", txID)
 	}
 	return nil
 }
 
+func (db *Persistence) QueryBalances(params driver.QueryBalancesParams) (map[string]*big.Int, error) {
+	records, err := db.QueryMovements(params.EnrollmentIDs, params.TokenTypes, params.Statuses, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return nil, err
+	}
+	return driver.SumByTokenType(records, params)
+}
+
+// QueryMovementSummary folds the selected movements in memory, badger cannot aggregate them
+func (db *Persistence) QueryMovementSummary(params driver.QueryMovementSummaryParams) ([]*driver.MovementSummaryRow, error) {
+	return driver.QueryMovementSummary(db, params)
+}
+
 func (db *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
 	// TODO: Move to stream
 	txn := db.db.NewTransaction(false)
@@ -322,6 +713,46 @@ func (db *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []strin
 	return res, nil
 }
 
+// QueryMovementsByTxID scans the movement records for those of the passed transaction, in insertion order
+func (db *Persistence) QueryMovementsByTxID(txID string) ([]*driver.MovementRecord, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	// keys end with the separator followed by the transaction id
+	var records RecordSlice
+	prefix := []byte("mv")
+	suffix := []byte(keys.NamespaceSeparator + txID)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if !bytes.HasSuffix(item.Key(), suffix) {
+			continue
+		}
+		err := item.Value(func(val []byte) error {
+			if len(val) == 0 {
+				return nil
+			}
+			record, err := UnmarshalMovementRecord(val)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
+		}
+	}
+	sort.Sort(records)
+
+	var res []*driver.MovementRecord
+	for _, record := range records {
+		res = append(res, record.Record)
+	}
+	return res, nil
+}
+
 func (db *Persistence) transactionKey(txID string) (uint64, string, error) {
 	next, err := db.seq.Next()
 	if err != nil {
@@ -349,55 +780,20 @@ func (p RecordSlice) Less(i, j int) bool { return p[i].Id < p[j].Id }
 func (p RecordSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 type TransactionIterator struct {
-	db   *Persistence
-	it   *badger.Iterator
-	from *time.Time
-	to   *time.Time
+	txs    []*driver.TransactionRecord
+	cursor int
 }
 
 func (t *TransactionIterator) Close() {
-	t.it.Close()
 }
 
 func (t *TransactionIterator) Next() (*driver.TransactionRecord, error) {
-	for {
-		if !t.it.Valid() {
-			return nil, nil
-		}
-		item := t.it.Item()
-		if item == nil {
-			return nil, nil
-		}
-
-		if !strings.HasPrefix(string(item.Key()), "tx") {
-			t.it.Next()
-			continue
-		}
-
-		var record *TransactionRecord
-		err := item.Value(func(val []byte) error {
-			var err error
-			if record, err = UnmarshalTransactionRecord(val); err != nil {
-				return errors.Wrapf(err, "could not unmarshal key %s", string(item.Key()))
-			}
-			return nil
-		})
-		if err != nil {
-			return nil, errors.Wrapf(err, "could not get transaction for key %s", string(item.Key()))
-		}
-
-		t.it.Next()
-
-		// is record in the time range
-		if t.from != nil && record.Record.Timestamp.Before(*t.from) {
-			continue
-		}
-		if t.to != nil && record.Record.Timestamp.After(*t.to) {
-			return nil, nil
-		}
-		logger.Debugf("found transaction [%s,%s]", string(item.Key()), record.Record.TxID)
-		return record.Record, nil
+	if t.cursor >= len(t.txs) {
+		return nil, nil
 	}
+	record := t.txs[t.cursor]
+	t.cursor++
+	return record, nil
 }
 
 // kThLexicographicString returns the k-th string of length n over alphabet (a+25) in lexicographic order.
@@ -63,7 +63,7 @@ func TestMovements(t *testing.T) {
 	assert.Len(t, records, 3)
 
 	assert.NoError(t, db.BeginUpdate())
-	assert.NoError(t, db.SetStatus("2", driver.Confirmed))
+	assert.NoError(t, db.SetStatus("2", driver.Confirmed, ""))
 	assert.NoError(t, db.Commit())
 
 	records, err = db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending}, driver.FromLast, driver.Received, 3)
@@ -101,7 +101,7 @@ func TestTransaction(t *testing.T) {
 	assert.NoError(t, db.Commit())
 	t1 := time.Now().UTC()
 
-	it, err := db.QueryTransactions(&t0, &t1)
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{From: &t0, To: &t1})
 	assert.NoError(t, err)
 	for i := 0; i < 20; i++ {
 		tr, err := it.Next()
@@ -111,6 +111,330 @@ func TestTransaction(t *testing.T) {
 	it.Close()
 }
 
+func TestLatestTransactions(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestLatestTransactions")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	t0 := time.Now().UTC()
+	assert.NoError(t, db.BeginUpdate())
+	records := []*driver.TransactionRecord{
+		{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(10), Timestamp: t0, Status: driver.Confirmed},
+		{TxID: "1", TransactionType: driver.Transfer, SenderEID: "alice", RecipientEID: "bob", TokenType: "magic", Amount: big.NewInt(5), Timestamp: t0.Add(time.Second), Status: driver.Confirmed},
+		{TxID: "2", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(3), Timestamp: t0.Add(3 * time.Second), Status: driver.Pending},
+		{TxID: "3", TransactionType: driver.Transfer, SenderEID: "bob", RecipientEID: "charlie", TokenType: "magic", Amount: big.NewInt(2), Timestamp: t0.Add(2 * time.Second), Status: driver.Confirmed},
+	}
+	for _, record := range records {
+		assert.NoError(t, db.AddTransaction(record))
+	}
+	assert.NoError(t, db.Commit())
+
+	latest, err := db.QueryLatestTransactions([]string{"alice", "bob", "dave"})
+	assert.NoError(t, err)
+	assert.Len(t, latest, 2)
+	assert.Equal(t, "2", latest["alice"].TxID)
+	assert.Equal(t, "3", latest["bob"].TxID)
+}
+
+func TestQueryTransactionsOrder(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestQueryTransactionsOrder")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	t0 := time.Now().UTC()
+	assert.NoError(t, db.BeginUpdate())
+	records := []*driver.TransactionRecord{
+		{TxID: "b", ActionIndex: 1, Timestamp: t0},
+		{TxID: "a", ActionIndex: 0, Timestamp: t0},
+		{TxID: "b", ActionIndex: 0, Timestamp: t0},
+		{TxID: "z", ActionIndex: 0, Timestamp: t0.Add(-time.Second)},
+		{TxID: "a", ActionIndex: 1, Timestamp: t0},
+	}
+	for _, record := range records {
+		assert.NoError(t, db.AddTransaction(record))
+	}
+	assert.NoError(t, db.Commit())
+
+	var keys []string
+	for offset := 0; offset < 6; offset += 2 {
+		it, err := db.QueryTransactions(driver.QueryTransactionsParams{Offset: offset, Limit: 2})
+		assert.NoError(t, err)
+		for {
+			tx, err := it.Next()
+			assert.NoError(t, err)
+			if tx == nil {
+				break
+			}
+			keys = append(keys, fmt.Sprintf("%s%d", tx.TxID, tx.ActionIndex))
+		}
+		it.Close()
+	}
+	assert.Equal(t, []string{"z0", "a0", "a1", "b0", "b1"}, keys)
+}
+
+func TestReorg(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestReorg")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "0", EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(10), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(5), Timestamp: time.Now(), Status: driver.Deleted}))
+	assert.NoError(t, db.Commit())
+
+	assert.NoError(t, db.Reorg("0"))
+	movements, err := db.QueryMovements([]string{"alice"}, nil, []driver.TxStatus{driver.Confirmed}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 0)
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, tx.Status)
+	assert.Equal(t, 1, tx.Reorgs)
+	it.Close()
+
+	assert.EqualError(t, db.Reorg("1"), "transaction [1] is deleted")
+}
+
+func TestGetStatus(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestGetStatus")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "11", Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "2", EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(1), Status: driver.Pending}))
+	assert.NoError(t, db.Commit())
+	assert.NoError(t, db.SetStatus("11", driver.Confirmed, ""))
+	assert.NoError(t, db.SetStatus("2", driver.Deleted, ""))
+
+	for txID, expected := range map[string]driver.TxStatus{"1": driver.Pending, "11": driver.Confirmed, "2": driver.Deleted, "3": ""} {
+		status, err := db.GetStatus(txID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, status, "status of [%s]", txID)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestFailureReason")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "magic", Amount: big.NewInt(5), Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.Commit())
+
+	assert.NoError(t, db.SetStatus("0", driver.Confirmed, ""))
+	assert.NoError(t, db.SetStatus("1", driver.Deleted, "mvcc conflict"))
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{Statuses: []driver.TxStatus{driver.Deleted}})
+	assert.NoError(t, err)
+	tx, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", tx.TxID)
+	assert.Equal(t, "mvcc conflict", tx.FailureReason)
+	tx, err = it.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, tx)
+	it.Close()
+}
+
+func TestQueryMultiTypeActions(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestQueryMultiTypeActions")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	assert.NoError(t, db.BeginUpdate())
+	for _, record := range []*driver.TransactionRecord{
+		{TxID: "swap", ActionIndex: 0, TokenType: "EUR"},
+		{TxID: "swap", ActionIndex: 0, TokenType: "USD"},
+		{TxID: "transfer", ActionIndex: 0, TokenType: "EUR"},
+		{TxID: "transfer", ActionIndex: 1, TokenType: "USD"},
+	} {
+		record.TransactionType = driver.Transfer
+		record.Amount = big.NewInt(1)
+		record.Timestamp = now
+		assert.NoError(t, db.AddTransaction(record))
+	}
+	assert.NoError(t, db.Commit())
+
+	txIDs, err := db.QueryMultiTypeActions(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"swap"}, txIDs)
+}
+
+func TestPrune(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestPrune")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	now := time.Now().UTC()
+	assert.NoError(t, db.BeginUpdate())
+	for _, record := range []*driver.TransactionRecord{
+		{TxID: "0", Timestamp: now.Add(-2 * time.Hour), Status: driver.Confirmed},
+		{TxID: "1", Timestamp: now.Add(-2 * time.Hour), Status: driver.Deleted},
+		{TxID: "2", Timestamp: now.Add(-2 * time.Hour), Status: driver.Pending},
+		{TxID: "3", Timestamp: now, Status: driver.Confirmed},
+	} {
+		assert.NoError(t, db.AddTransaction(record))
+		assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: record.TxID, EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(1), Status: record.Status}))
+	}
+	assert.NoError(t, db.Commit())
+
+	removed, err := db.Prune(now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	var txIDs []string
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			break
+		}
+		txIDs = append(txIDs, tx.TxID)
+	}
+	assert.Equal(t, []string{"2", "3"}, txIDs)
+	movements, err := db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 3)
+}
+
+func TestDeleteTransactionsBefore(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestDeleteTransactionsBefore")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	now := time.Now().UTC()
+	assert.NoError(t, db.BeginUpdate())
+	for _, record := range []*driver.TransactionRecord{
+		{TxID: "0", Timestamp: now.Add(-2 * time.Hour), Status: driver.Confirmed},
+		{TxID: "1", Timestamp: now.Add(-2 * time.Hour), Status: driver.Deleted},
+		{TxID: "2", Timestamp: now.Add(-2 * time.Hour), Status: driver.Pending},
+		{TxID: "3", Timestamp: now, Status: driver.Confirmed},
+	} {
+		assert.NoError(t, db.AddTransaction(record))
+		assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: record.TxID, EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(1), Status: record.Status}))
+	}
+	assert.NoError(t, db.Commit())
+
+	// the dry run only counts
+	count, err := db.DeleteTransactionsBefore(now.Add(-time.Hour), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	movements, err := db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 4)
+
+	removed, err := db.DeleteTransactionsBefore(now.Add(-time.Hour), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	var txIDs []string
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			break
+		}
+		txIDs = append(txIDs, tx.TxID)
+	}
+	assert.Equal(t, []string{"2", "3"}, txIDs)
+	movements, err = db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, movements, 2)
+}
+
+func TestDeleteTransactions(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestDeleteTransactions")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	for _, txID := range []string{"1", "11", "1", "2"} {
+		assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: txID, Timestamp: time.Now()}))
+	}
+	assert.NoError(t, db.Commit())
+
+	_, err = db.DeleteTransactions("1")
+	assert.EqualError(t, err, "no commit in progress")
+	assert.NoError(t, db.BeginUpdate())
+	deleted, err := db.DeleteTransactions("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.NoError(t, db.Commit())
+
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	var txIDs []string
+	for {
+		tx, err := it.Next()
+		assert.NoError(t, err)
+		if tx == nil {
+			break
+		}
+		txIDs = append(txIDs, tx.TxID)
+	}
+	assert.Equal(t, []string{"11", "2"}, txIDs)
+}
+
+func TestQueryMovementsByTxID(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestQueryMovementsByTxID")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	for i, txID := range []string{"1", "11", "1", "2"} {
+		assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: txID, EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(int64(i)), Status: driver.Pending}))
+	}
+	assert.NoError(t, db.Commit())
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.SetStatus("1", driver.Deleted, ""))
+	assert.NoError(t, db.Commit())
+
+	// all the movements of the transaction, whatever their status, in the order they have been added
+	records, err := db.QueryMovementsByTxID("1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	for i, record := range records {
+		assert.Equal(t, "1", record.TxID)
+		assert.Equal(t, driver.Deleted, record.Status)
+		assert.Equal(t, int64(2*i), record.Amount.Int64())
+	}
+
+	records, err = db.QueryMovementsByTxID("3")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
 func TestKThLexicographicString(t *testing.T) {
 	var list []string
 	for i := 0; i < 100; i++ {
@@ -135,3 +459,26 @@ func TestMain(m *testing.M) {
 
 	m.Run()
 }
+
+func TestQueryBalances(t *testing.T) {
+	dbpath := filepath.Join(tempDir, "DB-TestQueryBalances")
+	db, err := OpenDB(dbpath)
+	defer db.Close()
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "0", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(-4), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "bob", TokenType: "EUR", Amount: big.NewInt(4), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "2", EnrollmentID: "alice", TokenType: "USD", Amount: big.NewInt(5), Status: driver.Pending}))
+	assert.NoError(t, db.Commit())
+
+	balances, err := db.QueryBalances(driver.QueryBalancesParams{EnrollmentIDs: []string{"alice"}, Statuses: []driver.TxStatus{driver.Confirmed}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(6)}, balances)
+
+	balances, err = db.QueryBalances(driver.QueryBalancesParams{Statuses: []driver.TxStatus{driver.Confirmed, driver.Pending}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(10), "USD": big.NewInt(5)}, balances)
+}
@@ -6,9 +6,11 @@ SPDX-License-Identifier: Apache-2.0
 package badger
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/dgraph-io/badger/v3"
 	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/flogging"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
@@ -31,6 +33,7 @@ func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, err
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed getting opts for vault")
 	}
+	root := opts.Path
 	opts.Path = filepath.Join(opts.Path, name)
 	logger.Debugf("init kvs with badger at [%s]", opts.Path)
 
@@ -38,6 +41,9 @@ func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, err
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed creating folders for vault [%s]", opts.Path)
 	}
+	if err := migrateLegacyDB(root, opts.Path); err != nil {
+		return nil, errors.WithMessagef(err, "failed migrating vault [%s] to [%s]", root, opts.Path)
+	}
 	persistence, err := OpenDB(opts.Path)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed opening vault [%s]", opts.Path)
@@ -45,6 +51,35 @@ func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, err
 	return persistence, nil
 }
 
+// migrateLegacyDB moves the database found directly in root, where audit dbs were stored before
+// being kept in a folder per wallet, to path, unless path already contains a database.
+// Only the files of root are moved, the folders of the other wallets are left in place.
+func migrateLegacyDB(root, path string) error {
+	if root == path || !isDB(root) || isDB(path) {
+		return nil
+	}
+	logger.Warnf("moving audit db found at [%s] to [%s]", root, path)
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed listing [%s]", root)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := os.Rename(filepath.Join(root, entry.Name()), filepath.Join(path, entry.Name())); err != nil {
+			return errors.Wrapf(err, "failed moving [%s]", entry.Name())
+		}
+	}
+	return nil
+}
+
+// isDB returns true if the passed folder contains a badger database
+func isDB(path string) bool {
+	_, err := os.Stat(filepath.Join(path, badger.ManifestFilename))
+	return err == nil
+}
+
 func init() {
 	auditdb.Register("badger", &Driver{})
 }
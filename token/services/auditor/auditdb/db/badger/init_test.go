@@ -0,0 +1,77 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package badger
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	driver2 "github.com/hyperledger-labs/fabric-smart-client/platform/view/driver"
+	registry2 "github.com/hyperledger-labs/fabric-smart-client/platform/view/services/registry"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+)
+
+// configService returns the badger options with the configured path
+type configService struct {
+	driver2.ConfigService
+	path string
+}
+
+func (c *configService) UnmarshalKey(key string, rawVal interface{}) error {
+	*(rawVal.(*Opts)) = Opts{Path: c.path}
+	return nil
+}
+
+func TestOpenLegacyDB(t *testing.T) {
+	// audit dbs used to be stored directly in the configured path
+	root := filepath.Join(tempDir, "DB-TestOpenLegacyDB")
+	db, err := OpenDB(root)
+	assert.NoError(t, err)
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{
+		TxID: "tx1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR",
+		Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Confirmed,
+	}))
+	assert.NoError(t, db.Commit())
+	assert.NoError(t, db.Close())
+
+	registry := registry2.New()
+	assert.NoError(t, registry.RegisterService(&configService{path: root}))
+	m := auditdb.NewManager(registry, "badger", auditdb.WithWalletKeyFunc(func(*token.AuditorWallet) string {
+		return "auditor"
+	}))
+
+	// the history is found by the manager, once moved in the folder of the wallet
+	adb, err := m.AuditDB(nil)
+	assert.NoError(t, err)
+	assertTxIDs(t, adb, "tx1")
+	assert.False(t, isDB(root))
+	assert.True(t, isDB(filepath.Join(root, "auditor")))
+}
+
+func assertTxIDs(t *testing.T, db *auditdb.AuditDB, expected ...string) {
+	qe := db.NewQueryExecutor()
+	defer qe.Done()
+	it, err := qe.Transactions(nil, nil)
+	assert.NoError(t, err)
+	defer it.Close()
+	var txIDs []string
+	for {
+		tr, err := it.Next()
+		assert.NoError(t, err)
+		if tr == nil {
+			break
+		}
+		txIDs = append(txIDs, tr.TxID)
+	}
+	assert.Equal(t, expected, txIDs)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package leveldb
+
+import (
+	"os"
+	"path/filepath"
+
+	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/flogging"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+)
+
+var logger = flogging.MustGetLogger("token-sdk.auditor.auditdb.leveldb")
+
+type Opts struct {
+	Path string
+}
+
+type Driver struct {
+}
+
+// Open opens the LevelDB database in the folder named after the passed namespace, under the configured path
+func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, error) {
+	opts := &Opts{}
+	err := view2.GetConfigService(sp).UnmarshalKey("token.auditor.auditdb.persistence.opts", opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting opts for audit db")
+	}
+	opts.Path = filepath.Join(opts.Path, name)
+	logger.Debugf("init leveldb at [%s]", opts.Path)
+	if err := os.MkdirAll(opts.Path, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed creating folders for audit db [%s]", opts.Path)
+	}
+
+	persistence, err := OpenDB(opts.Path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed opening audit db [%s]", opts.Path)
+	}
+	return persistence, nil
+}
+
+func init() {
+	auditdb.Register("leveldb", &Driver{})
+}
@@ -0,0 +1,1043 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package leveldb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Records are stored as JSON under their sequence number, which keeps the insertion order.
+// The indexes are composite keys, whose components are separated by keySeparator, ending with the sequence
+// number of the record they point to. Index keys have no value.
+const (
+	// movementPrefix keys the movement records: mv|seq
+	movementPrefix = "mv"
+	// transactionPrefix keys the transaction records: tx|seq
+	transactionPrefix = "tx"
+	// movementByEIDPrefix indexes the movement records by enrollment ID and token type: me|eID|type|txID|seq
+	movementByEIDPrefix = "me"
+	// movementByTxIDPrefix indexes the movement records by transaction: mt|txID|seq
+	movementByTxIDPrefix = "mt"
+	// transactionByTxIDPrefix indexes the transaction records by transaction: tt|txID|seq
+	transactionByTxIDPrefix = "tt"
+	// transactionByTimePrefix indexes the transaction records by timestamp: ts|timestamp|seq
+	transactionByTimePrefix = "ts"
+	// uniqueKeyPrefix indexes the transaction records by driver.UniqueKey: tu|unique key|seq
+	uniqueKeyPrefix = "tu"
+	// uniqueConstraintsKey is set once the unique constraints are in place
+	uniqueConstraintsKey = "unique"
+
+	// keySeparator separates the components of the composite keys
+	keySeparator = "\x00"
+	// timestampLayout formats the timestamps of the time index so that their lexicographic order is the chronological one
+	timestampLayout = "2006-01-02T15:04:05.000000000"
+)
+
+// syncWrites makes each commit durable before returning, so that a committed update survives a crash
+var syncWrites = &opt.WriteOptions{Sync: true}
+
+// Persistence is an audit db backed by LevelDB.
+// Updates are collected in a write batch, which LevelDB applies atomically: after a crash,
+// either all the records of an update are found or none.
+type Persistence struct {
+	db *leveldb.DB
+	// mutex guards the update in progress and the sequence
+	mutex  sync.Mutex
+	update *update
+	seq    uint64
+}
+
+// OpenDB opens, creating it if needed, the LevelDB database at the passed path
+func OpenDB(path string) (*Persistence, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open DB at '%s'", path)
+	}
+	// the sequence resumes from the last record
+	var seq uint64
+	for _, prefix := range []string{movementPrefix, transactionPrefix} {
+		it := db.NewIterator(util.BytesPrefix([]byte(prefix+keySeparator)), nil)
+		if it.Last() {
+			last, err := strconv.ParseUint(seqOf(string(it.Key())), 16, 64)
+			if err != nil {
+				it.Release()
+				_ = db.Close()
+				return nil, errors.Wrapf(err, "invalid key %s in DB at '%s'", string(it.Key()), path)
+			}
+			if last > seq {
+				seq = last
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			_ = db.Close()
+			return nil, errors.Wrapf(err, "could not read DB at '%s'", path)
+		}
+	}
+	return &Persistence{db: db, seq: seq}, nil
+}
+
+// Close discards the update in progress, if any, and closes the database
+func (db *Persistence) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.update = nil
+	if err := db.db.Close(); err != nil {
+		return errors.Wrap(err, "could not close DB")
+	}
+	return nil
+}
+
+func (db *Persistence) BeginUpdate() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.update != nil {
+		return errors.New("previous commit in progress")
+	}
+	db.update = newUpdate()
+	return nil
+}
+
+// Commit writes the batch of the update in progress. If the write fails, the update is left in progress
+// to be discarded.
+func (db *Persistence) Commit() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.update == nil {
+		return errors.New("no commit in progress")
+	}
+	if err := db.db.Write(db.update.batch, syncWrites); err != nil {
+		return errors.Wrap(err, "could not commit batch")
+	}
+	db.update = nil
+	return nil
+}
+
+func (db *Persistence) Discard() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.update == nil {
+		return errors.New("no commit in progress")
+	}
+	db.update = nil
+	return nil
+}
+
+// Sync is a no-op, commits are written synchronously
+func (db *Persistence) Sync() error {
+	return nil
+}
+
+func (db *Persistence) AddMovement(record *driver.MovementRecord) error {
+	return db.AddMovements([]*driver.MovementRecord{record})
+}
+
+func (db *Persistence) AddTransaction(record *driver.TransactionRecord) error {
+	return db.AddTransactions([]*driver.TransactionRecord{record})
+}
+
+// AddMovements adds the passed movement records to the batch of the update in progress, or writes them in a batch
+// of their own if no update is in progress
+func (db *Persistence) AddMovements(records []*driver.MovementRecord) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.atomically(func(u *update) error {
+		for _, record := range records {
+			logger.Debugf("Adding movement record [%s:%s:%s:%s]", record.TxID, record.TokenType, record.EnrollmentID, record.Amount)
+			if err := u.putMovement(db.next(), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddTransactions adds the passed transaction records to the batch of the update in progress, or writes them
+// in a batch of their own if no update is in progress
+func (db *Persistence) AddTransactions(records []*driver.TransactionRecord) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.atomically(func(u *update) error {
+		v := db.view(u)
+		unique, err := v.uniqueConstraints()
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if unique {
+				keys, err := v.keys(key(uniqueKeyPrefix, driver.UniqueKey(record), ""))
+				if err != nil {
+					return err
+				}
+				if len(keys) != 0 {
+					return errors.Wrapf(driver.ErrDuplicateTransaction, "txid [%s], action index [%d]", record.TxID, record.ActionIndex)
+				}
+			}
+			if err := u.putTransaction(db.next(), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// EnsureUniqueConstraints checks the unique key index for duplicates and, if none is found,
+// records that the constraints are in place. The constraints survive the reopening of the database.
+func (db *Persistence) EnsureUniqueConstraints() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.atomically(func(u *update) error {
+		v := db.view(u)
+		unique, err := v.uniqueConstraints()
+		if err != nil || unique {
+			return err
+		}
+		keys, err := v.keys(uniqueKeyPrefix + keySeparator)
+		if err != nil {
+			return err
+		}
+		for i := 1; i < len(keys); i++ {
+			if withoutSeq(keys[i]) != withoutSeq(keys[i-1]) {
+				continue
+			}
+			record, err := v.transaction(seqOf(keys[i]))
+			if err != nil {
+				return err
+			}
+			return errors.Wrapf(driver.ErrDuplicateTransaction, "txid [%s], action index [%d]", record.TxID, record.ActionIndex)
+		}
+		u.put(uniqueConstraintsKey, []byte("true"))
+		return nil
+	})
+}
+
+// Snapshot reads all the records from a LevelDB snapshot, in insertion order
+func (db *Persistence) Snapshot() (*driver.Snapshot, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get DB snapshot")
+	}
+	defer snap.Release()
+	v := &view{r: snap}
+
+	s := &driver.Snapshot{}
+	keys, err := v.keys(movementPrefix + keySeparator)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		record, err := v.movement(seqOf(k))
+		if err != nil {
+			return nil, err
+		}
+		s.Movements = append(s.Movements, record)
+	}
+	keys, err = v.keys(transactionPrefix + keySeparator)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		record, err := v.transaction(seqOf(k))
+		if err != nil {
+			return nil, err
+		}
+		s.Transactions = append(s.Transactions, record)
+	}
+	return s, nil
+}
+
+// Restore writes the records of the passed snapshot in a single batch
+func (db *Persistence) Restore(snapshot *driver.Snapshot) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.atomically(func(u *update) error {
+		v := db.view(u)
+		for _, prefix := range []string{movementPrefix, transactionPrefix} {
+			keys, err := v.keys(prefix + keySeparator)
+			if err != nil {
+				return err
+			}
+			if len(keys) != 0 {
+				return errors.New("cannot restore a snapshot into a non-empty audit db")
+			}
+		}
+		unique, err := v.uniqueConstraints()
+		if err != nil {
+			return err
+		}
+		if duplicates := driver.CountDuplicates(snapshot.Transactions); unique && len(duplicates) != 0 {
+			return errors.Wrapf(driver.ErrDuplicateTransaction, "snapshot holds duplicates of [%d] transactions", len(duplicates))
+		}
+		for _, record := range snapshot.Movements {
+			if err := u.putMovement(db.next(), record); err != nil {
+				return err
+			}
+		}
+		for _, record := range snapshot.Transactions {
+			if err := u.putTransaction(db.next(), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) DeleteTransactions(txID string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	deleted := 0
+	err := db.atomically(func(u *update) error {
+		seqs, records, err := db.view(u).transactionsOf(txID)
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			u.deleteTransaction(seqs[i], record)
+		}
+		deleted = len(records)
+		return nil
+	})
+	return deleted, err
+}
+
+func (db *Persistence) DeleteMovements(txID string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	deleted := 0
+	err := db.atomically(func(u *update) error {
+		seqs, records, err := db.view(u).movementsOf(txID)
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			u.deleteMovement(seqs[i], record)
+		}
+		deleted = len(records)
+		return nil
+	})
+	return deleted, err
+}
+
+// GetStatus reads the status from the transaction records of the passed transaction or, if there are none,
+// from its movement records
+func (db *Persistence) GetStatus(txID string) (driver.TxStatus, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	v := db.view(db.update)
+	_, transactions, err := v.transactionsOf(txID)
+	if err != nil {
+		return "", err
+	}
+	if len(transactions) != 0 {
+		return transactions[0].Status, nil
+	}
+	_, movements, err := v.movementsOf(txID)
+	if err != nil {
+		return "", err
+	}
+	if len(movements) != 0 {
+		return movements[0].Status, nil
+	}
+	return "", nil
+}
+
+func (db *Persistence) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		record.Status = status
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		record.Status = status
+		record.FailureReason = reason
+		return nil
+	})
+}
+
+func (db *Persistence) Reorg(txID string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		switch record.Status {
+		case driver.Deleted:
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		case driver.Confirmed:
+			record.Status = driver.Pending
+		}
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		switch record.Status {
+		case driver.Deleted:
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		case driver.Confirmed:
+			record.Status = driver.Pending
+			record.Reorgs++
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) SetQuarantine(txID string, quarantined bool, reason string) error {
+	return db.updateRecords(txID, func(record *driver.MovementRecord) error {
+		record.Quarantined = quarantined
+		return nil
+	}, func(record *driver.TransactionRecord) error {
+		record.Quarantined = quarantined
+		record.QuarantineReason = reason
+		return nil
+	})
+}
+
+// updateRecords applies the passed update functions to all the movement and transaction records of the passed transaction.
+// If any of the update functions fails, no record is updated.
+func (db *Persistence) updateRecords(txID string, updateMovement func(*driver.MovementRecord) error, updateTransaction func(*driver.TransactionRecord) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.atomically(func(u *update) error {
+		v := db.view(u)
+		movementSeqs, movements, err := v.movementsOf(txID)
+		if err != nil {
+			return err
+		}
+		transactionSeqs, transactions, err := v.transactionsOf(txID)
+		if err != nil {
+			return err
+		}
+		for _, record := range movements {
+			if err := updateMovement(record); err != nil {
+				return err
+			}
+		}
+		for _, record := range transactions {
+			if err := updateTransaction(record); err != nil {
+				return err
+			}
+		}
+		for i, record := range movements {
+			if err := u.putMovement(movementSeqs[i], record); err != nil {
+				return err
+			}
+		}
+		for i, record := range transactions {
+			if err := u.putTransaction(transactionSeqs[i], record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) Prune(before time.Time) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	deleted := 0
+	err := db.atomically(func(u *update) error {
+		var err error
+		deleted, err = db.deleteBefore(u, before, func(status driver.TxStatus) bool {
+			// the movement records of the other transactions back the holdings
+			return status == driver.Deleted
+		})
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteTransactionsBefore deletes the selected records in a single batch
+func (db *Persistence) DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	withMovements := func(driver.TxStatus) bool { return true }
+	if dryRun {
+		// the deletions are collected in an update that is never written
+		return db.deleteBefore(newUpdate(), before, withMovements)
+	}
+	deleted := 0
+	err := db.atomically(func(u *update) error {
+		var err error
+		deleted, err = db.deleteBefore(u, before, withMovements)
+		return err
+	})
+	return deleted, err
+}
+
+// deleteBefore deletes, as part of the passed update, the transaction records older than the passed time, unless Pending,
+// and the movement records of those transactions whose status is accepted by withMovements.
+// It returns the number of deleted records.
+func (db *Persistence) deleteBefore(u *update, before time.Time, withMovements func(status driver.TxStatus) bool) (int, error) {
+	v := db.view(u)
+	keys, err := v.rangeKeys(&util.Range{
+		Start: []byte(transactionByTimePrefix + keySeparator),
+		Limit: []byte(key(transactionByTimePrefix, before.UTC().Format(timestampLayout))),
+	})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	var selected []string
+	for _, k := range keys {
+		seq := seqOf(k)
+		record, err := v.transaction(seq)
+		if err != nil {
+			return 0, err
+		}
+		if record.Status == driver.Pending {
+			continue
+		}
+		u.deleteTransaction(seq, record)
+		deleted++
+		if withMovements(record.Status) {
+			selected = append(selected, record.TxID)
+		}
+	}
+	for _, txID := range selected {
+		seqs, records, err := v.movementsOf(txID)
+		if err != nil {
+			return 0, err
+		}
+		for i, record := range records {
+			u.deleteMovement(seqs[i], record)
+		}
+		deleted += len(records)
+	}
+	return deleted, nil
+}
+
+func (db *Persistence) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	records, err := db.queryTransactions(params)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionIterator{txs: params.Page(records)}, nil
+}
+
+func (db *Persistence) QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error) {
+	records, err := db.queryTransactions(driver.QueryTransactionsParams{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return driver.CountDuplicates(records), nil
+}
+
+func (db *Persistence) QueryMultiTypeActions(from, to *time.Time) ([]string, error) {
+	records, err := db.queryTransactions(driver.QueryTransactionsParams{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	return driver.MultiTypeActions(records), nil
+}
+
+// queryTransactions iterates the time index over the interval of the passed parameters, and returns all
+// the transaction records selected by the other parameters, sorted and not paged
+func (db *Persistence) queryTransactions(params driver.QueryTransactionsParams) ([]*driver.TransactionRecord, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get DB snapshot")
+	}
+	defer snap.Release()
+	v := &view{r: snap}
+
+	rng := util.BytesPrefix([]byte(transactionByTimePrefix + keySeparator))
+	if params.From != nil {
+		rng.Start = []byte(key(transactionByTimePrefix, params.From.UTC().Format(timestampLayout)))
+	}
+	if params.To != nil {
+		// the upper bound is included
+		rng.Limit = []byte(key(transactionByTimePrefix, params.To.UTC().Format(timestampLayout), "\xff"))
+	}
+	keys, err := v.rangeKeys(rng)
+	if err != nil {
+		return nil, err
+	}
+	var records []*driver.TransactionRecord
+	for _, k := range keys {
+		record, err := v.transaction(seqOf(k))
+		if err != nil {
+			return nil, err
+		}
+		if len(params.Reference) != 0 && record.Reference != params.Reference {
+			continue
+		}
+		if params.Quarantined != nil && record.Quarantined != *params.Quarantined {
+			continue
+		}
+		if !params.SelectsStatus(record.Status) {
+			continue
+		}
+		if !params.SelectsTransactionType(record.TransactionType) {
+			continue
+		}
+		records = append(records, record)
+	}
+	driver.SortTransactions(records)
+	return records, nil
+}
+
+func (db *Persistence) QueryLatestTransactions(enrollmentIDs []string) (map[string]*driver.TransactionRecord, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get DB snapshot")
+	}
+	defer snap.Release()
+	v := &view{r: snap}
+
+	keys, err := v.keys(transactionPrefix + keySeparator)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]*driver.TransactionRecord{}
+	for _, k := range keys {
+		record, err := v.transaction(seqOf(k))
+		if err != nil {
+			return nil, err
+		}
+		if record.Status == driver.Deleted {
+			continue
+		}
+		for _, id := range enrollmentIDs {
+			if record.SenderEID != id && record.RecipientEID != id {
+				continue
+			}
+			if latest, ok := res[id]; ok && latest.Timestamp.After(record.Timestamp) {
+				continue
+			}
+			res[id] = record
+		}
+	}
+	return res, nil
+}
+
+func (db *Persistence) QueryBalances(params driver.QueryBalancesParams) (map[string]*big.Int, error) {
+	records, err := db.QueryMovements(params.EnrollmentIDs, params.TokenTypes, params.Statuses, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return nil, err
+	}
+	return driver.SumByTokenType(records, params)
+}
+
+// QueryMovementSummary folds the selected movements in memory, LevelDB cannot aggregate them
+func (db *Persistence) QueryMovementSummary(params driver.QueryMovementSummaryParams) ([]*driver.MovementSummaryRow, error) {
+	return driver.QueryMovementSummary(db, params)
+}
+
+// QueryMovements scans the enrollment ID index, by enrollment ID and token type, when enrollment IDs are passed,
+// and all the movement records otherwise
+func (db *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get DB snapshot")
+	}
+	defer snap.Release()
+	v := &view{r: snap}
+
+	var seqs []string
+	if len(enrollmentIDs) == 0 {
+		keys, err := v.keys(movementPrefix + keySeparator)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			seqs = append(seqs, seqOf(k))
+		}
+	} else {
+		var prefixes []string
+		for _, eID := range enrollmentIDs {
+			if len(tokenTypes) == 0 {
+				prefixes = append(prefixes, key(movementByEIDPrefix, eID, ""))
+				continue
+			}
+			for _, tokenType := range tokenTypes {
+				prefixes = append(prefixes, key(movementByEIDPrefix, eID, tokenType, ""))
+			}
+		}
+		found := map[string]bool{}
+		for _, prefix := range prefixes {
+			keys, err := v.keys(prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range keys {
+				if seq := seqOf(k); !found[seq] {
+					found[seq] = true
+					seqs = append(seqs, seq)
+				}
+			}
+		}
+		// sequence numbers have a fixed width, their lexicographic order is the insertion order
+		sort.Strings(seqs)
+	}
+	if searchDirection == driver.FromLast {
+		for i, j := 0, len(seqs)-1; i < j; i, j = i+1, j-1 {
+			seqs[i], seqs[j] = seqs[j], seqs[i]
+		}
+	}
+
+	var records []*driver.MovementRecord
+	for _, seq := range seqs {
+		record, err := v.movement(seq)
+		if err != nil {
+			return nil, err
+		}
+		if !selectMovement(record, tokenTypes, txStatuses, movementDirection) {
+			continue
+		}
+		records = append(records, record)
+		if numRecords > 0 && len(records) == numRecords {
+			break
+		}
+	}
+	return records, nil
+}
+
+// QueryMovementsByTxID scans the transaction index of the movement records, in insertion order
+func (db *Persistence) QueryMovementsByTxID(txID string) ([]*driver.MovementRecord, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get DB snapshot")
+	}
+	defer snap.Release()
+
+	_, records, err := (&view{r: snap}).movementsOf(txID)
+	return records, err
+}
+
+// atomically runs the passed function on the update in progress or, if there is none, on a new update
+// written right after. The caller must hold the mutex.
+func (db *Persistence) atomically(f func(u *update) error) error {
+	if db.update != nil {
+		return f(db.update)
+	}
+	u := newUpdate()
+	if err := f(u); err != nil {
+		return err
+	}
+	if err := db.db.Write(u.batch, syncWrites); err != nil {
+		return errors.Wrap(err, "could not write batch")
+	}
+	return nil
+}
+
+// next returns the next sequence number. The caller must hold the mutex.
+func (db *Persistence) next() string {
+	db.seq++
+	return fmt.Sprintf("%016x", db.seq)
+}
+
+// view returns a view of the database that includes the writes of the passed update, if not nil
+func (db *Persistence) view(u *update) *view {
+	return &view{r: db.db, u: u}
+}
+
+// update collects the writes of an update in a write batch.
+// The writes are also indexed by key, so that the reads of the update see them.
+type update struct {
+	batch *leveldb.Batch
+	// writes holds the values written so far, nil for the deleted keys
+	writes map[string][]byte
+}
+
+func newUpdate() *update {
+	return &update{batch: new(leveldb.Batch), writes: map[string][]byte{}}
+}
+
+func (u *update) put(key string, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	u.batch.Put([]byte(key), value)
+	u.writes[key] = value
+}
+
+func (u *update) delete(key string) {
+	u.batch.Delete([]byte(key))
+	u.writes[key] = nil
+}
+
+func (u *update) putMovement(seq string, record *driver.MovementRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal movement record of tx [%s]", record.TxID)
+	}
+	u.put(key(movementPrefix, seq), value)
+	for _, k := range movementIndexKeys(seq, record) {
+		u.put(k, nil)
+	}
+	return nil
+}
+
+func (u *update) deleteMovement(seq string, record *driver.MovementRecord) {
+	u.delete(key(movementPrefix, seq))
+	for _, k := range movementIndexKeys(seq, record) {
+		u.delete(k)
+	}
+}
+
+func (u *update) putTransaction(seq string, record *driver.TransactionRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal transaction record of tx [%s]", record.TxID)
+	}
+	u.put(key(transactionPrefix, seq), value)
+	for _, k := range transactionIndexKeys(seq, record) {
+		u.put(k, nil)
+	}
+	return nil
+}
+
+func (u *update) deleteTransaction(seq string, record *driver.TransactionRecord) {
+	u.delete(key(transactionPrefix, seq))
+	for _, k := range transactionIndexKeys(seq, record) {
+		u.delete(k)
+	}
+}
+
+// reader is implemented by both the database and its snapshots
+type reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// view reads the records through the passed reader, overlaid with the writes of the update, if not nil
+type view struct {
+	r reader
+	u *update
+}
+
+// get returns the value of the passed key, or nil if the key is not found
+func (v *view) get(k string) ([]byte, error) {
+	if v.u != nil {
+		if value, ok := v.u.writes[k]; ok {
+			return value, nil
+		}
+	}
+	value, err := v.r.Get([]byte(k), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get key %s", k)
+	}
+	return value, nil
+}
+
+// keys returns, in order, the keys with the passed prefix
+func (v *view) keys(prefix string) ([]string, error) {
+	return v.rangeKeys(util.BytesPrefix([]byte(prefix)))
+}
+
+// rangeKeys returns, in order, the keys in the passed range
+func (v *view) rangeKeys(rng *util.Range) ([]string, error) {
+	it := v.r.NewIterator(rng, nil)
+	defer it.Release()
+	var keys []string
+	for it.Next() {
+		k := string(it.Key())
+		if v.u != nil {
+			if _, ok := v.u.writes[k]; ok {
+				// the key is taken from the writes below, unless deleted
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	if err := it.Error(); err != nil {
+		return nil, errors.Wrap(err, "could not iterate keys")
+	}
+	if v.u == nil {
+		return keys, nil
+	}
+	added := false
+	for k, value := range v.u.writes {
+		if value == nil || k < string(rng.Start) || (rng.Limit != nil && k >= string(rng.Limit)) {
+			continue
+		}
+		keys = append(keys, k)
+		added = true
+	}
+	if added {
+		sort.Strings(keys)
+	}
+	return keys, nil
+}
+
+func (v *view) uniqueConstraints() (bool, error) {
+	value, err := v.get(uniqueConstraintsKey)
+	return value != nil, err
+}
+
+func (v *view) movement(seq string) (*driver.MovementRecord, error) {
+	value, err := v.get(key(movementPrefix, seq))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, errors.Errorf("movement record [%s] not found", seq)
+	}
+	record := &driver.MovementRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal movement record [%s]", seq)
+	}
+	return record, nil
+}
+
+func (v *view) transaction(seq string) (*driver.TransactionRecord, error) {
+	value, err := v.get(key(transactionPrefix, seq))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, errors.Errorf("transaction record [%s] not found", seq)
+	}
+	record := &driver.TransactionRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal transaction record [%s]", seq)
+	}
+	return record, nil
+}
+
+// movementsOf returns the movement records of the passed transaction, in insertion order, with their sequence numbers
+func (v *view) movementsOf(txID string) ([]string, []*driver.MovementRecord, error) {
+	keys, err := v.keys(key(movementByTxIDPrefix, txID, ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	seqs := make([]string, len(keys))
+	records := make([]*driver.MovementRecord, len(keys))
+	for i, k := range keys {
+		seqs[i] = seqOf(k)
+		if records[i], err = v.movement(seqs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seqs, records, nil
+}
+
+// transactionsOf returns the transaction records of the passed transaction, in insertion order, with their sequence numbers
+func (v *view) transactionsOf(txID string) ([]string, []*driver.TransactionRecord, error) {
+	keys, err := v.keys(key(transactionByTxIDPrefix, txID, ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	seqs := make([]string, len(keys))
+	records := make([]*driver.TransactionRecord, len(keys))
+	for i, k := range keys {
+		seqs[i] = seqOf(k)
+		if records[i], err = v.transaction(seqs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seqs, records, nil
+}
+
+func movementIndexKeys(seq string, record *driver.MovementRecord) []string {
+	return []string{
+		key(movementByEIDPrefix, record.EnrollmentID, record.TokenType, record.TxID, seq),
+		key(movementByTxIDPrefix, record.TxID, seq),
+	}
+}
+
+func transactionIndexKeys(seq string, record *driver.TransactionRecord) []string {
+	return []string{
+		key(transactionByTxIDPrefix, record.TxID, seq),
+		key(transactionByTimePrefix, record.Timestamp.UTC().Format(timestampLayout), seq),
+		key(uniqueKeyPrefix, driver.UniqueKey(record), seq),
+	}
+}
+
+// key joins the passed components into a composite key.
+// An empty last component makes the key a prefix of the keys extending it.
+func key(components ...string) string {
+	return strings.Join(components, keySeparator)
+}
+
+// seqOf returns the sequence number a key ends with
+func seqOf(k string) string {
+	return k[strings.LastIndex(k, keySeparator)+1:]
+}
+
+// withoutSeq returns the passed key without the sequence number it ends with
+func withoutSeq(k string) string {
+	return k[:strings.LastIndex(k, keySeparator)]
+}
+
+// selectMovement returns true if the passed record matches the selection criteria
+func selectMovement(record *driver.MovementRecord, tokenTypes []string, txStatuses []driver.TxStatus, movementDirection driver.MovementDirection) bool {
+	if len(tokenTypes) != 0 {
+		found := false
+		for _, typ := range tokenTypes {
+			if record.TokenType == typ {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(txStatuses) != 0 {
+		found := false
+		for _, st := range txStatuses {
+			if record.Status == st {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	} else if record.Status == driver.Deleted {
+		// exclude the deleted
+		return false
+	}
+	if movementDirection == driver.Sent && record.Amount.Sign() > 0 {
+		return false
+	}
+	if movementDirection == driver.Received && record.Amount.Sign() < 0 {
+		return false
+	}
+	return true
+}
+
+type TransactionIterator struct {
+	txs    []*driver.TransactionRecord
+	cursor int
+}
+
+func (t *TransactionIterator) Close() {
+}
+
+func (t *TransactionIterator) Next() (*driver.TransactionRecord, error) {
+	if t.cursor >= len(t.txs) {
+		return nil, nil
+	}
+	record := t.txs[t.cursor]
+	t.cursor++
+	return record, nil
+}
@@ -0,0 +1,338 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package leveldb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+)
+
+func TestMovements(t *testing.T) {
+	db, err := OpenDB(filepath.Join(tempDir, "DB-TestMovements"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddMovements([]*driver.MovementRecord{
+		{TxID: "0", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Confirmed},
+		{TxID: "1", EnrollmentID: "alice", TokenType: "USD", Amount: big.NewInt(20), Status: driver.Pending},
+		{TxID: "2", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(-5), Status: driver.Pending},
+		{TxID: "2", EnrollmentID: "alicia", TokenType: "EUR", Amount: big.NewInt(5), Status: driver.Pending},
+		{TxID: "3", EnrollmentID: "bob", TokenType: "EUR", Amount: big.NewInt(30), Status: driver.Deleted},
+	}))
+	assert.NoError(t, db.Commit())
+
+	txIDs := func(records []*driver.MovementRecord) []string {
+		var res []string
+		for _, record := range records {
+			res = append(res, record.TxID+"/"+record.EnrollmentID)
+		}
+		return res
+	}
+
+	// by enrollment ID, deleted movements are left out unless selected
+	records, err := db.QueryMovements([]string{"alice"}, nil, nil, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0/alice", "1/alice", "2/alice"}, txIDs(records))
+	records, err = db.QueryMovements([]string{"bob"}, nil, nil, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	records, err = db.QueryMovements([]string{"bob"}, nil, []driver.TxStatus{driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3/bob"}, txIDs(records))
+
+	// by enrollment ID and token type, from the last
+	records, err = db.QueryMovements([]string{"alice", "alicia"}, []string{"EUR"}, nil, driver.FromLast, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2/alicia", "2/alice", "0/alice"}, txIDs(records))
+
+	// by direction and status, limited
+	records, err = db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending}, driver.FromLast, driver.Received, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2/alicia"}, txIDs(records))
+	records, err = db.QueryMovements(nil, []string{"EUR"}, nil, driver.FromBeginning, driver.Sent, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2/alice"}, txIDs(records))
+
+	balances, err := db.QueryBalances(driver.QueryBalancesParams{EnrollmentIDs: []string{"alice"}, Statuses: []driver.TxStatus{driver.Confirmed, driver.Pending}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*big.Int{"EUR": big.NewInt(5), "USD": big.NewInt(20)}, balances)
+
+	records, err = db.QueryMovementsByTxID("2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2/alice", "2/alicia"}, txIDs(records))
+}
+
+func TestTransactions(t *testing.T) {
+	db, err := OpenDB(filepath.Join(tempDir, "DB-TestTransactions"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, db.BeginUpdate())
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{
+			TxID:            fmt.Sprintf("%d", 4-i),
+			TransactionType: driver.Issue,
+			RecipientEID:    "alice",
+			TokenType:       "EUR",
+			Amount:          big.NewInt(int64(i)),
+			// timestamps in a zone other than UTC are indexed in UTC
+			Timestamp: t0.Add(time.Duration(4-i) * time.Hour).In(time.FixedZone("CET", 3600)),
+			Status:    driver.Pending,
+			Reference: fmt.Sprintf("INV-%d", i%2),
+		}))
+	}
+	assert.NoError(t, db.Commit())
+
+	query := func(params driver.QueryTransactionsParams) []string {
+		it, err := db.QueryTransactions(params)
+		assert.NoError(t, err)
+		defer it.Close()
+		var txIDs []string
+		for {
+			record, err := it.Next()
+			assert.NoError(t, err)
+			if record == nil {
+				return txIDs
+			}
+			txIDs = append(txIDs, record.TxID)
+		}
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, query(driver.QueryTransactionsParams{}))
+
+	// bounds are included
+	from, to := t0.Add(time.Hour), t0.Add(3*time.Hour)
+	assert.Equal(t, []string{"1", "2", "3"}, query(driver.QueryTransactionsParams{From: &from, To: &to}))
+	assert.Equal(t, []string{"0", "1", "2", "3"}, query(driver.QueryTransactionsParams{To: &to}))
+	assert.Equal(t, []string{"1", "3"}, query(driver.QueryTransactionsParams{From: &from, Reference: "INV-1"}))
+	assert.Equal(t, []string{"2", "3"}, query(driver.QueryTransactionsParams{From: &from, Offset: 1, Limit: 2}))
+
+	assert.NoError(t, db.SetStatus("3", driver.Confirmed, ""))
+	assert.Equal(t, []string{"3"}, query(driver.QueryTransactionsParams{Statuses: []driver.TxStatus{driver.Confirmed}}))
+	latest, err := db.QueryLatestTransactions([]string{"alice", "bob"})
+	assert.NoError(t, err)
+	assert.Len(t, latest, 1)
+	assert.Equal(t, "4", latest["alice"].TxID)
+}
+
+func TestUpdates(t *testing.T) {
+	path := filepath.Join(tempDir, "DB-TestUpdates")
+	db, err := OpenDB(path)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, db.Commit(), "no commit in progress")
+	assert.EqualError(t, db.Discard(), "no commit in progress")
+
+	// the update sees its own writes, the queries only the committed ones
+	assert.NoError(t, db.BeginUpdate())
+	assert.EqualError(t, db.BeginUpdate(), "previous commit in progress")
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Pending}))
+	status, err := db.GetStatus("1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, status)
+	records, err := db.QueryMovementsByTxID("1")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	// discarded updates leave no record
+	assert.NoError(t, db.Discard())
+	status, err = db.GetStatus("1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.TxStatus(""), status)
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Pending}))
+	assert.NoError(t, db.Commit())
+	assert.NoError(t, db.Close())
+
+	// committed updates survive reopening, and the sequence resumes after the last record
+	db, err = OpenDB(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "2", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(5), Status: driver.Pending}))
+	records, err = db.QueryMovements([]string{"alice"}, nil, nil, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "1", records[0].TxID)
+	assert.Equal(t, "2", records[1].TxID)
+
+	// a failure while updating the records of a transaction leaves them untouched
+	assert.NoError(t, db.SetStatus("1", driver.Deleted, "mvcc conflict"))
+	assert.EqualError(t, db.Reorg("1"), "transaction [1] is deleted")
+	status, err = db.GetStatus("1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Deleted, status)
+}
+
+func TestReorg(t *testing.T) {
+	db, err := OpenDB(filepath.Join(tempDir, "DB-TestReorg"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", Timestamp: time.Now(), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Confirmed}))
+	assert.NoError(t, db.Commit())
+
+	// records reverted twice within the same update are counted twice
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.Reorg("1"))
+	assert.NoError(t, db.SetStatus("1", driver.Confirmed, ""))
+	assert.NoError(t, db.Reorg("1"))
+	assert.NoError(t, db.Commit())
+
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	record, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, record.Status)
+	assert.Equal(t, 2, record.Reorgs)
+	movements, err := db.QueryMovementsByTxID("1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, movements[0].Status)
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now().UTC()
+	records := []*driver.TransactionRecord{
+		{TxID: "0", Timestamp: now.Add(-2 * time.Hour), Status: driver.Confirmed},
+		{TxID: "1", Timestamp: now.Add(-2 * time.Hour), Status: driver.Deleted},
+		{TxID: "2", Timestamp: now.Add(-2 * time.Hour), Status: driver.Pending},
+		{TxID: "3", Timestamp: now, Status: driver.Confirmed},
+	}
+	open := func(name string) *Persistence {
+		db, err := OpenDB(filepath.Join(tempDir, name))
+		assert.NoError(t, err)
+		assert.NoError(t, db.BeginUpdate())
+		for _, record := range records {
+			assert.NoError(t, db.AddTransaction(record))
+			assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: record.TxID, EnrollmentID: "alice", TokenType: "magic", Amount: big.NewInt(1), Status: record.Status}))
+		}
+		assert.NoError(t, db.Commit())
+		return db
+	}
+	count := func(db *Persistence) (int, int) {
+		it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+		assert.NoError(t, err)
+		transactions := 0
+		for {
+			tx, err := it.Next()
+			assert.NoError(t, err)
+			if tx == nil {
+				break
+			}
+			transactions++
+		}
+		movements, err := db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+		assert.NoError(t, err)
+		return transactions, len(movements)
+	}
+
+	// prune keeps the movements of the confirmed transactions
+	db := open("DB-TestPrune")
+	defer db.Close()
+	removed, err := db.Prune(now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	transactions, movements := count(db)
+	assert.Equal(t, 2, transactions)
+	assert.Equal(t, 3, movements)
+
+	// delete removes all the movements, unless dry run
+	db = open("DB-TestDeleteTransactionsBefore")
+	defer db.Close()
+	removed, err = db.DeleteTransactionsBefore(now.Add(-time.Hour), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	transactions, movements = count(db)
+	assert.Equal(t, 4, transactions)
+	assert.Equal(t, 4, movements)
+	removed, err = db.DeleteTransactionsBefore(now.Add(-time.Hour), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	transactions, movements = count(db)
+	assert.Equal(t, 2, transactions)
+	assert.Equal(t, 2, movements)
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	path := filepath.Join(tempDir, "DB-TestUniqueConstraints")
+	db, err := OpenDB(path)
+	assert.NoError(t, err)
+
+	record := &driver.TransactionRecord{TxID: "1", RecipientEID: "alice", TokenType: "EUR", Timestamp: time.Now()}
+	assert.NoError(t, db.AddTransaction(record))
+	assert.NoError(t, db.AddTransaction(record))
+	err = db.EnsureUniqueConstraints()
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+
+	assert.NoError(t, db.BeginUpdate())
+	deleted, err := db.DeleteTransactions("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.NoError(t, db.Commit())
+	assert.NoError(t, db.EnsureUniqueConstraints())
+	assert.NoError(t, db.Close())
+
+	// the constraints survive reopening, and apply within the same batch too
+	db, err = OpenDB(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	err = db.AddTransactions([]*driver.TransactionRecord{record, record})
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+	assert.NoError(t, db.AddTransaction(record))
+	err = db.AddTransaction(record)
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+}
+
+func TestSnapshot(t *testing.T) {
+	db, err := OpenDB(filepath.Join(tempDir, "DB-TestSnapshot"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Pending}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now().UTC(), Status: driver.Pending}))
+	snapshot, err := db.Snapshot()
+	assert.NoError(t, err)
+	assert.Len(t, snapshot.Movements, 1)
+	assert.Len(t, snapshot.Transactions, 1)
+	assert.EqualError(t, db.Restore(snapshot), "cannot restore a snapshot into a non-empty audit db")
+
+	restored, err := OpenDB(filepath.Join(tempDir, "DB-TestSnapshot-Restored"))
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, restored.Restore(snapshot))
+	copied, err := restored.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot, copied)
+}
+
+var tempDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	tempDir, err = ioutil.TempDir("", "leveldb-auditdb-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create temporary directory: %v", err)
+		os.Exit(-1)
+	}
+	defer os.RemoveAll(tempDir)
+
+	m.Run()
+}
@@ -7,19 +7,43 @@ SPDX-License-Identifier: Apache-2.0
 package memory
 
 import (
+	"math/big"
+	"sync"
 	"time"
 
 	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
-	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
 )
 
+// Persistence is an audit db kept in memory. It is safe for concurrent use.
+// Stored records are never modified in place: updates replace them with modified copies,
+// so that the records returned by queries are not affected by later updates.
 type Persistence struct {
+	lock               sync.RWMutex
 	movementRecords    []*driver.MovementRecord
 	transactionRecords []*driver.TransactionRecord
+	// uniqueKeys, if not nil, indexes the transaction records by unique key
+	uniqueKeys map[string]bool
+	// update, if not nil, is the state to go back to if the update in progress is discarded
+	update *state
+}
+
+// state is the content of a Persistence at a given time
+type state struct {
+	movementRecords    []*driver.MovementRecord
+	transactionRecords []*driver.TransactionRecord
+	uniqueKeys         map[string]bool
 }
 
 func (p *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.queryMovements(enrollmentIDs, tokenTypes, txStatuses, searchDirection, movementDirection, numRecords)
+}
+
+func (p *Persistence) queryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
 	var res []*driver.MovementRecord
 
 	var cursor int
@@ -104,14 +128,99 @@ func (p *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string
 	return res, nil
 }
 
+func (p *Persistence) QueryBalances(params driver.QueryBalancesParams) (map[string]*big.Int, error) {
+	records, err := p.QueryMovements(params.EnrollmentIDs, params.TokenTypes, params.Statuses, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return nil, err
+	}
+	return driver.SumByTokenType(records, params)
+}
+
+func (p *Persistence) QueryMovementSummary(params driver.QueryMovementSummaryParams) ([]*driver.MovementSummaryRow, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var txIDs map[string]bool
+	if params.From != nil || params.To != nil {
+		txIDs = map[string]bool{}
+		for _, record := range p.transactionsIn(params.From, params.To) {
+			txIDs[record.TxID] = true
+		}
+	}
+	records, err := p.queryMovements(nil, nil, params.Statuses, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return nil, err
+	}
+	return driver.SummarizeMovements(records, txIDs), nil
+}
+
 func (p *Persistence) AddMovement(record *driver.MovementRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	p.movementRecords = append(p.movementRecords, record)
 
 	return nil
 }
 
-func (p *Persistence) QueryTransactions(from, to *time.Time) (driver.TransactionIterator, error) {
+func (p *Persistence) AddMovements(records []*driver.MovementRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.movementRecords = append(p.movementRecords, records...)
+
+	return nil
+}
+
+func (p *Persistence) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
 	// search over the transaction for those whose timestamp is between from and to
+	var subset []*driver.TransactionRecord
+	for _, record := range p.transactionRecords {
+		if params.From != nil && record.Timestamp.Before(*params.From) {
+			continue
+		}
+		if params.To != nil && record.Timestamp.After(*params.To) {
+			continue
+		}
+		if len(params.Reference) != 0 && record.Reference != params.Reference {
+			continue
+		}
+		if params.Quarantined != nil && record.Quarantined != *params.Quarantined {
+			continue
+		}
+		if !params.SelectsStatus(record.Status) {
+			continue
+		}
+		if !params.SelectsTransactionType(record.TransactionType) {
+			continue
+		}
+		subset = append(subset, record)
+	}
+	driver.SortTransactions(subset)
+	return &TransactionIterator{txs: params.Page(subset)}, nil
+}
+
+func (p *Persistence) QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return driver.CountDuplicates(p.transactionsIn(from, to)), nil
+}
+
+func (p *Persistence) QueryMultiTypeActions(from, to *time.Time) ([]string, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	subset := p.transactionsIn(from, to)
+	driver.SortTransactions(subset)
+	return driver.MultiTypeActions(subset), nil
+}
+
+// transactionsIn returns the transaction records in the passed time interval, in insertion order
+func (p *Persistence) transactionsIn(from, to *time.Time) []*driver.TransactionRecord {
 	var subset []*driver.TransactionRecord
 	for _, record := range p.transactionRecords {
 		if from != nil && record.Timestamp.Before(*from) {
@@ -122,44 +231,383 @@ func (p *Persistence) QueryTransactions(from, to *time.Time) (driver.Transaction
 		}
 		subset = append(subset, record)
 	}
-	return &TransactionIterator{txs: subset}, nil
+	return subset
+}
+
+func (p *Persistence) QueryLatestTransactions(enrollmentIDs []string) (map[string]*driver.TransactionRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	res := map[string]*driver.TransactionRecord{}
+	for _, record := range p.transactionRecords {
+		if record.Status == driver.Deleted {
+			continue
+		}
+		for _, id := range enrollmentIDs {
+			if record.SenderEID != id && record.RecipientEID != id {
+				continue
+			}
+			if latest, ok := res[id]; ok && latest.Timestamp.After(record.Timestamp) {
+				continue
+			}
+			res[id] = record
+		}
+	}
+	return res, nil
 }
 
 func (p *Persistence) AddTransaction(record *driver.TransactionRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.addTransaction(record)
+}
+
+func (p *Persistence) AddTransactions(records []*driver.TransactionRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, record := range records {
+		if err := p.addTransaction(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Persistence) addTransaction(record *driver.TransactionRecord) error {
+	if p.uniqueKeys != nil {
+		key := driver.UniqueKey(record)
+		if p.uniqueKeys[key] {
+			return errors.Wrapf(driver.ErrDuplicateTransaction, "txid [%s], action index [%d]", record.TxID, record.ActionIndex)
+		}
+		p.uniqueKeys[key] = true
+	}
 	p.transactionRecords = append(p.transactionRecords, record)
 
 	return nil
 }
 
-func (p *Persistence) SetStatus(txID string, status driver.TxStatus) error {
-	// movements
+// EnsureUniqueConstraints indexes the stored transaction records by unique key.
+// It fails if the stored records already violate the constraints.
+func (p *Persistence) EnsureUniqueConstraints() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.uniqueKeys != nil {
+		return nil
+	}
+	uniqueKeys := make(map[string]bool, len(p.transactionRecords))
+	for _, record := range p.transactionRecords {
+		key := driver.UniqueKey(record)
+		if uniqueKeys[key] {
+			return errors.Wrapf(driver.ErrDuplicateTransaction, "txid [%s], action index [%d]", record.TxID, record.ActionIndex)
+		}
+		uniqueKeys[key] = true
+	}
+	p.uniqueKeys = uniqueKeys
+	return nil
+}
+
+// Snapshot returns a copy of the stored records
+func (p *Persistence) Snapshot() (*driver.Snapshot, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	s := &driver.Snapshot{}
+	for _, record := range p.movementRecords {
+		r := *record
+		s.Movements = append(s.Movements, &r)
+	}
+	for _, record := range p.transactionRecords {
+		r := *record
+		s.Transactions = append(s.Transactions, &r)
+	}
+	return s, nil
+}
+
+// Restore stores the records of the passed snapshot, checking the unique constraints if in place.
+// The records are not copied.
+func (p *Persistence) Restore(snapshot *driver.Snapshot) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.movementRecords) != 0 || len(p.transactionRecords) != 0 {
+		return errors.New("cannot restore a snapshot into a non-empty audit db")
+	}
+	restored := &Persistence{movementRecords: snapshot.Movements, transactionRecords: snapshot.Transactions}
+	if p.uniqueKeys != nil {
+		if err := restored.EnsureUniqueConstraints(); err != nil {
+			return err
+		}
+	}
+	p.movementRecords = restored.movementRecords
+	p.transactionRecords = restored.transactionRecords
+	p.uniqueKeys = restored.uniqueKeys
+	return nil
+}
+
+func (p *Persistence) removeUniqueKeys(records []*driver.TransactionRecord) {
+	if p.uniqueKeys == nil {
+		return
+	}
+	for _, record := range records {
+		delete(p.uniqueKeys, driver.UniqueKey(record))
+	}
+}
+
+func (p *Persistence) DeleteTransactions(txID string) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var kept, deleted []*driver.TransactionRecord
+	for _, record := range p.transactionRecords {
+		if record.TxID != txID {
+			kept = append(kept, record)
+		} else {
+			deleted = append(deleted, record)
+		}
+	}
+	p.transactionRecords = kept
+	p.removeUniqueKeys(deleted)
+	return len(deleted), nil
+}
+
+func (p *Persistence) DeleteMovements(txID string) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var kept []*driver.MovementRecord
+	for _, record := range p.movementRecords {
+		if record.TxID != txID {
+			kept = append(kept, record)
+		}
+	}
+	deleted := len(p.movementRecords) - len(kept)
+	p.movementRecords = kept
+	return deleted, nil
+}
+
+func (p *Persistence) QueryMovementsByTxID(txID string) ([]*driver.MovementRecord, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var res []*driver.MovementRecord
 	for _, record := range p.movementRecords {
 		if record.TxID == txID {
-			record.Status = status
+			res = append(res, record)
 		}
 	}
-	// transactions
+	return res, nil
+}
+
+func (p *Persistence) GetStatus(txID string) (driver.TxStatus, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
 	for _, record := range p.transactionRecords {
 		if record.TxID == txID {
-			record.Status = status
+			return record.Status, nil
+		}
+	}
+	for _, record := range p.movementRecords {
+		if record.TxID == txID {
+			return record.Status, nil
 		}
 	}
+	return "", nil
+}
+
+func (p *Persistence) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.updateRecords(txID, func(record *driver.MovementRecord) bool {
+		record.Status = status
+		return true
+	}, func(record *driver.TransactionRecord) bool {
+		record.Status = status
+		record.FailureReason = reason
+		return true
+	})
 	return nil
 }
 
+func (p *Persistence) Reorg(txID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, record := range p.transactionRecords {
+		if record.TxID == txID && record.Status == driver.Deleted {
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		}
+	}
+	p.updateRecords(txID, func(record *driver.MovementRecord) bool {
+		if record.Status != driver.Confirmed {
+			return false
+		}
+		record.Status = driver.Pending
+		return true
+	}, func(record *driver.TransactionRecord) bool {
+		if record.Status != driver.Confirmed {
+			return false
+		}
+		record.Status = driver.Pending
+		record.Reorgs++
+		return true
+	})
+	return nil
+}
+
+func (p *Persistence) Prune(before time.Time) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.removeBefore(before, func(status driver.TxStatus) bool {
+		return status == driver.Deleted
+	}, false), nil
+}
+
+func (p *Persistence) DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.removeBefore(before, func(driver.TxStatus) bool { return true }, dryRun), nil
+}
+
+// removeBefore removes the transaction records older than the passed time, unless Pending, and the movement records
+// of those transactions whose status is accepted by withMovements. It returns the number of removed records.
+// With dryRun, the records are only counted.
+func (p *Persistence) removeBefore(before time.Time, withMovements func(status driver.TxStatus) bool, dryRun bool) int {
+	selected := map[string]bool{}
+	var transactions, pruned []*driver.TransactionRecord
+	for _, record := range p.transactionRecords {
+		if record.Status == driver.Pending || !record.Timestamp.Before(before) {
+			transactions = append(transactions, record)
+			continue
+		}
+		pruned = append(pruned, record)
+		if withMovements(record.Status) {
+			selected[record.TxID] = true
+		}
+	}
+	var movements []*driver.MovementRecord
+	for _, record := range p.movementRecords {
+		if !selected[record.TxID] {
+			movements = append(movements, record)
+		}
+	}
+	removed := len(p.transactionRecords) - len(transactions) + len(p.movementRecords) - len(movements)
+	if dryRun {
+		return removed
+	}
+	p.transactionRecords = transactions
+	p.movementRecords = movements
+	p.removeUniqueKeys(pruned)
+	return removed
+}
+
+func (p *Persistence) SetQuarantine(txID string, quarantined bool, reason string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.updateRecords(txID, func(record *driver.MovementRecord) bool {
+		record.Quarantined = quarantined
+		return true
+	}, func(record *driver.TransactionRecord) bool {
+		record.Quarantined = quarantined
+		record.QuarantineReason = reason
+		return true
+	})
+	return nil
+}
+
+// updateRecords applies the passed functions to copies of the records of the passed transaction.
+// The copies replace the stored records if the functions return true.
+func (p *Persistence) updateRecords(txID string, updateMovement func(*driver.MovementRecord) bool, updateTransaction func(*driver.TransactionRecord) bool) {
+	for i, record := range p.movementRecords {
+		if record.TxID != txID {
+			continue
+		}
+		r := *record
+		if updateMovement(&r) {
+			p.movementRecords[i] = &r
+		}
+	}
+	for i, record := range p.transactionRecords {
+		if record.TxID != txID {
+			continue
+		}
+		r := *record
+		if updateTransaction(&r) {
+			p.transactionRecords[i] = &r
+		}
+	}
+}
+
 func (p *Persistence) Close() error {
 	return nil
 }
 
+// BeginUpdate starts an update: the changes made until Commit are undone by Discard.
+// Only one update can be in progress at a time.
 func (p *Persistence) BeginUpdate() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.update != nil {
+		return errors.New("previous commit in progress")
+	}
+	p.update = &state{
+		movementRecords:    append([]*driver.MovementRecord(nil), p.movementRecords...),
+		transactionRecords: append([]*driver.TransactionRecord(nil), p.transactionRecords...),
+	}
+	if p.uniqueKeys != nil {
+		p.update.uniqueKeys = make(map[string]bool, len(p.uniqueKeys))
+		for key := range p.uniqueKeys {
+			p.update.uniqueKeys[key] = true
+		}
+	}
 	return nil
 }
 
 func (p *Persistence) Commit() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.update == nil {
+		return errors.New("no commit in progress")
+	}
+	p.update = nil
 	return nil
 }
 
 func (p *Persistence) Discard() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.update == nil {
+		return errors.New("no commit in progress")
+	}
+	p.movementRecords = p.update.movementRecords
+	p.transactionRecords = p.update.transactionRecords
+	p.uniqueKeys = p.update.uniqueKeys
+	p.update = nil
+	return nil
+}
+
+// Reset removes all the records and the unique constraints, and discards the update in progress, if any
+func (p *Persistence) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.movementRecords = nil
+	p.transactionRecords = nil
+	p.uniqueKeys = nil
+	p.update = nil
+}
+
+func (p *Persistence) Sync() error {
 	return nil
 }
 
@@ -181,12 +629,33 @@ func (t *TransactionIterator) Next() (*driver.TransactionRecord, error) {
 	return record, nil
 }
 
-type Driver struct{}
+// Driver keeps an in-memory audit db for each namespace.
+// Opening the same namespace twice returns the same audit db.
+type Driver struct {
+	mutex sync.Mutex
+	dbs   map[string]*Persistence
+}
+
+func (d *Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 
-func (d Driver) Open(sp view2.ServiceProvider, name string) (driver.AuditDB, error) {
-	return &Persistence{}, nil
+	if d.dbs == nil {
+		d.dbs = map[string]*Persistence{}
+	}
+	p, ok := d.dbs[name]
+	if !ok {
+		p = &Persistence{}
+		d.dbs[name] = p
+	}
+	return p, nil
 }
 
-func init() {
-	auditdb.Register("memory", &Driver{})
+// Reset drops all the audit dbs opened so far, so that tests can start from a clean state.
+// Audit dbs already opened are not affected; opening a namespace again returns a new, empty audit db.
+func (d *Driver) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.dbs = nil
 }
@@ -9,8 +9,10 @@ package memory
 import (
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +66,179 @@ func Test(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, records, 0)
 }
+
+func TestUniqueConstraints(t *testing.T) {
+	db := &Persistence{}
+	record := func(actionIndex int, recipient string) *driver.TransactionRecord {
+		return &driver.TransactionRecord{TxID: "tx1", ActionIndex: actionIndex, RecipientEID: recipient, TokenType: "EUR", Amount: big.NewInt(10)}
+	}
+	// without the constraints, duplicates are accepted
+	assert.NoError(t, db.AddTransaction(record(0, "alice")))
+	assert.NoError(t, db.AddTransaction(record(0, "alice")))
+	err := db.EnsureUniqueConstraints()
+	assert.Error(t, err)
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+
+	db = &Persistence{}
+	assert.NoError(t, db.EnsureUniqueConstraints())
+	assert.NoError(t, db.AddTransaction(record(0, "alice")))
+	assert.NoError(t, db.AddTransaction(record(1, "alice")))
+	assert.NoError(t, db.AddTransaction(record(0, "bob")))
+	err = db.AddTransaction(record(0, "alice"))
+	assert.Error(t, err)
+	assert.Equal(t, driver.ErrDuplicateTransaction, errors.Cause(err))
+	assert.Len(t, db.transactionRecords, 3)
+
+	// deleted records release their keys
+	n, err := db.DeleteTransactions("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.NoError(t, db.AddTransaction(record(0, "alice")))
+}
+
+func TestNamespaces(t *testing.T) {
+	d := &Driver{}
+	alice, err := d.Open(nil, "alice")
+	assert.NoError(t, err)
+	bob, err := d.Open(nil, "bob")
+	assert.NoError(t, err)
+
+	assert.NoError(t, alice.AddTransaction(&driver.TransactionRecord{TxID: "tx1", RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10)}))
+	count := func(db driver.AuditDB) int {
+		it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+		assert.NoError(t, err)
+		defer it.Close()
+		n := 0
+		for {
+			record, err := it.Next()
+			assert.NoError(t, err)
+			if record == nil {
+				return n
+			}
+			n++
+		}
+	}
+	assert.Equal(t, 1, count(alice))
+	assert.Equal(t, 0, count(bob))
+
+	// reopening a namespace gives back its records
+	again, err := d.Open(nil, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count(again))
+}
+
+func TestLatestTransactions(t *testing.T) {
+	db := &Persistence{}
+	t0 := time.Now()
+	records := []*driver.TransactionRecord{
+		{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: t0, Status: driver.Confirmed},
+		{TxID: "1", TransactionType: driver.Transfer, SenderEID: "alice", RecipientEID: "bob", TokenType: "EUR", Amount: big.NewInt(5), Timestamp: t0.Add(time.Second), Status: driver.Confirmed},
+		{TxID: "2", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(3), Timestamp: t0.Add(3 * time.Second), Status: driver.Pending},
+		{TxID: "3", TransactionType: driver.Transfer, SenderEID: "bob", RecipientEID: "charlie", TokenType: "EUR", Amount: big.NewInt(2), Timestamp: t0.Add(2 * time.Second), Status: driver.Confirmed},
+		{TxID: "4", TransactionType: driver.Transfer, SenderEID: "bob", RecipientEID: "charlie", TokenType: "EUR", Amount: big.NewInt(1), Timestamp: t0.Add(4 * time.Second), Status: driver.Deleted},
+	}
+	for _, record := range records {
+		assert.NoError(t, db.AddTransaction(record))
+	}
+
+	latest, err := db.QueryLatestTransactions([]string{"alice", "bob", "charlie", "dave"})
+	assert.NoError(t, err)
+	assert.Len(t, latest, 3)
+	assert.Equal(t, "2", latest["alice"].TxID)
+	assert.Equal(t, "3", latest["bob"].TxID)
+	assert.Equal(t, "3", latest["charlie"].TxID)
+	_, ok := latest["dave"]
+	assert.False(t, ok)
+}
+
+func TestStatusFilter(t *testing.T) {
+	db := &Persistence{}
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "0", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Pending}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "1", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Confirmed}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "2", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now()}))
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "3", TransactionType: driver.Issue, RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now(), Status: "Unknown"}))
+
+	query := func(statuses ...driver.TxStatus) []string {
+		it, err := db.QueryTransactions(driver.QueryTransactionsParams{Statuses: statuses})
+		assert.NoError(t, err)
+		defer it.Close()
+		var txIDs []string
+		for {
+			record, err := it.Next()
+			assert.NoError(t, err)
+			if record == nil {
+				return txIDs
+			}
+			txIDs = append(txIDs, record.TxID)
+		}
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3"}, query())
+	assert.Equal(t, []string{"1"}, query(driver.Confirmed))
+	assert.Equal(t, []string{"0", "1"}, query(driver.Pending, driver.Confirmed))
+	// empty and unknown statuses are never selected by a filter
+	assert.Equal(t, []string{"0"}, query(driver.Pending, "", "Unknown"))
+}
+
+func TestUpdates(t *testing.T) {
+	db := &Persistence{}
+	assert.NoError(t, db.EnsureUniqueConstraints())
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "tx1", Status: driver.Pending}))
+
+	// discarded changes are undone
+	assert.NoError(t, db.BeginUpdate())
+	assert.EqualError(t, db.BeginUpdate(), "previous commit in progress")
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "tx2", Status: driver.Pending}))
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "tx2", Amount: big.NewInt(1), Status: driver.Pending}))
+	assert.NoError(t, db.SetStatus("tx1", driver.Confirmed, ""))
+	assert.NoError(t, db.Discard())
+	status, err := db.GetStatus("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Pending, status)
+	status, err = db.GetStatus("tx2")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.TxStatus(""), status)
+	// the unique key of the discarded record is released
+	assert.NoError(t, db.AddTransaction(&driver.TransactionRecord{TxID: "tx2", Status: driver.Pending}))
+
+	// committed changes are kept
+	assert.NoError(t, db.BeginUpdate())
+	assert.NoError(t, db.SetStatus("tx1", driver.Confirmed, ""))
+	assert.NoError(t, db.Commit())
+	assert.EqualError(t, db.Commit(), "no commit in progress")
+	assert.EqualError(t, db.Discard(), "no commit in progress")
+	status, err = db.GetStatus("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Confirmed, status)
+
+	// queried records are not modified by later updates
+	it, err := db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	record, err := it.Next()
+	assert.NoError(t, err)
+	assert.NoError(t, db.SetQuarantine("tx1", true, "suspicious"))
+	assert.False(t, record.Quarantined)
+
+	db.Reset()
+	it, err = db.QueryTransactions(driver.QueryTransactionsParams{})
+	assert.NoError(t, err)
+	record, err = it.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestDriverReset(t *testing.T) {
+	d := &Driver{}
+	db, err := d.Open(nil, "ns")
+	assert.NoError(t, err)
+	assert.NoError(t, db.AddMovement(&driver.MovementRecord{TxID: "tx1", Amount: big.NewInt(1), Status: driver.Pending}))
+	same, err := d.Open(nil, "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, db, same)
+
+	d.Reset()
+	fresh, err := d.Open(nil, "ns")
+	assert.NoError(t, err)
+	records, err := fresh.QueryMovements(nil, nil, nil, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
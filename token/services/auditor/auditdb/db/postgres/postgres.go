@@ -0,0 +1,1009 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package postgres
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+)
+
+// uniqueViolation is the SQLSTATE reported by PostgreSQL when a unique constraint is violated
+const uniqueViolation = "23505"
+
+// maxBatchSize is the maximum number of rows inserted by a single statement, it keeps the number of
+// parameters of the statement below the limit of the PostgreSQL protocol
+const maxBatchSize = 1000
+
+const movementColumns = "namespace, tx_id, enrollment_id, token_type, amount, status, quarantined"
+
+// movementQueryColumns are the columns of the movement records read by the queries
+const movementQueryColumns = "tx_id, enrollment_id, token_type, amount, status, quarantined"
+
+const transactionColumns = "tx_id, action_index, transaction_type, sender_eid, recipient_eid, token_type, amount, stored_at, status, reference, quarantined, quarantine_reason, reorgs, failure_reason"
+
+// querier runs the statements of the audit db
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// contextQuerier is implemented by both sql.DB and sql.Tx
+type contextQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// boundQuerier runs the statements bound to a context
+type boundQuerier struct {
+	q   contextQuerier
+	ctx context.Context
+}
+
+func (b *boundQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return b.q.ExecContext(b.ctx, query, args...)
+}
+
+func (b *boundQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return b.q.QueryContext(b.ctx, query, args...)
+}
+
+func (b *boundQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return b.q.QueryRowContext(b.ctx, query, args...)
+}
+
+// update is the update in progress, shared by the copies of the audit db bound to different contexts
+type update struct {
+	txn  *sql.Tx
+	lock sync.Mutex
+}
+
+// Persistence stores the records of an audit db in the tables shared by all the namespaces,
+// each record carrying the namespace it belongs to.
+// Its statements are bound to the context passed to WithContext, if any, and abort once the context is done.
+type Persistence struct {
+	db        *sql.DB
+	namespace string
+	ctx       context.Context
+
+	update *update
+}
+
+// OpenDB migrates the schema of the passed database and returns the audit db for the passed namespace
+func OpenDB(db *sql.DB, namespace string) (*Persistence, error) {
+	if err := migrate(db); err != nil {
+		return nil, errors.WithMessagef(err, "failed migrating audit db")
+	}
+	return newPersistence(db, namespace), nil
+}
+
+func newPersistence(db *sql.DB, namespace string) *Persistence {
+	return &Persistence{db: db, namespace: namespace, ctx: context.Background(), update: &update{}}
+}
+
+// WithContext returns a copy of the audit db whose statements are bound to the passed context.
+// The copy shares the update in progress with the audit db.
+func (db *Persistence) WithContext(ctx context.Context) driver.AuditDB {
+	return &Persistence{db: db.db, namespace: db.namespace, ctx: ctx, update: db.update}
+}
+
+func (db *Persistence) Close() error {
+	db.update.lock.Lock()
+	defer db.update.lock.Unlock()
+
+	if db.update.txn != nil {
+		if err := db.update.txn.Rollback(); err != nil {
+			logger.Errorf("failed discarding update in progress [%s]", err)
+		}
+		db.update.txn = nil
+	}
+	if err := db.db.Close(); err != nil {
+		return errors.Wrap(err, "could not close DB")
+	}
+	return nil
+}
+
+func (db *Persistence) BeginUpdate() error {
+	db.update.lock.Lock()
+	defer db.update.lock.Unlock()
+
+	if db.update.txn != nil {
+		return errors.New("previous commit in progress")
+	}
+	txn, err := db.db.BeginTx(db.ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+	db.update.txn = txn
+	return nil
+}
+
+func (db *Persistence) Commit() error {
+	db.update.lock.Lock()
+	defer db.update.lock.Unlock()
+
+	if db.update.txn == nil {
+		return errors.New("no commit in progress")
+	}
+	err := db.update.txn.Commit()
+	db.update.txn = nil
+	if err != nil {
+		return errors.Wrap(err, "could not commit transaction")
+	}
+	return nil
+}
+
+// Discard rolls back the update in progress.
+// An update begun with a context that is now done has already been rolled back by database/sql.
+func (db *Persistence) Discard() error {
+	db.update.lock.Lock()
+	defer db.update.lock.Unlock()
+
+	if db.update.txn == nil {
+		return errors.New("no commit in progress")
+	}
+	err := db.update.txn.Rollback()
+	db.update.txn = nil
+	if err != nil && err != sql.ErrTxDone {
+		return errors.Wrap(err, "could not discard transaction")
+	}
+	return nil
+}
+
+// Sync is a no-op, committed updates are durable
+func (db *Persistence) Sync() error {
+	return nil
+}
+
+// querier returns the update in progress, if any, the database otherwise, bound to the context of the audit db
+func (db *Persistence) querier() querier {
+	db.update.lock.Lock()
+	defer db.update.lock.Unlock()
+
+	if db.update.txn != nil {
+		return &boundQuerier{q: db.update.txn, ctx: db.ctx}
+	}
+	return &boundQuerier{q: db.db, ctx: db.ctx}
+}
+
+// atomically runs the passed function as part of the update in progress, if any.
+// Otherwise, it runs the function in a transaction of its own, committed if the function succeeds.
+func (db *Persistence) atomically(f func(q querier) error) error {
+	db.update.lock.Lock()
+	txn := db.update.txn
+	db.update.lock.Unlock()
+	if txn != nil {
+		return f(&boundQuerier{q: txn, ctx: db.ctx})
+	}
+
+	txn, err := db.db.BeginTx(db.ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+	if err := f(&boundQuerier{q: txn, ctx: db.ctx}); err != nil {
+		if rbErr := txn.Rollback(); rbErr != nil {
+			logger.Errorf("failed rolling back transaction [%s]", rbErr)
+		}
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return errors.Wrap(err, "could not commit transaction")
+	}
+	return nil
+}
+
+func (db *Persistence) AddMovement(record *driver.MovementRecord) error {
+	return db.addMovements(db.querier(), []*driver.MovementRecord{record})
+}
+
+// AddMovements inserts the passed movement records with multi-row statements
+func (db *Persistence) AddMovements(records []*driver.MovementRecord) error {
+	return db.addMovements(db.querier(), records)
+}
+
+func (db *Persistence) addMovements(q querier, records []*driver.MovementRecord) error {
+	for len(records) != 0 {
+		batch := records
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+		records = records[len(batch):]
+
+		rows := make([][]interface{}, len(batch))
+		for i, record := range batch {
+			rows[i] = []interface{}{db.namespace, record.TxID, record.EnrollmentID, record.TokenType, amountValue(record.Amount), string(record.Status), record.Quarantined}
+		}
+		query, args := insertQuery(movementsTable, movementColumns, rows)
+		if _, err := q.Exec(query, args...); err != nil {
+			return errors.Wrapf(err, "failed adding movement records for tx [%s]", batch[0].TxID)
+		}
+	}
+	return nil
+}
+
+func (db *Persistence) AddTransaction(record *driver.TransactionRecord) error {
+	return db.addTransactions(db.querier(), []*driver.TransactionRecord{record})
+}
+
+// AddTransactions inserts the passed transaction records with multi-row statements
+func (db *Persistence) AddTransactions(records []*driver.TransactionRecord) error {
+	return db.addTransactions(db.querier(), records)
+}
+
+func (db *Persistence) addTransactions(q querier, records []*driver.TransactionRecord) error {
+	for len(records) != 0 {
+		batch := records
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+		records = records[len(batch):]
+
+		rows := make([][]interface{}, len(batch))
+		for i, record := range batch {
+			rows[i] = []interface{}{
+				db.namespace, record.TxID, record.ActionIndex, int(record.TransactionType), record.SenderEID, record.RecipientEID,
+				record.TokenType, amountValue(record.Amount), record.Timestamp, string(record.Status), record.Reference,
+				record.Quarantined, record.QuarantineReason, record.Reorgs, record.FailureReason,
+			}
+		}
+		query, args := insertQuery(transactionsTable, "namespace, "+transactionColumns, rows)
+		_, err := q.Exec(query, args...)
+		if isUniqueViolation(err) {
+			return errors.Wrapf(driver.ErrDuplicateTransaction, "txid [%s], action index [%d]", batch[0].TxID, batch[0].ActionIndex)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed adding transaction records for tx [%s]", batch[0].TxID)
+		}
+	}
+	return nil
+}
+
+// EnsureUniqueConstraints creates a unique index over the transaction records of the namespace.
+// It fails if the stored records already violate the constraints.
+// The index created by previous versions, which did not include the sender, is replaced.
+func (db *Persistence) EnsureUniqueConstraints() error {
+	err := db.atomically(func(q querier) error {
+		if _, err := q.Exec(fmt.Sprintf(
+			`CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (tx_id, action_index, sender_eid, recipient_eid, token_type) WHERE namespace = %s`,
+			uniqueIndexName(db.namespace), transactionsTable, quoteLiteral(db.namespace),
+		)); err != nil {
+			return err
+		}
+		_, err := q.Exec(`DROP INDEX IF EXISTS ` + legacyUniqueIndexName(db.namespace))
+		return err
+	})
+	if isUniqueViolation(err) {
+		return errors.Wrapf(driver.ErrDuplicateTransaction, "namespace [%s]", db.namespace)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed creating unique index")
+	}
+	return nil
+}
+
+func (db *Persistence) DeleteTransactions(txID string) (int, error) {
+	res, err := db.querier().Exec(`DELETE FROM `+transactionsTable+` WHERE namespace = $1 AND tx_id = $2`, db.namespace, txID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed deleting transaction records for tx [%s]", txID)
+	}
+	return rowsAffected(res)
+}
+
+func (db *Persistence) GetStatus(txID string) (driver.TxStatus, error) {
+	q := db.querier()
+	for _, table := range []string{transactionsTable, movementsTable} {
+		var status string
+		err := q.QueryRow(`SELECT status FROM `+table+` WHERE namespace = $1 AND tx_id = $2 LIMIT 1`, db.namespace, txID).Scan(&status)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "failed reading status of tx [%s]", txID)
+		}
+		return driver.TxStatus(status), nil
+	}
+	return "", nil
+}
+
+func (db *Persistence) DeleteMovements(txID string) (int, error) {
+	res, err := db.querier().Exec(`DELETE FROM `+movementsTable+` WHERE namespace = $1 AND tx_id = $2`, db.namespace, txID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed deleting movement records for tx [%s]", txID)
+	}
+	return rowsAffected(res)
+}
+
+func (db *Persistence) SetStatus(txID string, status driver.TxStatus, reason string) error {
+	return db.atomically(func(q querier) error {
+		if _, err := q.Exec(`UPDATE `+movementsTable+` SET status = $1 WHERE namespace = $2 AND tx_id = $3`, string(status), db.namespace, txID); err != nil {
+			return errors.Wrapf(err, "failed setting status of movement records for tx [%s]", txID)
+		}
+		if _, err := q.Exec(`UPDATE `+transactionsTable+` SET status = $1, failure_reason = $2 WHERE namespace = $3 AND tx_id = $4`, string(status), reason, db.namespace, txID); err != nil {
+			return errors.Wrapf(err, "failed setting status of transaction records for tx [%s]", txID)
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) Reorg(txID string) error {
+	return db.atomically(func(q querier) error {
+		var deleted bool
+		err := q.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM `+transactionsTable+` WHERE namespace = $1 AND tx_id = $2 AND status = $3)`,
+			db.namespace, txID, string(driver.Deleted),
+		).Scan(&deleted)
+		if err != nil {
+			return errors.Wrapf(err, "failed reading status of tx [%s]", txID)
+		}
+		if deleted {
+			return errors.Errorf("transaction [%s] is deleted", txID)
+		}
+		if _, err := q.Exec(
+			`UPDATE `+movementsTable+` SET status = $1 WHERE namespace = $2 AND tx_id = $3 AND status = $4`,
+			string(driver.Pending), db.namespace, txID, string(driver.Confirmed),
+		); err != nil {
+			return errors.Wrapf(err, "failed reverting movement records for tx [%s]", txID)
+		}
+		if _, err := q.Exec(
+			`UPDATE `+transactionsTable+` SET status = $1, reorgs = reorgs + 1 WHERE namespace = $2 AND tx_id = $3 AND status = $4`,
+			string(driver.Pending), db.namespace, txID, string(driver.Confirmed),
+		); err != nil {
+			return errors.Wrapf(err, "failed reverting transaction records for tx [%s]", txID)
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) Prune(before time.Time) (int, error) {
+	removed := 0
+	err := db.atomically(func(q querier) error {
+		res, err := q.Exec(
+			`DELETE FROM `+movementsTable+` WHERE namespace = $1 AND tx_id IN (
+				SELECT tx_id FROM `+transactionsTable+` WHERE namespace = $1 AND status = $2 AND stored_at < $3
+			)`,
+			db.namespace, string(driver.Deleted), before,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed pruning movement records")
+		}
+		movements, err := rowsAffected(res)
+		if err != nil {
+			return err
+		}
+		res, err = q.Exec(
+			`DELETE FROM `+transactionsTable+` WHERE namespace = $1 AND status <> $2 AND stored_at < $3`,
+			db.namespace, string(driver.Pending), before,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed pruning transaction records")
+		}
+		transactions, err := rowsAffected(res)
+		if err != nil {
+			return err
+		}
+		removed = movements + transactions
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (db *Persistence) DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error) {
+	// the transactions in a terminal state with records older than before
+	selected := `SELECT tx_id FROM ` + transactionsTable + ` WHERE namespace = $1 AND status <> $2 AND stored_at < $3`
+	args := []interface{}{db.namespace, string(driver.Pending), before}
+	if dryRun {
+		var removed int
+		err := db.querier().QueryRow(
+			`SELECT (SELECT COUNT(*) FROM `+movementsTable+` WHERE namespace = $1 AND tx_id IN (`+selected+`))
+			+ (SELECT COUNT(*) FROM `+transactionsTable+` WHERE namespace = $1 AND status <> $2 AND stored_at < $3)`,
+			args...,
+		).Scan(&removed)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed counting records to delete")
+		}
+		return removed, nil
+	}
+
+	removed := 0
+	err := db.atomically(func(q querier) error {
+		res, err := q.Exec(`DELETE FROM `+movementsTable+` WHERE namespace = $1 AND tx_id IN (`+selected+`)`, args...)
+		if err != nil {
+			return errors.Wrap(err, "failed deleting movement records")
+		}
+		movements, err := rowsAffected(res)
+		if err != nil {
+			return err
+		}
+		res, err = q.Exec(`DELETE FROM `+transactionsTable+` WHERE namespace = $1 AND status <> $2 AND stored_at < $3`, args...)
+		if err != nil {
+			return errors.Wrap(err, "failed deleting transaction records")
+		}
+		transactions, err := rowsAffected(res)
+		if err != nil {
+			return err
+		}
+		removed = movements + transactions
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (db *Persistence) SetQuarantine(txID string, quarantined bool, reason string) error {
+	return db.atomically(func(q querier) error {
+		if _, err := q.Exec(`UPDATE `+movementsTable+` SET quarantined = $1 WHERE namespace = $2 AND tx_id = $3`, quarantined, db.namespace, txID); err != nil {
+			return errors.Wrapf(err, "failed setting quarantine of movement records for tx [%s]", txID)
+		}
+		if _, err := q.Exec(`UPDATE `+transactionsTable+` SET quarantined = $1, quarantine_reason = $2 WHERE namespace = $3 AND tx_id = $4`, quarantined, reason, db.namespace, txID); err != nil {
+			return errors.Wrapf(err, "failed setting quarantine of transaction records for tx [%s]", txID)
+		}
+		return nil
+	})
+}
+
+func (db *Persistence) QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) ([]*driver.MovementRecord, error) {
+	query, args, err := movementsQuery(db.namespace, enrollmentIDs, tokenTypes, txStatuses, searchDirection, movementDirection, numRecords)
+	if err != nil {
+		return nil, err
+	}
+	return db.queryMovements(query, args...)
+}
+
+func (db *Persistence) QueryMovementsByTxID(txID string) ([]*driver.MovementRecord, error) {
+	return db.queryMovements(`SELECT `+movementQueryColumns+` FROM `+movementsTable+` WHERE namespace = $1 AND tx_id = $2 ORDER BY id ASC`, db.namespace, txID)
+}
+
+// queryMovements runs the passed query, that selects the movementQueryColumns, and reads the returned movement records
+func (db *Persistence) queryMovements(query string, args ...interface{}) ([]*driver.MovementRecord, error) {
+	rows, err := db.querier().Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying movements")
+	}
+	defer rows.Close()
+
+	var res []*driver.MovementRecord
+	for rows.Next() {
+		record := &driver.MovementRecord{}
+		var amount sql.NullString
+		var status string
+		if err := rows.Scan(&record.TxID, &record.EnrollmentID, &record.TokenType, &amount, &status, &record.Quarantined); err != nil {
+			return nil, errors.Wrap(err, "failed reading movement record")
+		}
+		if record.Amount, err = parseAmount(amount); err != nil {
+			return nil, err
+		}
+		record.Status = driver.TxStatus(status)
+		res = append(res, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed querying movements")
+	}
+	return res, nil
+}
+
+// QueryBalances sums the amounts in the database. A movement with a nil amount makes it fail,
+// unless NilAmountAsZero is set.
+func (db *Persistence) QueryBalances(params driver.QueryBalancesParams) (map[string]*big.Int, error) {
+	query, args := balancesQuery(db.namespace, params)
+	rows, err := db.querier().Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying balances")
+	}
+	defer rows.Close()
+
+	balances := map[string]*big.Int{}
+	for rows.Next() {
+		var tokenType string
+		var sum sql.NullString
+		var nils int
+		var txID sql.NullString
+		if err := rows.Scan(&tokenType, &sum, &nils, &txID); err != nil {
+			return nil, errors.Wrap(err, "failed reading balance")
+		}
+		if nils > 0 && !params.NilAmountAsZero {
+			return nil, errors.Errorf("nil amount for tx [%s]", txID.String)
+		}
+		balance, err := parseAmount(sum)
+		if err != nil {
+			return nil, err
+		}
+		if balance == nil {
+			balance = big.NewInt(0)
+		}
+		balances[tokenType] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed querying balances")
+	}
+	return balances, nil
+}
+
+func (db *Persistence) QueryMovementSummary(params driver.QueryMovementSummaryParams) ([]*driver.MovementSummaryRow, error) {
+	query, args := movementSummaryQuery(db.namespace, params)
+	rows, err := db.querier().Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying movement summary")
+	}
+	defer rows.Close()
+
+	var res []*driver.MovementSummaryRow
+	for rows.Next() {
+		row := &driver.MovementSummaryRow{}
+		var received, sent sql.NullString
+		if err := rows.Scan(&row.EnrollmentID, &row.TokenType, &received, &sent); err != nil {
+			return nil, errors.Wrap(err, "failed reading movement summary")
+		}
+		if row.Received, err = parseAmount(received); err != nil {
+			return nil, err
+		}
+		if row.Sent, err = parseAmount(sent); err != nil {
+			return nil, err
+		}
+		row.Net = new(big.Int).Sub(row.Received, row.Sent)
+		res = append(res, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed querying movement summary")
+	}
+	return res, nil
+}
+
+func (db *Persistence) QueryTransactions(params driver.QueryTransactionsParams) (driver.TransactionIterator, error) {
+	query, args := transactionsQuery(db.namespace, params)
+	rows, err := db.querier().Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying transactions")
+	}
+	return &TransactionIterator{rows: rows}, nil
+}
+
+func (db *Persistence) QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error) {
+	c := newConditions(db.namespace)
+	c.interval("stored_at", from, to)
+	rows, err := db.querier().Query(
+		`SELECT tx_id, MAX(n) FROM (
+			SELECT tx_id, COUNT(*) AS n FROM `+transactionsTable+c.where()+`
+			GROUP BY tx_id, action_index, sender_eid, recipient_eid, token_type
+			HAVING COUNT(*) > 1
+		) AS duplicates GROUP BY tx_id`,
+		c.args...,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying duplicate transactions")
+	}
+	defer rows.Close()
+
+	res := map[string]int{}
+	for rows.Next() {
+		var txID string
+		var n int
+		if err := rows.Scan(&txID, &n); err != nil {
+			return nil, errors.Wrap(err, "failed reading duplicate transaction")
+		}
+		res[txID] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed querying duplicate transactions")
+	}
+	return res, nil
+}
+
+func (db *Persistence) QueryMultiTypeActions(from, to *time.Time) ([]string, error) {
+	c := newConditions(db.namespace)
+	c.interval("stored_at", from, to)
+	rows, err := db.querier().Query(
+		`SELECT tx_id FROM `+transactionsTable+c.where()+`
+		GROUP BY tx_id, action_index
+		HAVING COUNT(DISTINCT token_type) > 1
+		ORDER BY MIN(stored_at), tx_id, action_index`,
+		c.args...,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying multi-type actions")
+	}
+	defer rows.Close()
+
+	var txIDs []string
+	found := map[string]bool{}
+	for rows.Next() {
+		var txID string
+		if err := rows.Scan(&txID); err != nil {
+			return nil, errors.Wrap(err, "failed reading multi-type action")
+		}
+		if !found[txID] {
+			found[txID] = true
+			txIDs = append(txIDs, txID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed querying multi-type actions")
+	}
+	return txIDs, nil
+}
+
+func (db *Persistence) QueryLatestTransactions(enrollmentIDs []string) (map[string]*driver.TransactionRecord, error) {
+	q := db.querier()
+	res := map[string]*driver.TransactionRecord{}
+	for _, id := range enrollmentIDs {
+		rows, err := q.Query(
+			`SELECT `+transactionColumns+` FROM `+transactionsTable+`
+			WHERE namespace = $1 AND status <> $2 AND (sender_eid = $3 OR recipient_eid = $3)
+			ORDER BY stored_at DESC, id DESC LIMIT 1`,
+			db.namespace, string(driver.Deleted), id,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed querying latest transaction of [%s]", id)
+		}
+		record, err := scanFirst(rows)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed reading latest transaction of [%s]", id)
+		}
+		if record != nil {
+			res[id] = record
+		}
+	}
+	return res, nil
+}
+
+// Snapshot reads all the records of the namespace, in insertion order
+func (db *Persistence) Snapshot() (*driver.Snapshot, error) {
+	s := &driver.Snapshot{}
+	var err error
+	s.Movements, err = db.QueryMovements(nil, nil, []driver.TxStatus{driver.Pending, driver.Confirmed, driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.querier().Query(`SELECT `+transactionColumns+` FROM `+transactionsTable+` WHERE namespace = $1 ORDER BY id`, db.namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed querying transactions")
+	}
+	it := &TransactionIterator{rows: rows}
+	defer it.Close()
+	for {
+		record, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			break
+		}
+		s.Transactions = append(s.Transactions, record)
+	}
+	return s, nil
+}
+
+// Restore inserts the records of the passed snapshot in a single transaction
+func (db *Persistence) Restore(snapshot *driver.Snapshot) error {
+	return db.atomically(func(q querier) error {
+		var empty bool
+		err := q.QueryRow(
+			`SELECT NOT EXISTS (SELECT 1 FROM `+movementsTable+` WHERE namespace = $1) AND NOT EXISTS (SELECT 1 FROM `+transactionsTable+` WHERE namespace = $1)`,
+			db.namespace,
+		).Scan(&empty)
+		if err != nil {
+			return errors.Wrap(err, "failed checking audit db is empty")
+		}
+		if !empty {
+			return errors.New("cannot restore a snapshot into a non-empty audit db")
+		}
+		if err := db.addMovements(q, snapshot.Movements); err != nil {
+			return err
+		}
+		return db.addTransactions(q, snapshot.Transactions)
+	})
+}
+
+// TransactionIterator streams the transaction records selected by a query
+type TransactionIterator struct {
+	rows *sql.Rows
+}
+
+func (t *TransactionIterator) Close() {
+	if err := t.rows.Close(); err != nil {
+		logger.Errorf("failed closing rows [%s]", err)
+	}
+}
+
+func (t *TransactionIterator) Next() (*driver.TransactionRecord, error) {
+	if !t.rows.Next() {
+		if err := t.rows.Err(); err != nil {
+			return nil, errors.Wrap(err, "failed iterating transactions")
+		}
+		return nil, nil
+	}
+	return scanTransaction(t.rows)
+}
+
+// scanFirst returns the first transaction record of the passed rows, if any, and closes them
+func scanFirst(rows *sql.Rows) (*driver.TransactionRecord, error) {
+	it := &TransactionIterator{rows: rows}
+	defer it.Close()
+	return it.Next()
+}
+
+func scanTransaction(rows *sql.Rows) (*driver.TransactionRecord, error) {
+	record := &driver.TransactionRecord{}
+	var transactionType int
+	var amount sql.NullString
+	var status string
+	err := rows.Scan(
+		&record.TxID, &record.ActionIndex, &transactionType, &record.SenderEID, &record.RecipientEID,
+		&record.TokenType, &amount, &record.Timestamp, &status, &record.Reference,
+		&record.Quarantined, &record.QuarantineReason, &record.Reorgs, &record.FailureReason,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading transaction record")
+	}
+	if record.Amount, err = parseAmount(amount); err != nil {
+		return nil, err
+	}
+	record.TransactionType = driver.TransactionType(transactionType)
+	record.Status = driver.TxStatus(status)
+	return record, nil
+}
+
+// conditions accumulates the conditions of a WHERE clause, together with their arguments.
+// The namespace condition is always the first.
+type conditions struct {
+	clauses []string
+	args    []interface{}
+}
+
+func newConditions(namespace string) *conditions {
+	c := &conditions{}
+	c.add("namespace = " + c.param(namespace))
+	return c
+}
+
+// param adds the passed argument and returns its placeholder
+func (c *conditions) param(v interface{}) string {
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+func (c *conditions) add(clause string) {
+	c.clauses = append(c.clauses, clause)
+}
+
+// in adds the condition that the column takes one of the passed values. Nothing is added if there are no values.
+func (c *conditions) in(column string, values []interface{}) {
+	if len(values) == 0 {
+		return
+	}
+	placeholders := make([]string, len(values))
+	for i, v := range values {
+		placeholders[i] = c.param(v)
+	}
+	c.add(column + " IN (" + strings.Join(placeholders, ", ") + ")")
+}
+
+// interval adds the conditions that the column is within the passed bounds, if any
+func (c *conditions) interval(column string, from, to *time.Time) {
+	if from != nil {
+		c.add(column + " >= " + c.param(*from))
+	}
+	if to != nil {
+		c.add(column + " <= " + c.param(*to))
+	}
+}
+
+func (c *conditions) where() string {
+	return " WHERE " + strings.Join(c.clauses, " AND ")
+}
+
+func stringValues(values []string) []interface{} {
+	res := make([]interface{}, len(values))
+	for i, v := range values {
+		res[i] = v
+	}
+	return res
+}
+
+func statusValues(statuses []driver.TxStatus) []interface{} {
+	res := make([]interface{}, len(statuses))
+	for i, s := range statuses {
+		res[i] = string(s)
+	}
+	return res
+}
+
+// transactionsQuery returns the query selecting the transaction records that match the passed parameters,
+// in the order defined by driver.SortTransactions
+func transactionsQuery(namespace string, params driver.QueryTransactionsParams) (string, []interface{}) {
+	c := newConditions(namespace)
+	c.interval("stored_at", params.From, params.To)
+	if len(params.Reference) != 0 {
+		c.add("reference = " + c.param(params.Reference))
+	}
+	if params.Quarantined != nil {
+		c.add("quarantined = " + c.param(*params.Quarantined))
+	}
+	if len(params.Statuses) != 0 {
+		var valid []driver.TxStatus
+		for _, s := range params.Statuses {
+			if s.IsValid() {
+				valid = append(valid, s)
+			}
+		}
+		if len(valid) == 0 {
+			c.add("FALSE")
+		}
+		c.in("status", statusValues(valid))
+	}
+	if len(params.TransactionTypes) != 0 {
+		types := make([]interface{}, len(params.TransactionTypes))
+		for i, t := range params.TransactionTypes {
+			types[i] = int(t)
+		}
+		c.in("transaction_type", types)
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM ` + transactionsTable + c.where() + ` ORDER BY stored_at, tx_id, action_index, id`
+	if params.Limit > 0 {
+		query += " LIMIT " + c.param(params.Limit)
+	}
+	if params.Offset > 0 {
+		query += " OFFSET " + c.param(params.Offset)
+	}
+	return query, c.args
+}
+
+// movementsQuery returns the query selecting the movement records that match the passed parameters.
+// Without statuses, the Deleted movements are excluded.
+func movementsQuery(namespace string, enrollmentIDs []string, tokenTypes []string, txStatuses []driver.TxStatus, searchDirection driver.SearchDirection, movementDirection driver.MovementDirection, numRecords int) (string, []interface{}, error) {
+	c := newConditions(namespace)
+	c.in("enrollment_id", stringValues(enrollmentIDs))
+	c.in("token_type", stringValues(tokenTypes))
+	if len(txStatuses) != 0 {
+		c.in("status", statusValues(txStatuses))
+	} else {
+		c.add("status <> " + c.param(string(driver.Deleted)))
+	}
+	switch movementDirection {
+	case driver.Sent:
+		c.add("amount <= 0")
+	case driver.Received:
+		c.add("amount >= 0")
+	}
+
+	var order string
+	switch searchDirection {
+	case driver.FromBeginning:
+		order = "ASC"
+	case driver.FromLast:
+		order = "DESC"
+	default:
+		return "", nil, errors.Errorf("direction [%d] not valid", searchDirection)
+	}
+
+	query := `SELECT ` + movementQueryColumns + ` FROM ` + movementsTable + c.where() + ` ORDER BY id ` + order
+	if numRecords > 0 {
+		query += " LIMIT " + c.param(numRecords)
+	}
+	return query, c.args, nil
+}
+
+// balancesQuery returns the query summing by token type the amounts of the movements selected by the passed parameters.
+// Each row carries the token type, the sum, the number of nil amounts and one of the transactions with a nil amount.
+func balancesQuery(namespace string, params driver.QueryBalancesParams) (string, []interface{}) {
+	c := newConditions(namespace)
+	c.in("enrollment_id", stringValues(params.EnrollmentIDs))
+	c.in("token_type", stringValues(params.TokenTypes))
+	if len(params.Statuses) != 0 {
+		c.in("status", statusValues(params.Statuses))
+	} else {
+		c.add("status <> " + c.param(string(driver.Deleted)))
+	}
+	if params.ExcludeQuarantined {
+		c.add("NOT quarantined")
+	}
+	return `SELECT token_type, SUM(amount), COUNT(*) - COUNT(amount), MIN(CASE WHEN amount IS NULL THEN tx_id END) FROM ` +
+		movementsTable + c.where() + ` GROUP BY token_type`, c.args
+}
+
+// movementSummaryQuery returns the query aggregating, by enrollment ID and token type, the movements selected
+// by the passed parameters. Movements with a NULL amount are not summed.
+func movementSummaryQuery(namespace string, params driver.QueryMovementSummaryParams) (string, []interface{}) {
+	c := newConditions(namespace)
+	if len(params.Statuses) != 0 {
+		c.in("status", statusValues(params.Statuses))
+	} else {
+		c.add("status <> " + c.param(string(driver.Deleted)))
+	}
+	c.add("amount IS NOT NULL")
+	if params.From != nil || params.To != nil {
+		window := &conditions{args: c.args}
+		window.add("namespace = $1")
+		window.interval("stored_at", params.From, params.To)
+		c.args = window.args
+		c.add("tx_id IN (SELECT tx_id FROM " + transactionsTable + window.where() + ")")
+	}
+	return `SELECT enrollment_id, token_type, COALESCE(SUM(CASE WHEN amount > 0 THEN amount END), 0), COALESCE(SUM(CASE WHEN amount < 0 THEN -amount END), 0) FROM ` +
+		movementsTable + c.where() + ` GROUP BY enrollment_id, token_type ORDER BY enrollment_id, token_type`, c.args
+}
+
+// insertQuery returns the statement inserting the passed rows into the passed table, with their arguments
+func insertQuery(table, columns string, rows [][]interface{}) (string, []interface{}) {
+	c := &conditions{}
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		placeholders := make([]string, len(row))
+		for j, v := range row {
+			placeholders[j] = c.param(v)
+		}
+		values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return `INSERT INTO ` + table + ` (` + columns + `) VALUES ` + strings.Join(values, ", "), c.args
+}
+
+// amountValue returns the value stored for the passed amount, nil amounts are stored as NULL
+func amountValue(amount *big.Int) interface{} {
+	if amount == nil {
+		return nil
+	}
+	return amount.String()
+}
+
+// parseAmount parses an amount read from the database, NULL gives a nil amount
+func parseAmount(s sql.NullString) (*big.Int, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	amount, ok := new(big.Int).SetString(s.String, 10)
+	if !ok {
+		return nil, errors.Errorf("invalid amount [%s]", s.String)
+	}
+	return amount, nil
+}
+
+func rowsAffected(res sql.Result) (int, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed getting number of affected rows")
+	}
+	return int(n), nil
+}
+
+// isUniqueViolation returns true if the passed error, reported by the database/sql driver, is a unique violation.
+// Both github.com/lib/pq and github.com/jackc/pgx expose the SQLSTATE of their errors with a SQLState method.
+func isUniqueViolation(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == uniqueViolation
+}
+
+// uniqueIndexName returns the name of the unique index of the passed namespace
+func uniqueIndexName(namespace string) string {
+	h := sha256.Sum256([]byte(namespace))
+	return transactionsTable + "_unique_sender_" + hex.EncodeToString(h[:8])
+}
+
+// legacyUniqueIndexName returns the name of the unique index, without the sender, created by previous versions
+func legacyUniqueIndexName(namespace string) string {
+	h := sha256.Sum256([]byte(namespace))
+	return transactionsTable + "_unique_" + hex.EncodeToString(h[:8])
+}
+
+// quoteLiteral quotes the passed string as a SQL literal, for the statements that do not accept parameters
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,499 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	driver2 "database/sql/driver"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionsQuery(t *testing.T) {
+	from := time.Unix(10, 0)
+	quarantined := true
+	query, args := transactionsQuery("ns", driver.QueryTransactionsParams{
+		From:             &from,
+		Reference:        "invoice-1",
+		Quarantined:      &quarantined,
+		Statuses:         []driver.TxStatus{driver.Confirmed, "", driver.Pending},
+		TransactionTypes: []driver.TransactionType{driver.Issue},
+		Offset:           5,
+		Limit:            10,
+	})
+	assert.Equal(t, `SELECT `+transactionColumns+` FROM auditdb_transactions WHERE namespace = $1 AND stored_at >= $2 AND reference = $3 AND quarantined = $4 AND status IN ($5, $6) AND transaction_type IN ($7) ORDER BY stored_at, tx_id, action_index, id LIMIT $8 OFFSET $9`, query)
+	assert.Equal(t, []interface{}{"ns", from, "invoice-1", true, "Confirmed", "Pending", 0, 10, 5}, args)
+
+	// only unknown statuses select nothing
+	query, args = transactionsQuery("ns", driver.QueryTransactionsParams{Statuses: []driver.TxStatus{"Unknown"}})
+	assert.Equal(t, `SELECT `+transactionColumns+` FROM auditdb_transactions WHERE namespace = $1 AND FALSE ORDER BY stored_at, tx_id, action_index, id`, query)
+	assert.Equal(t, []interface{}{"ns"}, args)
+}
+
+func TestMovementsQuery(t *testing.T) {
+	query, args, err := movementsQuery("ns", []string{"alice", "bob"}, []string{"EUR"}, nil, driver.FromLast, driver.Sent, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT tx_id, enrollment_id, token_type, amount, status, quarantined FROM auditdb_movements WHERE namespace = $1 AND enrollment_id IN ($2, $3) AND token_type IN ($4) AND status <> $5 AND amount <= 0 ORDER BY id DESC LIMIT $6`, query)
+	assert.Equal(t, []interface{}{"ns", "alice", "bob", "EUR", "Deleted", 3}, args)
+
+	query, args, err = movementsQuery("ns", nil, nil, []driver.TxStatus{driver.Deleted}, driver.FromBeginning, driver.All, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT tx_id, enrollment_id, token_type, amount, status, quarantined FROM auditdb_movements WHERE namespace = $1 AND status IN ($2) ORDER BY id ASC`, query)
+	assert.Equal(t, []interface{}{"ns", "Deleted"}, args)
+
+	_, _, err = movementsQuery("ns", nil, nil, nil, driver.SearchDirection(7), driver.All, 0)
+	assert.EqualError(t, err, "direction [7] not valid")
+}
+
+func TestBalancesQuery(t *testing.T) {
+	query, args := balancesQuery("ns", driver.QueryBalancesParams{
+		EnrollmentIDs:      []string{"alice"},
+		Statuses:           []driver.TxStatus{driver.Confirmed},
+		ExcludeQuarantined: true,
+	})
+	assert.Equal(t, `SELECT token_type, SUM(amount), COUNT(*) - COUNT(amount), MIN(CASE WHEN amount IS NULL THEN tx_id END) FROM auditdb_movements WHERE namespace = $1 AND enrollment_id IN ($2) AND status IN ($3) AND NOT quarantined GROUP BY token_type`, query)
+	assert.Equal(t, []interface{}{"ns", "alice", "Confirmed"}, args)
+}
+
+func TestMovementSummaryQuery(t *testing.T) {
+	from := time.Unix(10, 0)
+	query, args := movementSummaryQuery("ns", driver.QueryMovementSummaryParams{From: &from, Statuses: []driver.TxStatus{driver.Confirmed}})
+	assert.Equal(t, `SELECT enrollment_id, token_type, COALESCE(SUM(CASE WHEN amount > 0 THEN amount END), 0), COALESCE(SUM(CASE WHEN amount < 0 THEN -amount END), 0) FROM auditdb_movements WHERE namespace = $1 AND status IN ($2) AND amount IS NOT NULL AND tx_id IN (SELECT tx_id FROM auditdb_transactions WHERE namespace = $1 AND stored_at >= $3) GROUP BY enrollment_id, token_type ORDER BY enrollment_id, token_type`, query)
+	assert.Equal(t, []interface{}{"ns", "Confirmed", from}, args)
+
+	query, args = movementSummaryQuery("ns", driver.QueryMovementSummaryParams{})
+	assert.Equal(t, `SELECT enrollment_id, token_type, COALESCE(SUM(CASE WHEN amount > 0 THEN amount END), 0), COALESCE(SUM(CASE WHEN amount < 0 THEN -amount END), 0) FROM auditdb_movements WHERE namespace = $1 AND status <> $2 AND amount IS NOT NULL GROUP BY enrollment_id, token_type ORDER BY enrollment_id, token_type`, query)
+	assert.Equal(t, []interface{}{"ns", "Deleted"}, args)
+}
+
+func TestAmounts(t *testing.T) {
+	assert.Nil(t, amountValue(nil))
+	assert.Equal(t, "-42", amountValue(big.NewInt(-42)))
+
+	amount, err := parseAmount(sql.NullString{})
+	assert.NoError(t, err)
+	assert.Nil(t, amount)
+	amount, err = parseAmount(sql.NullString{String: "123456789012345678901234567890", Valid: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "123456789012345678901234567890", amount.String())
+	_, err = parseAmount(sql.NullString{String: "1.5", Valid: true})
+	assert.EqualError(t, err, "invalid amount [1.5]")
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sql error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsUniqueViolation(t *testing.T) {
+	assert.True(t, isUniqueViolation(errors.Wrap(sqlStateError("23505"), "insert")))
+	assert.False(t, isUniqueViolation(sqlStateError("23503")))
+	assert.False(t, isUniqueViolation(errors.New("some error")))
+	assert.False(t, isUniqueViolation(nil))
+}
+
+func TestUniqueIndex(t *testing.T) {
+	assert.Equal(t, uniqueIndexName("ns"), uniqueIndexName("ns"))
+	assert.NotEqual(t, uniqueIndexName("ns"), uniqueIndexName("other"))
+	assert.NotEqual(t, uniqueIndexName("ns"), legacyUniqueIndexName("ns"))
+	assert.Equal(t, `'o''brien'`, quoteLiteral("o'brien"))
+}
+
+func TestInsertQuery(t *testing.T) {
+	query, args := insertQuery(movementsTable, "tx_id, amount", [][]interface{}{{"tx1", "10"}, {"tx1", "-10"}})
+	assert.Equal(t, `INSERT INTO auditdb_movements (tx_id, amount) VALUES ($1, $2), ($3, $4)`, query)
+	assert.Equal(t, []interface{}{"tx1", "10", "tx1", "-10"}, args)
+}
+
+// blockingDriver is a database/sql driver whose statements block until their context is done,
+// as those of an unreachable server do
+type blockingDriver struct{}
+
+func (blockingDriver) Open(string) (driver2.Conn, error) { return &blockingConn{}, nil }
+
+type blockingConn struct{}
+
+func (c *blockingConn) Prepare(string) (driver2.Stmt, error) { return nil, errors.New("not supported") }
+func (c *blockingConn) Close() error                         { return nil }
+func (c *blockingConn) Begin() (driver2.Tx, error)           { return c, nil }
+func (c *blockingConn) Commit() error                        { return nil }
+func (c *blockingConn) Rollback() error                      { return nil }
+
+func (c *blockingConn) BeginTx(context.Context, driver2.TxOptions) (driver2.Tx, error) {
+	return c, nil
+}
+
+func (c *blockingConn) ExecContext(ctx context.Context, _ string, _ []driver2.NamedValue) (driver2.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *blockingConn) QueryContext(ctx context.Context, _ string, _ []driver2.NamedValue) (driver2.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func init() {
+	sql.Register("blocking", blockingDriver{})
+}
+
+func TestWithContext(t *testing.T) {
+	db, err := sql.Open("blocking", "")
+	assert.NoError(t, err)
+	p := newPersistence(db, "ns")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	bound := p.WithContext(ctx)
+
+	// the update begun by the bound audit db is shared with the audit db
+	assert.NoError(t, bound.BeginUpdate())
+	err = bound.AddTransactions([]*driver.TransactionRecord{{TxID: "tx1", Amount: big.NewInt(10), Timestamp: time.Now()}})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.NoError(t, p.Discard())
+
+	_, err = bound.GetStatus("tx1")
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	_, err = bound.QueryMovements(nil, nil, nil, driver.FromBeginning, driver.All, 0)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+// fakeState is the content of a fakeDatabase: its tables, the applied schema versions,
+// and the status of the movement and transaction records of each transaction
+type fakeState struct {
+	tables       map[string]bool
+	versions     map[int64]bool
+	movements    map[string]string
+	transactions map[string]string
+}
+
+func (s *fakeState) clone() *fakeState {
+	c := &fakeState{tables: map[string]bool{}, versions: map[int64]bool{}, movements: map[string]string{}, transactions: map[string]string{}}
+	for k, v := range s.tables {
+		c.tables[k] = v
+	}
+	for k, v := range s.versions {
+		c.versions[k] = v
+	}
+	for k, v := range s.movements {
+		c.movements[k] = v
+	}
+	for k, v := range s.transactions {
+		c.transactions[k] = v
+	}
+	return c
+}
+
+// fakeDatabase interprets the statements of the audit db on a fakeState, enough to check its behaviour
+// without a PostgreSQL server. A transaction works on a copy of the state, which replaces the state on commit.
+// The log records the statements, prefixed by "tx: " when run in a transaction, and the transaction boundaries.
+type fakeDatabase struct {
+	mutex sync.Mutex
+	state *fakeState
+	log   []string
+}
+
+func (d *fakeDatabase) Open(string) (driver2.Conn, error) { return &fakeConn{db: d}, nil }
+
+func (d *fakeDatabase) record(entry string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.log = append(d.log, entry)
+}
+
+func (d *fakeDatabase) entries() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.log...)
+}
+
+// fakeDatabases are the fake databases, by data source name
+var fakeDatabases = map[string]*fakeDatabase{}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver2.Conn, error) { return fakeDatabases[name].Open(name) }
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// openFake opens a fake database starting from the passed state, empty if nil
+func openFake(t *testing.T, state *fakeState) (*sql.DB, *fakeDatabase) {
+	if state == nil {
+		state = (&fakeState{}).clone()
+	}
+	fake := &fakeDatabase{state: state}
+	fakeDatabases[t.Name()] = fake
+	db, err := sql.Open("fake", t.Name())
+	assert.NoError(t, err)
+	return db, fake
+}
+
+type fakeConn struct {
+	db *fakeDatabase
+	// tx is the state of the transaction in progress, if any
+	tx *fakeState
+}
+
+func (c *fakeConn) Prepare(string) (driver2.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                         { return nil }
+func (c *fakeConn) Begin() (driver2.Tx, error) {
+	return c.BeginTx(context.Background(), driver2.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver2.TxOptions) (driver2.Tx, error) {
+	c.db.mutex.Lock()
+	c.tx = c.db.state.clone()
+	c.db.mutex.Unlock()
+	c.db.record("begin")
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mutex.Lock()
+	c.db.state, c.tx = c.tx, nil
+	c.db.mutex.Unlock()
+	c.db.record("commit")
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.tx = nil
+	c.db.record("rollback")
+	return nil
+}
+
+var (
+	createTable     = regexp.MustCompile(`^CREATE TABLE (IF NOT EXISTS )?(\w+)`)
+	insertRecords   = regexp.MustCompile(`^INSERT INTO (auditdb_movements|auditdb_transactions) \(([^)]*)\)`)
+	updateStatus    = regexp.MustCompile(`^UPDATE (auditdb_movements|auditdb_transactions) SET status = \$1`)
+	selectStatus    = regexp.MustCompile(`^SELECT status FROM (auditdb_movements|auditdb_transactions) WHERE namespace = \$1 AND tx_id = \$2 LIMIT 1$`)
+	selectVersion   = regexp.MustCompile(`^SELECT EXISTS \(SELECT 1 FROM auditdb_schema_migrations WHERE version = \$1\)$`)
+	insertVersion   = regexp.MustCompile(`^INSERT INTO auditdb_schema_migrations \(version\) VALUES \(\$1\)$`)
+	migrationsNoOps = regexp.MustCompile(`^(CREATE INDEX|SELECT pg_advisory_xact_lock)`)
+)
+
+// run interprets the passed statement on the state of the transaction in progress, if any, on the database state otherwise
+func (c *fakeConn) run(query string, args []driver2.NamedValue) (int64, []driver2.Value, error) {
+	c.db.mutex.Lock()
+	defer c.db.mutex.Unlock()
+	state, prefix := c.db.state, ""
+	if c.tx != nil {
+		state, prefix = c.tx, "tx: "
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	c.db.log = append(c.db.log, prefix+query)
+
+	records := func(table string) map[string]string {
+		if table == movementsTable {
+			return state.movements
+		}
+		return state.transactions
+	}
+	switch {
+	case createTable.MatchString(query):
+		m := createTable.FindStringSubmatch(query)
+		if state.tables[m[2]] && len(m[1]) == 0 {
+			return 0, nil, errors.Errorf(`relation "%s" already exists`, m[2])
+		}
+		state.tables[m[2]] = true
+	case migrationsNoOps.MatchString(query):
+	case selectVersion.MatchString(query):
+		return 0, []driver2.Value{state.versions[args[0].Value.(int64)]}, nil
+	case insertVersion.MatchString(query):
+		state.versions[args[0].Value.(int64)] = true
+	case insertRecords.MatchString(query):
+		m := insertRecords.FindStringSubmatch(query)
+		columns := strings.Split(m[2], ", ")
+		var txID, status int
+		for i, column := range columns {
+			switch column {
+			case "tx_id":
+				txID = i
+			case "status":
+				status = i
+			}
+		}
+		rows := int64(len(args) / len(columns))
+		for i := 0; i < len(args); i += len(columns) {
+			records(m[1])[args[i+txID].Value.(string)] = args[i+status].Value.(string)
+		}
+		return rows, nil, nil
+	case updateStatus.MatchString(query):
+		m := updateStatus.FindStringSubmatch(query)
+		txID := args[len(args)-1].Value.(string)
+		if _, ok := records(m[1])[txID]; !ok {
+			return 0, nil, nil
+		}
+		records(m[1])[txID] = args[0].Value.(string)
+		return 1, nil, nil
+	case selectStatus.MatchString(query):
+		m := selectStatus.FindStringSubmatch(query)
+		status, ok := records(m[1])[args[1].Value.(string)]
+		if !ok {
+			return 0, nil, nil
+		}
+		return 0, []driver2.Value{status}, nil
+	default:
+		return 0, nil, errors.Errorf("unsupported statement [%s]", query)
+	}
+	return 0, nil, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver2.NamedValue) (driver2.Result, error) {
+	n, _, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver2.RowsAffected(n), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver2.NamedValue) (driver2.Rows, error) {
+	_, row, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{row: row}, nil
+}
+
+// fakeRows returns a single row, if any
+type fakeRows struct {
+	row  []driver2.Value
+	read bool
+}
+
+func (r *fakeRows) Columns() []string { return make([]string, len(r.row)) }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver2.Value) error {
+	if r.read || r.row == nil {
+		return io.EOF
+	}
+	r.read = true
+	copy(dest, r.row)
+	return nil
+}
+
+func TestUpdates(t *testing.T) {
+	db, fake := openFake(t, nil)
+	p, err := OpenDB(db, "ns")
+	assert.NoError(t, err)
+	// another audit db on the same database, that does not share the update in progress
+	other := newPersistence(db, "ns")
+	status := func(p *Persistence, txID string) driver.TxStatus {
+		s, err := p.GetStatus(txID)
+		assert.NoError(t, err)
+		return s
+	}
+
+	// the update is a SQL transaction, whose records are visible to others once committed
+	assert.EqualError(t, p.Commit(), "no commit in progress")
+	assert.EqualError(t, p.Discard(), "no commit in progress")
+	start := len(fake.entries())
+	assert.NoError(t, p.BeginUpdate())
+	assert.EqualError(t, p.BeginUpdate(), "previous commit in progress")
+	assert.NoError(t, p.AddMovement(&driver.MovementRecord{TxID: "tx1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Pending}))
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Pending}))
+	assert.Equal(t, driver.Pending, status(p, "tx1"))
+	assert.Equal(t, driver.TxStatus(""), status(other, "tx1"))
+	assert.NoError(t, p.Commit())
+	log := fake.entries()[start:]
+	assert.Equal(t, driver.Pending, status(other, "tx1"))
+	assert.Equal(t, "begin", log[0])
+	assert.Equal(t, "commit", log[len(log)-1])
+	for _, entry := range log[1 : len(log)-1] {
+		if !strings.HasPrefix(entry, "tx: ") {
+			// only the reads of the other audit db run outside the update
+			assert.True(t, strings.HasPrefix(entry, "SELECT status"), entry)
+		}
+	}
+
+	// discarded updates are rolled back
+	assert.NoError(t, p.BeginUpdate())
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx2", Timestamp: time.Now(), Status: driver.Pending}))
+	assert.Equal(t, driver.Pending, status(p, "tx2"))
+	assert.NoError(t, p.Discard())
+	assert.Equal(t, "rollback", fake.entries()[len(fake.entries())-1])
+	assert.Equal(t, driver.TxStatus(""), status(p, "tx2"))
+	assert.Equal(t, driver.TxStatus(""), status(other, "tx2"))
+
+	// without an update, a status change is a transaction of its own
+	start = len(fake.entries())
+	assert.NoError(t, p.SetStatus("tx1", driver.Confirmed, ""))
+	log = fake.entries()[start:]
+	assert.Equal(t, []string{"begin", "commit"}, []string{log[0], log[len(log)-1]})
+	assert.Equal(t, driver.Confirmed, status(other, "tx1"))
+}
+
+func TestConfirmedReplay(t *testing.T) {
+	db, _ := openFake(t, nil)
+	p, err := OpenDB(db, "ns")
+	assert.NoError(t, err)
+	assert.NoError(t, p.AddMovement(&driver.MovementRecord{TxID: "tx1", EnrollmentID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Status: driver.Pending}))
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", RecipientEID: "alice", TokenType: "EUR", Amount: big.NewInt(10), Timestamp: time.Now(), Status: driver.Pending}))
+
+	// replaying a Confirmed status, alone or within an update, succeeds and leaves the status unchanged
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, p.SetStatus("tx1", driver.Confirmed, ""))
+		status, err := p.GetStatus("tx1")
+		assert.NoError(t, err)
+		assert.Equal(t, driver.Confirmed, status)
+	}
+	assert.NoError(t, p.BeginUpdate())
+	assert.NoError(t, p.SetStatus("tx1", driver.Confirmed, ""))
+	assert.NoError(t, p.SetStatus("tx1", driver.Confirmed, ""))
+	assert.NoError(t, p.Commit())
+	status, err := p.GetStatus("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Confirmed, status)
+}
+
+func TestMigrate(t *testing.T) {
+	db, fake := openFake(t, nil)
+	p, err := OpenDB(db, "ns")
+	assert.NoError(t, err)
+	assert.NoError(t, p.AddTransaction(&driver.TransactionRecord{TxID: "tx1", Timestamp: time.Now(), Status: driver.Confirmed}))
+	assert.Equal(t, map[int64]bool{1: true}, fake.state.versions)
+
+	// reopening an up-to-date schema creates nothing and keeps the records
+	start := len(fake.entries())
+	p, err = OpenDB(db, "ns")
+	assert.NoError(t, err)
+	for _, entry := range fake.entries()[start:] {
+		assert.False(t, strings.Contains(entry, "CREATE TABLE "+transactionsTable), entry)
+		assert.False(t, strings.Contains(entry, "CREATE INDEX"), entry)
+	}
+	status, err := p.GetStatus("tx1")
+	assert.NoError(t, err)
+	assert.Equal(t, driver.Confirmed, status)
+
+	// a schema created outside the migrations is not clobbered: the migration fails, and rolls back, instead
+	db, fake = openFake(t, &fakeState{
+		tables:       map[string]bool{movementsTable: true, transactionsTable: true},
+		versions:     map[int64]bool{},
+		movements:    map[string]string{},
+		transactions: map[string]string{"tx1": string(driver.Confirmed)},
+	})
+	_, err = OpenDB(db, "ns")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `failed migrating schema to version [1]`)
+	assert.Contains(t, err.Error(), `relation "`+movementsTable+`" already exists`)
+	assert.Equal(t, "rollback", fake.entries()[len(fake.entries())-1])
+	assert.Empty(t, fake.state.versions)
+	assert.Equal(t, map[string]string{"tx1": string(driver.Confirmed)}, fake.state.transactions)
+}
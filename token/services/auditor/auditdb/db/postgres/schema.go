@@ -0,0 +1,110 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	movementsTable    = "auditdb_movements"
+	transactionsTable = "auditdb_transactions"
+	migrationsTable   = "auditdb_schema_migrations"
+
+	// migrationLockID identifies the advisory lock that serializes the migrations of concurrent openers
+	migrationLockID = 0x61756469
+)
+
+// migrations are the statements that bring the schema from one version to the next.
+// The schema version is the number of migrations applied. Migrations are never modified once released:
+// changes to the schema are made by appending new ones.
+var migrations = [][]string{
+	// version 1: movements and transactions
+	{
+		`CREATE TABLE ` + movementsTable + ` (
+			id BIGSERIAL PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			tx_id TEXT NOT NULL,
+			enrollment_id TEXT NOT NULL,
+			token_type TEXT NOT NULL,
+			amount NUMERIC,
+			status TEXT NOT NULL,
+			quarantined BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE INDEX ` + movementsTable + `_tx ON ` + movementsTable + ` (namespace, tx_id)`,
+		`CREATE INDEX ` + movementsTable + `_eid ON ` + movementsTable + ` (namespace, enrollment_id, token_type)`,
+		`CREATE TABLE ` + transactionsTable + ` (
+			id BIGSERIAL PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			tx_id TEXT NOT NULL,
+			action_index INTEGER NOT NULL,
+			transaction_type INTEGER NOT NULL,
+			sender_eid TEXT NOT NULL,
+			recipient_eid TEXT NOT NULL,
+			token_type TEXT NOT NULL,
+			amount NUMERIC,
+			stored_at TIMESTAMPTZ NOT NULL,
+			status TEXT NOT NULL,
+			reference TEXT NOT NULL DEFAULT '',
+			quarantined BOOLEAN NOT NULL DEFAULT FALSE,
+			quarantine_reason TEXT NOT NULL DEFAULT '',
+			reorgs INTEGER NOT NULL DEFAULT 0,
+			failure_reason TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX ` + transactionsTable + `_tx ON ` + transactionsTable + ` (namespace, tx_id)`,
+		`CREATE INDEX ` + transactionsTable + `_time ON ` + transactionsTable + ` (namespace, stored_at)`,
+	},
+}
+
+// migrate applies to the database the migrations not applied yet, each in its own transaction.
+// The tables are never dropped, therefore an existing schema, and its data, are preserved.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (version INTEGER PRIMARY KEY)`); err != nil {
+		return errors.Wrap(err, "failed creating migrations table")
+	}
+	for version := 1; version <= len(migrations); version++ {
+		if err := applyMigration(db, version); err != nil {
+			return errors.WithMessagef(err, "failed migrating schema to version [%d]", version)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration to the passed version, unless already applied
+func applyMigration(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return errors.Wrap(err, "failed acquiring migration lock")
+	}
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+migrationsTable+` WHERE version = $1)`, version).Scan(&applied); err != nil {
+		return errors.Wrap(err, "failed reading schema version")
+	}
+	if applied {
+		return nil
+	}
+	logger.Infof("migrating audit db schema to version [%d]", version)
+	for _, statement := range migrations[version-1] {
+		if _, err := tx.Exec(statement); err != nil {
+			return errors.Wrapf(err, "failed executing [%s]", statement)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO `+migrationsTable+` (version) VALUES ($1)`, version); err != nil {
+		return errors.Wrap(err, "failed recording schema version")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed committing migration")
+	}
+	return nil
+}
@@ -7,10 +7,23 @@ SPDX-License-Identifier: Apache-2.0
 package driver
 
 import (
+	"context"
+	"fmt"
 	"math/big"
+	"sort"
 	"time"
 
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUniqueConstraintsNotSupported is returned by EnsureUniqueConstraints when the driver cannot enforce them
+	ErrUniqueConstraintsNotSupported = errors.New("unique constraints not supported")
+	// ErrDuplicateTransaction is returned by AddTransaction when the record violates the unique constraints
+	ErrDuplicateTransaction = errors.New("duplicate transaction record")
+	// ErrSnapshotNotSupported is returned by Snapshot and Restore when the driver cannot take or restore snapshots
+	ErrSnapshotNotSupported = errors.New("snapshot not supported")
 )
 
 // TransactionType is the type of transaction
@@ -59,6 +72,16 @@ const (
 	Deleted TxStatus = "Deleted"
 )
 
+// IsValid returns true if the status is one of the known statuses
+func (s TxStatus) IsValid() bool {
+	switch s {
+	case Pending, Confirmed, Deleted:
+		return true
+	default:
+		return false
+	}
+}
+
 // MovementRecord is a record of a movement
 type MovementRecord struct {
 	// TxID is the transaction ID
@@ -71,12 +94,16 @@ type MovementRecord struct {
 	Amount *big.Int
 	// Status is the status of the transaction
 	Status TxStatus
+	// Quarantined is true if the transaction has been put in quarantine pending review
+	Quarantined bool
 }
 
 // TransactionRecord is the record of a transaction
 type TransactionRecord struct {
 	// TxID is the transaction ID
 	TxID string
+	// ActionIndex is the index, in the token request, of the action this record refers to
+	ActionIndex int
 	// TransactionType is the type of transaction
 	TransactionType TransactionType
 	// SenderEID is the enrollment ID of the account that is sending tokens
@@ -91,6 +118,305 @@ type TransactionRecord struct {
 	Timestamp time.Time
 	// Status is the status of the transaction
 	Status TxStatus
+	// Reference is an application-defined reference attached to the transaction (e.g. an invoice number)
+	Reference string
+	// Quarantined is true if the transaction has been put in quarantine pending review
+	Quarantined bool
+	// QuarantineReason is the reason why the transaction has been put in quarantine
+	QuarantineReason string
+	// Reorgs is the number of times the transaction has been reverted from Confirmed to Pending
+	// due to a ledger reorganization
+	Reorgs int
+	// FailureReason is the reason, if recorded, why the transaction failed to commit
+	FailureReason string
+}
+
+// QueryTransactionsParams defines the parameters for querying transactions
+type QueryTransactionsParams struct {
+	// From and To define the time interval of the query.
+	// If both are nil, all transactions are selected.
+	From *time.Time
+	To   *time.Time
+	// Reference, if not empty, selects only the transactions carrying this reference
+	Reference string
+	// Quarantined, if not nil, selects only the transactions whose quarantine flag matches the pointed value
+	Quarantined *bool
+	// Statuses, if not empty, selects only the transactions whose status is among these.
+	// Transactions with an empty or unknown status are then never selected.
+	Statuses []TxStatus
+	// TransactionTypes, if not empty, selects only the transactions whose type is among these
+	TransactionTypes []TransactionType
+	// Offset is the number of selected transactions to skip
+	Offset int
+	// Limit, if positive, is the maximum number of transactions to return
+	Limit int
+}
+
+// SelectsStatus returns true if the passed status is selected by the Statuses parameter.
+// If the parameter is not empty, an empty or unknown status is never selected.
+func (p QueryTransactionsParams) SelectsStatus(status TxStatus) bool {
+	if len(p.Statuses) == 0 {
+		return true
+	}
+	if !status.IsValid() {
+		return false
+	}
+	for _, s := range p.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectsTransactionType returns true if the passed transaction type is selected by the TransactionTypes parameter
+func (p QueryTransactionsParams) SelectsTransactionType(tt TransactionType) bool {
+	if len(p.TransactionTypes) == 0 {
+		return true
+	}
+	for _, t := range p.TransactionTypes {
+		if t == tt {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryBalancesParams defines the parameters for summing movements by token type
+type QueryBalancesParams struct {
+	// EnrollmentIDs, if not empty, selects only the movements of these enrollment IDs
+	EnrollmentIDs []string
+	// TokenTypes, if not empty, selects only the movements of these token types
+	TokenTypes []string
+	// Statuses, if not empty, selects only the movements whose status is among these
+	Statuses []TxStatus
+	// ExcludeQuarantined tells to leave out the movements of the transactions in quarantine
+	ExcludeQuarantined bool
+	// NilAmountAsZero tells to count movements with a nil amount as zero, instead of failing
+	NilAmountAsZero bool
+}
+
+// QueryMovementSummaryParams selects the movements summarized by QueryMovementSummary
+type QueryMovementSummaryParams struct {
+	// From and To, if not nil, select only the movements of the transactions whose records
+	// have a timestamp within the interval, bounds included
+	From *time.Time
+	To   *time.Time
+	// Statuses, if not empty, selects only the movements whose status is among these.
+	// Otherwise, Deleted movements are left out.
+	Statuses []TxStatus
+}
+
+// MovementSummaryRow is the flow of a token type in and out of an enrollment ID
+type MovementSummaryRow struct {
+	EnrollmentID string
+	TokenType    string
+	// Received is the sum of the positive amounts
+	Received *big.Int
+	// Sent is the sum of the negative amounts, as a positive number
+	Sent *big.Int
+	// Net is Received minus Sent
+	Net *big.Int
+}
+
+// SummarizeMovements folds the passed movement records into one row per enrollment ID and token type.
+// If txIDs is not nil, only the movements of the transactions in it are considered.
+// Movements with a nil amount are skipped. Rows are sorted by enrollment ID and token type.
+// It is the fallback for the drivers that cannot aggregate in the backend.
+func SummarizeMovements(records []*MovementRecord, txIDs map[string]bool) []*MovementSummaryRow {
+	type key struct{ eID, tokenType string }
+	rows := map[key]*MovementSummaryRow{}
+	var res []*MovementSummaryRow
+	for _, record := range records {
+		if record.Amount == nil || (txIDs != nil && !txIDs[record.TxID]) {
+			continue
+		}
+		k := key{eID: record.EnrollmentID, tokenType: record.TokenType}
+		row, ok := rows[k]
+		if !ok {
+			row = &MovementSummaryRow{
+				EnrollmentID: record.EnrollmentID,
+				TokenType:    record.TokenType,
+				Received:     big.NewInt(0),
+				Sent:         big.NewInt(0),
+				Net:          big.NewInt(0),
+			}
+			rows[k] = row
+			res = append(res, row)
+		}
+		if record.Amount.Sign() > 0 {
+			row.Received.Add(row.Received, record.Amount)
+		} else {
+			row.Sent.Sub(row.Sent, record.Amount)
+		}
+		row.Net.Add(row.Net, record.Amount)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].EnrollmentID != res[j].EnrollmentID {
+			return res[i].EnrollmentID < res[j].EnrollmentID
+		}
+		return res[i].TokenType < res[j].TokenType
+	})
+	return res
+}
+
+// QueryMovementSummary summarizes the movements selected by the passed parameters with SummarizeMovements,
+// querying the passed audit db. It is the fallback for the drivers that cannot aggregate in the backend.
+func QueryMovementSummary(db AuditDB, params QueryMovementSummaryParams) ([]*MovementSummaryRow, error) {
+	var txIDs map[string]bool
+	if params.From != nil || params.To != nil {
+		it, err := db.QueryTransactions(QueryTransactionsParams{From: params.From, To: params.To})
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		txIDs = map[string]bool{}
+		for {
+			record, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if record == nil {
+				break
+			}
+			txIDs[record.TxID] = true
+		}
+	}
+	records, err := db.QueryMovements(nil, nil, params.Statuses, FromBeginning, All, 0)
+	if err != nil {
+		return nil, err
+	}
+	return SummarizeMovements(records, txIDs), nil
+}
+
+// SumByTokenType sums by token type the amounts of the passed movement records, according to the passed parameters.
+// Only ExcludeQuarantined and NilAmountAsZero are applied, the records are assumed to be already selected by the others.
+// Token types without records are absent from the returned map.
+func SumByTokenType(records []*MovementRecord, params QueryBalancesParams) (map[string]*big.Int, error) {
+	balances := map[string]*big.Int{}
+	for _, record := range records {
+		if params.ExcludeQuarantined && record.Quarantined {
+			continue
+		}
+		balance, ok := balances[record.TokenType]
+		if !ok {
+			balance = big.NewInt(0)
+			balances[record.TokenType] = balance
+		}
+		if record.Amount == nil {
+			if params.NilAmountAsZero {
+				continue
+			}
+			return nil, errors.Errorf("nil amount for tx [%s]", record.TxID)
+		}
+		balance.Add(balance, record.Amount)
+	}
+	return balances, nil
+}
+
+// SortTransactions sorts the passed transaction records by timestamp, then by transaction ID, then by action index.
+// The sort is stable, records equal with respect to these keys keep their relative order.
+// Drivers use it to return transactions in a deterministic order, so that pagination is stable
+// even when many records share the same timestamp.
+func SortTransactions(records []*TransactionRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.TxID != b.TxID {
+			return a.TxID < b.TxID
+		}
+		return a.ActionIndex < b.ActionIndex
+	})
+}
+
+// UniqueKey returns the key that identifies the passed transaction record under the unique constraints.
+// See AuditDB.EnsureUniqueConstraints.
+func UniqueKey(record *TransactionRecord) string {
+	return fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s", record.TxID, record.ActionIndex, record.SenderEID, record.RecipientEID, record.TokenType)
+}
+
+// MultiTypeActions returns the IDs of the transactions, among the passed records, with an action whose records
+// refer to more than one token type, as it happens with atomic swaps. The IDs are returned in the order
+// of their first record.
+func MultiTypeActions(records []*TransactionRecord) []string {
+	type action struct {
+		txID  string
+		index int
+	}
+	tokenTypes := map[action]string{}
+	found := map[string]bool{}
+	var txIDs []string
+	for _, record := range records {
+		if found[record.TxID] {
+			continue
+		}
+		a := action{txID: record.TxID, index: record.ActionIndex}
+		tokenType, ok := tokenTypes[a]
+		if !ok {
+			tokenTypes[a] = record.TokenType
+			continue
+		}
+		if tokenType != record.TokenType {
+			found[record.TxID] = true
+			txIDs = append(txIDs, record.TxID)
+		}
+	}
+	return txIDs
+}
+
+// CountDuplicates returns the transaction IDs whose records appear more times than their action structure implies.
+// An action yields at most one record for each sender, recipient and token type. Therefore, a transaction is
+// duplicated when more records share its action index, sender, recipient and token type.
+// For each offending transaction ID, the returned map holds the number of times the transaction has been recorded.
+func CountDuplicates(records []*TransactionRecord) map[string]int {
+	type key struct {
+		txID         string
+		actionIndex  int
+		senderEID    string
+		recipientEID string
+		tokenType    string
+	}
+	counters := map[key]int{}
+	res := map[string]int{}
+	for _, record := range records {
+		k := key{
+			txID:         record.TxID,
+			actionIndex:  record.ActionIndex,
+			senderEID:    record.SenderEID,
+			recipientEID: record.RecipientEID,
+			tokenType:    record.TokenType,
+		}
+		counters[k]++
+		if counters[k] > 1 && counters[k] > res[record.TxID] {
+			res[record.TxID] = counters[k]
+		}
+	}
+	return res
+}
+
+// Page returns the page of the passed records selected by the offset and limit of the parameters
+func (p QueryTransactionsParams) Page(records []*TransactionRecord) []*TransactionRecord {
+	if p.Offset >= len(records) {
+		return nil
+	}
+	records = records[p.Offset:]
+	if p.Limit > 0 && len(records) > p.Limit {
+		records = records[:p.Limit]
+	}
+	return records
+}
+
+// Snapshot is the whole content of an audit database
+type Snapshot struct {
+	Movements    []*MovementRecord
+	Transactions []*TransactionRecord
+}
+
+// IsEmpty returns true if the snapshot contains no record
+func (s *Snapshot) IsEmpty() bool {
+	return len(s.Movements) == 0 && len(s.Transactions) == 0
 }
 
 // TransactionIterator is an iterator for transactions
@@ -113,25 +439,123 @@ type AuditDB interface {
 	// Discard discards the current update to the audit database
 	Discard() error
 
-	// SetStatus sets the status of a transaction
-	SetStatus(txID string, status TxStatus) error
+	// Sync makes durable all the updates committed so far.
+	// Drivers that are always durable implement it as a no-op.
+	Sync() error
+
+	// GetStatus returns the status of a transaction, read from its transaction records or,
+	// if there are none, from its movement records. It returns an empty status if the transaction is unknown.
+	GetStatus(txID string) (TxStatus, error)
+
+	// SetStatus sets the status of a transaction, and the failure reason of its transaction records.
+	// An empty reason clears any previously recorded one.
+	SetStatus(txID string, status TxStatus, reason string) error
+
+	// Reorg reverts the records of a Confirmed transaction to Pending, and increments the reorg counter
+	// of its transaction records. Pending transactions are left unchanged.
+	// It returns an error if the transaction is Deleted.
+	Reorg(txID string) error
+
+	// Prune removes the transaction records older than the passed time, unless Pending.
+	// The movement records of the removed Deleted transactions are removed as well, while the other movement records
+	// are kept because they back the holdings.
+	// It returns the number of removed records.
+	Prune(before time.Time) (int, error)
+
+	// DeleteTransactionsBefore removes, in a single transaction, the transaction records older than the passed time
+	// whose transaction is in a terminal state, that is, Confirmed or Deleted, together with all the movement records
+	// of those transactions. Pending transactions are never removed.
+	// It returns the number of removed records. With dryRun, it only counts the records that would be removed.
+	DeleteTransactionsBefore(before time.Time, dryRun bool) (int, error)
+
+	// SetQuarantine sets the quarantine flag, and the reason, of the records of a transaction
+	SetQuarantine(txID string, quarantined bool, reason string) error
 
 	// AddMovement adds a movement record to the audit database
 	AddMovement(record *MovementRecord) error
 
-	// AddTransaction adds a transaction record to the audit database
+	// AddTransaction adds a transaction record to the audit database.
+	// If the unique constraints are in place, it returns ErrDuplicateTransaction when a record with the same
+	// transaction id, action index, sender, recipient, and token type already exists.
 	AddTransaction(record *TransactionRecord) error
 
-	// QueryTransactions returns a list of transactions that match the given criteria
-	// If both from and to are nil, then all transactions are returned.
-	QueryTransactions(from, to *time.Time) (TransactionIterator, error)
+	// AddMovements adds, as part of the current update, the passed movement records in a single batch.
+	// Drivers that cannot batch add the records one by one.
+	AddMovements(records []*MovementRecord) error
+
+	// AddTransactions adds, as part of the current update, the passed transaction records in a single batch.
+	// It fails as AddTransaction does when a record violates the unique constraints.
+	// Drivers that cannot batch add the records one by one.
+	AddTransactions(records []*TransactionRecord) error
+
+	// EnsureUniqueConstraints makes sure that the audit database rejects duplicate transaction records,
+	// that is, records with the same transaction id, action index, sender, recipient, and token type.
+	// Drivers that cannot enforce the constraints return ErrUniqueConstraintsNotSupported.
+	EnsureUniqueConstraints() error
+
+	// Snapshot returns the whole content of the audit database.
+	// Drivers that cannot take snapshots return ErrSnapshotNotSupported.
+	Snapshot() (*Snapshot, error)
+
+	// Restore loads the records of the passed snapshot into the audit database, which must be empty.
+	// Drivers that cannot restore snapshots return ErrSnapshotNotSupported.
+	Restore(snapshot *Snapshot) error
+
+	// DeleteTransactions deletes, as part of the current update, the transaction records of the passed transaction.
+	// It returns the number of deleted records.
+	DeleteTransactions(txID string) (int, error)
+
+	// DeleteMovements deletes, as part of the current update, the movement records of the passed transaction.
+	// It returns the number of deleted records.
+	DeleteMovements(txID string) (int, error)
+
+	// QueryTransactions returns a list of transactions that match the given criteria.
+	// Transactions are returned in the order defined by SortTransactions.
+	QueryTransactions(params QueryTransactionsParams) (TransactionIterator, error)
+
+	// QueryDuplicateTransactions returns the transaction IDs, among the transactions in the passed time interval,
+	// that have been recorded more than once, together with the number of times they have been recorded.
+	// See CountDuplicates.
+	QueryDuplicateTransactions(from, to *time.Time) (map[string]int, error)
+
+	// QueryMultiTypeActions returns the IDs of the transactions, among the transactions in the passed time interval,
+	// with an action that moved more than one token type. See MultiTypeActions.
+	QueryMultiTypeActions(from, to *time.Time) ([]string, error)
+
+	// QueryLatestTransactions returns, for each of the passed enrollment IDs, the transaction record with the
+	// most recent timestamp in which the enrollment ID appears either as sender or as recipient.
+	// Deleted transactions are not considered. Enrollment IDs without transactions are absent from the returned map.
+	QueryLatestTransactions(enrollmentIDs []string) (map[string]*TransactionRecord, error)
+
+	// QueryBalances returns the amounts of the movements selected by the passed parameters, summed by token type.
+	// See SumByTokenType.
+	QueryBalances(params QueryBalancesParams) (map[string]*big.Int, error)
+
+	// QueryMovementSummary returns the flow of each token type in and out of each enrollment ID,
+	// considering the movements selected by the passed parameters. See SummarizeMovements.
+	QueryMovementSummary(params QueryMovementSummaryParams) ([]*MovementSummaryRow, error)
 
 	// QueryMovements returns a list of movement records
 	QueryMovements(enrollmentIDs []string, tokenTypes []string, txStatuses []TxStatus, searchDirection SearchDirection, movementDirection MovementDirection, numRecords int) ([]*MovementRecord, error)
+
+	// QueryMovementsByTxID returns the movement records of the passed transaction, whatever their status,
+	// in the order they have been added
+	QueryMovementsByTxID(txID string) ([]*MovementRecord, error)
+}
+
+// ContextAuditDB is implemented by the audit databases whose operations block on remote I/O, such as those
+// backed by a SQL server, and can be aborted once a context is done
+type ContextAuditDB interface {
+	// WithContext returns the audit database with its operations bound to the passed context.
+	// The returned audit database shares the update in progress, if any, with the receiver.
+	WithContext(ctx context.Context) AuditDB
 }
 
 // Driver is the interface for a database driver
 type Driver interface {
-	// Open opens a database connection
+	// Open opens a database connection.
+	// The name is the namespace of the audit database, as derived by the Manager from the auditor wallet.
+	// Audit databases opened with different names must not share any record: drivers isolate them
+	// by using, for instance, a dedicated folder, table, or key prefix per name.
 	Open(sp view.ServiceProvider, name string) (AuditDB, error)
 }
@@ -0,0 +1,185 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExportHeader is the header row of the CSV export of transaction records.
+// It names the fields of TransactionRecord, which are also the keys of the JSON export.
+var ExportHeader = []string{"TxID", "ActionIndex", "TransactionType", "SenderEID", "RecipientEID", "TokenType", "Amount", "Timestamp", "Status", "Reference", "Quarantined", "QuarantineReason", "Reorgs", "FailureReason"}
+
+// ExportFormat is the format of the export of transaction records
+type ExportFormat int
+
+const (
+	// CSVFormat exports the transaction records as CSV rows, preceded by ExportHeader
+	CSVFormat ExportFormat = iota
+	// JSONLinesFormat exports each transaction record as a JSON object on its own line
+	JSONLinesFormat
+)
+
+// ExportOptions models the options of the export of transaction records
+type ExportOptions struct {
+	// AmountWidth, if positive, is the width amounts are left-padded with zeros to,
+	// so that the lexicographic order of the exported amounts matches their numeric order
+	AmountWidth int
+}
+
+// ExportOption is a function that modifies ExportOptions
+type ExportOption func(*ExportOptions)
+
+// WithFixedWidthAmount left-pads the exported amounts with zeros to the passed width.
+// The export fails if an amount does not fit the width.
+func WithFixedWidthAmount(width int) ExportOption {
+	return func(o *ExportOptions) {
+		o.AmountWidth = width
+	}
+}
+
+// recordWriter writes exported transaction records, whose fields are ordered as in ExportHeader
+type recordWriter interface {
+	Write(fields []string) error
+	Flush() error
+}
+
+type csvWriter struct {
+	*csv.Writer
+}
+
+func (w *csvWriter) Flush() error {
+	w.Writer.Flush()
+	return w.Writer.Error()
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonLinesWriter) Write(fields []string) error {
+	// the object is built by hand to keep the keys in the order of ExportHeader.
+	// Marshalling a string never fails.
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(ExportHeader[i])
+		value, _ := json.Marshal(field)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return w.encoder.Encode(json.RawMessage(buf.Bytes()))
+}
+
+func (w *jsonLinesWriter) Flush() error {
+	return nil
+}
+
+// ExportTransactions writes to the passed writer the transaction records in the given time interval.
+// If from and to are both nil, all transactions are exported.
+// Records are written as they are read, either as CSV rows preceded by ExportHeader,
+// or as JSON objects, one per line, whose values are strings keyed by the names in ExportHeader.
+// Amounts are exported in base units, as plain decimals unless WithFixedWidthAmount is used.
+// The iterator over the records is closed in any case.
+func (qe *QueryExecutor) ExportTransactions(w io.Writer, format ExportFormat, from, to *time.Time, opts ...ExportOption) error {
+	options := &ExportOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	var writer recordWriter
+	switch format {
+	case CSVFormat:
+		writer = &csvWriter{Writer: csv.NewWriter(w)}
+	case JSONLinesFormat:
+		writer = &jsonLinesWriter{encoder: json.NewEncoder(w)}
+	default:
+		return errors.Errorf("unknown export format [%d]", format)
+	}
+
+	it, err := qe.Transactions(from, to)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	if format == CSVFormat {
+		if err := writer.Write(ExportHeader); err != nil {
+			return errors.Wrap(err, "failed writing export header")
+		}
+	}
+	for {
+		record, err := it.Next()
+		if err != nil {
+			return errors.WithMessage(err, "failed reading transaction record")
+		}
+		if record == nil {
+			break
+		}
+		amount, err := FormatAmount(record.Amount, options.AmountWidth)
+		if err != nil {
+			return errors.WithMessagef(err, "failed exporting transaction record [%s]", record.TxID)
+		}
+		if err := writer.Write([]string{
+			record.TxID,
+			strconv.Itoa(record.ActionIndex),
+			record.TransactionType.String(),
+			record.SenderEID,
+			record.RecipientEID,
+			record.TokenType,
+			amount,
+			record.Timestamp.UTC().Format(time.RFC3339Nano),
+			string(record.Status),
+			record.Reference,
+			strconv.FormatBool(record.Quarantined),
+			record.QuarantineReason,
+			strconv.Itoa(record.Reorgs),
+			record.FailureReason,
+		}); err != nil {
+			return errors.Wrapf(err, "failed writing transaction record [%s]", record.TxID)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return errors.Wrap(err, "failed flushing export")
+	}
+	return nil
+}
+
+// FormatAmount returns the decimal representation of the passed amount.
+// If width is positive, the amount is left-padded with zeros to the passed width. In this case,
+// an error is returned if the amount is negative or does not fit the width.
+// A nil amount is formatted as the empty string.
+func FormatAmount(amount *big.Int, width int) (string, error) {
+	if amount == nil {
+		return "", nil
+	}
+	s := amount.String()
+	if width <= 0 {
+		return s, nil
+	}
+	if amount.Sign() < 0 {
+		return "", errors.Errorf("negative amount [%s] cannot be padded", s)
+	}
+	if len(s) > width {
+		return "", errors.Errorf("amount [%s] exceeds the width of [%d] digits", s, width)
+	}
+	return strings.Repeat("0", width-len(s)) + s, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"context"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+)
+
+// NewAuditDB exposes newAuditDB to the tests of package auditdb_test
+func NewAuditDB(p driver.AuditDB, opts ...Option) *AuditDB {
+	options := compile(opts...)
+	return newAuditDB(p, options, &dbStats{stats: newStats(options.MetricsProvider)})
+}
+
+// referencedRecord provides the passed record, with the passed reference
+type referencedRecord struct {
+	record *token.AuditRecord
+	ref    string
+}
+
+func (r *referencedRecord) AuditRecord() (*token.AuditRecord, error) { return r.record, nil }
+
+func (r *referencedRecord) reference() string { return r.ref }
+
+// AppendRecord appends the passed record, with the passed reference, through AppendContext,
+// for the tests of package auditdb_test
+func (db *AuditDB) AppendRecord(record *token.AuditRecord, reference string) error {
+	return db.AppendContext(context.Background(), &referencedRecord{record: record, ref: reference})
+}
+
+// AppendMovements adds the movements computed by movementRecords, for the tests of package auditdb_test
+func (db *AuditDB) AppendMovements(record *token.AuditRecord) error {
+	return db.db.AddMovements(db.movementRecords(record))
+}
+
+// NewAuditDB exposes newAuditDB of Manager to the tests of package auditdb_test
+func (cm *Manager) NewAuditDB(p driver.AuditDB) *AuditDB {
+	return cm.newAuditDB("", p)
+}
+
+// AuditDBByKey exposes auditDB of Manager to the tests of package auditdb_test
+func (cm *Manager) AuditDBByKey(key string) (*AuditDB, error) {
+	return cm.auditDB(key)
+}
+
+// AddAuditDB registers with the manager an AuditDB for the passed wallet ID, backed by the passed driver
+func (cm *Manager) AddAuditDB(walletID string, p driver.AuditDB) *AuditDB {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	db := cm.newAuditDB(walletID, p)
+	cm.dbs[walletID] = db
+	return db
+}
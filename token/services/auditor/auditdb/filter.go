@@ -7,14 +7,17 @@ SPDX-License-Identifier: Apache-2.0
 package auditdb
 
 import (
+	"context"
 	"math/big"
+	"time"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
 	token2 "github.com/hyperledger-labs/fabric-token-sdk/token/token"
 )
 
 type PaymentsFilter struct {
-	db *AuditDB
+	db  *AuditDB
+	ctx context.Context
 
 	EnrollmentIds  []string
 	Types          []string
@@ -28,6 +31,8 @@ func (f *PaymentsFilter) ByEnrollmentId(id string) *PaymentsFilter {
 	return f
 }
 
+// ByType restricts the payments to the passed token type.
+// The restriction is applied by the driver, and successive calls select the union of the passed types.
 func (f *PaymentsFilter) ByType(tokenType string) *PaymentsFilter {
 	f.Types = append(f.Types, tokenType)
 	return f
@@ -39,7 +44,8 @@ func (f *PaymentsFilter) Last(num int) *PaymentsFilter {
 }
 
 func (f *PaymentsFilter) Execute() (*PaymentsFilter, error) {
-	records, err := f.db.db.QueryMovements(
+	start := time.Now()
+	records, err := f.db.store(f.ctx).QueryMovements(
 		f.EnrollmentIds,
 		f.Types,
 		[]driver.TxStatus{driver.Pending, driver.Confirmed},
@@ -47,9 +53,14 @@ func (f *PaymentsFilter) Execute() (*PaymentsFilter, error) {
 		driver.Sent,
 		f.LastNumRecords,
 	)
+	f.db.stats.observeQuery("Payments", start)
 	if err != nil {
 		return nil, err
 	}
+	f.db.stats.addRows("Payments", len(records))
+	if err := f.db.checkMovementAmounts(records); err != nil {
+		return nil, err
+	}
 	f.records = records
 	return f, nil
 }
@@ -57,6 +68,9 @@ func (f *PaymentsFilter) Execute() (*PaymentsFilter, error) {
 func (f *PaymentsFilter) Sum() token2.Quantity {
 	sum := big.NewInt(0)
 	for _, record := range f.records {
+		if record.Amount == nil {
+			continue
+		}
 		sum = sum.Add(sum, record.Amount)
 	}
 	sum.Neg(sum)
@@ -64,10 +78,14 @@ func (f *PaymentsFilter) Sum() token2.Quantity {
 }
 
 type HoldingsFilter struct {
-	db *AuditDB
+	db  *AuditDB
+	ctx context.Context
 
-	EnrollmentIds []string
-	Types         []string
+	EnrollmentIds      []string
+	Types              []string
+	ExcludeQuarantined bool
+	ConfirmedOnly      bool
+	IncludePending     bool
 
 	records []*driver.MovementRecord
 }
@@ -82,11 +100,72 @@ func (f *HoldingsFilter) ByType(tokenType string) *HoldingsFilter {
 	return f
 }
 
+// Available excludes from the holdings the movements of the transactions in quarantine
+func (f *HoldingsFilter) Available() *HoldingsFilter {
+	f.ExcludeQuarantined = true
+	return f
+}
+
+// Confirmed excludes from the holdings the movements of the transactions not yet confirmed by the ledger
+func (f *HoldingsFilter) Confirmed() *HoldingsFilter {
+	f.ConfirmedOnly = true
+	return f
+}
+
+// WithPending includes in the Balance the movements of the transactions not yet confirmed by the ledger
+func (f *HoldingsFilter) WithPending() *HoldingsFilter {
+	f.IncludePending = true
+	return f
+}
+
+// Balance returns the holdings of the selected enrollment IDs and token types, summed by token type by the driver.
+// Unlike Execute, it counts only the movements of Confirmed transactions, unless WithPending is used.
+// Token types without movements are absent from the returned map.
+func (f *HoldingsFilter) Balance() (map[string]*big.Int, error) {
+	statuses := []driver.TxStatus{driver.Confirmed}
+	if f.IncludePending {
+		statuses = append(statuses, driver.Pending)
+	}
+	start := time.Now()
+	balances, err := f.db.store(f.ctx).QueryBalances(driver.QueryBalancesParams{
+		EnrollmentIDs:      f.EnrollmentIds,
+		TokenTypes:         f.Types,
+		Statuses:           statuses,
+		ExcludeQuarantined: f.ExcludeQuarantined,
+		NilAmountAsZero:    f.db.opts.NilAmountPolicy == ZeroNilAmount,
+	})
+	f.db.stats.observeQuery("Balance", start)
+	if err != nil {
+		return nil, err
+	}
+	f.db.stats.addRows("Balance", len(balances))
+	return balances, nil
+}
+
 func (f *HoldingsFilter) Execute() (*HoldingsFilter, error) {
-	records, err := f.db.db.QueryMovements(f.EnrollmentIds, f.Types, []driver.TxStatus{driver.Pending, driver.Confirmed}, driver.FromBeginning, driver.All, 0)
+	statuses := []driver.TxStatus{driver.Pending, driver.Confirmed}
+	if f.ConfirmedOnly {
+		statuses = []driver.TxStatus{driver.Confirmed}
+	}
+	start := time.Now()
+	records, err := f.db.store(f.ctx).QueryMovements(f.EnrollmentIds, f.Types, statuses, driver.FromBeginning, driver.All, 0)
+	f.db.stats.observeQuery("Holdings", start)
 	if err != nil {
 		return nil, err
 	}
+	f.db.stats.addRows("Holdings", len(records))
+	if err := f.db.checkMovementAmounts(records); err != nil {
+		return nil, err
+	}
+	if f.ExcludeQuarantined {
+		var filtered []*driver.MovementRecord
+		for _, record := range records {
+			if !record.Quarantined {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
 	f.records = records
 	return f, nil
 }
@@ -94,6 +173,9 @@ func (f *HoldingsFilter) Execute() (*HoldingsFilter, error) {
 func (f *HoldingsFilter) Sum() token2.Quantity {
 	sum := big.NewInt(0)
 	for _, record := range f.records {
+		if record.Amount == nil {
+			continue
+		}
 		sum = sum.Add(sum, record.Amount)
 	}
 	return token2.NewQuantityFromBig64(sum)
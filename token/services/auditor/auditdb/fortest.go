@@ -0,0 +1,30 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"fmt"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/memory"
+	"go.uber.org/atomic"
+)
+
+var testDBs atomic.Int64
+
+// NewInMemoryForTest returns a ready-to-use AuditDB backed by the in-memory driver, in a namespace of its own,
+// together with the function that releases it.
+// It is meant for tests only. The in-memory driver is registered again, if replaced or removed in the meantime.
+func NewInMemoryForTest() (*AuditDB, func()) {
+	RegisterOrReplace(InMemoryDriver, inMemoryDriver)
+
+	m := NewManager(nil, InMemoryDriver)
+	// opening an in-memory audit db never fails
+	db, _ := m.auditDB(fmt.Sprintf("test-%d", testDBs.Inc()))
+	return db, func() {
+		db.db.(*memory.Persistence).Reset()
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/db/memory"
+)
+
+const (
+	// InMemoryDriver is the name under which the in-memory driver, package db/memory, is registered
+	InMemoryDriver = "inmemory"
+	// InMemoryDriverAlias is the name the in-memory driver has been registered under so far, kept as an alias
+	InMemoryDriverAlias = "memory"
+)
+
+// inMemoryDriver is the in-memory driver, always available as the default driver
+var inMemoryDriver = &memory.Driver{}
+
+func init() {
+	RegisterOrReplace(InMemoryDriver, inMemoryDriver)
+	RegisterOrReplace(InMemoryDriverAlias, inMemoryDriver)
+}
+
+// ResetInMemory drops all the audit dbs opened so far with the in-memory driver, under either of its names,
+// so that tests can start from a clean state. Opening a namespace again returns a new, empty audit db.
+func ResetInMemory() {
+	inMemoryDriver.Reset()
+}
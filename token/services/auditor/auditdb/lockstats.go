@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LockStats reports the time spent waiting for, and holding, the exclusive store lock of an AuditDB.
+// The store lock is acquired exclusively by the operations that modify the audit db, such as Append and SetStatus.
+type LockStats struct {
+	// Acquisitions is the number of times the lock has been acquired
+	Acquisitions int64
+	// TotalWait and MaxWait are the total and the maximum time spent waiting to acquire the lock
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	// TotalHold and MaxHold are the total and the maximum time the lock has been held
+	TotalHold time.Duration
+	MaxHold   time.Duration
+}
+
+// LockMetrics is a sink for the observations of the store lock of an AuditDB.
+// The operation is the name of the AuditDB method that acquired the lock.
+type LockMetrics interface {
+	ObserveLockWait(operation string, wait time.Duration)
+	ObserveLockHold(operation string, hold time.Duration)
+}
+
+type lockStats struct {
+	lock  sync.Mutex
+	stats LockStats
+}
+
+func (s *lockStats) observe(wait, hold time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Acquisitions++
+	s.stats.TotalWait += wait
+	if wait > s.stats.MaxWait {
+		s.stats.MaxWait = wait
+	}
+	s.stats.TotalHold += hold
+	if hold > s.stats.MaxHold {
+		s.stats.MaxHold = hold
+	}
+}
+
+func (s *lockStats) get() LockStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// LockStats returns the statistics of the exclusive store lock of this audit db
+func (db *AuditDB) LockStats() LockStats {
+	return db.lockStats.get()
+}
+
+// lockStore acquires exclusively the store lock on behalf of the passed operation, and returns the function
+// that releases it. The time spent waiting for and holding the lock is recorded in the lock statistics and,
+// if configured, reported to the LockMetrics.
+func (db *AuditDB) lockStore(operation string) func() {
+	start := time.Now()
+	db.storeLock.Lock()
+	acquired := time.Now()
+	wait := acquired.Sub(start)
+	db.stats.setLockWait(operation, wait)
+	if db.opts.LockMetrics != nil {
+		db.opts.LockMetrics.ObserveLockWait(operation, wait)
+	}
+	return func() {
+		db.storeLock.Unlock()
+		hold := time.Since(acquired)
+		db.lockStats.observe(wait, hold)
+		if db.opts.LockMetrics != nil {
+			db.opts.LockMetrics.ObserveLockHold(operation, hold)
+		}
+	}
+}
+
+// lockStoreContext is like lockStore, but it stops waiting for the store lock when the passed context is done.
+// In that case, the lock is released as soon as it is eventually acquired.
+func (db *AuditDB) lockStoreContext(ctx context.Context, operation string) (func(), error) {
+	return acquireContext(ctx, "store lock for ["+operation+"]", func() func() { return db.lockStore(operation) })
+}
+
+// rLockStoreContext acquires the store lock for reading, unless the passed context is done first.
+// It returns the function that releases the lock.
+func (db *AuditDB) rLockStoreContext(ctx context.Context, operation string) (func(), error) {
+	return acquireContext(ctx, "store lock for ["+operation+"]", func() func() {
+		db.storeLock.RLock()
+		return db.storeLock.RUnlock
+	})
+}
+
+// acquireContext calls the passed acquire function, that returns the release function of the passed lock,
+// and waits for it until the passed context is done. If the context is done first, the lock is released once acquired.
+func acquireContext(ctx context.Context, lock string, acquire func() func()) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithMessagef(err, "failed acquiring %s", lock)
+	}
+	acquired := make(chan func(), 1)
+	go func() {
+		acquired <- acquire()
+	}()
+	select {
+	case release := <-acquired:
+		return release, nil
+	case <-ctx.Done():
+		go func() {
+			release := <-acquired
+			release()
+		}()
+		return nil, errors.WithMessagef(ctx.Err(), "failed acquiring %s", lock)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	"github.com/hyperledger/fabric/common/metrics/disabled"
+)
+
+var (
+	appendDurationOpts = metrics.HistogramOpts{
+		Namespace:    "token_sdk",
+		Subsystem:    "auditdb",
+		Name:         "append_duration",
+		Help:         "Time taken in seconds to append an audit record, including the wait for the store lock.",
+		LabelNames:   []string{"wallet"},
+		StatsdFormat: "%{#fqname}.%{wallet}",
+		Buckets:      []float64{0.005, 0.01, 0.015, 0.05, 0.1, 1, 10},
+	}
+
+	setStatusDurationOpts = metrics.HistogramOpts{
+		Namespace:    "token_sdk",
+		Subsystem:    "auditdb",
+		Name:         "set_status_duration",
+		Help:         "Time taken in seconds to set the status of a transaction, including the wait for the store lock.",
+		LabelNames:   []string{"wallet"},
+		StatsdFormat: "%{#fqname}.%{wallet}",
+		Buckets:      []float64{0.005, 0.01, 0.015, 0.05, 0.1, 1, 10},
+	}
+
+	queryDurationOpts = metrics.HistogramOpts{
+		Namespace:    "token_sdk",
+		Subsystem:    "auditdb",
+		Name:         "query_duration",
+		Help:         "Time taken in seconds by the driver to run a query.",
+		LabelNames:   []string{"wallet", "query"},
+		StatsdFormat: "%{#fqname}.%{wallet}.%{query}",
+		Buckets:      []float64{0.005, 0.01, 0.015, 0.05, 0.1, 1, 10},
+	}
+
+	rowsReturnedOpts = metrics.CounterOpts{
+		Namespace:    "token_sdk",
+		Subsystem:    "auditdb",
+		Name:         "rows_returned",
+		Help:         "Number of records returned by queries.",
+		LabelNames:   []string{"wallet", "query"},
+		StatsdFormat: "%{#fqname}.%{wallet}.%{query}",
+	}
+
+	lockWaitOpts = metrics.GaugeOpts{
+		Namespace:    "token_sdk",
+		Subsystem:    "auditdb",
+		Name:         "lock_wait",
+		Help:         "Time in seconds the last exclusive acquisition of the store lock waited for.",
+		LabelNames:   []string{"wallet", "operation"},
+		StatsdFormat: "%{#fqname}.%{wallet}.%{operation}",
+	}
+)
+
+// stats holds the collectors shared by the audit dbs of a Manager
+type stats struct {
+	appendDuration    metrics.Histogram
+	setStatusDuration metrics.Histogram
+	queryDuration     metrics.Histogram
+	rowsReturned      metrics.Counter
+	lockWait          metrics.Gauge
+}
+
+// newStats creates the collectors with the passed provider. A nil provider gives no-op collectors.
+func newStats(provider metrics.Provider) *stats {
+	if provider == nil {
+		provider = &disabled.Provider{}
+	}
+	return &stats{
+		appendDuration:    provider.NewHistogram(appendDurationOpts),
+		setStatusDuration: provider.NewHistogram(setStatusDurationOpts),
+		queryDuration:     provider.NewHistogram(queryDurationOpts),
+		rowsReturned:      provider.NewCounter(rowsReturnedOpts),
+		lockWait:          provider.NewGauge(lockWaitOpts),
+	}
+}
+
+// dbStats reports to the shared collectors the observations of the audit db of a wallet
+type dbStats struct {
+	*stats
+	wallet string
+}
+
+func (s *dbStats) observeAppend(start time.Time) {
+	s.appendDuration.With("wallet", s.wallet).Observe(time.Since(start).Seconds())
+}
+
+func (s *dbStats) observeSetStatus(start time.Time) {
+	s.setStatusDuration.With("wallet", s.wallet).Observe(time.Since(start).Seconds())
+}
+
+func (s *dbStats) observeQuery(query string, start time.Time) {
+	s.queryDuration.With("wallet", s.wallet, "query", query).Observe(time.Since(start).Seconds())
+}
+
+func (s *dbStats) addRows(query string, rows int) {
+	s.rowsReturned.With("wallet", s.wallet, "query", query).Add(float64(rows))
+}
+
+func (s *dbStats) setLockWait(operation string, wait time.Duration) {
+	s.lockWait.With("wallet", s.wallet, "operation", operation).Set(wait.Seconds())
+}
@@ -0,0 +1,293 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger/fabric/common/metrics"
+)
+
+// UnknownTransactionTypePolicy defines how records carrying an unknown transaction type are handled on read
+type UnknownTransactionTypePolicy int
+
+const (
+	// FailOnUnknownTransactionType returns an error when a record with an unknown transaction type is read
+	FailOnUnknownTransactionType UnknownTransactionTypePolicy = iota
+	// SkipUnknownTransactionType skips, with a warning, records with an unknown transaction type
+	SkipUnknownTransactionType
+)
+
+// NilAmountPolicy defines how records carrying a nil amount are handled on read
+type NilAmountPolicy int
+
+const (
+	// FailOnNilAmount returns an error when a record with a nil amount is read
+	FailOnNilAmount NilAmountPolicy = iota
+	// ZeroNilAmount treats a nil amount as zero
+	ZeroNilAmount
+)
+
+// MissingRatePolicy defines how token types without a conversion rate are handled when computing a total value
+type MissingRatePolicy int
+
+const (
+	// FailOnMissingRate returns an error when a token type has no conversion rate
+	FailOnMissingRate MissingRatePolicy = iota
+	// SkipMissingRate leaves out of the total the token types without a conversion rate
+	SkipMissingRate
+)
+
+// MultipleSendersPolicy defines how actions spending the inputs of more than one enrollment ID are handled on append
+type MultipleSendersPolicy int
+
+const (
+	// FailOnMultipleSenders fails the append of records with an action spending the inputs of more than one enrollment ID
+	FailOnMultipleSenders MultipleSendersPolicy = iota
+	// SplitByInputAmount records a transaction per sender, attributing to each sender a share of each amount received
+	// proportional to the amount of inputs of the same token type it spent in the action
+	SplitByInputAmount
+)
+
+// DuplicateAppendPolicy defines how the append of a record whose transaction has already been appended is handled
+type DuplicateAppendPolicy int
+
+const (
+	// AppendDuplicates appends the records again, as if the transaction were new.
+	// Audit dbs that enforce the unique constraints, as those opened by a Manager do, reject the records
+	// and the append fails with driver.ErrDuplicateTransaction.
+	AppendDuplicates DuplicateAppendPolicy = iota
+	// FailOnDuplicateAppend fails the append with ErrDuplicateAppend
+	FailOnDuplicateAppend
+	// SkipDuplicateAppend leaves the stored records unchanged and reports success, making the append idempotent
+	SkipDuplicateAppend
+	// ReplaceDuplicateAppend replaces the stored movement and transaction records of the transaction with the new ones,
+	// keeping the current status of the transaction
+	ReplaceDuplicateAppend
+)
+
+// MetadataExtractor extracts from a token request the application reference to be stored with its audit records
+type MetadataExtractor func(*token.Request) (string, error)
+
+// ApplicationMetadataExtractor returns a MetadataExtractor that reads the reference from
+// the application metadata of the token request stored under the passed key
+func ApplicationMetadataExtractor(key string) MetadataExtractor {
+	return func(request *token.Request) (string, error) {
+		return string(request.ApplicationMetadata(key)), nil
+	}
+}
+
+// EnrollmentResolver maps a raw owner identity to the canonical enrollment ID under which it is audited
+type EnrollmentResolver func(identity []byte) (string, error)
+
+// RetentionResolver returns the retention horizon of the audit records of the passed wallet.
+// It returns false if the records of the wallet must be retained indefinitely.
+// Wallets are identified by the key given by the WalletKeyFunc of the Manager.
+type RetentionResolver func(walletID string) (time.Duration, bool)
+
+// RetentionByWallet returns a RetentionResolver backed by the passed map from wallet ID to retention horizon
+func RetentionByWallet(horizons map[string]time.Duration) RetentionResolver {
+	return func(walletID string) (time.Duration, bool) {
+		horizon, ok := horizons[walletID]
+		return horizon, ok
+	}
+}
+
+// WalletKeyFunc derives from an auditor wallet the key that identifies its audit db within a Manager.
+// The key is passed to the driver as the namespace of the audit db, therefore it must be stable across restarts.
+// The badger driver stores each namespace in a folder of its own, and moves there the audit db found in the
+// configured path by versions that did not use namespaces.
+type WalletKeyFunc func(w *token.AuditorWallet) string
+
+// WalletID is the default WalletKeyFunc, it returns the identifier of the wallet
+func WalletID(w *token.AuditorWallet) string {
+	return w.ID()
+}
+
+// HashedWalletID is a WalletKeyFunc that returns the hex-encoded SHA-256 hash of the identifier of the wallet.
+// It suits wallet identifiers that are long or contain characters the driver cannot use in a namespace.
+func HashedWalletID(w *token.AuditorWallet) string {
+	h := sha256.Sum256([]byte(w.ID()))
+	return hex.EncodeToString(h[:])
+}
+
+// Options contains the options for the audit databases handled by a Manager
+type Options struct {
+	// UnknownTransactionTypePolicy tells how to handle records with an unknown transaction type.
+	// It defaults to FailOnUnknownTransactionType.
+	UnknownTransactionTypePolicy UnknownTransactionTypePolicy
+	// MetadataExtractor, if not nil, is used on append to extract the reference of the transaction records
+	MetadataExtractor MetadataExtractor
+	// NilAmountPolicy tells how to handle records with a nil amount.
+	// It defaults to FailOnNilAmount.
+	NilAmountPolicy NilAmountPolicy
+	// MissingRatePolicy tells how to handle token types without a conversion rate.
+	// It defaults to FailOnMissingRate.
+	MissingRatePolicy MissingRatePolicy
+	// EnrollmentResolver, if not nil, is used on append to resolve the enrollment IDs of the owners
+	// of inputs and outputs, instead of the enrollment IDs provided by the token layer
+	EnrollmentResolver EnrollmentResolver
+	// MaxConcurrentAppends, if positive, bounds the number of Append operations in flight
+	// across all the audit dbs of a Manager. Zero means unbounded.
+	MaxConcurrentAppends int
+	// RetentionResolver, if not nil, gives the retention horizon of the audit db of each wallet.
+	// See Manager.RunRetention.
+	RetentionResolver RetentionResolver
+	// RetentionWorkers is the number of audit dbs pruned concurrently by Manager.RunRetention.
+	// It defaults to one.
+	RetentionWorkers int
+	// RetentionTimeout, if positive, bounds the time Manager.RunRetention waits for the prune of each audit db.
+	// A prune that the driver cannot abort keeps running, and the next run waits for it before pruning the same audit db.
+	RetentionTimeout time.Duration
+	// SupplyEnrollmentID, if not empty, is the enrollment ID of the pseudo-account that tracks the supply of each
+	// token type: issuances are recorded as movements received by it, redeems as movements sent by it.
+	SupplyEnrollmentID string
+	// LockMetrics, if not nil, receives the time spent waiting for, and holding, the store lock of each audit db
+	LockMetrics LockMetrics
+	// WalletKeyFunc derives the key of the audit db of a wallet.
+	// It defaults to WalletID.
+	WalletKeyFunc WalletKeyFunc
+	// MultipleSendersPolicy tells how to handle actions spending the inputs of more than one enrollment ID.
+	// It defaults to FailOnMultipleSenders.
+	MultipleSendersPolicy MultipleSendersPolicy
+	// MetricsProvider, if not nil, creates the collectors of the metrics of the audit dbs.
+	// If nil, the metrics are not collected.
+	MetricsProvider metrics.Provider
+	// DuplicateAppendPolicy tells how to handle the append of a transaction that has already been appended,
+	// as it happens when an append is retried. It defaults to AppendDuplicates, that fails on the audit dbs
+	// opened by a Manager: set SkipDuplicateAppend to make retried appends succeed.
+	DuplicateAppendPolicy DuplicateAppendPolicy
+}
+
+// Option is a function that configures Options
+type Option func(*Options)
+
+func compile(opts ...Option) *Options {
+	options := &Options{WalletKeyFunc: WalletID}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithUnknownTransactionTypePolicy sets the policy to apply to records with an unknown transaction type
+func WithUnknownTransactionTypePolicy(policy UnknownTransactionTypePolicy) Option {
+	return func(o *Options) {
+		o.UnknownTransactionTypePolicy = policy
+	}
+}
+
+// WithMetadataExtractor sets the extractor used on append to get the reference of the transaction records
+func WithMetadataExtractor(extractor MetadataExtractor) Option {
+	return func(o *Options) {
+		o.MetadataExtractor = extractor
+	}
+}
+
+// WithNilAmountPolicy sets the policy to apply to records with a nil amount
+func WithNilAmountPolicy(policy NilAmountPolicy) Option {
+	return func(o *Options) {
+		o.NilAmountPolicy = policy
+	}
+}
+
+// WithMissingRatePolicy sets the policy to apply to token types without a conversion rate
+func WithMissingRatePolicy(policy MissingRatePolicy) Option {
+	return func(o *Options) {
+		o.MissingRatePolicy = policy
+	}
+}
+
+// WithEnrollmentResolver sets the resolver used on append to map owner identities to enrollment IDs
+func WithEnrollmentResolver(resolver EnrollmentResolver) Option {
+	return func(o *Options) {
+		o.EnrollmentResolver = resolver
+	}
+}
+
+// WithMaxConcurrentAppends bounds the number of Append operations in flight across all the audit dbs
+// managed by the same Manager. Additional appends wait for a slot before acquiring any lock.
+// A non-positive value means unbounded.
+func WithMaxConcurrentAppends(n int) Option {
+	return func(o *Options) {
+		o.MaxConcurrentAppends = n
+	}
+}
+
+// WithRetention sets the resolver of the retention horizon of the audit db of each wallet
+func WithRetention(resolver RetentionResolver) Option {
+	return func(o *Options) {
+		o.RetentionResolver = resolver
+	}
+}
+
+// WithRetentionWorkers sets the number of audit dbs pruned concurrently by Manager.RunRetention
+func WithRetentionWorkers(n int) Option {
+	return func(o *Options) {
+		o.RetentionWorkers = n
+	}
+}
+
+// WithRetentionTimeout bounds the time Manager.RunRetention waits for the prune of each audit db
+func WithRetentionTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.RetentionTimeout = timeout
+	}
+}
+
+// WithSupplyMovements records, for each issuance and redeem, a movement of the supply pseudo-account with
+// the passed enrollment ID, so that its holdings give the net supply, issued minus redeemed, of each token type.
+// The enrollment ID must not be used by any business party.
+func WithSupplyMovements(supplyEID string) Option {
+	return func(o *Options) {
+		o.SupplyEnrollmentID = supplyEID
+	}
+}
+
+// WithLockMetrics sets the sink of the observations of the store lock of the audit dbs.
+// See AuditDB.LockStats.
+func WithLockMetrics(metrics LockMetrics) Option {
+	return func(o *Options) {
+		o.LockMetrics = metrics
+	}
+}
+
+// WithWalletKeyFunc sets the function that derives the key of the audit db of a wallet.
+// The key is used by the Manager to cache the audit db, to identify the wallet in RunRetention, and
+// as the namespace passed to the driver when opening the audit db.
+func WithWalletKeyFunc(f WalletKeyFunc) Option {
+	return func(o *Options) {
+		o.WalletKeyFunc = f
+	}
+}
+
+// WithMultipleSendersPolicy sets the policy to apply to actions spending the inputs of more than one enrollment ID
+func WithMultipleSendersPolicy(policy MultipleSendersPolicy) Option {
+	return func(o *Options) {
+		o.MultipleSendersPolicy = policy
+	}
+}
+
+// WithMetricsProvider sets the provider of the collectors of the latency of appends, status updates and queries,
+// of the number of records returned by queries, and of the wait for the store lock.
+// The collectors are created once per Manager and labelled with the key of the wallet of each audit db,
+// therefore a provider that registers them globally, such as the Prometheus one, must not be shared by more Managers.
+func WithMetricsProvider(provider metrics.Provider) Option {
+	return func(o *Options) {
+		o.MetricsProvider = provider
+	}
+}
+
+// WithDuplicateAppendPolicy sets the policy to apply to the append of a transaction that has already been appended
+func WithDuplicateAppendPolicy(policy DuplicateAppendPolicy) Option {
+	return func(o *Options) {
+		o.DuplicateAppendPolicy = policy
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb/driver"
+	"github.com/pkg/errors"
+)
+
+// managerSnapshot is the serialization of the audit dbs of a Manager, indexed by wallet key
+type managerSnapshot struct {
+	Wallets map[string]*driver.Snapshot
+}
+
+// Snapshot writes to the passed writer the content of the audit dbs of the passed auditor wallets, opened if needed,
+// and of all the other audit dbs opened so far by the manager, indexed by wallet key.
+// The manager cannot enumerate by itself the auditor wallets of the node: the audit db of a wallet that
+// is neither passed nor already opened is not part of the snapshot. To capture the full audit state,
+// pass all the auditor wallets of the node.
+// The store locks of all the audit dbs are held while their content is read, so that the snapshot is consistent
+// across wallets. It fails if the driver does not support snapshots.
+func (cm *Manager) Snapshot(w io.Writer, wallets ...*token.AuditorWallet) error {
+	for _, wallet := range wallets {
+		if _, err := cm.AuditDB(wallet); err != nil {
+			return errors.WithMessagef(err, "failed opening audit db for wallet [%s]", cm.opts.WalletKeyFunc(wallet))
+		}
+	}
+	keys, dbs := cm.managed()
+	for _, key := range keys {
+		defer dbs[key].lockStore("Snapshot")()
+	}
+
+	s := &managerSnapshot{Wallets: make(map[string]*driver.Snapshot, len(keys))}
+	for _, key := range keys {
+		snapshot, err := dbs[key].db.Snapshot()
+		if err != nil {
+			return errors.WithMessagef(err, "failed taking snapshot of audit db for wallet [%s]", key)
+		}
+		s.Wallets[key] = snapshot
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return errors.Wrap(err, "failed writing snapshot")
+	}
+	return nil
+}
+
+// Restore reads from the passed reader a snapshot written by Snapshot and loads the content of each wallet
+// into the audit db with the same wallet key, opening it if needed.
+// Before loading anything, Restore checks that all the target audit dbs are empty, so that a snapshot is either
+// restored as a whole or, unless the driver fails while loading, not at all.
+// It fails if the driver does not support snapshots.
+func (cm *Manager) Restore(r io.Reader) error {
+	s := &managerSnapshot{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return errors.Wrap(err, "failed reading snapshot")
+	}
+	keys := make([]string, 0, len(s.Wallets))
+	for key := range s.Wallets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	dbs := make(map[string]*AuditDB, len(keys))
+	for _, key := range keys {
+		db, err := cm.auditDB(key)
+		if err != nil {
+			return errors.WithMessagef(err, "failed opening audit db for wallet [%s]", key)
+		}
+		defer db.lockStore("Restore")()
+		dbs[key] = db
+	}
+
+	for _, key := range keys {
+		current, err := dbs[key].db.Snapshot()
+		if err != nil {
+			return errors.WithMessagef(err, "failed checking audit db for wallet [%s]", key)
+		}
+		if !current.IsEmpty() {
+			return errors.Errorf("cannot restore snapshot, audit db for wallet [%s] is not empty", key)
+		}
+	}
+	for _, key := range keys {
+		if err := dbs[key].db.Restore(s.Wallets[key]); err != nil {
+			return errors.WithMessagef(err, "failed restoring audit db for wallet [%s]", key)
+		}
+	}
+	return nil
+}
+
+// managed returns the audit dbs opened so far, with their wallet keys in sorted order
+func (cm *Manager) managed() ([]string, map[string]*AuditDB) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	keys := make([]string, 0, len(cm.dbs))
+	dbs := make(map[string]*AuditDB, len(cm.dbs))
+	for key, db := range cm.dbs {
+		keys = append(keys, key)
+		dbs[key] = db
+	}
+	sort.Strings(keys)
+	return keys, dbs
+}
@@ -0,0 +1,67 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"fmt"
+)
+
+// statusTransitions is the state machine of the status of a transaction, see StatusTransitions
+var statusTransitions = map[TxStatus][]TxStatus{
+	Pending:   {Confirmed, Deleted},
+	Confirmed: {},
+	Deleted:   {},
+}
+
+// StatusTransitions returns the statuses SetStatus can move a transaction in the passed status to.
+// Confirmed and Deleted are terminal: once the ledger has decided, the status does not change anymore,
+// except for the reversal of a Confirmed transaction to Pending due to a ledger reorganization, see AuditDB.Reorg.
+// Setting the status a transaction is already in is always permitted, and is not listed.
+func StatusTransitions(from TxStatus) []TxStatus {
+	return append([]TxStatus(nil), statusTransitions[from]...)
+}
+
+// CanTransition returns true if SetStatus can move a transaction from the first passed status to the second one.
+// Setting a known status again is permitted, as a no-op.
+func CanTransition(from, to TxStatus) bool {
+	targets, ok := statusTransitions[from]
+	if !ok {
+		return false
+	}
+	if from == to {
+		return true
+	}
+	for _, target := range targets {
+		if target == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IllegalTransitionError is returned when the status of a transaction cannot be changed as requested,
+// because the state machine does not permit it. See CanTransition.
+type IllegalTransitionError struct {
+	TxID string
+	From TxStatus
+	To   TxStatus
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal status transition for tx [%s] from [%s] to [%s]", e.TxID, e.From, e.To)
+}
+
+// StatusMismatchError is returned by SetStatusIf when the transaction is not in the expected status
+type StatusMismatchError struct {
+	TxID     string
+	Expected TxStatus
+	Actual   TxStatus
+}
+
+func (e *StatusMismatchError) Error() string {
+	return fmt.Sprintf("status of tx [%s] is [%s], expected [%s]", e.TxID, e.Actual, e.Expected)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditdb
+
+import (
+	"sync"
+)
+
+// statusSubscriptionBuffer is the number of notifications a subscription holds before the next ones are dropped
+const statusSubscriptionBuffer = 64
+
+// StatusEvent notifies the change of status of a transaction
+type StatusEvent struct {
+	TxID   string
+	Status TxStatus
+}
+
+// statusSubscriptions tracks the subscribers to the status changes of an audit db.
+// Notifications never block: a subscriber that does not keep up loses the notifications exceeding its buffer.
+type statusSubscriptions struct {
+	mutex  sync.Mutex
+	byTxID map[string]map[chan TxStatus]struct{}
+	all    map[chan StatusEvent]struct{}
+}
+
+// SubscribeStatus returns a channel on which the new status of the passed transaction is sent each time
+// SetStatus or Reorg change it, together with the function that cancels the subscription.
+// The cancel function closes the channel and must be called once the subscriber is done, it can be called more than once.
+// Notifications are buffered; if the subscriber does not keep up, the notifications exceeding the buffer are dropped.
+func (db *AuditDB) SubscribeStatus(txID string) (<-chan TxStatus, func()) {
+	s := &db.subscriptions
+	ch := make(chan TxStatus, statusSubscriptionBuffer)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.byTxID == nil {
+		s.byTxID = map[string]map[chan TxStatus]struct{}{}
+	}
+	if s.byTxID[txID] == nil {
+		s.byTxID[txID] = map[chan TxStatus]struct{}{}
+	}
+	s.byTxID[txID][ch] = struct{}{}
+
+	return ch, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.byTxID[txID][ch]; !ok {
+			return
+		}
+		delete(s.byTxID[txID], ch)
+		if len(s.byTxID[txID]) == 0 {
+			delete(s.byTxID, txID)
+		}
+		close(ch)
+	}
+}
+
+// SubscribeAllStatuses is like SubscribeStatus, but the returned channel receives the status changes
+// of any transaction, as needed to build a live audit feed
+func (db *AuditDB) SubscribeAllStatuses() (<-chan StatusEvent, func()) {
+	s := &db.subscriptions
+	ch := make(chan StatusEvent, statusSubscriptionBuffer)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.all == nil {
+		s.all = map[chan StatusEvent]struct{}{}
+	}
+	s.all[ch] = struct{}{}
+
+	return ch, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.all[ch]; !ok {
+			return
+		}
+		delete(s.all, ch)
+		close(ch)
+	}
+}
+
+// notify sends the passed status change to the subscribers of the transaction and to those of all transactions
+func (s *statusSubscriptions) notify(txID string, status TxStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.byTxID[txID] {
+		select {
+		case ch <- status:
+		default:
+			logger.Warnf("subscriber to the status of [%s] is not keeping up, dropping status [%s]", txID, status)
+		}
+	}
+	for ch := range s.all {
+		select {
+		case ch <- StatusEvent{TxID: txID, Status: status}:
+		default:
+			logger.Warnf("subscriber to all statuses is not keeping up, dropping status [%s] of [%s]", status, txID)
+		}
+	}
+}
@@ -103,6 +103,8 @@ type TxStatusChangesListener struct {
 	db  *auditdb.AuditDB
 }
 
+// OnStatusChange records in the audit db the final status of the transaction.
+// The codes telling that the transaction is not final yet are ignored.
 func (t *TxStatusChangesListener) OnStatusChange(txID string, status int) error {
 	logger.Debugf("tx status changed for tx %s: %s", txID, status)
 	var auditDBTxStatus auditdb.TxStatus
@@ -111,6 +113,11 @@ func (t *TxStatusChangesListener) OnStatusChange(txID string, status int) error
 		auditDBTxStatus = auditdb.Confirmed
 	case network.Invalid:
 		auditDBTxStatus = auditdb.Deleted
+	case network.Busy, network.Unknown, network.HasDependencies:
+		logger.Debugf("tx %s not final yet, status %d, nothing to record", txID, status)
+		return nil
+	default:
+		return errors.Errorf("unexpected validation code [%d] for request %s", status, txID)
 	}
 	if err := t.db.SetStatus(txID, auditDBTxStatus); err != nil {
 		return errors.WithMessagef(err, "failed setting status for request %s", txID)
@@ -0,0 +1,74 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package auditor
+
+import (
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/auditor/auditdb"
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/network"
+	token2 "github.com/hyperledger-labs/fabric-token-sdk/token/token"
+	"github.com/stretchr/testify/assert"
+)
+
+type issueRecord string
+
+func (r issueRecord) AuditRecord() (*token.AuditRecord, error) {
+	return &token.AuditRecord{
+		Anchor: string(r),
+		Inputs: token.NewInputStream(nil, nil, 64),
+		Outputs: token.NewOutputStream([]*token.Output{{
+			Owner:        []byte("alice"),
+			EnrollmentID: "alice",
+			Type:         "EUR",
+			Quantity:     token2.NewQuantityFromUInt64(10),
+		}}, 64),
+	}, nil
+}
+
+func TestOnStatusChange(t *testing.T) {
+	db, cleanup := auditdb.NewInMemoryForTest()
+	defer cleanup()
+	assert.NoError(t, db.Append(issueRecord("tx1")))
+	assert.NoError(t, db.Append(issueRecord("tx2")))
+	l := &TxStatusChangesListener{db: db}
+
+	status := func(txID string) auditdb.TxStatus {
+		qe := db.NewQueryExecutor()
+		defer qe.Done()
+		it, err := qe.Transactions(nil, nil)
+		assert.NoError(t, err)
+		defer it.Close()
+		for {
+			tr, err := it.Next()
+			assert.NoError(t, err)
+			if tr == nil {
+				return ""
+			}
+			if tr.TxID == txID {
+				return tr.Status
+			}
+		}
+	}
+
+	// the codes of transactions not final yet are ignored
+	for _, vc := range []network.ValidationCode{network.Busy, network.Unknown, network.HasDependencies} {
+		assert.NoError(t, l.OnStatusChange("tx1", int(vc)))
+	}
+	assert.Equal(t, auditdb.Pending, status("tx1"))
+
+	// final codes are recorded
+	assert.NoError(t, l.OnStatusChange("tx1", int(network.Valid)))
+	assert.Equal(t, auditdb.Confirmed, status("tx1"))
+	assert.NoError(t, l.OnStatusChange("tx2", int(network.Invalid)))
+	assert.Equal(t, auditdb.Deleted, status("tx2"))
+
+	// unexpected codes
+	assert.EqualError(t, l.OnStatusChange("tx1", 0), "unexpected validation code [0] for request tx1")
+	assert.EqualError(t, l.OnStatusChange("tx1", 42), "unexpected validation code [42] for request tx1")
+}
@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ContextFinality is implemented by the networks that can stop waiting for the finality of a transaction
+// once a context is done
+type ContextFinality interface {
+	// IsFinalContext waits, as IsFinal does, for the confirmation of the passed transaction,
+	// until the passed context is done
+	IsFinalContext(ctx context.Context, id string) error
+}
+
+// WaitFinality waits for the finality of the passed transaction on the passed network until the passed context is done.
+// The transactions known to the local vault, whose status is read with status, are waited for by listening
+// to their status changes. The others are checked with IsFinal, which asks remote parties and cannot be interrupted:
+// once the context is done, the check is left to complete in background.
+func WaitFinality(ctx context.Context, n Network, id string, status func(id string) (ValidationCode, error)) (err error) {
+	l := &finalityListener{statuses: make(chan ValidationCode, 1)}
+	if err := n.SubscribeTxStatusChanges(id, l); err != nil {
+		return errors.WithMessagef(err, "failed listening to the status changes of [%s]", id)
+	}
+	defer func() {
+		if unsubscribeErr := n.UnsubscribeTxStatusChanges(id, l); unsubscribeErr != nil && err == nil {
+			err = errors.WithMessagef(unsubscribeErr, "failed removing the listener of [%s]", id)
+		}
+	}()
+
+	// the transaction might have been committed before the listener was in place
+	vc, err := status(id)
+	if err != nil {
+		return errors.WithMessagef(err, "failed getting status of [%s]", id)
+	}
+	if vc == Busy {
+		select {
+		case vc = <-l.statuses:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	switch vc {
+	case Valid:
+		return nil
+	case Invalid:
+		return errors.Errorf("transaction [%s] is not valid", id)
+	default:
+		return runContext(ctx, func() error { return n.IsFinal(id) })
+	}
+}
+
+// finalityListener forwards the final status of a transaction
+type finalityListener struct {
+	statuses chan ValidationCode
+}
+
+func (l *finalityListener) OnStatusChange(_ string, status int) error {
+	switch vc := ValidationCode(status); vc {
+	case Valid, Invalid:
+		select {
+		case l.statuses <- vc:
+		default:
+		}
+	}
+	return nil
+}
+
+// runContext runs the passed function and waits for it to complete until the passed context is done.
+// The function is then left to complete in background.
+func runContext(ctx context.Context, f func() error) error {
+	if ctx.Done() == nil {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// listenedNetwork keeps the listeners of the status changes, and answers IsFinal with isFinal
+type listenedNetwork struct {
+	Network
+	lock      sync.Mutex
+	listeners map[string]TxStatusChangeListener
+	isFinal   error
+}
+
+func (n *listenedNetwork) SubscribeTxStatusChanges(txID string, listener TxStatusChangeListener) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.listeners[txID] = listener
+	return nil
+}
+
+func (n *listenedNetwork) UnsubscribeTxStatusChanges(txID string, listener TxStatusChangeListener) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.listeners, txID)
+	return nil
+}
+
+func (n *listenedNetwork) IsFinal(string) error { return n.isFinal }
+
+// notify notifies the passed status to the listener of the passed transaction, once in place
+func (n *listenedNetwork) notify(txID string, status ValidationCode) {
+	for {
+		n.lock.Lock()
+		l, ok := n.listeners[txID]
+		n.lock.Unlock()
+		if ok {
+			_ = l.OnStatusChange(txID, int(status))
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitFinality(t *testing.T) {
+	n := &listenedNetwork{listeners: map[string]TxStatusChangeListener{}}
+	status := func(vc ValidationCode) func(string) (ValidationCode, error) {
+		return func(string) (ValidationCode, error) { return vc, nil }
+	}
+
+	// committed before the listener was in place
+	assert.NoError(t, WaitFinality(context.Background(), n, "tx1", status(Valid)))
+	assert.EqualError(t, WaitFinality(context.Background(), n, "tx1", status(Invalid)), "transaction [tx1] is not valid")
+
+	// committed while waiting
+	go n.notify("tx2", Valid)
+	assert.NoError(t, WaitFinality(context.Background(), n, "tx2", status(Busy)))
+	go n.notify("tx3", Invalid)
+	assert.EqualError(t, WaitFinality(context.Background(), n, "tx3", status(Busy)), "transaction [tx3] is not valid")
+
+	// the context is done, the listener is removed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := WaitFinality(ctx, n, "tx4", status(Busy))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Empty(t, n.listeners)
+
+	// unknown to the local vault, the network is asked
+	assert.NoError(t, WaitFinality(context.Background(), n, "tx5", status(Unknown)))
+	n.isFinal = errors.New("transaction [tx5] is not valid")
+	assert.EqualError(t, WaitFinality(context.Background(), n, "tx5", status(Unknown)), "transaction [tx5] is not valid")
+
+	assert.EqualError(t, WaitFinality(context.Background(), n, "tx6", func(string) (ValidationCode, error) {
+		return 0, errors.New("boom")
+	}), "failed getting status of [tx6]: boom")
+}
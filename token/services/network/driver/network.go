@@ -60,6 +60,9 @@ type Network interface {
 	// IsFinal takes in input a transaction id and waits for its confirmation.
 	IsFinal(id string) error
 
+	// FinalityInfo returns where the passed final transaction has been committed, and its validation code
+	FinalityInfo(id string) (*FinalityInfo, error)
+
 	// NewEnvelope returns a new instance of an envelope
 	NewEnvelope() Envelope
 
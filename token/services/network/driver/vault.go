@@ -22,6 +22,15 @@ const (
 	HasDependencies                // Transaction is unknown but has known dependencies
 )
 
+// FinalityInfo describes where a final transaction has been committed
+type FinalityInfo struct {
+	// BlockNumber is the number of the block the transaction has been committed in.
+	// It is zero if the network does not expose it.
+	BlockNumber uint64
+	// ValidationCode is the validation code of the transaction
+	ValidationCode ValidationCode
+}
+
 // Vault models the vault service
 type Vault interface {
 	// GetLastTxID returns the last transaction ID committed into the vault
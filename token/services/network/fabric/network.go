@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package fabric
 
 import (
+	context2 "context"
 	"encoding/json"
 	"strings"
 	"sync"
@@ -210,6 +211,27 @@ func (n *Network) IsFinal(id string) error {
 	return n.ch.Finality().IsFinal(id)
 }
 
+// IsFinalContext waits for the finality of the passed transaction until the passed context is done,
+// see driver.WaitFinality
+func (n *Network) IsFinalContext(ctx context2.Context, id string) error {
+	return driver.WaitFinality(ctx, n, id, func(id string) (driver.ValidationCode, error) {
+		vc, _, err := n.ch.Committer().Status(id)
+		return driver.ValidationCode(vc), err
+	})
+}
+
+func (n *Network) FinalityInfo(id string) (*driver.FinalityInfo, error) {
+	vc, _, err := n.ch.Committer().Status(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting status of [%s]", id)
+	}
+	block, err := n.ch.Ledger().GetBlockNumberByTxID(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting block number of [%s]", id)
+	}
+	return &driver.FinalityInfo{BlockNumber: block, ValidationCode: driver.ValidationCode(vc)}, nil
+}
+
 func (n *Network) NewEnvelope() driver.Envelope {
 	return n.n.TransactionManager().NewEnvelope()
 }
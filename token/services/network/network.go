@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package network
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -271,6 +272,45 @@ func (n *Network) IsFinal(id string) error {
 	return n.n.IsFinal(id)
 }
 
+// IsFinalContext is like IsFinal, but it stops waiting once the passed context is done, returning the error of the context.
+// If the driver cannot stop waiting, see driver.ContextFinality, the wait is left to complete in background.
+func (n *Network) IsFinalContext(ctx context.Context, id string) error {
+	if f, ok := n.n.(driver.ContextFinality); ok {
+		return f.IsFinalContext(ctx, id)
+	}
+	if ctx.Done() == nil {
+		return n.n.IsFinal(id)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- n.n.IsFinal(id)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FinalityInfo describes where a final transaction has been committed
+type FinalityInfo struct {
+	// BlockNumber is the number of the block the transaction has been committed in.
+	// It is zero if the network does not expose it.
+	BlockNumber uint64
+	// ValidationCode is the validation code of the transaction
+	ValidationCode ValidationCode
+}
+
+// FinalityInfo returns where the given final transaction has been committed, and its validation code
+func (n *Network) FinalityInfo(id string) (*FinalityInfo, error) {
+	info, err := n.n.FinalityInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	return &FinalityInfo{BlockNumber: info.BlockNumber, ValidationCode: ValidationCode(info.ValidationCode)}, nil
+}
+
 // AnonymousIdentity returns a fresh anonymous identity
 func (n *Network) AnonymousIdentity() view.Identity {
 	return n.n.LocalMembership().AnonymousIdentity()
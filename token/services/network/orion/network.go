@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package orion
 
 import (
+	context2 "context"
 	"sync"
 
 	idemix2 "github.com/hyperledger-labs/fabric-smart-client/platform/fabric/core/generic/msp/idemix"
@@ -110,6 +111,25 @@ func (n *Network) IsFinal(id string) error {
 	return n.n.Finality().IsFinal(id)
 }
 
+// IsFinalContext waits for the finality of the passed transaction until the passed context is done,
+// see driver.WaitFinality
+func (n *Network) IsFinalContext(ctx context2.Context, id string) error {
+	return driver.WaitFinality(ctx, n, id, func(id string) (driver.ValidationCode, error) {
+		vc, err := n.n.Vault().Status(id)
+		return driver.ValidationCode(vc), err
+	})
+}
+
+// FinalityInfo returns the validation code of the passed transaction.
+// Orion does not expose the block a transaction has been committed in, then the block number is always zero.
+func (n *Network) FinalityInfo(id string) (*driver.FinalityInfo, error) {
+	vc, err := n.n.Vault().Status(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting status of [%s]", id)
+	}
+	return &driver.FinalityInfo{ValidationCode: driver.ValidationCode(vc)}, nil
+}
+
 func (n *Network) NewEnvelope() driver.Envelope {
 	return n.n.TransactionManager().NewEnvelope()
 }
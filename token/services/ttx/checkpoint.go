@@ -0,0 +1,109 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/hash"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/kvs"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/pkg/errors"
+)
+
+const endorsementsCheckpointPrefix = "token-sdk.ttx.endorsements"
+
+// endorsementsCheckpoint records the signatures collected so far on a token request,
+// so that an initiator restarting the collection does not have to ask the same parties again.
+// A party signs the same message for all its inputs, then signatures are indexed by party.
+type endorsementsCheckpoint struct {
+	// RequestHash is the hash of the token request the signatures are on
+	RequestHash string
+	// Signatures are indexed by the unique ID of the signer
+	Signatures map[string][]byte
+}
+
+func newEndorsementsCheckpoint(request []byte) *endorsementsCheckpoint {
+	return &endorsementsCheckpoint{
+		RequestHash: hash.Hashable(request).String(),
+		Signatures:  map[string][]byte{},
+	}
+}
+
+// signature returns the signature of the passed party, if recorded.
+// A nil checkpoint records nothing.
+func (cp *endorsementsCheckpoint) signature(party view.Identity) ([]byte, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	sigma, ok := cp.Signatures[party.UniqueID()]
+	return sigma, ok
+}
+
+// resumes returns true if the checkpoint holds signatures on the passed token request
+func (cp *endorsementsCheckpoint) resumes(request []byte) bool {
+	return cp.RequestHash == hash.Hashable(request).String()
+}
+
+// loadCheckpoint returns the checkpoint of the signatures collected on the token request of the transaction.
+// If no checkpoint exists, or it refers to a different token request, an empty checkpoint is returned.
+func (c *collectEndorsementsView) loadCheckpoint() (*endorsementsCheckpoint, error) {
+	requestRaw, err := c.requestBytes()
+	if err != nil {
+		return nil, err
+	}
+	k, err := c.checkpointKey()
+	if err != nil {
+		return nil, err
+	}
+	store := kvs.GetService(c.tx.SP)
+	if !store.Exists(k) {
+		return newEndorsementsCheckpoint(requestRaw), nil
+	}
+	cp := &endorsementsCheckpoint{}
+	if err := store.Get(k, cp); err != nil {
+		return nil, errors.WithMessagef(err, "failed loading endorsements checkpoint for [%s]", c.tx.ID())
+	}
+	if !cp.resumes(requestRaw) {
+		logger.Warnf("discarding endorsements checkpoint for [%s], the token request changed", c.tx.ID())
+		return newEndorsementsCheckpoint(requestRaw), nil
+	}
+	logger.Infof("resuming collection of endorsements for [%s], [%d] signatures already collected", c.tx.ID(), len(cp.Signatures))
+	return cp, nil
+}
+
+// recordCheckpoint adds the passed signature to the checkpoint, if any, and stores it
+func (c *collectEndorsementsView) recordCheckpoint(party view.Identity, sigma []byte) error {
+	if c.checkpoint == nil {
+		return nil
+	}
+	c.checkpoint.Signatures[party.UniqueID()] = sigma
+	k, err := c.checkpointKey()
+	if err != nil {
+		return err
+	}
+	if err := kvs.GetService(c.tx.SP).Put(k, c.checkpoint); err != nil {
+		return errors.WithMessagef(err, "failed storing endorsements checkpoint for [%s]", c.tx.ID())
+	}
+	return nil
+}
+
+// deleteCheckpoint removes the checkpoint, if any, once the collection is complete
+func (c *collectEndorsementsView) deleteCheckpoint() {
+	if c.checkpoint == nil {
+		return
+	}
+	k, err := c.checkpointKey()
+	if err == nil {
+		err = kvs.GetService(c.tx.SP).Delete(k)
+	}
+	if err != nil {
+		logger.Warnf("failed deleting endorsements checkpoint for [%s]: [%s]", c.tx.ID(), err)
+	}
+}
+
+func (c *collectEndorsementsView) checkpointKey() (string, error) {
+	return kvs.CreateCompositeKey(endorsementsCheckpointPrefix, []string{c.tx.Network(), c.tx.Channel(), c.tx.ID()})
+}
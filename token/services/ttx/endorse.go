@@ -7,8 +7,10 @@ SPDX-License-Identifier: Apache-2.0
 package ttx
 
 import (
+	context2 "context"
 	"encoding/base64"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/tracker/metrics"
@@ -27,14 +29,53 @@ type signatureRequest struct {
 	Request []byte
 	TxID    []byte
 	Signer  view.Identity
+	// CorrelationID is set when the request is multiplexed with others over the same session.
+	// In this case, the reply is a signatureResponse carrying the same correlation ID.
+	CorrelationID string
+	// Batch is the number of requests multiplexed over the same session, this one included
+	Batch int
 }
 
 func (sr *signatureRequest) MessageToSign() []byte {
 	return append(sr.Request, sr.TxID...)
 }
 
+// signatureResponse is the reply to a signature request carrying a correlation ID
+type signatureResponse struct {
+	CorrelationID string
+	Signature     []byte
+}
+
+// EndorsementsResult is the result of the view collecting endorsements
+type EndorsementsResult struct {
+	// Tx is the endorsed transaction
+	Tx *Transaction
+	// Endorsers are the parties whose signatures on the token request have been collected,
+	// in the order the signatures have been appended
+	Endorsers []view.Identity
+	// Signatures is the number of signatures collected on the token request
+	Signatures int
+	// Failed are the parties that did not provide a valid signature, skipped because a threshold is set.
+	// See WithThreshold.
+	Failed []view.Identity
+}
+
+const (
+	// signatureRequestTimeout is the time a party has to reply to a signature request
+	signatureRequestTimeout = 60 * time.Second
+	// defaultReceiveSignatureRequestTimeout is the time the responder waits for each signature request,
+	// unless WithEndorseTimeout is used
+	defaultReceiveSignatureRequestTimeout = 60 * time.Second
+	// defaultReceiveTransactionTimeout is the time to wait for a transaction, unless WithEndorseTimeout is used
+	defaultReceiveTransactionTimeout = 240 * time.Second
+)
+
 type collectEndorsementsView struct {
-	tx *Transaction
+	tx         *Transaction
+	opts       *EndorsementsOptions
+	endorsers  []view.Identity
+	failed     []view.Identity
+	checkpoint *endorsementsCheckpoint
 }
 
 // NewCollectEndorsementsView returns an instance of the collectEndorsementsView struct.
@@ -45,8 +86,8 @@ type collectEndorsementsView struct {
 // 3. Before completing, all recipients receive the approved transaction.
 // Depending on the token driver implementation, the recipient's signature might or might not be needed to make
 // the token transaction valid.
-func NewCollectEndorsementsView(tx *Transaction) *collectEndorsementsView {
-	return &collectEndorsementsView{tx: tx}
+func NewCollectEndorsementsView(tx *Transaction, opts ...EndorsementsOption) *collectEndorsementsView {
+	return &collectEndorsementsView{tx: tx, opts: compileEndorsementsOptions(opts...)}
 }
 
 // Call executes the view.
@@ -57,31 +98,58 @@ func NewCollectEndorsementsView(tx *Transaction) *collectEndorsementsView {
 // 3. Before completing, all recipients receive the approved transaction.
 // Depending on the token driver implementation, the recipient's signature might or might not be needed to make
 // the token transaction valid.
-func (c *collectEndorsementsView) Call(context view.Context) (interface{}, error) {
+// The view returns an *EndorsementsResult.
+func (c *collectEndorsementsView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "collectEndorsements", TxIDAttribute, c.tx.ID())
+	defer func() { span.End(err) }()
+
 	agent := metrics.Get(context)
 	agent.EmitKey(0, "ttx", "start", "collectEndorsements", c.tx.ID())
 	defer agent.EmitKey(0, "ttx", "end", "collectEndorsements", c.tx.ID())
 
 	// Store transient
-	err := c.tx.storeTransient()
+	err = c.tx.storeTransient()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed storing transient")
 	}
 
 	// 1. First collect signatures on the token request
 	var distributionList []view.Identity
+	c.endorsers = nil
+	c.failed = nil
+	c.checkpoint = nil
+	if c.opts.Checkpoints && c.opts.Gateway.IsNone() {
+		c.checkpoint, err = c.loadCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	parties, err := c.requestSignaturesOnIssues(context)
-	if err != nil {
+	if !c.opts.Gateway.IsNone() {
+		parties, err := c.requestSignaturesViaGateway(context)
+		if err != nil {
+			return nil, err
+		}
+		distributionList = append(distributionList, parties...)
+	} else {
+		parties, err := c.requestSignaturesOnIssues(context)
+		if err != nil {
+			return nil, err
+		}
+		distributionList = append(distributionList, parties...)
+
+		parties, err = c.requestSignaturesOnTransfers(context)
+		if err != nil {
+			return nil, err
+		}
+		distributionList = append(distributionList, parties...)
+	}
+	if err := c.checkThreshold(); err != nil {
 		return nil, err
 	}
-	distributionList = append(distributionList, parties...)
-
-	parties, err = c.requestSignaturesOnTransfers(context)
-	if err != nil {
+	if err := c.checkRequiredEndorsers(); err != nil {
 		return nil, err
 	}
-	distributionList = append(distributionList, parties...)
 
 	// 2. Audit
 	if !c.tx.Opts.Auditor.IsNone() {
@@ -112,10 +180,70 @@ func (c *collectEndorsementsView) Call(context view.Context) (interface{}, error
 		session.Close()
 	}
 
+	c.deleteCheckpoint()
+
 	if logger.IsEnabledFor(zapcore.DebugLevel) {
 		logger.Debugf("collectEndorsementsView done.")
 	}
-	return nil, nil
+	return c.result(), nil
+}
+
+// appendSignature appends the passed signature to the token request, recording the party that produced it
+func (c *collectEndorsementsView) appendSignature(party view.Identity, sigma []byte) {
+	c.tx.TokenRequest.AppendSignature(sigma)
+	c.endorsers = append(c.endorsers, party)
+}
+
+// skipFailure records that the passed party failed to provide a valid signature, with the passed error.
+// It returns the error unless a threshold is set and the number of failures is still tolerated.
+func (c *collectEndorsementsView) skipFailure(party view.Identity, err error) error {
+	if c.opts.Threshold <= 0 {
+		return err
+	}
+	c.failed = append(c.failed, party)
+	if len(c.failed) > c.opts.MaxFailures {
+		return errors.WithMessagef(err, "too many parties failed to endorse, [%d] out of [%d] tolerated", len(c.failed), c.opts.MaxFailures)
+	}
+	logger.Warnf("skipping party [%s], failed to endorse [%d] out of [%d] tolerated: [%s]", party, len(c.failed), c.opts.MaxFailures, err)
+	return nil
+}
+
+// checkThreshold returns an error if a threshold is set and not enough signatures have been collected
+func (c *collectEndorsementsView) checkThreshold() error {
+	if c.opts.Threshold > 0 && len(c.endorsers) < c.opts.Threshold {
+		return errors.Errorf("collected [%d] signatures, threshold is [%d]", len(c.endorsers), c.opts.Threshold)
+	}
+	return nil
+}
+
+// checkRequiredEndorsers returns an error listing the required endorsers whose signature has not been collected
+func (c *collectEndorsementsView) checkRequiredEndorsers() error {
+	var missing []string
+	for _, required := range c.opts.RequiredEndorsers {
+		found := false
+		for _, endorser := range c.endorsers {
+			if required.Equal(endorser) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, required.String())
+		}
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("missing endorsements from required endorsers [%s]", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c *collectEndorsementsView) result() *EndorsementsResult {
+	return &EndorsementsResult{
+		Tx:         c.tx,
+		Endorsers:  c.endorsers,
+		Signatures: len(c.endorsers),
+		Failed:     c.failed,
+	}
 }
 
 func (c *collectEndorsementsView) requestSignaturesOnIssues(context view.Context) ([]view.Identity, error) {
@@ -159,56 +287,24 @@ func (c *collectEndorsementsView) requestSignaturesOnIssues(context view.Context
 			if err != nil {
 				return nil, err
 			}
-			c.tx.TokenRequest.AppendSignature(sigma)
+			c.appendSignature(party, sigma)
 			continue
 		}
 
-		session, err := context.GetSession(context.Initiator(), party)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed getting session")
-		}
-		// Wait to receive a content back
-		ch := session.Receive()
-
 		signatureRequest := &signatureRequest{
 			Request: requestRaw,
 			TxID:    []byte(c.tx.ID()),
 			Signer:  party,
 		}
-		signatureRequestRaw, err := Marshal(signatureRequest)
-		if err != nil {
-			return nil, err
-		}
-		err = session.Send(signatureRequestRaw)
+		sigma, err := c.requestSignature(context, signatureRequest, c.tx.TokenService().SigService().IssuerVerifier)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed sending transaction content")
-		}
-
-		var msg *view.Message
-		select {
-		case msg = <-ch:
-			if logger.IsEnabledFor(zapcore.DebugLevel) {
-				logger.Debugf("collect signatures on issue: reply received from [%s]", party)
+			if err := c.skipFailure(party, err); err != nil {
+				return nil, err
 			}
-		case <-time.After(60 * time.Second):
-			return nil, errors.Errorf("Timeout from party %s", party)
-		}
-		if msg.Status == view.ERROR {
-			return nil, errors.New(string(msg.Payload))
-		}
-
-		sigma := msg.Payload
-
-		verifier, err := c.tx.TokenService().SigService().IssuerVerifier(party)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed getting verifier for [%s]", party)
-		}
-		err = verifier.Verify(signatureRequest.MessageToSign(), sigma)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed verifying signature from [%s]", party)
+			continue
 		}
 
-		c.tx.TokenRequest.AppendSignature(sigma)
+		c.appendSignature(party, sigma)
 	}
 
 	return distributionList, nil
@@ -271,66 +367,316 @@ func (c *collectEndorsementsView) requestSignaturesOnTransfers(context view.Cont
 					)
 				}
 
-				c.tx.TokenRequest.AppendSignature(sigma)
+				c.appendSignature(party, sigma)
 				continue
 			}
 			if logger.IsEnabledFor(zapcore.DebugLevel) {
 				logger.Debugf("collecting signature on request (transfer) from [%s], it is not me, connect to party!", party.UniqueID())
 			}
 
-			session, err := context.GetSession(context.Initiator(), party)
+			sigma, err := c.requestSignature(context, signatureRequest, c.tx.TokenService().SigService().OwnerVerifier)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed getting session")
+				if err := c.skipFailure(party, err); err != nil {
+					return nil, err
+				}
+				continue
 			}
-			// Wait to receive a content back
-			ch := session.Receive()
 
-			signatureRequestRaw, err := Marshal(signatureRequest)
+			if logger.IsEnabledFor(zapcore.DebugLevel) {
+				logger.Debugf("signature verified [%s,%s,%s]",
+					hash.Hashable(signatureRequest.MessageToSign()).String(),
+					hash.Hashable(sigma).String(),
+					party.UniqueID(),
+				)
+			}
+
+			c.appendSignature(party, sigma)
+		}
+	}
+
+	return distributionList, nil
+}
+
+// requestSignature sends the passed signature request to its signer and returns the verified signature.
+// Transient failures, namely failing to reach the party, a timeout, or an error response, are retried
+// as configured by WithRetry, each time over a new session.
+// If checkpoints are enabled, a signature already collected from the signer is reused,
+// and a new one is checkpointed once verified.
+func (c *collectEndorsementsView) requestSignature(context view.Context, request *signatureRequest, verifier func(view.Identity) (token.Verifier, error)) ([]byte, error) {
+	party := request.Signer
+	sigma, resumed := c.checkpoint.signature(party)
+	if !resumed {
+		var err error
+		sigma, err = c.sendSignatureRequestWithRetry(context, request)
+		if err != nil {
+			return nil, err
+		}
+	} else if logger.IsEnabledFor(zapcore.DebugLevel) {
+		logger.Debugf("signature from [%s] resumed from checkpoint", party)
+	}
+
+	v, err := verifier(party)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting verifier for [%s]", party)
+	}
+	err = v.Verify(request.MessageToSign(), sigma)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed verifying signature from [%s]", party)
+	}
+
+	if !resumed {
+		if err := c.recordCheckpoint(party, sigma); err != nil {
+			return nil, err
+		}
+	}
+	return sigma, nil
+}
+
+// sendSignatureRequestWithRetry sends the passed signature request, retrying on transient failures.
+// The wait between the attempts is interrupted when the context of the view is done,
+// and no retry is attempted if the deadline of the context of the view, if any, would expire during the wait.
+func (c *collectEndorsementsView) sendSignatureRequestWithRetry(context view.Context, request *signatureRequest) ([]byte, error) {
+	ctx := context.Context()
+	if ctx == nil {
+		ctx = context2.Background()
+	}
+	for attempt := 1; ; attempt++ {
+		sigma, retry, err := c.sendSignatureRequest(context, request)
+		if err == nil {
+			return sigma, nil
+		}
+		if !retry || attempt >= c.opts.MaxAttempts {
+			return nil, err
+		}
+		delay := retryDelay(c.opts.RetryBaseDelay, attempt, signatureRequestTimeout)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return nil, errors.WithMessagef(err, "failed collecting signature from [%s], no time left for attempt [%d]", request.Signer, attempt+1)
+		}
+		logger.Warnf("failed collecting signature from [%s], attempt [%d of %d], retry in [%s]: [%s]", request.Signer, attempt, c.opts.MaxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, errors.WithMessagef(err, "failed collecting signature from [%s], retry interrupted [%s]", request.Signer, ctx.Err())
+		}
+	}
+}
+
+// sendSignatureRequest sends the passed signature request to its signer and waits for the reply.
+// On failure, it reports whether the request can be attempted again, in which case the session is closed,
+// so that the next attempt opens a new one.
+func (c *collectEndorsementsView) sendSignatureRequest(context view.Context, request *signatureRequest) ([]byte, bool, error) {
+	party := request.Signer
+	session, err := context.GetSession(context.Initiator(), party)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed getting session")
+	}
+	// Wait to receive a content back
+	ch := session.Receive()
+
+	signatureRequestRaw, err := Marshal(request)
+	if err != nil {
+		return nil, false, err
+	}
+	err = session.Send(signatureRequestRaw)
+	if err != nil {
+		session.Close()
+		return nil, true, errors.Wrap(err, "failed sending transaction content")
+	}
+
+	var msg *view.Message
+	select {
+	case msg = <-ch:
+		if logger.IsEnabledFor(zapcore.DebugLevel) {
+			logger.Debugf("collect signatures: reply received from [%s]", party)
+		}
+	case <-time.After(signatureRequestTimeout):
+		session.Close()
+		return nil, true, errors.Errorf("Timeout from party %s", party)
+	}
+	if err := c.checkResponseSize(msg, party); err != nil {
+		session.Close()
+		return nil, false, err
+	}
+	if msg.Status == view.ERROR {
+		session.Close()
+		return nil, true, errors.New(string(msg.Payload))
+	}
+	return msg.Payload, false, nil
+}
+
+// retryDelay returns the delay before the passed retry attempt, doubling the base delay at each attempt
+// up to the passed maximum
+func retryDelay(base time.Duration, attempt int, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// requestSignaturesViaGateway collects the signatures on the issues and transfers of the token request.
+// Local signatures are computed directly, while the remote ones are requested over a single session
+// with the gateway, correlating requests and responses by correlation ID.
+// Signatures are appended to the token request in the same order used by
+// requestSignaturesOnIssues and requestSignaturesOnTransfers.
+func (c *collectEndorsementsView) requestSignaturesViaGateway(context view.Context) ([]view.Identity, error) {
+	agent := metrics.Get(context)
+	agent.EmitKey(0, "ttx", "start", "requestSignaturesViaGateway", c.tx.ID())
+	defer agent.EmitKey(0, "ttx", "end", "requestSignaturesViaGateway", c.tx.ID())
+
+	requestRaw, err := c.requestBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	type slot struct {
+		request  *signatureRequest
+		verifier func(view.Identity) (token.Verifier, error)
+		sigma    []byte
+	}
+	var slots []*slot
+	var distributionList []view.Identity
+	sigService := c.tx.TokenService().SigService()
+	addSlot := func(party view.Identity, verifier func(view.Identity) (token.Verifier, error)) error {
+		s := &slot{
+			request: &signatureRequest{
+				Request: requestRaw,
+				TxID:    []byte(c.tx.ID()),
+				Signer:  party,
+			},
+			verifier: verifier,
+		}
+		if signer, err := sigService.GetSigner(party); err == nil {
+			s.sigma, err = signer.Sign(s.request.MessageToSign())
 			if err != nil {
+				return err
+			}
+		} else {
+			s.request.CorrelationID = strconv.Itoa(len(slots))
+		}
+		slots = append(slots, s)
+		return nil
+	}
+	for _, issue := range c.tx.TokenRequest.Issues() {
+		distributionList = append(distributionList, issue.Issuer)
+		distributionList = append(distributionList, issue.Receivers...)
+		if err := addSlot(issue.Issuer, sigService.IssuerVerifier); err != nil {
+			return nil, err
+		}
+	}
+	for _, transfer := range c.tx.TokenRequest.Transfers() {
+		distributionList = append(distributionList, transfer.Senders...)
+		distributionList = append(distributionList, transfer.Receivers...)
+		for _, party := range transfer.Senders {
+			if err := addSlot(party, sigService.OwnerVerifier); err != nil {
 				return nil, err
 			}
-			err = session.Send(signatureRequestRaw)
+		}
+	}
+
+	// send all remote requests over the same session
+	var correlationIDs []string
+	for _, s := range slots {
+		if len(s.request.CorrelationID) != 0 {
+			correlationIDs = append(correlationIDs, s.request.CorrelationID)
+		}
+	}
+	if len(correlationIDs) != 0 {
+		session, err := context.GetSession(context.Initiator(), c.opts.Gateway)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed getting session with gateway")
+		}
+		ch := session.Receive()
+		for _, s := range slots {
+			if len(s.request.CorrelationID) == 0 {
+				continue
+			}
+			s.request.Batch = len(correlationIDs)
+			raw, err := Marshal(s.request)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed sending transaction content")
+				return nil, err
 			}
-
-			var msg *view.Message
-			select {
-			case msg = <-ch:
-				if logger.IsEnabledFor(zapcore.DebugLevel) {
-					logger.Debugf("collect signatures on transfer: reply received from [%s]", party)
-				}
-			case <-time.After(60 * time.Second):
-				return nil, errors.Errorf("Timeout from party %s", party)
+			if err := session.Send(raw); err != nil {
+				return nil, errors.Wrap(err, "failed sending signature request to gateway")
 			}
-			if msg.Status == view.ERROR {
-				return nil, errors.New(string(msg.Payload))
+		}
+		responses, err := collectCorrelatedResponses(ch, correlationIDs, signatureRequestTimeout, c.opts.MaxResponseSize)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed collecting signatures from gateway [%s]", c.opts.Gateway)
+		}
+		for _, s := range slots {
+			if len(s.request.CorrelationID) == 0 {
+				continue
 			}
-
-			sigma := msg.Payload
-
-			verifier, err := c.tx.TokenService().SigService().OwnerVerifier(party)
+			s.sigma = responses[s.request.CorrelationID]
+			verifier, err := s.verifier(s.request.Signer)
 			if err != nil {
-				return nil, errors.Wrapf(err, "failed getting verifier for [%s]", party)
+				return nil, errors.Wrapf(err, "failed getting verifier for [%s]", s.request.Signer)
 			}
-			err = verifier.Verify(signatureRequest.MessageToSign(), sigma)
-			if err != nil {
-				return nil, errors.Wrapf(err, "failed verifying signature from [%s]", party)
+			if err := verifier.Verify(s.request.MessageToSign(), s.sigma); err != nil {
+				return nil, errors.Wrapf(err, "failed verifying signature from [%s]", s.request.Signer)
 			}
+		}
+	}
 
-			if logger.IsEnabledFor(zapcore.DebugLevel) {
-				logger.Debugf("signature verified [%s,%s,%s]",
-					hash.Hashable(signatureRequest.MessageToSign()).String(),
-					hash.Hashable(sigma).String(),
-					party.UniqueID(),
-				)
-			}
+	for _, s := range slots {
+		c.appendSignature(s.request.Signer, s.sigma)
+	}
+	return distributionList, nil
+}
 
-			c.tx.TokenRequest.AppendSignature(sigma)
+// collectCorrelatedResponses reads from the passed channel one signatureResponse for each of the passed
+// correlation IDs, in any order, and returns the signatures indexed by correlation ID.
+// Responses larger than maxSize bytes are rejected, if maxSize is positive.
+func collectCorrelatedResponses(ch <-chan *view.Message, correlationIDs []string, timeout time.Duration, maxSize int) (map[string][]byte, error) {
+	pending := make(map[string]bool, len(correlationIDs))
+	for _, id := range correlationIDs {
+		pending[id] = true
+	}
+	responses := make(map[string][]byte, len(correlationIDs))
+	deadline := time.After(timeout)
+	for len(pending) != 0 {
+		var msg *view.Message
+		select {
+		case msg = <-ch:
+		case <-deadline:
+			return nil, errors.Errorf("timeout waiting for [%d] responses", len(pending))
 		}
+		if err := checkResponseSize(msg, maxSize); err != nil {
+			return nil, err
+		}
+		if msg.Status == view.ERROR {
+			return nil, errors.New(string(msg.Payload))
+		}
+		response := &signatureResponse{}
+		if err := Unmarshal(msg.Payload, response); err != nil {
+			return nil, errors.Wrap(err, "failed unmarshalling signature response")
+		}
+		if !pending[response.CorrelationID] {
+			return nil, errors.Errorf("unexpected response with correlation id [%s]", response.CorrelationID)
+		}
+		delete(pending, response.CorrelationID)
+		responses[response.CorrelationID] = response.Signature
 	}
+	return responses, nil
+}
 
-	return distributionList, nil
+// checkResponseSize returns an error if the payload of the passed response, received from the passed party,
+// exceeds the maximum response size
+func (c *collectEndorsementsView) checkResponseSize(msg *view.Message, party view.Identity) error {
+	return errors.WithMessagef(checkResponseSize(msg, c.opts.MaxResponseSize), "invalid response from [%s]", party)
+}
+
+// checkResponseSize returns an error if the payload of the passed response exceeds maxSize bytes.
+// A non-positive maxSize means no limit.
+func checkResponseSize(msg *view.Message, maxSize int) error {
+	if maxSize > 0 && len(msg.Payload) > maxSize {
+		return errors.Errorf("response of [%d] bytes exceeds the maximum size of [%d] bytes", len(msg.Payload), maxSize)
+	}
+	return nil
 }
 
 func (c *collectEndorsementsView) requestApproval(context view.Context) (*network.Envelope, error) {
@@ -498,6 +844,9 @@ func (c *collectEndorsementsView) distributeEnv(context view.Context, env *netwo
 		case <-time.After(240 * time.Second):
 			return errors.Errorf("Timeout from party %s", entry.ID)
 		}
+		if err := c.checkResponseSize(msg, entry.ID); err != nil {
+			return err
+		}
 		if msg.Status == view.ERROR {
 			return errors.New(string(msg.Payload))
 		}
@@ -519,33 +868,32 @@ func (c *collectEndorsementsView) requestBytes() ([]byte, error) {
 type receiveTransactionView struct {
 	network string
 	channel string
+	timeout time.Duration
 }
 
 func NewReceiveTransactionView(network string) *receiveTransactionView {
-	return &receiveTransactionView{network: network}
+	return &receiveTransactionView{network: network, timeout: defaultReceiveTransactionTimeout}
 }
 
 func (f *receiveTransactionView) Call(context view.Context) (interface{}, error) {
 	// Wait to receive a transaction back
-	ch := context.Session().Receive()
-
-	select {
-	case msg := <-ch:
-		if msg.Status == view.ERROR {
-			return nil, errors.New(string(msg.Payload))
-		}
-		tx, err := NewTransactionFromBytes(context, f.network, f.channel, msg.Payload)
-		if err != nil {
-			return nil, err
-		}
-		return tx, nil
-	case <-time.After(240 * time.Second):
-		return nil, errors.New("timeout reached")
+	msg, err := receive(context.Context(), context.Session(), f.timeout, "receiving transaction")
+	if err != nil {
+		return nil, err
 	}
+	if msg.Status == view.ERROR {
+		return nil, errors.New(string(msg.Payload))
+	}
+	tx, err := NewTransactionFromBytes(context, f.network, f.channel, msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
 }
 
 type endorseView struct {
-	tx *Transaction
+	tx   *Transaction
+	opts *EndorseOptions
 }
 
 // NewEndorseView returns an instance of the endorseView.
@@ -555,8 +903,9 @@ type endorseView struct {
 // 3. After, it waits to receive the Transaction. The Transaction is validated and stored locally
 // to be processed at time of committing.
 // 4. It sends back an ack.
-func NewEndorseView(tx *Transaction) *endorseView {
-	return &endorseView{tx: tx}
+// Use WithEndorseTimeout to bound the blocking steps of the view.
+func NewEndorseView(tx *Transaction, opts ...EndorseOption) *endorseView {
+	return &endorseView{tx: tx, opts: compileEndorseOptions(opts...)}
 }
 
 // Call executes the view.
@@ -567,10 +916,14 @@ func NewEndorseView(tx *Transaction) *endorseView {
 // to be processed at time of committing.
 // 4. It sends back an ack.
 func (s *endorseView) Call(context view.Context) (interface{}, error) {
-	// Process signature requests
-	requestsToBeSigned, err := s.requestsToBeSigned()
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed collecting requests of signature")
+	// Process signature requests, unless they reach this node through a gateway
+	var requestsToBeSigned []*token.Transfer
+	if !s.opts.SignaturesViaGateway {
+		var err error
+		requestsToBeSigned, err = s.requestsToBeSigned()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed collecting requests of signature")
+		}
 	}
 
 	session := context.Session()
@@ -578,21 +931,18 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 		if logger.IsEnabledFor(zapcore.DebugLevel) {
 			logger.Debugf("Receiving signature request...")
 		}
-		sessionChannel := session.Receive()
-		var msg *view.Message
-		select {
-		case msg = <-sessionChannel:
-			logger.Debug("message received from %s", session.Info().Caller)
-		case <-time.After(60 * time.Second):
-			return nil, errors.Errorf("Timeout from party %s", session.Info().Caller)
+		msg, err := receive(context.Context(), session, timeoutOrDefault(s.opts.Timeout, defaultReceiveSignatureRequestTimeout), "receiving signature request")
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed receiving signature request from party %s", session.Info().Caller)
 		}
+		logger.Debugf("message received from %s", session.Info().Caller)
 		if msg.Status == view.ERROR {
 			return nil, errors.New(string(msg.Payload))
 		}
 
 		// TODO: check what is signed...
 		signatureRequest := &signatureRequest{}
-		err := Unmarshal(msg.Payload, signatureRequest)
+		err = Unmarshal(msg.Payload, signatureRequest)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed unmarshalling signature request")
 		}
@@ -612,10 +962,22 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed signing request")
 		}
+		if len(signatureRequest.CorrelationID) != 0 {
+			// the request was multiplexed, reply with the correlation ID
+			sigma, err = Marshal(&signatureResponse{
+				CorrelationID: signatureRequest.CorrelationID,
+				Signature:     sigma,
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed marshalling signature response")
+			}
+		}
 		if logger.IsEnabledFor(zapcore.DebugLevel) {
 			logger.Debugf("Send back signature...")
 		}
-		err = session.Send(sigma)
+		err = runWithTimeout(context.Context(), s.opts.Timeout, "sending signature back", func(ctx context2.Context) error {
+			return send(ctx, session, sigma)
+		})
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed sending signature back")
 		}
@@ -626,7 +988,7 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 		logger.Debugf("Receive transaction with envelope...")
 	}
 	// TODO: this might also happen multiple times because of the pseudonym. Avoid this by identity resolution at the sender
-	tx, err := ReceiveTransaction(context)
+	tx, err := receiveTransaction(context, timeoutOrDefault(s.opts.Timeout, defaultReceiveTransactionTimeout))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed receiving transaction")
 	}
@@ -642,7 +1004,9 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 		return nil, errors.Errorf("expected fabric envelope")
 	}
 
-	err = tx.storeTransient()
+	err = runWithTimeout(context.Context(), s.opts.Timeout, "storing transient", func(context2.Context) error {
+		return tx.storeTransient()
+	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed storing transient")
 	}
@@ -659,7 +1023,10 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 	if err != nil {
 		return nil, errors.WithMessagef(err, "failed marshalling tx env [%s]", tx.ID())
 	}
-	if err := backend.StoreEnvelope(env.TxID(), rawEnv); err != nil {
+	err = runWithTimeout(context.Context(), s.opts.Timeout, "storing envelope", func(context2.Context) error {
+		return backend.StoreEnvelope(env.TxID(), rawEnv)
+	})
+	if err != nil {
 		return nil, errors.WithMessagef(err, "failed storing tx env [%s]", tx.ID())
 	}
 
@@ -667,7 +1034,9 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 	if logger.IsEnabledFor(zapcore.DebugLevel) {
 		logger.Debugf("Send the ack")
 	}
-	err = session.Send([]byte("ack"))
+	err = runWithTimeout(context.Context(), s.opts.Timeout, "sending ack", func(ctx context2.Context) error {
+		return send(ctx, session, []byte("ack"))
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -676,6 +1045,64 @@ func (s *endorseView) Call(context view.Context) (interface{}, error) {
 	return tx, nil
 }
 
+// runWithTimeout runs the passed step, bounded by the passed context and, if positive, by the passed timeout.
+// The step is not started if the context is already done. Otherwise, it is passed the bounded context,
+// and it must return once the context is done. A failure of the step after the context is done
+// is reported as a timeout or as an interruption of the step.
+func runWithTimeout(ctx context2.Context, timeout time.Duration, step string, f func(ctx context2.Context) error) error {
+	if ctx == nil {
+		ctx = context2.Background()
+	}
+	if timeout > 0 {
+		var cancel context2.CancelFunc
+		ctx, cancel = context2.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if ctx.Err() == nil {
+		err := f(ctx)
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+	}
+	if ctx.Err() == context2.DeadlineExceeded {
+		return errors.Errorf("timeout after [%s] while %s", timeout, step)
+	}
+	return errors.Wrapf(ctx.Err(), "interrupted while %s", step)
+}
+
+// receive waits for the next message of the passed session, bounded as done by runWithTimeout
+func receive(ctx context2.Context, session view.Session, timeout time.Duration, step string) (*view.Message, error) {
+	var msg *view.Message
+	err := runWithTimeout(ctx, timeout, step, func(ctx context2.Context) error {
+		select {
+		case msg = <-session.Receive():
+			if msg == nil {
+				return errors.Errorf("session closed while %s", step)
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return msg, err
+}
+
+// send sends the passed payload on the passed session.
+// The session cannot be told to stop sending: if the passed context is done before the send completes,
+// the session is closed, so that the send returns.
+func send(ctx context2.Context, session view.Session, payload []byte) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+	return session.Send(payload)
+}
+
 func (s *endorseView) requestsToBeSigned() ([]*token.Transfer, error) {
 	var res []*token.Transfer
 	for _, transfer := range s.tx.TokenRequest.Transfers() {
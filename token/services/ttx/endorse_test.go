@@ -0,0 +1,353 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	context2 "context"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndorsementsResult(t *testing.T) {
+	tx := &Transaction{Payload: &Payload{TokenRequest: token.NewRequest(nil, "tx1")}}
+	c := NewCollectEndorsementsView(tx)
+	requested := []view.Identity{view.Identity("issuer"), view.Identity("alice"), view.Identity("bob")}
+	for _, party := range requested {
+		c.appendSignature(party, append([]byte("sigma of "), party...))
+	}
+
+	res := c.result()
+	assert.Equal(t, tx, res.Tx)
+	assert.Equal(t, requested, res.Endorsers)
+	assert.Equal(t, 3, res.Signatures)
+	assert.Len(t, tx.TokenRequest.Actions.Signatures, 3)
+	assert.Equal(t, []byte("sigma of alice"), tx.TokenRequest.Actions.Signatures[1])
+}
+
+func TestCollectCorrelatedResponses(t *testing.T) {
+	response := func(id string, sigma string) *view.Message {
+		raw, err := Marshal(&signatureResponse{CorrelationID: id, Signature: []byte(sigma)})
+		assert.NoError(t, err)
+		return &view.Message{Payload: raw}
+	}
+
+	// responses arrive out of order
+	ch := make(chan *view.Message, 3)
+	ch <- response("2", "sigma2")
+	ch <- response("0", "sigma0")
+	ch <- response("1", "sigma1")
+	responses, err := collectCorrelatedResponses(ch, []string{"0", "1", "2"}, time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"0": []byte("sigma0"),
+		"1": []byte("sigma1"),
+		"2": []byte("sigma2"),
+	}, responses)
+
+	// unknown correlation id
+	ch <- response("3", "sigma3")
+	_, err = collectCorrelatedResponses(ch, []string{"0"}, time.Second, 0)
+	assert.EqualError(t, err, "unexpected response with correlation id [3]")
+
+	// missing response
+	ch <- response("0", "sigma0")
+	_, err = collectCorrelatedResponses(ch, []string{"0", "1"}, 10*time.Millisecond, 0)
+	assert.EqualError(t, err, "timeout waiting for [1] responses")
+
+	// error from the gateway
+	ch <- &view.Message{Status: view.ERROR, Payload: []byte("boom")}
+	_, err = collectCorrelatedResponses(ch, []string{"0"}, time.Second, 0)
+	assert.EqualError(t, err, "boom")
+
+	// oversized response
+	ch <- response("0", "a very long signature")
+	_, err = collectCorrelatedResponses(ch, []string{"0"}, time.Second, 16)
+	assert.Contains(t, err.Error(), "exceeds the maximum size of [16] bytes")
+}
+
+func TestCheckResponseSize(t *testing.T) {
+	c := NewCollectEndorsementsView(nil, WithMaxResponseSize(8))
+	assert.NoError(t, c.checkResponseSize(&view.Message{Payload: []byte("sigma")}, view.Identity("alice")))
+	err := c.checkResponseSize(&view.Message{Payload: make([]byte, 1024)}, view.Identity("alice"))
+	assert.Contains(t, err.Error(), "response of [1024] bytes exceeds the maximum size of [8] bytes")
+
+	// default and no limit
+	assert.Equal(t, DefaultMaxResponseSize, NewCollectEndorsementsView(nil).opts.MaxResponseSize)
+	c = NewCollectEndorsementsView(nil, WithMaxResponseSize(0))
+	assert.NoError(t, c.checkResponseSize(&view.Message{Payload: make([]byte, 1024)}, view.Identity("alice")))
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	// a slow vault store times out
+	slowStore := func(ctx context2.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := runWithTimeout(context2.Background(), 10*time.Millisecond, "storing envelope", slowStore)
+	assert.EqualError(t, err, "timeout after [10ms] while storing envelope")
+
+	// the context of the view is cancelled before the timeout expires
+	ctx, cancel := context2.WithCancel(context2.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = runWithTimeout(ctx, time.Minute, "storing envelope", slowStore)
+	assert.True(t, errors.Is(err, context2.Canceled))
+	assert.EqualError(t, err, "interrupted while storing envelope: context canceled")
+
+	// no step is started once the context is done
+	started := false
+	err = runWithTimeout(ctx, time.Minute, "storing envelope", func(context2.Context) error {
+		started = true
+		return nil
+	})
+	assert.EqualError(t, err, "interrupted while storing envelope: context canceled")
+	assert.False(t, started)
+
+	// fast steps complete, errors are propagated
+	assert.NoError(t, runWithTimeout(nil, time.Second, "storing envelope", func(context2.Context) error { return nil }))
+	assert.EqualError(t, runWithTimeout(context2.Background(), time.Second, "storing envelope", func(context2.Context) error { return errors.New("boom") }), "boom")
+
+	// no timeout
+	assert.NoError(t, runWithTimeout(context2.Background(), 0, "storing envelope", func(context2.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}))
+}
+
+// blockedSession blocks the sends until closed
+type blockedSession struct {
+	view.Session
+	incoming chan *view.Message
+	closed   chan struct{}
+}
+
+func newBlockedSession() *blockedSession {
+	return &blockedSession{incoming: make(chan *view.Message, 1), closed: make(chan struct{})}
+}
+
+func (s *blockedSession) Send([]byte) error {
+	<-s.closed
+	return errors.New("session closed")
+}
+
+func (s *blockedSession) Receive() <-chan *view.Message { return s.incoming }
+
+func (s *blockedSession) Close() { close(s.closed) }
+
+func TestSendAndReceive(t *testing.T) {
+	// a blocked send is stopped by closing the session
+	session := newBlockedSession()
+	err := runWithTimeout(context2.Background(), 10*time.Millisecond, "sending ack", func(ctx context2.Context) error {
+		return send(ctx, session, []byte("ack"))
+	})
+	assert.EqualError(t, err, "timeout after [10ms] while sending ack")
+	select {
+	case <-session.closed:
+	default:
+		t.Fatal("session not closed")
+	}
+
+	// the wait for a message is bounded
+	session = newBlockedSession()
+	_, err = receive(context2.Background(), session, 10*time.Millisecond, "receiving transaction")
+	assert.EqualError(t, err, "timeout after [10ms] while receiving transaction")
+	session.incoming <- &view.Message{Payload: []byte("tx")}
+	msg, err := receive(context2.Background(), session, time.Second, "receiving transaction")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tx"), msg.Payload)
+	close(session.incoming)
+	_, err = receive(context2.Background(), session, time.Second, "receiving transaction")
+	assert.EqualError(t, err, "session closed while receiving transaction")
+}
+
+// scriptedSession replies to each request with the next message of its script
+type scriptedSession struct {
+	view.Session
+	replies chan *view.Message
+	script  *[]*view.Message
+	closed  *int
+}
+
+func (s *scriptedSession) Receive() <-chan *view.Message { return s.replies }
+
+func (s *scriptedSession) Send([]byte) error {
+	reply := (*s.script)[0]
+	*s.script = (*s.script)[1:]
+	s.replies <- reply
+	return nil
+}
+
+func (s *scriptedSession) Close() { *s.closed++ }
+
+type scriptedContext struct {
+	viewContext
+	ctx      context2.Context
+	script   []*view.Message
+	sessions int
+	closed   int
+}
+
+func (c *scriptedContext) Initiator() view.View { return nil }
+
+func (c *scriptedContext) Context() context2.Context { return c.ctx }
+
+func (c *scriptedContext) GetSession(view.View, view.Identity) (view.Session, error) {
+	c.sessions++
+	return &scriptedSession{replies: make(chan *view.Message, 1), script: &c.script, closed: &c.closed}, nil
+}
+
+type verifierFunc func(message, sigma []byte) error
+
+func (f verifierFunc) Verify(message, sigma []byte) error { return f(message, sigma) }
+
+func TestRequestSignatureRetry(t *testing.T) {
+	request := &signatureRequest{Request: []byte("request"), TxID: []byte("tx1"), Signer: view.Identity("alice")}
+	verifier := func(view.Identity) (token.Verifier, error) {
+		return verifierFunc(func(message, sigma []byte) error {
+			if string(sigma) != "sigma" {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}), nil
+	}
+	failure := &view.Message{Status: view.ERROR, Payload: []byte("temporarily unavailable")}
+	success := &view.Message{Payload: []byte("sigma")}
+
+	// without retries, the first failure aborts
+	context := &scriptedContext{script: []*view.Message{failure, success}}
+	_, err := NewCollectEndorsementsView(nil).requestSignature(context, request, verifier)
+	assert.EqualError(t, err, "temporarily unavailable")
+	assert.Equal(t, 1, context.sessions)
+
+	// the failing party is asked again over a new session
+	context = &scriptedContext{script: []*view.Message{failure, failure, success}}
+	sigma, err := NewCollectEndorsementsView(nil, WithRetry(3, time.Millisecond)).requestSignature(context, request, verifier)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("sigma"), sigma)
+	assert.Equal(t, 3, context.sessions)
+	assert.Equal(t, 2, context.closed)
+
+	// attempts are bounded
+	context = &scriptedContext{script: []*view.Message{failure, failure, success}}
+	_, err = NewCollectEndorsementsView(nil, WithRetry(2, time.Millisecond)).requestSignature(context, request, verifier)
+	assert.EqualError(t, err, "temporarily unavailable")
+	assert.Equal(t, 2, context.sessions)
+
+	// invalid signatures are not retried
+	context = &scriptedContext{script: []*view.Message{{Payload: []byte("forged")}, success}}
+	_, err = NewCollectEndorsementsView(nil, WithRetry(3, time.Millisecond)).requestSignature(context, request, verifier)
+	assert.Contains(t, err.Error(), "invalid signature")
+	assert.Equal(t, 1, context.sessions)
+
+	// oversized responses are not retried, and their session is closed
+	context = &scriptedContext{script: []*view.Message{{Payload: make([]byte, 1024)}, success}}
+	_, err = NewCollectEndorsementsView(nil, WithRetry(3, time.Millisecond), WithMaxResponseSize(8)).requestSignature(context, request, verifier)
+	assert.Contains(t, err.Error(), "exceeds the maximum size of [8] bytes")
+	assert.Equal(t, 1, context.sessions)
+	assert.Equal(t, 1, context.closed)
+
+	// the backoff is interrupted when the context of the view is done
+	ctx, cancel := context2.WithCancel(context2.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	context = &scriptedContext{ctx: ctx, script: []*view.Message{failure, success}}
+	start := time.Now()
+	_, err = NewCollectEndorsementsView(nil, WithRetry(3, time.Minute)).requestSignature(context, request, verifier)
+	assert.EqualError(t, err, "failed collecting signature from ["+view.Identity("alice").String()+"], retry interrupted [context canceled]: temporarily unavailable")
+	assert.True(t, time.Since(start) < time.Minute)
+	assert.Equal(t, 1, context.sessions)
+
+	// no retry is attempted past the deadline of the view
+	ctx, cancel = context2.WithTimeout(context2.Background(), time.Second)
+	defer cancel()
+	context = &scriptedContext{ctx: ctx, script: []*view.Message{failure, success}}
+	_, err = NewCollectEndorsementsView(nil, WithRetry(3, time.Minute)).requestSignature(context, request, verifier)
+	assert.EqualError(t, err, "failed collecting signature from ["+view.Identity("alice").String()+"], no time left for attempt [2]: temporarily unavailable")
+	assert.Equal(t, 1, context.sessions)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 100*time.Millisecond, retryDelay(100*time.Millisecond, 1, time.Second))
+	assert.Equal(t, 200*time.Millisecond, retryDelay(100*time.Millisecond, 2, time.Second))
+	assert.Equal(t, 800*time.Millisecond, retryDelay(100*time.Millisecond, 4, time.Second))
+	assert.Equal(t, time.Second, retryDelay(100*time.Millisecond, 5, time.Second))
+	assert.Equal(t, time.Second, retryDelay(100*time.Millisecond, 100, time.Second))
+}
+
+func TestCheckRequiredEndorsers(t *testing.T) {
+	tx := &Transaction{Payload: &Payload{TokenRequest: token.NewRequest(nil, "tx1")}}
+	c := NewCollectEndorsementsView(tx, WithRequiredEndorsers(view.Identity("regulator"), view.Identity("issuer")))
+	c.appendSignature(view.Identity("issuer"), []byte("sigma of issuer"))
+	err := c.checkRequiredEndorsers()
+	assert.EqualError(t, err, "missing endorsements from required endorsers ["+view.Identity("regulator").String()+"]")
+
+	c.appendSignature(view.Identity("regulator"), []byte("sigma of regulator"))
+	assert.NoError(t, c.checkRequiredEndorsers())
+
+	// no requirement
+	assert.NoError(t, NewCollectEndorsementsView(tx).checkRequiredEndorsers())
+}
+
+func TestThreshold(t *testing.T) {
+	tx := &Transaction{Payload: &Payload{TokenRequest: token.NewRequest(nil, "tx1")}}
+	boom := errors.New("boom")
+
+	// without threshold, any failure aborts
+	c := NewCollectEndorsementsView(tx)
+	assert.EqualError(t, c.skipFailure(view.Identity("alice"), boom), "boom")
+
+	// 2-of-4, tolerating 2 failures
+	c = NewCollectEndorsementsView(tx, WithThreshold(2, 2))
+	c.appendSignature(view.Identity("alice"), []byte("sigma of alice"))
+	assert.NoError(t, c.skipFailure(view.Identity("bob"), boom))
+	assert.EqualError(t, c.checkThreshold(), "collected [1] signatures, threshold is [2]")
+	c.appendSignature(view.Identity("charlie"), []byte("sigma of charlie"))
+	assert.NoError(t, c.checkThreshold())
+	assert.NoError(t, c.skipFailure(view.Identity("dave"), boom))
+	err := c.skipFailure(view.Identity("eve"), boom)
+	assert.EqualError(t, err, "too many parties failed to endorse, [3] out of [2] tolerated: boom")
+
+	res := c.result()
+	assert.Equal(t, []view.Identity{view.Identity("alice"), view.Identity("charlie")}, res.Endorsers)
+	assert.Equal(t, 2, res.Signatures)
+	assert.Equal(t, []view.Identity{view.Identity("bob"), view.Identity("dave"), view.Identity("eve")}, res.Failed)
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	request := &signatureRequest{Request: []byte("request"), TxID: []byte("tx1"), Signer: view.Identity("alice")}
+	verifier := func(view.Identity) (token.Verifier, error) {
+		return verifierFunc(func(message, sigma []byte) error { return nil }), nil
+	}
+
+	cp := newEndorsementsCheckpoint([]byte("request"))
+	assert.True(t, cp.resumes([]byte("request")))
+	assert.False(t, cp.resumes([]byte("another request")))
+	cp.Signatures[view.Identity("alice").UniqueID()] = []byte("sigma")
+
+	// the signature of alice is not requested again
+	c := NewCollectEndorsementsView(nil, WithCheckpoints())
+	c.checkpoint = cp
+	context := &scriptedContext{}
+	sigma, err := c.requestSignature(context, request, verifier)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("sigma"), sigma)
+	assert.Equal(t, 0, context.sessions)
+
+	// no checkpoint
+	var none *endorsementsCheckpoint
+	_, ok := none.signature(view.Identity("alice"))
+	assert.False(t, ok)
+}
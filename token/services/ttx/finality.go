@@ -27,7 +27,10 @@ func NewFinalityView(tx *Transaction) *finalityView {
 // Call executes the view.
 // The view does the following: It waits for the finality of the passed transaction.
 // If the transaction is final, the vault is updated.
-func (f *finalityView) Call(context view.Context) (interface{}, error) {
+func (f *finalityView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "finality", TxIDAttribute, f.tx.ID())
+	defer func() { span.End(err) }()
+
 	agent := metrics.Get(context)
 	agent.EmitKey(0, "ttx", "start", "finalityView", f.tx.ID())
 	defer agent.EmitKey(0, "ttx", "end", "finalityView", f.tx.ID())
@@ -0,0 +1,217 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/pkg/errors"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+// signatureService resolves the signers of the identities of this node
+type signatureService interface {
+	IsMe(party view.Identity) bool
+	GetSigner(id view.Identity) (token.Signer, error)
+}
+
+type endorsementGatewayView struct{}
+
+// NewEndorsementGatewayView returns the view that the gateway set with WithGateway runs as responder
+// of the initiator collecting the endorsements.
+// The view receives the signature requests multiplexed over the session with the initiator, forwards them,
+// grouped by signer, to the parties, and relays back the responses, each carrying the correlation ID
+// of its request.
+// The parties answer the forwarded requests with the view returned by NewGatewaySignatureResponderView.
+func NewEndorsementGatewayView() *endorsementGatewayView {
+	return &endorsementGatewayView{}
+}
+
+func (g *endorsementGatewayView) Call(context view.Context) (interface{}, error) {
+	upstream := context.Session()
+	requests, err := receiveSignatureRequests(upstream.Receive(), signatureRequestTimeout)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed receiving signature requests from [%s]", upstream.Info().Caller)
+	}
+
+	// group the requests by signer, each group is forwarded over the session with the signer
+	var signers []string
+	groups := map[string][]*signatureRequest{}
+	for _, request := range requests {
+		key := request.Signer.UniqueID()
+		if _, ok := groups[key]; !ok {
+			signers = append(signers, key)
+		}
+		groups[key] = append(groups[key], request)
+	}
+
+	var lock sync.Mutex
+	relay := func(raw []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return upstream.Send(raw)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(signers))
+	for i, key := range signers {
+		wg.Add(1)
+		go func(i int, group []*signatureRequest) {
+			defer wg.Done()
+			errs[i] = g.forward(context, group, relay)
+		}(i, groups[key])
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			lock.Lock()
+			defer lock.Unlock()
+			if sendErr := upstream.SendError([]byte(err.Error())); sendErr != nil {
+				logger.Errorf("failed reporting error to [%s]: [%s]", upstream.Info().Caller, sendErr)
+			}
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// forward sends the passed requests, all addressed to the same signer, over the session with the signer,
+// and relays its responses
+func (g *endorsementGatewayView) forward(context view.Context, requests []*signatureRequest, relay func([]byte) error) error {
+	party := requests[0].Signer
+	session, err := context.GetSession(g, party)
+	if err != nil {
+		return errors.Wrapf(err, "failed getting session with [%s]", party)
+	}
+	ch := session.Receive()
+	for _, request := range requests {
+		request.Batch = len(requests)
+		raw, err := Marshal(request)
+		if err != nil {
+			return errors.Wrapf(err, "failed marshalling signature request")
+		}
+		if err := session.Send(raw); err != nil {
+			return errors.Wrapf(err, "failed forwarding signature request to [%s]", party)
+		}
+	}
+	for range requests {
+		var msg *view.Message
+		select {
+		case msg = <-ch:
+		case <-time.After(signatureRequestTimeout):
+			return errors.Errorf("timeout waiting for signatures from [%s]", party)
+		}
+		if err := checkResponseSize(msg, DefaultMaxResponseSize); err != nil {
+			return errors.WithMessagef(err, "invalid response from [%s]", party)
+		}
+		if msg.Status == view.ERROR {
+			return errors.Errorf("party [%s] failed signing: %s", party, string(msg.Payload))
+		}
+		if err := relay(msg.Payload); err != nil {
+			return errors.Wrapf(err, "failed relaying signature from [%s]", party)
+		}
+	}
+	return nil
+}
+
+type gatewaySignatureResponderView struct {
+	// sigService returns the service resolving the signers of this node, the one of the TMS by default
+	sigService func(context view.Context) (signatureService, error)
+}
+
+// NewGatewaySignatureResponderView returns the view that a party runs as responder of the gateway view
+// returned by NewEndorsementGatewayView. The view signs the forwarded requests with the identities of
+// this node in the TMS selected by the passed options.
+// The party then runs the endorse view with WithSignaturesViaGateway to receive the transaction.
+func NewGatewaySignatureResponderView(opts ...token.ServiceOption) *gatewaySignatureResponderView {
+	return &gatewaySignatureResponderView{sigService: tmsSignatureService(opts)}
+}
+
+func (r *gatewaySignatureResponderView) Call(context view.Context) (interface{}, error) {
+	session := context.Session()
+	if err := r.answer(context, session); err != nil {
+		if sendErr := session.SendError([]byte(err.Error())); sendErr != nil {
+			logger.Errorf("failed reporting error to [%s]: [%s]", session.Info().Caller, sendErr)
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// answer signs the requests received over the passed session and replies with the correlated signatures
+func (r *gatewaySignatureResponderView) answer(context view.Context, session view.Session) error {
+	sigService, err := r.sigService(context)
+	if err != nil {
+		return err
+	}
+	requests, err := receiveSignatureRequests(session.Receive(), signatureRequestTimeout)
+	if err != nil {
+		return errors.WithMessagef(err, "failed receiving signature requests from [%s]", session.Info().Caller)
+	}
+	for _, request := range requests {
+		if !sigService.IsMe(request.Signer) {
+			return errors.Errorf("identity [%s] is not me", request.Signer.UniqueID())
+		}
+		signer, err := sigService.GetSigner(request.Signer)
+		if err != nil {
+			return errors.Wrapf(err, "cannot find signer for [%s]", request.Signer.UniqueID())
+		}
+		sigma, err := signer.Sign(request.MessageToSign())
+		if err != nil {
+			return errors.Wrapf(err, "failed signing request")
+		}
+		raw, err := Marshal(&signatureResponse{CorrelationID: request.CorrelationID, Signature: sigma})
+		if err != nil {
+			return errors.Wrapf(err, "failed marshalling signature response")
+		}
+		if err := session.Send(raw); err != nil {
+			return errors.Wrapf(err, "failed sending signature back")
+		}
+	}
+	return nil
+}
+
+// tmsSignatureService returns the signature service of the TMS selected by the passed options
+func tmsSignatureService(opts []token.ServiceOption) func(context view.Context) (signatureService, error) {
+	return func(context view.Context) (signatureService, error) {
+		tms := token.GetManagementService(context, opts...)
+		if tms == nil {
+			return nil, errors.New("failed getting TMS")
+		}
+		return tms.SigService(), nil
+	}
+}
+
+// receiveSignatureRequests reads from the passed channel the signature requests multiplexed over a session.
+// The first request tells how many requests are in the batch, each of them must carry a correlation ID.
+func receiveSignatureRequests(ch <-chan *view.Message, timeout time.Duration) ([]*signatureRequest, error) {
+	var requests []*signatureRequest
+	deadline := time.After(timeout)
+	for len(requests) == 0 || len(requests) < requests[0].Batch {
+		var msg *view.Message
+		select {
+		case msg = <-ch:
+		case <-deadline:
+			return nil, errors.Errorf("timeout waiting for signature requests, received [%d]", len(requests))
+		}
+		if msg.Status == view.ERROR {
+			return nil, errors.New(string(msg.Payload))
+		}
+		request := &signatureRequest{}
+		if err := Unmarshal(msg.Payload, request); err != nil {
+			return nil, errors.Wrap(err, "failed unmarshalling signature request")
+		}
+		if len(request.CorrelationID) == 0 {
+			return nil, errors.New("signature request without correlation id")
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+// pipeSession is one end of an in-memory session
+type pipeSession struct {
+	view.Session
+	caller view.Identity
+	in     chan *view.Message
+	out    chan *view.Message
+}
+
+// newPipe returns the two ends of an in-memory session opened by the passed caller
+func newPipe(caller view.Identity) (*pipeSession, *pipeSession) {
+	a, b := make(chan *view.Message, 16), make(chan *view.Message, 16)
+	return &pipeSession{caller: caller, in: a, out: b}, &pipeSession{caller: caller, in: b, out: a}
+}
+
+func (s *pipeSession) Info() view.SessionInfo        { return view.SessionInfo{Caller: s.caller} }
+func (s *pipeSession) Receive() <-chan *view.Message { return s.in }
+func (s *pipeSession) Close()                        {}
+func (s *pipeSession) Send(payload []byte) error {
+	s.out <- &view.Message{Payload: payload}
+	return nil
+}
+func (s *pipeSession) SendError(payload []byte) error {
+	s.out <- &view.Message{Status: view.ERROR, Payload: payload}
+	return nil
+}
+
+// sessionContext is the context of a responder, bound to the session that started it
+type sessionContext struct {
+	viewContext
+	session view.Session
+	// parties are the nodes the context can open a session with, by identity
+	parties map[string]*partyNode
+}
+
+func (c *sessionContext) Session() view.Session { return c.session }
+
+func (c *sessionContext) GetSession(_ view.View, party view.Identity) (view.Session, error) {
+	node, ok := c.parties[party.UniqueID()]
+	if !ok {
+		return nil, errors.Errorf("party [%s] unreachable", party)
+	}
+	local, remote := newPipe(view.Identity("gateway"))
+	go func() {
+		_, err := node.responder.Call(&sessionContext{session: remote})
+		node.errs <- err
+	}()
+	return local, nil
+}
+
+// partyNode is a node answering the signature requests forwarded by the gateway
+type partyNode struct {
+	responder view.View
+	errs      chan error
+}
+
+// nodeSigService signs, for the identities of a node, by prefixing the message with the identity
+type nodeSigService map[string]bool
+
+func (s nodeSigService) IsMe(party view.Identity) bool { return s[party.UniqueID()] }
+
+func (s nodeSigService) GetSigner(id view.Identity) (token.Signer, error) {
+	if !s[id.UniqueID()] {
+		return nil, errors.Errorf("no signer for [%s]", id)
+	}
+	return signerFunc(func(message []byte) ([]byte, error) {
+		return append(append([]byte{}, id...), message...), nil
+	}), nil
+}
+
+type signerFunc func(message []byte) ([]byte, error)
+
+func (f signerFunc) Sign(message []byte) ([]byte, error) { return f(message) }
+
+func newPartyNode(identities ...view.Identity) *partyNode {
+	sigService := nodeSigService{}
+	for _, id := range identities {
+		sigService[id.UniqueID()] = true
+	}
+	return &partyNode{
+		responder: &gatewaySignatureResponderView{
+			sigService: func(view.Context) (signatureService, error) { return sigService, nil },
+		},
+		errs: make(chan error, 1),
+	}
+}
+
+func TestEndorsementGateway(t *testing.T) {
+	alice, bob, bob2 := view.Identity("alice"), view.Identity("bob"), view.Identity("bob-pseudonym")
+	aliceNode, bobNode := newPartyNode(alice), newPartyNode(bob, bob2)
+	parties := map[string]*partyNode{alice.UniqueID(): aliceNode, bob.UniqueID(): bobNode, bob2.UniqueID(): bobNode}
+
+	// the initiator multiplexes the requests over the session with the gateway
+	initiator, upstream := newPipe(view.Identity("initiator"))
+	requests := []*signatureRequest{
+		{Request: []byte("request"), TxID: []byte("tx1"), Signer: bob, CorrelationID: "0"},
+		{Request: []byte("request"), TxID: []byte("tx1"), Signer: alice, CorrelationID: "1"},
+		{Request: []byte("request"), TxID: []byte("tx1"), Signer: bob2, CorrelationID: "2"},
+	}
+	for _, request := range requests {
+		request.Batch = len(requests)
+		raw, err := Marshal(request)
+		assert.NoError(t, err)
+		assert.NoError(t, initiator.Send(raw))
+	}
+
+	_, err := NewEndorsementGatewayView().Call(&sessionContext{session: upstream, parties: parties})
+	assert.NoError(t, err)
+	responses, err := collectCorrelatedResponses(initiator.Receive(), []string{"0", "1", "2"}, time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{
+		"0": []byte("bobrequesttx1"),
+		"1": []byte("alicerequesttx1"),
+		"2": []byte("bob-pseudonymrequesttx1"),
+	}, responses)
+	// each party has been contacted once per signer identity
+	assert.NoError(t, <-aliceNode.errs)
+	assert.NoError(t, <-bobNode.errs)
+	assert.NoError(t, <-bobNode.errs)
+
+	// a party refusing to sign fails the collection
+	initiator, upstream = newPipe(view.Identity("initiator"))
+	request := &signatureRequest{Request: []byte("request"), TxID: []byte("tx2"), Signer: view.Identity("carol"), CorrelationID: "0", Batch: 1}
+	raw, err := Marshal(request)
+	assert.NoError(t, err)
+	assert.NoError(t, initiator.Send(raw))
+	parties[request.Signer.UniqueID()] = aliceNode
+	_, err = NewEndorsementGatewayView().Call(&sessionContext{session: upstream, parties: parties})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not me")
+	assert.Error(t, <-aliceNode.errs)
+	_, err = collectCorrelatedResponses(initiator.Receive(), []string{"0"}, time.Second, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not me")
+}
+
+func TestReceiveSignatureRequests(t *testing.T) {
+	ch := make(chan *view.Message, 2)
+	raw, err := Marshal(&signatureRequest{Signer: view.Identity("alice"), Batch: 2, CorrelationID: "0"})
+	assert.NoError(t, err)
+	ch <- &view.Message{Payload: raw}
+	_, err = receiveSignatureRequests(ch, 10*time.Millisecond)
+	assert.EqualError(t, err, "timeout waiting for signature requests, received [1]")
+
+	raw, err = Marshal(&signatureRequest{Signer: view.Identity("alice")})
+	assert.NoError(t, err)
+	ch <- &view.Message{Payload: raw}
+	_, err = receiveSignatureRequests(ch, time.Second)
+	assert.EqualError(t, err, "signature request without correlation id")
+}
@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+// Recipient is the recipient of an issuance
+type Recipient struct {
+	// Identity is the identity of the recipient
+	Identity view.Identity
+	// Type of tokens to issue
+	Type string
+	// Quantity to issue
+	Quantity uint64
+}
+
+// SplitIssuance splits the passed recipients in chunks of at most maxPerTx recipients, preserving their order.
+// Each chunk is meant to be issued in a separate transaction.
+// If maxPerTx is not positive, a single chunk with all the recipients is returned.
+func SplitIssuance(recipients []Recipient, maxPerTx int) [][]Recipient {
+	if len(recipients) == 0 {
+		return nil
+	}
+	if maxPerTx <= 0 {
+		return [][]Recipient{recipients}
+	}
+	chunks := make([][]Recipient, 0, (len(recipients)+maxPerTx-1)/maxPerTx)
+	for len(recipients) > maxPerTx {
+		chunks = append(chunks, recipients[:maxPerTx])
+		recipients = recipients[maxPerTx:]
+	}
+	return append(chunks, recipients)
+}
+
+// IssuanceChunkStatus is the status of a chunk of a bulk issuance
+type IssuanceChunkStatus string
+
+const (
+	// IssuanceChunkCommitted is the status of a chunk whose transaction has been committed
+	IssuanceChunkCommitted IssuanceChunkStatus = "Committed"
+	// IssuanceChunkFailed is the status of a chunk whose transaction failed
+	IssuanceChunkFailed IssuanceChunkStatus = "Failed"
+	// IssuanceChunkSkipped is the status of a chunk not processed because a previous chunk failed
+	IssuanceChunkSkipped IssuanceChunkStatus = "Skipped"
+)
+
+// IssuanceChunkResult is the outcome of the issuance of a chunk of recipients
+type IssuanceChunkResult struct {
+	// TxID is the transaction id of the chunk, empty if no transaction has been assembled
+	TxID string
+	// Recipients are the recipients of the chunk
+	Recipients []Recipient
+	// Status is the status of the chunk
+	Status IssuanceChunkStatus
+	// Err is the reason of the failure, if any
+	Err error
+}
+
+type bulkIssuanceView struct {
+	wallet     *token.IssuerWallet
+	recipients []Recipient
+	maxPerTx   int
+	opts       *BulkIssuanceOptions
+	// issueChunk issues to the passed recipients in a transaction and returns its id, issue by default
+	issueChunk func(context view.Context, recipients []Recipient) (string, error)
+}
+
+// NewBulkIssuanceView returns an instance of the bulkIssuanceView.
+// The view splits the passed recipients in chunks of at most maxPerTx recipients (see SplitIssuance), and for each chunk:
+// 1. It assembles a transaction issuing to the recipients of the chunk from the passed wallet.
+// 2. It collects the endorsements on the transaction.
+// 3. It sends the transaction for ordering and waits for its finality.
+// The view returns a slice of *IssuanceChunkResult, one per chunk, in the order of the chunks.
+// By default, the view stops at the first failing chunk, marking the remaining ones as skipped.
+// Use WithContinueOnFailure to process all the chunks anyway.
+func NewBulkIssuanceView(wallet *token.IssuerWallet, recipients []Recipient, maxPerTx int, opts ...BulkIssuanceOption) *bulkIssuanceView {
+	b := &bulkIssuanceView{
+		wallet:     wallet,
+		recipients: recipients,
+		maxPerTx:   maxPerTx,
+		opts:       compileBulkIssuanceOptions(opts...),
+	}
+	b.issueChunk = b.issue
+	return b
+}
+
+// Call executes the view.
+// It returns the results of the chunks and, if a chunk failed, an error.
+func (b *bulkIssuanceView) Call(context view.Context) (interface{}, error) {
+	chunks := SplitIssuance(b.recipients, b.maxPerTx)
+	results := make([]*IssuanceChunkResult, len(chunks))
+	var failed int
+	for i, chunk := range chunks {
+		results[i] = &IssuanceChunkResult{Recipients: chunk, Status: IssuanceChunkSkipped}
+		if failed != 0 && !b.opts.ContinueOnFailure {
+			continue
+		}
+		results[i].TxID, results[i].Err = b.issueChunk(context, chunk)
+		if results[i].Err != nil {
+			if logger.IsEnabledFor(zapcore.DebugLevel) {
+				logger.Debugf("bulk issuance: chunk [%d] failed [%s]", i, results[i].Err)
+			}
+			results[i].Status = IssuanceChunkFailed
+			failed++
+			continue
+		}
+		results[i].Status = IssuanceChunkCommitted
+	}
+	if failed != 0 {
+		return results, errors.Errorf("[%d] out of [%d] issuance chunks failed", failed, len(chunks))
+	}
+	return results, nil
+}
+
+func (b *bulkIssuanceView) issue(context view.Context, recipients []Recipient) (string, error) {
+	tx, err := NewAnonymousTransaction(context, b.opts.TxOptions...)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed creating transaction")
+	}
+	for _, recipient := range recipients {
+		if err := tx.Issue(b.wallet, recipient.Identity, recipient.Type, recipient.Quantity); err != nil {
+			return tx.ID(), errors.WithMessagef(err, "failed issuing to [%s]", recipient.Identity)
+		}
+	}
+	if _, err := context.RunView(NewCollectEndorsementsView(tx)); err != nil {
+		return tx.ID(), errors.WithMessage(err, "failed collecting endorsements")
+	}
+	if _, err := context.RunView(NewOrderingAndFinalityView(tx)); err != nil {
+		return tx.ID(), errors.WithMessage(err, "failed ordering and waiting for finality")
+	}
+	return tx.ID(), nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitIssuance(t *testing.T) {
+	var recipients []Recipient
+	for i := 0; i < 2500; i++ {
+		recipients = append(recipients, Recipient{Identity: view.Identity(strconv.Itoa(i)), Type: "USD", Quantity: 10})
+	}
+
+	chunks := SplitIssuance(recipients, 1000)
+	assert.Len(t, chunks, 3)
+	assert.Len(t, chunks[0], 1000)
+	assert.Len(t, chunks[1], 1000)
+	assert.Len(t, chunks[2], 500)
+	var joined []Recipient
+	for _, chunk := range chunks {
+		joined = append(joined, chunk...)
+	}
+	assert.Equal(t, recipients, joined)
+
+	assert.Len(t, SplitIssuance(recipients[:1000], 1000), 1)
+	assert.Len(t, SplitIssuance(recipients, 0), 1)
+	assert.Nil(t, SplitIssuance(nil, 1000))
+}
+
+func TestBulkIssuanceView(t *testing.T) {
+	var recipients []Recipient
+	for i := 0; i < 5; i++ {
+		recipients = append(recipients, Recipient{Identity: view.Identity(strconv.Itoa(i)), Type: "USD", Quantity: 10})
+	}
+	// chunks of two recipients, the second one fails after its transaction has been assembled
+	newView := func(opts ...BulkIssuanceOption) (*bulkIssuanceView, *[][]Recipient) {
+		var issued [][]Recipient
+		b := NewBulkIssuanceView(nil, recipients, 2, opts...)
+		b.issueChunk = func(_ view.Context, chunk []Recipient) (string, error) {
+			issued = append(issued, chunk)
+			txID := "tx" + strconv.Itoa(len(issued))
+			if len(issued) == 2 {
+				return txID, errors.New("endorsement failed")
+			}
+			return txID, nil
+		}
+		return b, &issued
+	}
+
+	// by default, the chunks after the failing one are skipped
+	b, issued := newView()
+	res, err := b.Call(nil)
+	assert.EqualError(t, err, "[1] out of [3] issuance chunks failed")
+	assert.Len(t, *issued, 2)
+	results := res.([]*IssuanceChunkResult)
+	assert.Len(t, results, 3)
+	assert.Equal(t, &IssuanceChunkResult{TxID: "tx1", Recipients: recipients[0:2], Status: IssuanceChunkCommitted}, results[0])
+	assert.Equal(t, "tx2", results[1].TxID)
+	assert.Equal(t, recipients[2:4], results[1].Recipients)
+	assert.Equal(t, IssuanceChunkFailed, results[1].Status)
+	assert.EqualError(t, results[1].Err, "endorsement failed")
+	assert.Equal(t, &IssuanceChunkResult{Recipients: recipients[4:], Status: IssuanceChunkSkipped}, results[2])
+
+	// with WithContinueOnFailure, all the chunks are processed
+	b, issued = newView(WithContinueOnFailure())
+	res, err = b.Call(nil)
+	assert.EqualError(t, err, "[1] out of [3] issuance chunks failed")
+	assert.Equal(t, [][]Recipient{recipients[0:2], recipients[2:4], recipients[4:]}, *issued)
+	results = res.([]*IssuanceChunkResult)
+	assert.Equal(t, []IssuanceChunkStatus{IssuanceChunkCommitted, IssuanceChunkFailed, IssuanceChunkCommitted},
+		[]IssuanceChunkStatus{results[0].Status, results[1].Status, results[2].Status})
+	assert.Equal(t, []string{"tx1", "tx2", "tx3"}, []string{results[0].TxID, results[1].TxID, results[2].TxID})
+	assert.Nil(t, results[2].Err)
+
+	// no failure, no error
+	b = NewBulkIssuanceView(nil, recipients, 3)
+	b.issueChunk = func(_ view.Context, chunk []Recipient) (string, error) {
+		return string(chunk[0].Identity), nil
+	}
+	res, err = b.Call(nil)
+	assert.NoError(t, err)
+	results = res.([]*IssuanceChunkResult)
+	assert.Len(t, results, 2)
+	assert.Equal(t, []string{"0", "3"}, []string{results[0].TxID, results[1].TxID})
+	assert.Equal(t, IssuanceChunkCommitted, results[1].Status)
+}
@@ -6,6 +6,8 @@ SPDX-License-Identifier: Apache-2.0
 package ttx
 
 import (
+	"time"
+
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token"
@@ -77,3 +79,231 @@ func WithTMSID(id token.TMSID) TxOption {
 		return nil
 	}
 }
+
+// DefaultMaxResponseSize is the default maximum size, in bytes, of a response received while collecting endorsements
+const DefaultMaxResponseSize = 4 * 1024 * 1024
+
+// EndorsementsOptions models the options that can be passed to the view collecting endorsements
+type EndorsementsOptions struct {
+	// Gateway, if set, is the party through which all the remote signature requests are sent,
+	// over a single session, instead of opening a session per party.
+	Gateway view.Identity
+	// MaxResponseSize is the maximum size, in bytes, of a response from a party.
+	// Larger responses are rejected before being processed. A non-positive value means no limit.
+	// It defaults to DefaultMaxResponseSize.
+	MaxResponseSize int
+	// MaxAttempts is the number of times a signature request to a party is attempted before giving up.
+	// Only transient failures, like timeouts and error responses, are retried. It defaults to 1, no retry.
+	MaxAttempts int
+	// RetryBaseDelay is the delay before the first retry. It doubles at each following retry,
+	// up to the timeout of a signature request. The retries stop at the deadline of the context of the view.
+	RetryBaseDelay time.Duration
+	// RequiredEndorsers are the identities whose signatures must be among the collected ones,
+	// independently of the parties involved in the token request.
+	RequiredEndorsers []view.Identity
+	// Threshold, if positive, is the number of valid signatures that suffices to complete the collection.
+	// In this case, the parties that fail to provide a valid signature are skipped, up to MaxFailures of them.
+	Threshold int
+	// MaxFailures is the number of parties that can fail to provide a valid signature when Threshold is set
+	MaxFailures int
+	// Checkpoints, if true, makes the view persist the signatures collected from remote parties,
+	// and resume from them when the collection for the same transaction is restarted.
+	Checkpoints bool
+}
+
+func compileEndorsementsOptions(opts ...EndorsementsOption) *EndorsementsOptions {
+	options := &EndorsementsOptions{MaxResponseSize: DefaultMaxResponseSize, MaxAttempts: 1}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// EndorsementsOption is a function that modifies EndorsementsOptions
+type EndorsementsOption func(*EndorsementsOptions)
+
+// WithGateway multiplexes all the remote signature requests over a single session with the passed gateway.
+// Requests and responses are correlated by a per-request correlation ID.
+// The gateway runs the view returned by NewEndorsementGatewayView, that forwards the requests to the parties.
+// The parties answer them with the view returned by NewGatewaySignatureResponderView, and run the endorse view
+// with WithSignaturesViaGateway.
+func WithGateway(gateway view.Identity) EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.Gateway = gateway
+	}
+}
+
+// WithMaxResponseSize sets the maximum size, in bytes, of a response from a party.
+// A non-positive value removes the limit.
+func WithMaxResponseSize(size int) EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.MaxResponseSize = size
+	}
+}
+
+// WithRetry makes the view attempt each remote signature request up to maxAttempts times,
+// waiting an exponential backoff starting at baseDelay between the attempts.
+// Only the failing party is asked again, over a new session; the signatures already collected are kept.
+func WithRetry(maxAttempts int, baseDelay time.Duration) EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.MaxAttempts = maxAttempts
+		o.RetryBaseDelay = baseDelay
+	}
+}
+
+// WithRequiredEndorsers makes the view fail unless signatures from all the passed identities are collected,
+// as needed by endorsement policies like "must be signed by the regulator".
+func WithRequiredEndorsers(endorsers ...view.Identity) EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.RequiredEndorsers = endorsers
+	}
+}
+
+// WithThreshold makes the view tolerate up to maxFailures parties failing to provide a valid signature,
+// and succeed if at least threshold valid signatures are collected, as needed by threshold endorsement policies.
+// The signature of each accepted party is verified as usual. It does not apply when a gateway is used.
+func WithThreshold(threshold, maxFailures int) EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.Threshold = threshold
+		o.MaxFailures = maxFailures
+	}
+}
+
+// WithCheckpoints makes the view store the collected signatures in the key-value store, keyed by transaction ID,
+// after each party replies. If the initiator crashes, running the view again for the same transaction
+// reloads them and asks only the parties that did not sign yet. It does not apply when a gateway is used.
+func WithCheckpoints() EndorsementsOption {
+	return func(o *EndorsementsOptions) {
+		o.Checkpoints = true
+	}
+}
+
+// EndorseOptions models the options that can be passed to the endorse responder view
+type EndorseOptions struct {
+	// Timeout bounds each of the blocking steps performed by the responder
+	// (waiting for the requests and the transaction, storing the transaction, sending messages back to the initiator).
+	// Zero means no timeout for the storing and sending steps, and the default waits for the requests and the transaction.
+	// The steps are also bounded by the context of the view. A send that does not complete in time closes the session,
+	// and no step is started once the time is over.
+	Timeout time.Duration
+	// SignaturesViaGateway, if true, tells that the signature requests reach this node through a gateway,
+	// see WithGateway. The responder then only receives the transaction.
+	SignaturesViaGateway bool
+}
+
+func compileEndorseOptions(opts ...EndorseOption) *EndorseOptions {
+	options := &EndorseOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// EndorseOption is a function that modifies EndorseOptions
+type EndorseOption func(*EndorseOptions)
+
+// WithEndorseTimeout bounds each of the blocking steps of the endorse responder by the passed timeout
+func WithEndorseTimeout(timeout time.Duration) EndorseOption {
+	return func(o *EndorseOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithSignaturesViaGateway makes the endorse responder skip the signature requests, that reach this node
+// through the gateway set by the initiator with WithGateway and are answered by the view returned by
+// NewGatewaySignatureResponderView
+func WithSignaturesViaGateway() EndorseOption {
+	return func(o *EndorseOptions) {
+		o.SignaturesViaGateway = true
+	}
+}
+
+// BulkIssuanceOptions models the options that can be passed to the bulk issuance view
+type BulkIssuanceOptions struct {
+	// ContinueOnFailure, if true, makes the view process all the chunks even if some of them fail
+	ContinueOnFailure bool
+	// TxOptions are the options used to create the transaction of each chunk
+	TxOptions []TxOption
+}
+
+func compileBulkIssuanceOptions(opts ...BulkIssuanceOption) *BulkIssuanceOptions {
+	options := &BulkIssuanceOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// BulkIssuanceOption is a function that modifies BulkIssuanceOptions
+type BulkIssuanceOption func(*BulkIssuanceOptions)
+
+// WithContinueOnFailure makes the bulk issuance process all the chunks even if some of them fail
+func WithContinueOnFailure() BulkIssuanceOption {
+	return func(o *BulkIssuanceOptions) {
+		o.ContinueOnFailure = true
+	}
+}
+
+// WithChunkTxOptions sets the options used to create the transaction of each chunk of the bulk issuance
+func WithChunkTxOptions(opts ...TxOption) BulkIssuanceOption {
+	return func(o *BulkIssuanceOptions) {
+		o.TxOptions = opts
+	}
+}
+
+// OrderingOptions models the options that can be passed to the ordering views
+type OrderingOptions struct {
+	// FinalityTimeout bounds the wait for the finality of the transaction, once broadcast.
+	// Zero means no timeout, the wait is bound only by the context of the view.
+	FinalityTimeout time.Duration
+	// BroadcastMaxAttempts is the number of times the broadcast of the transaction is attempted before giving up.
+	// Only the failures deemed retryable by IsRetryable are retried. It defaults to 1, no retry.
+	BroadcastMaxAttempts int
+	// BroadcastInitialDelay is the delay before the first retry of the broadcast
+	BroadcastInitialDelay time.Duration
+	// BroadcastMultiplier is the factor the delay is multiplied by at each following retry. It defaults to 2.
+	BroadcastMultiplier float64
+	// IsRetryable tells whether a broadcast failure is transient, and then the broadcast can be retried.
+	// It defaults to IsTransientBroadcastError.
+	IsRetryable func(err error) bool
+}
+
+func compileOrderingOptions(opts ...OrderingOption) *OrderingOptions {
+	options := &OrderingOptions{
+		BroadcastMaxAttempts: 1,
+		BroadcastMultiplier:  2,
+		IsRetryable:          IsTransientBroadcastError,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// OrderingOption is a function that modifies OrderingOptions
+type OrderingOption func(*OrderingOptions)
+
+// WithFinalityTimeout bounds the wait for the finality of the transaction by the passed timeout
+func WithFinalityTimeout(timeout time.Duration) OrderingOption {
+	return func(o *OrderingOptions) {
+		o.FinalityTimeout = timeout
+	}
+}
+
+// WithBroadcastRetry makes the view attempt the broadcast of the transaction up to maxAttempts times,
+// waiting initialDelay before the first retry, and multiplying the delay by multiplier at each following retry.
+// Only transient failures, like connection errors and timeouts, are retried; rejections are returned immediately.
+func WithBroadcastRetry(maxAttempts int, initialDelay time.Duration, multiplier float64) OrderingOption {
+	return func(o *OrderingOptions) {
+		o.BroadcastMaxAttempts = maxAttempts
+		o.BroadcastInitialDelay = initialDelay
+		o.BroadcastMultiplier = multiplier
+	}
+}
+
+// WithRetryableBroadcastErrors replaces the function telling which broadcast failures can be retried
+func WithRetryableBroadcastErrors(isRetryable func(err error) bool) OrderingOption {
+	return func(o *OrderingOptions) {
+		o.IsRetryable = isRetryable
+	}
+}
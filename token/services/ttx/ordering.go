@@ -7,41 +7,80 @@ SPDX-License-Identifier: Apache-2.0
 package ttx
 
 import (
+	context2 "context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/tracker/metrics"
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
 	"github.com/pkg/errors"
 	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/hyperledger-labs/fabric-token-sdk/token/services/network"
 )
 
 type orderingView struct {
-	tx *Transaction
+	tx   *Transaction
+	opts *OrderingOptions
 }
 
 // NewOrderingView returns a new instance of the orderingView struct.
 // The view does the following:
 // 1. It broadcasts the token transaction to the proper Fabric ordering service.
-func NewOrderingView(tx *Transaction) *orderingView {
-	return &orderingView{tx: tx}
+func NewOrderingView(tx *Transaction, opts ...OrderingOption) *orderingView {
+	return &orderingView{tx: tx, opts: compileOrderingOptions(opts...)}
 }
 
 // Call execute the view.
 // The view does the following:
 // 1. It broadcasts the token token transaction to the proper Fabric ordering service.
-func (o *orderingView) Call(context view.Context) (interface{}, error) {
+// It returns the id of the transaction, whose finality can then be awaited with AwaitFinality,
+// also later or on another node.
+func (o *orderingView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "ordering", TxIDAttribute, o.tx.ID())
+	defer func() { span.End(err) }()
+
 	agent := metrics.Get(context)
 	agent.EmitKey(0, "ttx", "start", "orderingView", o.tx.ID())
 	defer agent.EmitKey(0, "ttx", "end", "orderingView", o.tx.ID())
 
-	if err := network.GetInstance(context, o.tx.Network(), "").Broadcast(o.tx.Payload.Envelope); err != nil {
+	if err := o.broadcast(context, network.GetInstance(context, o.tx.Network(), "")); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	return o.tx.ID(), nil
+}
+
+// broadcast sends the envelope of the transaction to the ordering service of the passed network
+func (o *orderingView) broadcast(context view.Context, nw *network.Network) error {
+	return broadcast(context.Context(), o.tx.ID(), o.opts, func() error {
+		return nw.Broadcast(o.tx.Payload.Envelope)
+	})
+}
+
+// FinalityTimeoutError is returned when a transaction has been broadcast, but its finality
+// has not been confirmed in time. The transaction might still become final: its status can be checked later.
+type FinalityTimeoutError struct {
+	// TxID is the id of the broadcast transaction
+	TxID string
+	// Err is context.DeadlineExceeded if the finality timeout expired, or the error of the context of the view
+	Err error
+}
+
+func (e *FinalityTimeoutError) Error() string {
+	return fmt.Sprintf("transaction [%s] broadcast, but its finality has not been confirmed: %s", e.TxID, e.Err)
+}
+
+func (e *FinalityTimeoutError) Unwrap() error {
+	return e.Err
 }
 
 type orderingAndFinalityView struct {
-	tx *Transaction
+	tx   *Transaction
+	opts *OrderingOptions
 }
 
 // NewOrderingAndFinalityView returns a new instance of the orderingAndFinalityView struct.
@@ -49,8 +88,15 @@ type orderingAndFinalityView struct {
 // 1. It broadcasts the token transaction to the proper Fabric ordering service.
 // 2. It waits for finality of the token transaction by listening to delivery events from one of the
 // Fabric peer nodes trusted by the FSC node.
-func NewOrderingAndFinalityView(tx *Transaction) *orderingAndFinalityView {
-	return &orderingAndFinalityView{tx: tx}
+func NewOrderingAndFinalityView(tx *Transaction, opts ...OrderingOption) *orderingAndFinalityView {
+	return &orderingAndFinalityView{tx: tx, opts: compileOrderingOptions(opts...)}
+}
+
+// NewOrderingAndFinalityViewWithTimeout returns a new instance of the orderingAndFinalityView struct
+// that waits for the finality of the token transaction for at most the passed timeout.
+// On timeout, the view returns a *FinalityTimeoutError.
+func NewOrderingAndFinalityViewWithTimeout(tx *Transaction, timeout time.Duration) *orderingAndFinalityView {
+	return NewOrderingAndFinalityView(tx, WithFinalityTimeout(timeout))
 }
 
 // Call executes the view.
@@ -58,7 +104,11 @@ func NewOrderingAndFinalityView(tx *Transaction) *orderingAndFinalityView {
 // 1. It broadcasts the token transaction to the proper Fabric ordering service.
 // 2. It waits for finality of the token transaction by listening to delivery events from one of the
 // Fabric peer nodes trusted by the FSC node.
-func (o *orderingAndFinalityView) Call(context view.Context) (interface{}, error) {
+// On success, it returns a *FinalityResult telling where the transaction has been committed.
+func (o *orderingAndFinalityView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "orderingAndFinality", TxIDAttribute, o.tx.ID())
+	defer func() { span.End(err) }()
+
 	agent := metrics.Get(context)
 	agent.EmitKey(0, "ttx", "start", "orderingAndFinalityView", o.tx.ID())
 	defer agent.EmitKey(0, "ttx", "end", "orderingAndFinalityView", o.tx.ID())
@@ -82,9 +132,168 @@ func (o *orderingAndFinalityView) Call(context view.Context) (interface{}, error
 		}
 	}
 
-	if err := nw.Broadcast(env); err != nil {
+	if err := (&orderingView{tx: o.tx, opts: o.opts}).broadcast(context, nw); err != nil {
+		return nil, err
+	}
+
+	res, err := awaitFinality(context, nw, o.tx.ID(), o.opts.FinalityTimeout)
+	if err != nil {
 		return nil, err
 	}
+	return res, nil
+}
+
+// FinalityResult describes where a final transaction has been committed
+type FinalityResult struct {
+	// TxID is the id of the transaction
+	TxID string
+	// BlockNumber is the number of the block the transaction has been committed in.
+	// It is zero if the network does not expose it, or if it could not be retrieved.
+	BlockNumber uint64
+	// ValidationCode is the validation code of the transaction
+	ValidationCode network.ValidationCode
+}
+
+type awaitFinalityView struct {
+	txID    string
+	timeout time.Duration
+	opts    []TxOption
+}
+
+// NewAwaitFinalityView returns an instance of the awaitFinalityView.
+// The view waits for the finality of the transaction with the passed id, see AwaitFinality.
+func NewAwaitFinalityView(txID string, timeout time.Duration, opts ...TxOption) *awaitFinalityView {
+	return &awaitFinalityView{txID: txID, timeout: timeout, opts: opts}
+}
+
+// Call executes the view.
+// The view waits for the finality of the transaction, see AwaitFinality.
+// On success, it returns a *FinalityResult.
+func (a *awaitFinalityView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "awaitFinality", TxIDAttribute, a.txID)
+	defer func() { span.End(err) }()
+
+	agent := metrics.Get(context)
+	agent.EmitKey(0, "ttx", "start", "awaitFinalityView", a.txID)
+	defer agent.EmitKey(0, "ttx", "end", "awaitFinalityView", a.txID)
+
+	res, err := AwaitFinality(context, a.txID, a.timeout, a.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	return nil, nw.IsFinal(o.tx.ID())
+// AwaitFinality waits for the finality of the transaction with the passed id, for at most the passed timeout, if positive.
+// Only the id of the transaction is needed, then the transaction can have been broadcast earlier, or by another node.
+// Use WithNetwork and WithChannel to select the network the transaction has been broadcast to.
+// If the finality is not confirmed in time, it returns a *FinalityTimeoutError.
+func AwaitFinality(context view.Context, txID string, timeout time.Duration, opts ...TxOption) (*FinalityResult, error) {
+	options, err := compile(opts...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed compiling options")
+	}
+	nw := network.GetInstance(context, options.Network, options.Channel)
+	if nw == nil {
+		return nil, errors.Errorf("network [%s] not found", options.Network)
+	}
+	return awaitFinality(context, nw, txID, timeout)
+}
+
+// awaitFinality waits for the finality of the passed transaction on the passed network, see waitFinality,
+// and then looks up where it has been committed
+func awaitFinality(context view.Context, nw *network.Network, txID string, timeout time.Duration) (*FinalityResult, error) {
+	if err := waitFinality(context.Context(), txID, timeout, nw.IsFinalContext); err != nil {
+		return nil, err
+	}
+	return finalityResult(txID, nw.FinalityInfo), nil
+}
+
+// finalityResult returns the result for the passed final transaction, as reported by lookup.
+// The transaction is final, therefore a failure of the lookup is logged but not returned.
+func finalityResult(txID string, lookup func(txID string) (*network.FinalityInfo, error)) *FinalityResult {
+	res := &FinalityResult{TxID: txID, ValidationCode: network.Valid}
+	info, err := lookup(txID)
+	if err != nil {
+		logger.Warnf("transaction [%s] is final, but failed looking up where it has been committed: [%s]", txID, err)
+		return res
+	}
+	res.BlockNumber = info.BlockNumber
+	res.ValidationCode = info.ValidationCode
+	return res
+}
+
+// waitFinality waits for the finality of the passed transaction, as reported by isFinal, until the passed context is done
+// or, if positive, the timeout expires. In these cases, it returns a *FinalityTimeoutError.
+// isFinal is passed the context bounded by the timeout, and it must stop waiting once the context is done.
+func waitFinality(ctx context2.Context, txID string, timeout time.Duration, isFinal func(ctx context2.Context, txID string) error) error {
+	if ctx == nil {
+		ctx = context2.Background()
+	}
+	if timeout > 0 {
+		var cancel context2.CancelFunc
+		ctx, cancel = context2.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := isFinal(ctx, txID); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			return &FinalityTimeoutError{TxID: txID, Err: ctxErr}
+		}
+		return err
+	}
+	return nil
+}
+
+// IsTransientBroadcastError returns true if the passed broadcast failure is due to the connection with
+// the ordering service, and then the broadcast can be retried. These are:
+// the expiration of a deadline, the errors of the network connection, the end of the broadcast stream,
+// and the gRPC statuses telling that the ordering service is unavailable or did not answer in time.
+// Any other failure, like the rejection of the transaction, is considered terminal.
+func IsTransientBroadcastError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context2.DeadlineExceeded) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast calls send, retrying the transient failures as configured by the passed options.
+// The wait between the attempts is interrupted when the passed context is done.
+func broadcast(ctx context2.Context, txID string, opts *OrderingOptions, send func() error) error {
+	if ctx == nil {
+		ctx = context2.Background()
+	}
+	delay := opts.BroadcastInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		if attempt >= opts.BroadcastMaxAttempts || !opts.IsRetryable(err) {
+			if attempt == 1 {
+				return err
+			}
+			return errors.WithMessagef(err, "failed broadcasting transaction [%s] after [%d] attempts", txID, attempt)
+		}
+		logger.Warnf("failed broadcasting transaction [%s], attempt [%d] of [%d], retrying in [%s]: [%s]", txID, attempt, opts.BroadcastMaxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.WithMessagef(err, "failed broadcasting transaction [%s], retry interrupted [%s]", txID, ctx.Err())
+		}
+		delay = time.Duration(float64(delay) * opts.BroadcastMultiplier)
+	}
 }
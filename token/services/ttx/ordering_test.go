@@ -0,0 +1,140 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token/services/network"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWaitFinality(t *testing.T) {
+	final := func(context.Context, string) error { return nil }
+	invalid := func(_ context.Context, txID string) error {
+		return errors.Errorf("transaction [%s] is not valid", txID)
+	}
+	// pending waits until the context is done, and signals its return on stopped
+	stopped := make(chan struct{}, 1)
+	pending := func(ctx context.Context, _ string) error {
+		defer func() { stopped <- struct{}{} }()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	assert.NoError(t, waitFinality(context.Background(), "tx1", 0, final))
+	assert.NoError(t, waitFinality(nil, "tx1", time.Second, final))
+	assert.EqualError(t, waitFinality(context.Background(), "tx1", time.Second, invalid), "transaction [tx1] is not valid")
+
+	// the timeout expires, the wait stops
+	err := waitFinality(context.Background(), "tx1", 10*time.Millisecond, pending)
+	<-stopped
+	timeoutErr := &FinalityTimeoutError{}
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "tx1", timeoutErr.TxID)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.EqualError(t, err, "transaction [tx1] broadcast, but its finality has not been confirmed: context deadline exceeded")
+
+	// the context of the view is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = waitFinality(ctx, "tx2", 0, pending)
+	<-stopped
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// errors other than the one of the context are returned as they are
+	err = waitFinality(context.Background(), "tx3", 10*time.Millisecond, func(ctx context.Context, txID string) error {
+		<-ctx.Done()
+		return errors.Errorf("transaction [%s] is not valid", txID)
+	})
+	assert.EqualError(t, err, "transaction [tx3] is not valid")
+}
+
+func TestBroadcastRetry(t *testing.T) {
+	var attempts int
+	sender := func(errs ...error) func() error {
+		attempts = 0
+		return func() error {
+			attempts++
+			if attempts <= len(errs) {
+				return errs[attempts-1]
+			}
+			return nil
+		}
+	}
+	unavailable := errors.Wrap(status.Error(codes.Unavailable, "transport is closing"), "failed to send transaction to orderer")
+	rejected := errors.New("failed broadcasting, status BAD_REQUEST: MVCC_READ_CONFLICT")
+
+	// no retry by default
+	opts := compileOrderingOptions()
+	assert.Equal(t, unavailable, broadcast(context.Background(), "tx1", opts, sender(unavailable)))
+	assert.Equal(t, 1, attempts)
+
+	// transient failures are retried, with backoff
+	opts = compileOrderingOptions(WithBroadcastRetry(3, 5*time.Millisecond, 2))
+	start := time.Now()
+	assert.NoError(t, broadcast(context.Background(), "tx1", opts, sender(unavailable, unavailable)))
+	assert.Equal(t, 3, attempts)
+	assert.True(t, time.Since(start) >= 15*time.Millisecond)
+	err := broadcast(context.Background(), "tx1", opts, sender(unavailable, unavailable, unavailable))
+	assert.EqualError(t, err, "failed broadcasting transaction [tx1] after [3] attempts: "+unavailable.Error())
+	assert.Equal(t, 3, attempts)
+
+	// rejections are terminal
+	assert.Equal(t, rejected, broadcast(context.Background(), "tx1", opts, sender(rejected)))
+	assert.Equal(t, 1, attempts)
+	err = broadcast(context.Background(), "tx1", opts, sender(unavailable, rejected))
+	assert.EqualError(t, err, "failed broadcasting transaction [tx1] after [2] attempts: "+rejected.Error())
+
+	// the wait is interrupted by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts = compileOrderingOptions(WithBroadcastRetry(3, time.Hour, 2))
+	err = broadcast(ctx, "tx1", opts, sender(unavailable))
+	assert.EqualError(t, err, "failed broadcasting transaction [tx1], retry interrupted [context canceled]: "+unavailable.Error())
+
+	// custom classification
+	opts = compileOrderingOptions(WithBroadcastRetry(2, 0, 2), WithRetryableBroadcastErrors(func(error) bool { return true }))
+	assert.NoError(t, broadcast(context.Background(), "tx1", opts, sender(rejected)))
+}
+
+func TestIsTransientBroadcastError(t *testing.T) {
+	assert.False(t, IsTransientBroadcastError(nil))
+	assert.True(t, IsTransientBroadcastError(errors.Wrap(context.DeadlineExceeded, "failed broadcasting")))
+	assert.True(t, IsTransientBroadcastError(errors.Wrap(io.EOF, "failed to send transaction to orderer")))
+	assert.True(t, IsTransientBroadcastError(errors.WithMessage(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, "failed to connect to orderer")))
+	assert.True(t, IsTransientBroadcastError(errors.Wrapf(status.Error(codes.Unavailable, "transport is closing"), "broadcast recv error from orderer orderer0:7050")))
+	assert.True(t, IsTransientBroadcastError(errors.Wrap(status.Error(codes.DeadlineExceeded, "deadline"), "failed to new a broadcast")))
+	assert.False(t, IsTransientBroadcastError(errors.Wrap(status.Error(codes.PermissionDenied, "access denied"), "broadcast recv error from orderer orderer0:7050")))
+	// the messages do not matter
+	assert.False(t, IsTransientBroadcastError(errors.New("broadcast recv error from orderer orderer0:7050, Unavailable")))
+	assert.False(t, IsTransientBroadcastError(errors.New("invalid blob's type, got [string]")))
+}
+
+func TestFinalityResult(t *testing.T) {
+	res := finalityResult("tx1", func(txID string) (*network.FinalityInfo, error) {
+		return &network.FinalityInfo{BlockNumber: 42, ValidationCode: network.Valid}, nil
+	})
+	assert.Equal(t, &FinalityResult{TxID: "tx1", BlockNumber: 42, ValidationCode: network.Valid}, res)
+
+	// the transaction is final even if the lookup fails
+	res = finalityResult("tx1", func(txID string) (*network.FinalityInfo, error) {
+		return nil, errors.New("peer unreachable")
+	})
+	assert.Equal(t, &FinalityResult{TxID: "tx1", ValidationCode: network.Valid}, res)
+}
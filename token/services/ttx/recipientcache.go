@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+// RecipientIdentityCacheTTLParam is the key of the token.ServiceOptions parameter
+// holding the time to live of the recipient identities cached by RequestRecipientIdentity
+const RecipientIdentityCacheTTLParam = "ttx.RecipientIdentityCacheTTL"
+
+// WithRecipientIdentityCache lets RequestRecipientIdentity reuse, for at most the passed time to live,
+// the identity received by a previous request to the same recipient for the same TMS and wallet.
+// A non-positive time to live forces a fresh request, which is also the default.
+func WithRecipientIdentityCache(ttl time.Duration) token.ServiceOption {
+	return token.WithParam(RecipientIdentityCacheTTLParam, ttl)
+}
+
+// recipientIdentityCacheTTL returns the time to live set by WithRecipientIdentityCache, zero if not set
+func recipientIdentityCacheTTL(options *token.ServiceOptions) time.Duration {
+	ttl, ok := options.Params[RecipientIdentityCacheTTLParam].(time.Duration)
+	if !ok {
+		return 0
+	}
+	return ttl
+}
+
+type cachedRecipientIdentity struct {
+	identity view.Identity
+	expiry   time.Time
+}
+
+// recipientIdentityCache stores the recipient identities received from the recipients, by TMS, wallet, and recipient
+type recipientIdentityCache struct {
+	lock    sync.Mutex
+	entries map[string]*cachedRecipientIdentity
+	now     func() time.Time
+}
+
+var recipientIdentities = newRecipientIdentityCache()
+
+func newRecipientIdentityCache() *recipientIdentityCache {
+	return &recipientIdentityCache{entries: map[string]*cachedRecipientIdentity{}, now: time.Now}
+}
+
+// Get returns the identity cached for the passed wallet of the passed recipient, if not expired
+func (c *recipientIdentityCache) Get(tmsID token.TMSID, walletID string, recipient view.Identity) (view.Identity, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := c.key(tmsID, walletID, recipient)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.identity, true
+}
+
+// Put caches the passed identity of the passed wallet of the passed recipient for the passed time to live.
+// The expired entries are evicted.
+func (c *recipientIdentityCache) Put(tmsID token.TMSID, walletID string, recipient view.Identity, identity view.Identity, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[c.key(tmsID, walletID, recipient)] = &cachedRecipientIdentity{identity: identity, expiry: now.Add(ttl)}
+}
+
+// key returns the key of the entry of the passed wallet of the passed recipient.
+// The parts are separated, so that different parts cannot give the same key.
+func (c *recipientIdentityCache) key(tmsID token.TMSID, walletID string, recipient view.Identity) string {
+	return tmsID.String() + "\x00" + walletID + "\x00" + recipient.UniqueID()
+}
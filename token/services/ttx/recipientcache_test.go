@@ -0,0 +1,87 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+func TestRecipientIdentityCache(t *testing.T) {
+	now := time.Now()
+	c := newRecipientIdentityCache()
+	c.now = func() time.Time { return now }
+
+	tms1 := token.TMSID{Network: "n", Channel: "c", Namespace: "ns1"}
+	tms2 := token.TMSID{Network: "n", Channel: "c", Namespace: "ns2"}
+	alice := view.Identity("alice")
+
+	_, ok := c.Get(tms1, "", alice)
+	assert.False(t, ok)
+
+	c.Put(tms1, "", alice, view.Identity("pseudonym"), time.Minute)
+	id, ok := c.Get(tms1, "", alice)
+	assert.True(t, ok)
+	assert.Equal(t, view.Identity("pseudonym"), id)
+
+	// entries are scoped by TMS, wallet, and recipient
+	_, ok = c.Get(tms2, "", alice)
+	assert.False(t, ok)
+	_, ok = c.Get(tms1, "", view.Identity("bob"))
+	assert.False(t, ok)
+	_, ok = c.Get(tms1, "savings", alice)
+	assert.False(t, ok)
+
+	// two wallets of the same recipient do not share the entry
+	c.Put(tms1, "savings", alice, view.Identity("savings pseudonym"), time.Minute)
+	id, ok = c.Get(tms1, "savings", alice)
+	assert.True(t, ok)
+	assert.Equal(t, view.Identity("savings pseudonym"), id)
+	id, ok = c.Get(tms1, "", alice)
+	assert.True(t, ok)
+	assert.Equal(t, view.Identity("pseudonym"), id)
+	_, ok = c.Get(tms1, "checking", alice)
+	assert.False(t, ok)
+
+	// the parts of the key are separated
+	c.Put(tms1, "a", view.Identity("bc"), view.Identity("pseudonym of bc"), time.Minute)
+	_, ok = c.Get(tms1, "ab", view.Identity("c"))
+	assert.False(t, ok)
+
+	// expired entries are evicted
+	now = now.Add(time.Minute)
+	_, ok = c.Get(tms1, "", alice)
+	assert.False(t, ok)
+	assert.NotContains(t, c.entries, c.key(tms1, "", alice))
+	assert.Len(t, c.entries, 2)
+
+	c.Put(tms1, "", alice, view.Identity("pseudonym"), time.Second)
+	now = now.Add(time.Second)
+	c.Put(tms2, "", alice, view.Identity("pseudonym2"), time.Second)
+	assert.Len(t, c.entries, 1)
+}
+
+func TestRecipientIdentityCacheTTL(t *testing.T) {
+	options, err := token.CompileServiceOptions(token.WithNetwork("n"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), recipientIdentityCacheTTL(options))
+
+	options, err = token.CompileServiceOptions(token.WithNetwork("n"), WithRecipientIdentityCache(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, recipientIdentityCacheTTL(options))
+	assert.Equal(t, "n", options.TMSID().Network)
+	assert.Equal(t, "", recipientWallet(options))
+
+	options, err = token.CompileServiceOptions(WithRecipientWallet("savings"))
+	assert.NoError(t, err)
+	assert.Equal(t, "savings", recipientWallet(options))
+}
@@ -7,6 +7,8 @@ SPDX-License-Identifier: Apache-2.0
 package ttx
 
 import (
+	context2 "context"
+	"fmt"
 	"time"
 
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/tracker/metrics"
@@ -20,15 +22,141 @@ import (
 	"github.com/hyperledger-labs/fabric-token-sdk/token"
 )
 
-func compileServiceOptions(opts ...token.ServiceOption) (*token.TMSID, error) {
-	txOptions := &token.ServiceOptions{}
-	for _, opt := range opts {
-		if err := opt(txOptions); err != nil {
-			return nil, err
+const (
+	// RecipientExchangeTimeoutParam is the key of the token.ServiceOptions parameter holding the time
+	// to wait for the counterparty of a recipient identity exchange to reply
+	RecipientExchangeTimeoutParam = "ttx.RecipientExchangeTimeout"
+	// RecipientWalletParam is the key of the token.ServiceOptions parameter holding the id of the wallet
+	// of the recipient to take the identity from
+	RecipientWalletParam = "ttx.RecipientWallet"
+
+	// defaultRequestRecipientTimeout is the time to wait for the identities requested to a recipient
+	defaultRequestRecipientTimeout = 60 * time.Second
+	// defaultExchangeRecipientTimeout is the time to wait for the identity of the counterparty of an exchange
+	defaultExchangeRecipientTimeout = 30 * time.Second
+)
+
+// WithRecipientExchangeTimeout bounds the time to wait for the counterparty of RequestRecipientIdentity,
+// RequestRecipientIdentities, and ExchangeRecipientIdentities to reply.
+// On timeout, the functions return a *CounterpartyUnreachableError.
+func WithRecipientExchangeTimeout(timeout time.Duration) token.ServiceOption {
+	return token.WithParam(RecipientExchangeTimeoutParam, timeout)
+}
+
+// recipientExchangeTimeout returns the timeout set by WithRecipientExchangeTimeout, zero if not set
+func recipientExchangeTimeout(options *token.ServiceOptions) time.Duration {
+	timeout, ok := options.Params[RecipientExchangeTimeoutParam].(time.Duration)
+	if !ok {
+		return 0
+	}
+	return timeout
+}
+
+// WithRecipientWallet asks RequestRecipientIdentity for an identity of the passed wallet of the recipient.
+// By default, the recipient chooses the wallet by the identity it is contacted with.
+func WithRecipientWallet(walletID string) token.ServiceOption {
+	return token.WithParam(RecipientWalletParam, walletID)
+}
+
+// recipientWallet returns the wallet id set by WithRecipientWallet, empty if not set
+func recipientWallet(options *token.ServiceOptions) string {
+	walletID, ok := options.Params[RecipientWalletParam].(string)
+	if !ok {
+		return ""
+	}
+	return walletID
+}
+
+// CounterpartyUnreachableError is returned when the counterparty of a recipient identity exchange
+// cannot be contacted or does not reply in time
+type CounterpartyUnreachableError struct {
+	// Counterparty is the identity of the counterparty
+	Counterparty view.Identity
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *CounterpartyUnreachableError) Error() string {
+	return fmt.Sprintf("counterparty [%s] unreachable: %s", e.Counterparty, e.Err)
+}
+
+func (e *CounterpartyUnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// CounterpartyRefusedError is returned when the counterparty of a recipient identity exchange
+// replies with an error
+type CounterpartyRefusedError struct {
+	// Counterparty is the identity of the counterparty
+	Counterparty view.Identity
+	// Reason is the error sent by the counterparty
+	Reason string
+}
+
+func (e *CounterpartyRefusedError) Error() string {
+	return fmt.Sprintf("counterparty [%s] refused: %s", e.Counterparty, e.Reason)
+}
+
+// sendToCounterparty opens a session with the counterparty and sends the passed request.
+// It returns a *CounterpartyUnreachableError if the counterparty cannot be contacted.
+func sendToCounterparty(context view.Context, counterparty view.Identity, request []byte) (view.Session, error) {
+	session, err := context.GetSession(context.Initiator(), counterparty)
+	if err != nil {
+		return nil, &CounterpartyUnreachableError{Counterparty: counterparty, Err: errors.Wrap(err, "failed to get session")}
+	}
+	if err := session.Send(request); err != nil {
+		return nil, &CounterpartyUnreachableError{Counterparty: counterparty, Err: errors.Wrap(err, "failed to send request")}
+	}
+	return session, nil
+}
+
+// receiveFromCounterparty waits for the reply of the counterparty on the passed session, for at most
+// the passed timeout or until the passed context is done. In these cases, it returns a *CounterpartyUnreachableError.
+// If the counterparty replies with an error, it returns a *CounterpartyRefusedError.
+func receiveFromCounterparty(ctx context2.Context, session view.Session, counterparty view.Identity, timeout time.Duration) ([]byte, error) {
+	if ctx == nil {
+		ctx = context2.Background()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-session.Receive():
+		if msg == nil {
+			return nil, &CounterpartyUnreachableError{Counterparty: counterparty, Err: errors.New("session closed")}
+		}
+		if msg.Status == view.ERROR {
+			return nil, &CounterpartyRefusedError{Counterparty: counterparty, Reason: string(msg.Payload)}
 		}
+		return msg.Payload, nil
+	case <-timer.C:
+		return nil, &CounterpartyUnreachableError{Counterparty: counterparty, Err: errors.Errorf("no reply within [%s]", timeout)}
+	case <-ctx.Done():
+		return nil, &CounterpartyUnreachableError{Counterparty: counterparty, Err: ctx.Err()}
 	}
-	id := txOptions.TMSID()
-	return &id, nil
+}
+
+// WalletSelector returns the identifier of the wallet to respond from to the passed caller.
+// An empty identifier stands for the wallet requested by the caller, if any, or the default wallet.
+type WalletSelector func(caller view.Identity) (walletID string)
+
+// selectWallet returns the wallet to respond from to the passed caller: the passed wallet, if not empty,
+// then the one chosen by the passed selector, if any, and finally the wallet requested by the caller
+func selectWallet(wallet string, selector WalletSelector, caller view.Identity, requested []byte) string {
+	if len(wallet) == 0 && selector != nil {
+		wallet = selector(caller)
+	}
+	if len(wallet) == 0 && len(requested) != 0 {
+		wallet = string(requested)
+	}
+	return wallet
+}
+
+// timeoutOrDefault returns the passed timeout, if positive, the passed default otherwise
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return def
 }
 
 type RecipientData struct {
@@ -75,24 +203,57 @@ func (r *RecipientRequest) FromBytes(raw []byte) error {
 type RequestRecipientIdentityView struct {
 	TMSID token.TMSID
 	Other view.Identity
+	// WalletID is the id of the wallet of the recipient to take the identity from.
+	// If empty, the recipient chooses the wallet by Other.
+	WalletID string
+	// Timeout bounds the wait for the reply of the recipient. If not positive, a default of 60 seconds applies.
+	Timeout time.Duration
 }
 
 // RequestRecipientIdentity executes the RequestRecipientIdentityView.
 // The sender contacts the recipient's FSC node identified via the passed view identity.
 // The sender gets back the identity the recipient wants to use to assign ownership of tokens.
+// Use WithRecipientWallet to select the wallet of the recipient.
+// By default, each call contacts the recipient. Use WithRecipientIdentityCache to reuse a recently received identity.
+// Use WithRecipientExchangeTimeout to bound the wait for the recipient.
+// If the recipient cannot be contacted in time, the function returns a *CounterpartyUnreachableError,
+// if it replies with an error, a *CounterpartyRefusedError.
 func RequestRecipientIdentity(context view.Context, recipient view.Identity, opts ...token.ServiceOption) (view.Identity, error) {
-	tmsID, err := compileServiceOptions(opts...)
+	options, err := token.CompileServiceOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
-	pseudonymBoxed, err := context.RunView(&RequestRecipientIdentityView{TMSID: *tmsID, Other: recipient})
+	tmsID := options.TMSID()
+	walletID := recipientWallet(options)
+	ttl := recipientIdentityCacheTTL(options)
+	if ttl > 0 {
+		if id, ok := recipientIdentities.Get(tmsID, walletID, recipient); ok {
+			if logger.IsEnabledFor(zapcore.DebugLevel) {
+				logger.Debugf("reuse cached recipient identity [%s] of [%s] for TMS [%s]", id, recipient, tmsID)
+			}
+			return id, nil
+		}
+	}
+	pseudonymBoxed, err := context.RunView(&RequestRecipientIdentityView{
+		TMSID:    tmsID,
+		Other:    recipient,
+		WalletID: walletID,
+		Timeout:  recipientExchangeTimeout(options),
+	})
 	if err != nil {
 		return nil, err
 	}
-	return pseudonymBoxed.(view.Identity), nil
+	id := pseudonymBoxed.(view.Identity)
+	if ttl > 0 {
+		recipientIdentities.Put(tmsID, walletID, recipient, id, ttl)
+	}
+	return id, nil
 }
 
-func (f *RequestRecipientIdentityView) Call(context view.Context) (interface{}, error) {
+func (f *RequestRecipientIdentityView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "requestRecipientIdentity", ContextIDAttribute, context.ID())
+	defer func() { span.End(err) }()
+
 	agent := metrics.Get(context)
 	agent.EmitKey(0, "ttx", "start", "RequestRecipientIdentityView", context.ID())
 	defer agent.EmitKey(0, "ttx", "end", "RequestRecipientIdentityView", context.ID())
@@ -116,36 +277,30 @@ func (f *RequestRecipientIdentityView) Call(context view.Context) (interface{},
 		if logger.IsEnabledFor(zapcore.DebugLevel) {
 			logger.Debugf("request recipient [%s] is not registered", f.Other)
 		}
-		session, err := context.GetSession(context.Initiator(), f.Other)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get session with [%s]", f.Other)
-		}
-
 		// Ask for identity
 		rr := &RecipientRequest{
 			TMSID:    f.TMSID,
 			WalletID: f.Other,
 		}
+		if len(f.WalletID) != 0 {
+			rr.WalletID = []byte(f.WalletID)
+		}
 		rrRaw, err := rr.Bytes()
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed marshalling recipient request")
 		}
-		err = session.Send(rrRaw)
+		session, err := sendToCounterparty(context, f.Other, rrRaw)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to send recipient request")
+			return nil, err
 		}
 		agent.EmitKey(0, "ttx", "sent", "requestRecipientIdentity", session.Info().ID)
 
 		// Wait to receive a view identity
-		ch := session.Receive()
-		var payload []byte
-		select {
-		case msg := <-ch:
-			payload = msg.Payload
-			agent.EmitKey(0, "ttx", "received", "responseRecipientIdentity", session.Info().ID)
-		case <-time.After(60 * time.Second):
-			return nil, errors.New("time out reached")
+		payload, err := receiveFromCounterparty(context.Context(), session, f.Other, timeoutOrDefault(f.Timeout, defaultRequestRecipientTimeout))
+		if err != nil {
+			return nil, err
 		}
+		agent.EmitKey(0, "ttx", "received", "responseRecipientIdentity", session.Info().ID)
 
 		recipientData := &RecipientData{}
 		if err := recipientData.FromBytes(payload); err != nil {
@@ -174,13 +329,31 @@ func (f *RequestRecipientIdentityView) Call(context view.Context) (interface{},
 
 type RespondRequestRecipientIdentityView struct {
 	Wallet string
+	// Selector chooses the wallet based on the caller, when Wallet is empty
+	Selector WalletSelector
 }
 
 // RespondRequestRecipientIdentity executes the RespondRequestRecipientIdentityView.
 // The recipient sends back the identity to receive ownership of tokens.
 // The identity is taken from the wallet
 func RespondRequestRecipientIdentity(context view.Context) (view.Identity, error) {
-	id, err := context.RunView(&RespondRequestRecipientIdentityView{})
+	return respondRequestRecipientIdentity(context, &RespondRequestRecipientIdentityView{})
+}
+
+// RespondRequestRecipientIdentityUsingWallet is like RespondRequestRecipientIdentity,
+// but the identity is taken from the passed wallet
+func RespondRequestRecipientIdentityUsingWallet(context view.Context, wallet string) (view.Identity, error) {
+	return respondRequestRecipientIdentity(context, &RespondRequestRecipientIdentityView{Wallet: wallet})
+}
+
+// RespondRequestRecipientIdentityUsingSelector is like RespondRequestRecipientIdentity,
+// but the identity is taken from the wallet the passed selector chooses for the caller
+func RespondRequestRecipientIdentityUsingSelector(context view.Context, selector WalletSelector) (view.Identity, error) {
+	return respondRequestRecipientIdentity(context, &RespondRequestRecipientIdentityView{Selector: selector})
+}
+
+func respondRequestRecipientIdentity(context view.Context, v *RespondRequestRecipientIdentityView) (view.Identity, error) {
+	id, err := context.RunView(v)
 	if err != nil {
 		return nil, err
 	}
@@ -205,10 +378,7 @@ func (s *RespondRequestRecipientIdentityView) Call(context view.Context) (interf
 		return nil, errors.Wrapf(err, "failed to umarshal recipient request")
 	}
 
-	wallet := s.Wallet
-	if len(wallet) == 0 && len(recipientRequest.WalletID) != 0 {
-		wallet = string(recipientRequest.WalletID)
-	}
+	wallet := selectWallet(s.Wallet, s.Selector, session.Info().Caller, recipientRequest.WalletID)
 	w := GetWallet(
 		context,
 		wallet,
@@ -266,13 +436,267 @@ func (s *RespondRequestRecipientIdentityView) Call(context view.Context) (interf
 	return recipientIdentity, nil
 }
 
+type RecipientsRequest struct {
+	TMSID    token.TMSID
+	WalletID []byte
+	Count    int
+}
+
+func (r *RecipientsRequest) Bytes() ([]byte, error) {
+	return Marshal(r)
+}
+
+func (r *RecipientsRequest) FromBytes(raw []byte) error {
+	return Unmarshal(raw, r)
+}
+
+type RecipientsData struct {
+	Recipients []*RecipientData
+}
+
+func (r *RecipientsData) Bytes() ([]byte, error) {
+	return Marshal(r)
+}
+
+func (r *RecipientsData) FromBytes(raw []byte) error {
+	return Unmarshal(raw, r)
+}
+
+type RequestRecipientIdentitiesView struct {
+	TMSID token.TMSID
+	Other view.Identity
+	Count int
+	// Timeout bounds the wait for the reply of the recipient. If not positive, a default of 60 seconds applies.
+	Timeout time.Duration
+}
+
+// RequestRecipientIdentities executes the RequestRecipientIdentitiesView.
+// The sender contacts the recipient's FSC node identified via the passed view identity.
+// The sender gets back, in a single round-trip, the passed number of identities the recipient wants to use
+// to assign ownership of tokens. The recipient is expected to respond with RespondRequestRecipientIdentities.
+// Use WithRecipientExchangeTimeout to bound the wait for the recipient, see RequestRecipientIdentity.
+func RequestRecipientIdentities(context view.Context, recipient view.Identity, count int, opts ...token.ServiceOption) ([]view.Identity, error) {
+	if count <= 0 {
+		return nil, errors.Errorf("invalid number of recipient identities [%d], must be positive", count)
+	}
+	options, err := token.CompileServiceOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	pseudonymsBoxed, err := context.RunView(&RequestRecipientIdentitiesView{
+		TMSID:   options.TMSID(),
+		Other:   recipient,
+		Count:   count,
+		Timeout: recipientExchangeTimeout(options),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pseudonymsBoxed.([]view.Identity), nil
+}
+
+func (f *RequestRecipientIdentitiesView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "requestRecipientIdentities", ContextIDAttribute, context.ID())
+	defer func() { span.End(err) }()
+
+	agent := metrics.Get(context)
+	agent.EmitKey(0, "ttx", "start", "RequestRecipientIdentitiesView", context.ID())
+	defer agent.EmitKey(0, "ttx", "end", "RequestRecipientIdentitiesView", context.ID())
+
+	if logger.IsEnabledFor(zapcore.DebugLevel) {
+		logger.Debugf("request [%d] recipients to [%s] for TMS [%s]", f.Count, f.Other, f.TMSID)
+	}
+
+	tms := token.GetManagementService(context, token.WithTMSID(f.TMSID))
+
+	if w := tms.WalletManager().OwnerWalletByIdentity(f.Other); w != nil {
+		if logger.IsEnabledFor(zapcore.DebugLevel) {
+			logger.Debugf("request recipient [%s] is already registered", f.Other)
+		}
+		recipients := make([]view.Identity, f.Count)
+		for i := range recipients {
+			if recipients[i], err = w.GetRecipientIdentity(); err != nil {
+				return nil, errors.Wrapf(err, "failed to get recipient identity from wallet [%s]", w.ID())
+			}
+		}
+		return recipients, nil
+	}
+
+	if logger.IsEnabledFor(zapcore.DebugLevel) {
+		logger.Debugf("request recipient [%s] is not registered", f.Other)
+	}
+	// Ask for identities
+	rr := &RecipientsRequest{
+		TMSID:    f.TMSID,
+		WalletID: f.Other,
+		Count:    f.Count,
+	}
+	rrRaw, err := rr.Bytes()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed marshalling recipients request")
+	}
+	session, err := sendToCounterparty(context, f.Other, rrRaw)
+	if err != nil {
+		return nil, err
+	}
+	agent.EmitKey(0, "ttx", "sent", "requestRecipientIdentities", session.Info().ID)
+
+	// Wait to receive the view identities
+	payload, err := receiveFromCounterparty(context.Context(), session, f.Other, timeoutOrDefault(f.Timeout, defaultRequestRecipientTimeout))
+	if err != nil {
+		return nil, err
+	}
+	agent.EmitKey(0, "ttx", "received", "responseRecipientIdentities", session.Info().ID)
+
+	recipientsData := &RecipientsData{}
+	if err := recipientsData.FromBytes(payload); err != nil {
+		logger.Errorf("failed to unmarshal recipients data: [%s][%s]", payload, err)
+		return nil, errors.Wrapf(err, "failed to unmarshal recipients data")
+	}
+	if len(recipientsData.Recipients) != f.Count {
+		return nil, errors.Errorf("expected [%d] recipient identities, got [%d]", f.Count, len(recipientsData.Recipients))
+	}
+	resolver := view2.GetEndpointService(context)
+	recipients := make([]view.Identity, f.Count)
+	for i, recipientData := range recipientsData.Recipients {
+		if recipientData == nil {
+			return nil, errors.Errorf("recipient identity [%d] is missing", i)
+		}
+		if err := tms.WalletManager().RegisterRecipientIdentity(recipientData.Identity, recipientData.AuditInfo, recipientData.Metadata); err != nil {
+			logger.Errorf("failed to register recipient identity: [%s]", err)
+			return nil, errors.Wrapf(err, "failed to register recipient identity [%d]", i)
+		}
+
+		// Update the Endpoint Resolver
+		if err := resolver.Bind(f.Other, recipientData.Identity); err != nil {
+			return nil, errors.Wrapf(err, "failed binding [%s] to [%s]", recipientData.Identity, f.Other)
+		}
+		recipients[i] = recipientData.Identity
+	}
+
+	return recipients, nil
+}
+
+type RespondRequestRecipientIdentitiesView struct {
+	Wallet string
+	// Selector chooses the wallet based on the caller, when Wallet is empty
+	Selector WalletSelector
+}
+
+// RespondRequestRecipientIdentities executes the RespondRequestRecipientIdentitiesView.
+// The recipient sends back, in a single message, the requested number of identities to receive ownership of tokens.
+// The identities are taken from the wallet
+func RespondRequestRecipientIdentities(context view.Context) ([]view.Identity, error) {
+	return respondRequestRecipientIdentities(context, &RespondRequestRecipientIdentitiesView{})
+}
+
+// RespondRequestRecipientIdentitiesUsingSelector is like RespondRequestRecipientIdentities,
+// but the identities are taken from the wallet the passed selector chooses for the caller
+func RespondRequestRecipientIdentitiesUsingSelector(context view.Context, selector WalletSelector) ([]view.Identity, error) {
+	return respondRequestRecipientIdentities(context, &RespondRequestRecipientIdentitiesView{Selector: selector})
+}
+
+func respondRequestRecipientIdentities(context view.Context, v *RespondRequestRecipientIdentitiesView) ([]view.Identity, error) {
+	ids, err := context.RunView(v)
+	if err != nil {
+		return nil, err
+	}
+	return ids.([]view.Identity), nil
+}
+
+func (s *RespondRequestRecipientIdentitiesView) Call(context view.Context) (interface{}, error) {
+	agent := metrics.Get(context)
+	agent.EmitKey(0, "ttx", "start", "RespondRequestRecipientIdentitiesView", context.ID())
+	defer agent.EmitKey(0, "ttx", "end", "RespondRequestRecipientIdentitiesView", context.ID())
+
+	session, payload, err := session2.ReadFirstMessage(context)
+	if err != nil {
+		logger.Errorf("failed to read first message: [%s]", err)
+		return nil, errors.Wrapf(err, "failed to read first message")
+	}
+	agent.EmitKey(0, "ttx", "received", "requestRecipientIdentities", session.Info().ID)
+
+	recipientsRequest := &RecipientsRequest{}
+	if err := recipientsRequest.FromBytes(payload); err != nil {
+		logger.Errorf("failed to unmarshal recipients request: [%s][%s]", payload, err)
+		return nil, errors.Wrapf(err, "failed to umarshal recipients request")
+	}
+	if recipientsRequest.Count <= 0 {
+		return nil, errors.Errorf("invalid number of recipient identities [%d], must be positive", recipientsRequest.Count)
+	}
+
+	wallet := selectWallet(s.Wallet, s.Selector, session.Info().Caller, recipientsRequest.WalletID)
+	w := GetWallet(
+		context,
+		wallet,
+		token.WithTMSID(recipientsRequest.TMSID),
+	)
+	if w == nil {
+		logger.Errorf("failed to get wallet [%s]", wallet)
+		return nil, errors.Errorf("wallet [%s:%s] not found", wallet, recipientsRequest.TMSID)
+	}
+	recipientsData := &RecipientsData{Recipients: make([]*RecipientData, recipientsRequest.Count)}
+	recipients := make([]view.Identity, recipientsRequest.Count)
+	for i := range recipients {
+		recipientIdentity, err := w.GetRecipientIdentity()
+		if err != nil {
+			logger.Errorf("failed to get recipient identity: [%s]", err)
+			return nil, errors.Wrapf(err, "failed to get recipient identity")
+		}
+		auditInfo, err := w.GetAuditInfo(recipientIdentity)
+		if err != nil {
+			logger.Errorf("failed to get audit info: [%s]", err)
+			return nil, errors.Wrapf(err, "failed to get audit info")
+		}
+		metadata, err := w.GetTokenMetadata(recipientIdentity)
+		if err != nil {
+			logger.Errorf("failed to get token metadata: [%s]", err)
+			return nil, errors.Wrapf(err, "failed to get token metadata")
+		}
+		recipientsData.Recipients[i] = &RecipientData{
+			Identity:  recipientIdentity,
+			AuditInfo: auditInfo,
+			Metadata:  metadata,
+		}
+		recipients[i] = recipientIdentity
+	}
+	recipientsDataRaw, err := recipientsData.Bytes()
+	if err != nil {
+		logger.Errorf("failed to marshal recipients data: [%s]", err)
+		return nil, errors.Wrapf(err, "failed marshalling recipients data")
+	}
+
+	// Send the public keys back to the invoker
+	if err := session.Send(recipientsDataRaw); err != nil {
+		logger.Errorf("failed to send recipients data: [%s]", err)
+		return nil, errors.Wrapf(err, "failed to send recipients data")
+	}
+	agent.EmitKey(0, "ttx", "sent", "responseRecipientIdentities", session.Info().ID)
+
+	// Update the Endpoint Resolver
+	resolver := view2.GetEndpointService(context)
+	for _, recipientIdentity := range recipients {
+		if err := resolver.Bind(context.Me(), recipientIdentity); err != nil {
+			logger.Errorf("failed binding [%s] to [%s]", context.Me(), recipientIdentity)
+			return nil, errors.Wrapf(err, "failed to bind me to recipient identity")
+		}
+	}
+
+	return recipients, nil
+}
+
 type ExchangeRecipientIdentitiesView struct {
 	TMSID  token.TMSID
 	Wallet string
 	Other  view.Identity
+	// Timeout bounds the wait for the reply of the counterparty. If not positive, a default of 30 seconds applies.
+	Timeout time.Duration
 }
 
-func (f *ExchangeRecipientIdentitiesView) Call(context view.Context) (interface{}, error) {
+func (f *ExchangeRecipientIdentitiesView) Call(context view.Context) (_ interface{}, err error) {
+	span, context := startSpan(context, "exchangeRecipientIdentities", ContextIDAttribute, context.ID())
+	defer func() { span.End(err) }()
+
 	ts := token.GetManagementService(context, token.WithTMSID(f.TMSID))
 
 	if w := ts.WalletManager().OwnerWalletByIdentity(f.Other); w != nil {
@@ -288,11 +712,6 @@ func (f *ExchangeRecipientIdentitiesView) Call(context view.Context) (interface{
 
 		return []view.Identity{me, other}, nil
 	} else {
-		session, err := context.GetSession(context.Initiator(), f.Other)
-		if err != nil {
-			return nil, err
-		}
-
 		w := ts.WalletManager().OwnerWallet(f.Wallet)
 		me, err := w.GetRecipientIdentity()
 		if err != nil {
@@ -320,12 +739,13 @@ func (f *ExchangeRecipientIdentitiesView) Call(context view.Context) (interface{
 		if err != nil {
 			return nil, err
 		}
-		if err := session.Send(requestRaw); err != nil {
+		session, err := sendToCounterparty(context, f.Other, requestRaw)
+		if err != nil {
 			return nil, err
 		}
 
 		// Wait to receive a view identity
-		payload, err := session2.ReadMessageWithTimeout(session, 30*time.Second)
+		payload, err := receiveFromCounterparty(context.Context(), session, f.Other, timeoutOrDefault(f.Timeout, defaultExchangeRecipientTimeout))
 		if err != nil {
 			return nil, err
 		}
@@ -362,16 +782,18 @@ func (f *ExchangeRecipientIdentitiesView) Call(context view.Context) (interface{
 
 // ExchangeRecipientIdentities executes the ExchangeRecipientIdentitiesView using by passed wallet id to
 // derive the recipient identity to send to the passed recipient.
-// The function returns, the recipient identity of the sender, the recipient identity of the recipient
+// The function returns, the recipient identity of the sender, the recipient identity of the recipient.
+// Use WithRecipientExchangeTimeout to bound the wait for the recipient, see RequestRecipientIdentity.
 func ExchangeRecipientIdentities(context view.Context, walletID string, recipient view.Identity, opts ...token.ServiceOption) (view.Identity, view.Identity, error) {
-	tmsID, err := compileServiceOptions(opts...)
+	options, err := token.CompileServiceOptions(opts...)
 	if err != nil {
 		return nil, nil, err
 	}
 	ids, err := context.RunView(&ExchangeRecipientIdentitiesView{
-		TMSID:  *tmsID,
-		Wallet: walletID,
-		Other:  recipient,
+		TMSID:   options.TMSID(),
+		Wallet:  walletID,
+		Other:   recipient,
+		Timeout: recipientExchangeTimeout(options),
 	})
 	if err != nil {
 		return nil, nil, err
@@ -382,13 +804,31 @@ func ExchangeRecipientIdentities(context view.Context, walletID string, recipien
 
 type RespondExchangeRecipientIdentitiesView struct {
 	Wallet string
+	// Selector chooses the wallet based on the caller, when Wallet is empty
+	Selector WalletSelector
 }
 
 // RespondExchangeRecipientIdentities executes the RespondExchangeRecipientIdentitiesView.
 // The recipient sends back the identity to receive ownership of tokens.
 // The identity is taken from the default wallet
 func RespondExchangeRecipientIdentities(context view.Context) (view.Identity, view.Identity, error) {
-	ids, err := context.RunView(&RespondExchangeRecipientIdentitiesView{})
+	return respondExchangeRecipientIdentities(context, &RespondExchangeRecipientIdentitiesView{})
+}
+
+// RespondExchangeRecipientIdentitiesUsingWallet is like RespondExchangeRecipientIdentities,
+// but the identity is taken from the passed wallet
+func RespondExchangeRecipientIdentitiesUsingWallet(context view.Context, wallet string) (view.Identity, view.Identity, error) {
+	return respondExchangeRecipientIdentities(context, &RespondExchangeRecipientIdentitiesView{Wallet: wallet})
+}
+
+// RespondExchangeRecipientIdentitiesUsingSelector is like RespondExchangeRecipientIdentities,
+// but the identity is taken from the wallet the passed selector chooses for the caller
+func RespondExchangeRecipientIdentitiesUsingSelector(context view.Context, selector WalletSelector) (view.Identity, view.Identity, error) {
+	return respondExchangeRecipientIdentities(context, &RespondExchangeRecipientIdentitiesView{Selector: selector})
+}
+
+func respondExchangeRecipientIdentities(context view.Context, v *RespondExchangeRecipientIdentitiesView) (view.Identity, view.Identity, error) {
+	ids, err := context.RunView(v)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -415,11 +855,11 @@ func (s *RespondExchangeRecipientIdentitiesView) Call(context view.Context) (int
 	}
 
 	// me
-	wallet := s.Wallet
-	if len(wallet) == 0 && len(request.WalletID) != 0 {
-		wallet = string(request.WalletID)
-	}
+	wallet := selectWallet(s.Wallet, s.Selector, session.Info().Caller, request.WalletID)
 	w := ts.WalletManager().OwnerWallet(wallet)
+	if w == nil {
+		return nil, errors.Errorf("wallet [%s:%s] not found", wallet, request.TMSID)
+	}
 	me, err := w.GetRecipientIdentity()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,112 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hyperledger-labs/fabric-token-sdk/token"
+)
+
+func TestRequestRecipientIdentitiesCount(t *testing.T) {
+	_, err := RequestRecipientIdentities(nil, view.Identity("alice"), 0)
+	assert.EqualError(t, err, "invalid number of recipient identities [0], must be positive")
+}
+
+func TestRecipientsDataRoundTrip(t *testing.T) {
+	request := &RecipientsRequest{TMSID: token.TMSID{Network: "n"}, WalletID: []byte("alice"), Count: 2}
+	raw, err := request.Bytes()
+	assert.NoError(t, err)
+	request2 := &RecipientsRequest{}
+	assert.NoError(t, request2.FromBytes(raw))
+	assert.Equal(t, request, request2)
+
+	data := &RecipientsData{Recipients: []*RecipientData{
+		{Identity: view.Identity("id1"), AuditInfo: []byte("ai1")},
+		{Identity: view.Identity("id2"), Metadata: []byte("md2")},
+	}}
+	raw, err = data.Bytes()
+	assert.NoError(t, err)
+	data2 := &RecipientsData{}
+	assert.NoError(t, data2.FromBytes(raw))
+	assert.Equal(t, data, data2)
+}
+
+// replySession delivers its replies to the receiver
+type replySession struct {
+	view.Session
+	replies chan *view.Message
+}
+
+func (s *replySession) Receive() <-chan *view.Message { return s.replies }
+
+func TestReceiveFromCounterparty(t *testing.T) {
+	bob := view.Identity("bob")
+	session := &replySession{replies: make(chan *view.Message, 1)}
+
+	session.replies <- &view.Message{Status: view.OK, Payload: []byte("recipient")}
+	payload, err := receiveFromCounterparty(context.Background(), session, bob, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("recipient"), payload)
+
+	// the counterparty replies with an error
+	session.replies <- &view.Message{Status: view.ERROR, Payload: []byte("wallet not found")}
+	_, err = receiveFromCounterparty(context.Background(), session, bob, time.Second)
+	refused := &CounterpartyRefusedError{}
+	assert.ErrorAs(t, err, &refused)
+	assert.Equal(t, "wallet not found", refused.Reason)
+	assert.EqualError(t, err, "counterparty ["+bob.String()+"] refused: wallet not found")
+
+	// the counterparty does not reply in time
+	_, err = receiveFromCounterparty(context.Background(), session, bob, 10*time.Millisecond)
+	unreachable := &CounterpartyUnreachableError{}
+	assert.ErrorAs(t, err, &unreachable)
+	assert.EqualError(t, err, "counterparty ["+bob.String()+"] unreachable: no reply within [10ms]")
+
+	// the context of the view is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = receiveFromCounterparty(ctx, session, bob, time.Minute)
+	assert.ErrorAs(t, err, &unreachable)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRecipientExchangeTimeout(t *testing.T) {
+	options, err := token.CompileServiceOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), recipientExchangeTimeout(options))
+	assert.Equal(t, defaultExchangeRecipientTimeout, timeoutOrDefault(recipientExchangeTimeout(options), defaultExchangeRecipientTimeout))
+
+	options, err = token.CompileServiceOptions(WithRecipientExchangeTimeout(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, timeoutOrDefault(recipientExchangeTimeout(options), defaultExchangeRecipientTimeout))
+}
+
+func TestSelectWallet(t *testing.T) {
+	alice := view.Identity("alice")
+	selector := func(caller view.Identity) string {
+		if caller.Equal(alice) {
+			return "retail"
+		}
+		return ""
+	}
+
+	// the passed wallet has precedence
+	assert.Equal(t, "wholesale", selectWallet("wholesale", selector, alice, []byte("requested")))
+	// then the wallet chosen by the selector
+	assert.Equal(t, "retail", selectWallet("", selector, alice, []byte("requested")))
+	// then the wallet requested by the caller
+	assert.Equal(t, "requested", selectWallet("", selector, view.Identity("bob"), []byte("requested")))
+	assert.Equal(t, "requested", selectWallet("", nil, alice, []byte("requested")))
+	// otherwise, the default wallet
+	assert.Equal(t, "", selectWallet("", selector, view.Identity("bob"), nil))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	context2 "context"
+	"reflect"
+
+	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+)
+
+const (
+	// TxIDAttribute is the span attribute carrying the transaction id
+	TxIDAttribute = "ttx.txid"
+	// ContextIDAttribute is the span attribute carrying the view context id,
+	// used by the stages that run before the transaction is assembled
+	ContextIDAttribute = "ttx.context"
+)
+
+var tracerProviderKey = reflect.TypeOf((*TracerProvider)(nil))
+
+// Span models a span of a trace.
+// It is meant to be implemented by a thin adapter over an OpenTelemetry span.
+type Span interface {
+	// RecordError records the passed error on the span and marks the span as failed
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// Tracer creates spans.
+// It is meant to be implemented by a thin adapter over an OpenTelemetry tracer.
+type Tracer interface {
+	// Start starts a new span with the passed name and attributes, child of the span carried by the passed
+	// context, if any. It returns the span and a copy of the passed context carrying it.
+	Start(ctx context2.Context, name string, attributes map[string]string) (context2.Context, Span)
+}
+
+// TracerProvider provides the tracer used to trace the lifecycle of token transactions
+// (recipients exchange, endorsement, ordering, and finality).
+// Tracing is opt-in: it is enabled by registering a TracerProvider in the service provider of the view context.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// GetTracerProvider returns the TracerProvider registered in the passed service provider, nil if none is registered
+func GetTracerProvider(sp view2.ServiceProvider) TracerProvider {
+	s, err := sp.GetService(tracerProviderKey)
+	if err != nil {
+		return nil
+	}
+	return s.(TracerProvider)
+}
+
+// viewContext lets tracedContext embed view.Context, whose Context method clashes with the field name
+type viewContext = view.Context
+
+// tracedContext is a view context whose Go context carries the span of the running stage.
+// The views it runs see the same Go context, so that their spans are children of the stage span.
+type tracedContext struct {
+	viewContext
+	ctx context2.Context
+}
+
+// WithSpanContext returns a view context whose Go context is the passed one.
+// The spans of the token transaction stages run through the returned context, for instance
+// with RunView, are children of the span carried by the passed context, if any.
+func WithSpanContext(context view.Context, ctx context2.Context) view.Context {
+	return &tracedContext{viewContext: context, ctx: ctx}
+}
+
+func (c *tracedContext) Context() context2.Context {
+	return c.ctx
+}
+
+// RunView runs the passed view with a child context carrying the same Go context
+func (c *tracedContext) RunView(v view.View, opts ...view.RunViewOption) (interface{}, error) {
+	options, err := view.CompileRunViewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	call := options.Call
+	if call == nil {
+		call = v.Call
+	}
+	return c.viewContext.RunView(v, append(opts, view.WithViewCall(func(child view.Context) (interface{}, error) {
+		return call(&tracedContext{viewContext: child, ctx: c.ctx})
+	}))...)
+}
+
+// stageSpan traces a stage of the lifecycle of a token transaction
+type stageSpan struct {
+	span Span
+}
+
+// startSpan starts a span for the passed stage, if a TracerProvider is available. The passed attribute,
+// either TxIDAttribute or ContextIDAttribute, identifies the transaction.
+// The span is a child of the span carried by the Go context of the passed view context, if any.
+// It returns the span, that must be ended with End on both success and error paths, and the view context
+// the stage must use from then on, so that the spans of the views it runs are children of the stage span.
+func startSpan(context view.Context, stage, attribute, id string) (*stageSpan, view.Context) {
+	tp := GetTracerProvider(context)
+	if tp == nil {
+		return &stageSpan{}, context
+	}
+	parent := context.Context()
+	if parent == nil {
+		parent = context2.Background()
+	}
+	ctx, span := tp.Tracer("ttx").Start(parent, stage, map[string]string{attribute: id})
+	return &stageSpan{span: span}, &tracedContext{viewContext: context, ctx: ctx}
+}
+
+// End ends the span, recording the passed error, if any
+func (s *stageSpan) End(err error) {
+	if s.span == nil {
+		return
+	}
+	if err != nil {
+		s.span.RecordError(err)
+	}
+	s.span.End()
+}
@@ -0,0 +1,139 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ttx
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger-labs/fabric-smart-client/platform/view/view"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type services map[reflect.Type]interface{}
+
+func (s services) GetService(v interface{}) (interface{}, error) {
+	service, ok := s[v.(reflect.Type)]
+	if !ok {
+		return nil, errors.New("service not found")
+	}
+	return service, nil
+}
+
+type recordingSpan struct {
+	name       string
+	attributes map[string]string
+	parent     *recordingSpan
+	err        error
+	ended      bool
+}
+
+func (s *recordingSpan) RecordError(err error) { s.err = err }
+func (s *recordingSpan) End()                  { s.ended = true }
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Tracer(string) Tracer { return t }
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, attributes: attributes, parent: parent}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// servicesContext is a view context with the passed services. As the FSC view contexts do, the contexts
+// of the views it runs share its Go context.
+type servicesContext struct {
+	viewContext
+	services services
+	ctx      context.Context
+}
+
+func (c *servicesContext) GetService(v interface{}) (interface{}, error) {
+	return c.services.GetService(v)
+}
+func (c *servicesContext) Context() context.Context { return c.ctx }
+
+func (c *servicesContext) RunView(v view.View, opts ...view.RunViewOption) (interface{}, error) {
+	options, err := view.CompileRunViewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	child := &servicesContext{services: c.services, ctx: c.ctx}
+	if options.Call != nil {
+		return options.Call(child)
+	}
+	return v.Call(child)
+}
+
+// stageView runs a stage, and optionally a nested view through the context of the stage
+type stageView struct {
+	stage  string
+	nested view.View
+}
+
+func (v *stageView) Call(context view.Context) (interface{}, error) {
+	span, context := startSpan(context, v.stage, TxIDAttribute, "tx1")
+	defer span.End(nil)
+	if v.nested != nil {
+		return context.RunView(v.nested)
+	}
+	return nil, nil
+}
+
+func TestStageSpans(t *testing.T) {
+	// no tracer provider, no spans
+	c := &servicesContext{services: services{}, ctx: context.Background()}
+	span, traced := startSpan(c, "ordering", TxIDAttribute, "tx1")
+	span.End(errors.New("boom"))
+	assert.Equal(t, view.Context(c), traced)
+
+	tracer := &recordingTracer{}
+	c = &servicesContext{services: services{tracerProviderKey: tracer}, ctx: context.Background()}
+	span, _ = startSpan(c, "collectEndorsements", TxIDAttribute, "tx1")
+	span.End(nil)
+	span, _ = startSpan(c, "ordering", TxIDAttribute, "tx1")
+	span.End(errors.New("boom"))
+
+	assert.Len(t, tracer.spans, 2)
+	assert.Equal(t, "collectEndorsements", tracer.spans[0].name)
+	assert.Equal(t, map[string]string{TxIDAttribute: "tx1"}, tracer.spans[0].attributes)
+	assert.True(t, tracer.spans[0].ended)
+	assert.NoError(t, tracer.spans[0].err)
+	assert.Equal(t, "ordering", tracer.spans[1].name)
+	assert.True(t, tracer.spans[1].ended)
+	assert.EqualError(t, tracer.spans[1].err, "boom")
+}
+
+func TestNestedStageSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	c := &servicesContext{services: services{tracerProviderKey: tracer}, ctx: context.Background()}
+
+	// the spans of the views run by a stage are children of the stage span,
+	// and the span of the application is their root
+	root, app := tracer.Start(context.Background(), "application", nil)
+	_, err := WithSpanContext(c, root).RunView(&stageView{
+		stage:  "collectEndorsements",
+		nested: &stageView{stage: "auditing"},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, tracer.spans, 3)
+	assert.Equal(t, "collectEndorsements", tracer.spans[1].name)
+	assert.Equal(t, app, tracer.spans[1].parent)
+	assert.Equal(t, "auditing", tracer.spans[2].name)
+	assert.Equal(t, tracer.spans[1], tracer.spans[2].parent)
+	assert.True(t, tracer.spans[2].ended)
+}
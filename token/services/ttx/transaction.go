@@ -8,6 +8,7 @@ package ttx
 
 import (
 	"encoding/asn1"
+	"time"
 
 	view2 "github.com/hyperledger-labs/fabric-smart-client/platform/view"
 	"github.com/hyperledger-labs/fabric-smart-client/platform/view/services/tracker/metrics"
@@ -135,7 +136,12 @@ func ReceiveTransaction(context view.Context) (*Transaction, error) {
 		logger.Debugf("receive a new transaction...")
 	}
 
-	txBoxed, err := context.RunView(NewReceiveTransactionView(""), view.WithSameContext())
+	return receiveTransaction(context, defaultReceiveTransactionTimeout)
+}
+
+// receiveTransaction receives a transaction, waiting for at most the passed timeout
+func receiveTransaction(context view.Context, timeout time.Duration) (*Transaction, error) {
+	txBoxed, err := context.RunView(&receiveTransactionView{timeout: timeout}, view.WithSameContext())
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +48,8 @@ type ServiceOptions struct {
 	Namespace string
 	// PublicParamsFetcher is used to fetch the public parameters
 	PublicParamsFetcher PublicParamsFetcher
+	// Params is used to pass additional parameters to the services built on top of the TMS
+	Params map[string]interface{}
 }
 
 // TMSID returns the TMSID for the given ServiceOptions
@@ -105,6 +107,17 @@ func WithPublicParameterFetcher(ppFetcher PublicParamsFetcher) ServiceOption {
 	}
 }
 
+// WithParam sets the passed additional parameter
+func WithParam(key string, value interface{}) ServiceOption {
+	return func(o *ServiceOptions) error {
+		if o.Params == nil {
+			o.Params = map[string]interface{}{}
+		}
+		o.Params[key] = value
+		return nil
+	}
+}
+
 // WithTMS filters by network, channel and namespace. Each of them can be empty
 func WithTMS(network, channel, namespace string) ServiceOption {
 	return func(o *ServiceOptions) error {